@@ -14,7 +14,9 @@ import (
 	"math/rand"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
 	"time"
 )
 
@@ -28,7 +30,9 @@ const (
 func main() {
 	rand.Seed(time.Now().UnixNano())
 
-	ctx, cancelRoot := context.WithCancel(context.Background())
+	// Interrupting the process cancels ctx, which closes the listeners and lets ListenAndServe return
+	ctx, cancelRoot := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancelRoot()
 
 	basePort := flag.Int("bind", defaultPort, "Bind address and port")
 	statsPort := flag.String("stats-port", "", "Enable stats HTTP endpoint on address and port")
@@ -75,14 +79,26 @@ func main() {
 		logger.Fatalw("Configuration directory not found", "path", configDir)
 	}
 
-	srv, err := hotline.NewServer(*configDir, "", *basePort, logger, &hotline.OSFileStore{})
+	srv, err := hotline.NewServer(*configDir, "", *basePort, logger, nil)
 	if err != nil {
 		logger.Fatal(err)
 	}
 
+	// Reload the settings that can be changed without a restart on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := srv.ReloadConfig(); err != nil {
+				logger.Errorw("Error reloading config", "err", err)
+			}
+		}
+	}()
+
 	sh := statHandler{hlServer: srv}
 	if *statsPort != "" {
 		http.HandleFunc("/", sh.RenderStats)
+		http.HandleFunc("/transfers", sh.RenderTransfers)
 
 		go func(srv *hotline.Server) {
 			// Use the default DefaultServeMux.
@@ -93,8 +109,11 @@ func main() {
 		}(srv)
 	}
 
-	// Serve Hotline requests until program exit
-	logger.Fatal(srv.ListenAndServe(ctx, cancelRoot))
+	// Serve Hotline requests until the process is interrupted
+	if err := srv.ListenAndServe(ctx, cancelRoot); err != nil {
+		logger.Fatal(err)
+	}
+	logger.Infow("Hotline server stopped")
 }
 
 type statHandler struct {
@@ -110,6 +129,16 @@ func (sh *statHandler) RenderStats(w http.ResponseWriter, _ *http.Request) {
 	_, _ = io.WriteString(w, string(u))
 }
 
+// RenderTransfers lists the file transfers that are waiting or in progress
+func (sh *statHandler) RenderTransfers(w http.ResponseWriter, _ *http.Request) {
+	u, err := json.Marshal(sh.hlServer.Transfers())
+	if err != nil {
+		panic(err)
+	}
+
+	_, _ = io.WriteString(w, string(u))
+}
+
 func newStdoutCore(level zapcore.Level) zapcore.Core {
 	encoderCfg := zap.NewProductionEncoderConfig()
 	encoderCfg.TimeKey = "timestamp"
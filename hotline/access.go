@@ -37,13 +37,13 @@ const (
 	accessUploadAnywhere = 25
 	// accessAnyName          = 26
 	// accessNoAgreement      = 27
-	// accessSetFileComment   = 28
-	// accessSetFolderComment = 29
-	accessViewDropBoxes = 30
-	accessMakeAlias     = 31
-	accessBroadcast     = 32
-	accessNewsDeleteArt = 33
-	accessNewsCreateCat = 34
+	accessSetFileComment   = 28
+	accessSetFolderComment = 29
+	accessViewDropBoxes    = 30
+	accessMakeAlias        = 31
+	accessBroadcast        = 32
+	accessNewsDeleteArt    = 33
+	accessNewsCreateCat    = 34
 	// accessNewsDeleteCat    = 35
 	accessNewsCreateFldr = 36
 	// accessNewsDeleteFldr   = 37
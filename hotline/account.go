@@ -9,10 +9,15 @@ import (
 const GuestAccount = "guest" // default account used when no login is provided for a connection
 
 type Account struct {
-	Login    string  `yaml:"Login"`
-	Name     string  `yaml:"Name"`
-	Password string  `yaml:"Password"`
-	Access   *[]byte `yaml:"Access"` // 8 byte bitmap
+	Login         string   `yaml:"Login"`
+	Name          string   `yaml:"Name"`
+	Password      string   `yaml:"Password"`
+	Access        *[]byte  `yaml:"Access"`                  // 8 byte bitmap
+	IdleExempt    bool     `yaml:"IdleExempt,omitempty"`    // Exempt the account from idle disconnect
+	Groups        []string `yaml:"Groups,omitempty"`        // Groups the account belongs to, used by folder ACLs and upload quotas
+	UploadQuota   int64    `yaml:"UploadQuota,omitempty"`   // Bytes the account may upload in total; 0 uses the quotas of its groups
+	UploadedBytes int64    `yaml:"UploadedBytes,omitempty"` // Bytes uploaded by the account since its quota was last reset
+	TransferRate  int64    `yaml:"TransferRate,omitempty"`  // Bytes per second shared by the file transfers of the account; 0 uses the rates of its groups
 }
 
 // MarshalBinary marshals an Account to byte slice
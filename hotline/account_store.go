@@ -0,0 +1,152 @@
+package hotline
+
+import (
+	"errors"
+	"os"
+	"path"
+	"sort"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// AccountStore persists user accounts.  The Server keeps the loaded accounts in memory in Server.Accounts and calls
+// the AccountStore whenever an account is created, modified or deleted.
+type AccountStore interface {
+	List() ([]*Account, error)
+	Put(account *Account) error
+	Rename(login, newLogin string) error
+	Delete(login string) error
+}
+
+// YAMLAccountStore stores each account as a YAML file named <login>.yaml in Dir
+type YAMLAccountStore struct {
+	Dir string
+	FS  FileStore
+}
+
+func NewYAMLAccountStore(dir string, fs FileStore) *YAMLAccountStore {
+	return &YAMLAccountStore{Dir: dir, FS: fs}
+}
+
+func (as *YAMLAccountStore) accountPath(login string) string {
+	return path.Join(as.Dir, login+".yaml")
+}
+
+func (as *YAMLAccountStore) List() ([]*Account, error) {
+	entries, err := as.FS.ReadDir(as.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []string
+	for _, entry := range entries {
+		if !entry.IsDir() && path.Ext(entry.Name()) == ".yaml" {
+			matches = append(matches, path.Join(as.Dir, entry.Name()))
+		}
+	}
+
+	if len(matches) == 0 {
+		return nil, errors.New("no user accounts found in " + as.Dir)
+	}
+
+	var accounts []*Account
+	for _, file := range matches {
+		fh, err := as.FS.Open(file)
+		if err != nil {
+			return nil, err
+		}
+
+		account := Account{}
+		decoder := yaml.NewDecoder(fh)
+		err = decoder.Decode(&account)
+		_ = fh.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		accounts = append(accounts, &account)
+	}
+	return accounts, nil
+}
+
+func (as *YAMLAccountStore) Put(account *Account) error {
+	out, err := yaml.Marshal(account)
+	if err != nil {
+		return err
+	}
+
+	return as.FS.WriteFile(as.accountPath(account.Login), out, 0666)
+}
+
+func (as *YAMLAccountStore) Rename(login, newLogin string) error {
+	return as.FS.Rename(as.accountPath(login), as.accountPath(newLogin))
+}
+
+func (as *YAMLAccountStore) Delete(login string) error {
+	return as.FS.Remove(as.accountPath(login))
+}
+
+// MemAccountStore keeps accounts in memory only.  It is intended for tests and servers embedded in other programs.
+type MemAccountStore struct {
+	accounts map[string]Account
+	mux      sync.Mutex
+}
+
+// NewMemAccountStore returns a MemAccountStore populated with accounts
+func NewMemAccountStore(accounts ...*Account) *MemAccountStore {
+	as := &MemAccountStore{accounts: make(map[string]Account)}
+	for _, account := range accounts {
+		as.accounts[account.Login] = *account
+	}
+	return as
+}
+
+func (as *MemAccountStore) List() ([]*Account, error) {
+	as.mux.Lock()
+	defer as.mux.Unlock()
+
+	var logins []string
+	for login := range as.accounts {
+		logins = append(logins, login)
+	}
+	sort.Strings(logins)
+
+	var accounts []*Account
+	for _, login := range logins {
+		account := as.accounts[login]
+		accounts = append(accounts, &account)
+	}
+	return accounts, nil
+}
+
+func (as *MemAccountStore) Put(account *Account) error {
+	as.mux.Lock()
+	defer as.mux.Unlock()
+
+	as.accounts[account.Login] = *account
+	return nil
+}
+
+func (as *MemAccountStore) Rename(login, newLogin string) error {
+	as.mux.Lock()
+	defer as.mux.Unlock()
+
+	account, ok := as.accounts[login]
+	if !ok {
+		return os.ErrNotExist
+	}
+	delete(as.accounts, login)
+	account.Login = newLogin
+	as.accounts[newLogin] = account
+
+	return nil
+}
+
+func (as *MemAccountStore) Delete(login string) error {
+	as.mux.Lock()
+	defer as.mux.Unlock()
+
+	delete(as.accounts, login)
+	return nil
+}
@@ -0,0 +1,159 @@
+package hotline
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// adminCommand is a chat command available to admins.  args is the rest of the message after the command name.  It
+// returns the text sent back to the admin who used it.
+type adminCommand func(cc *ClientConn, args string) string
+
+// adminCommands are the chat commands available to admins.  Replies are sent only to the admin who used the command.
+var adminCommands = map[string]adminCommand{
+	"/trash":      cmdTrash,
+	"/restore":    cmdRestore,
+	"/versions":   cmdVersions,
+	"/rollback":   cmdRollback,
+	"/transfers":  cmdTransfers,
+	"/cancel":     cmdCancel,
+	"/resetquota": cmdResetQuota,
+}
+
+// isAdmin reports whether cc may use admin commands.  Accounts that can disconnect users are shown to clients as
+// admins, so the same privilege is used here.
+func (cc *ClientConn) isAdmin() bool {
+	return authorize(cc.Account.Access, accessDisconUser)
+}
+
+// runAdminCommand runs the admin command in msg and returns its reply.  ok is false if msg is not an admin command or
+// cc is not an admin, in which case msg is handled as a regular chat message.
+func (cc *ClientConn) runAdminCommand(msg []byte) (reply string, ok bool) {
+	name, args, _ := strings.Cut(strings.TrimSpace(string(msg)), " ")
+
+	cmd, ok := adminCommands[name]
+	if !ok || !cc.isAdmin() {
+		return "", false
+	}
+
+	return cmd(cc, strings.TrimSpace(args)), true
+}
+
+// cmdTrash lists the items in the trash
+func cmdTrash(cc *ClientConn, _ string) string {
+	items, err := cc.Server.TrashItems()
+	if err != nil {
+		cc.Server.Logger.Errorw("Error reading trash", "err", err)
+		return "Cannot list the trash because an error occurred."
+	}
+	if len(items) == 0 {
+		return "The trash is empty."
+	}
+
+	lines := []string{"Trash:"}
+	for _, item := range items {
+		lines = append(lines, fmt.Sprintf("  %s  %s  deleted by %s on %s", item.ID, item.Path, item.DeletedBy, item.DeletedAt.Format("Jan 2 2006 15:04")))
+	}
+
+	return strings.Join(lines, "\r")
+}
+
+// cmdRestore moves an item from the trash back to where it was deleted from
+func cmdRestore(cc *ClientConn, args string) string {
+	if args == "" || strings.Contains(args, " ") {
+		return "Usage: /restore <trash ID>"
+	}
+
+	item, err := cc.Server.RestoreTrashItem(args)
+	if err != nil {
+		return fmt.Sprintf("Cannot restore %s: %v.", args, err)
+	}
+	cc.Server.Logger.Infow("Restored from trash", "id", item.ID, "path", item.Path, "login", cc.Account.Login)
+
+	return fmt.Sprintf("Restored %s.", item.Path)
+}
+
+// adminFilePath returns the path in the file area of filePath, a path relative to the file root as typed by an admin
+func (cc *ClientConn) adminFilePath(filePath string) string {
+	return path.Join("/", cc.Server.Config.FileRoot, path.Clean("/"+filePath))
+}
+
+// cmdVersions lists the prior versions of a file
+func cmdVersions(cc *ClientConn, args string) string {
+	if args == "" {
+		return "Usage: /versions <path>"
+	}
+
+	versions, err := cc.Server.FileVersions(cc.adminFilePath(args))
+	if err != nil {
+		cc.Server.Logger.Errorw("Error reading file versions", "path", args, "err", err)
+		return "Cannot list the versions because an error occurred."
+	}
+	if len(versions) == 0 {
+		return fmt.Sprintf("There are no prior versions of %s.", args)
+	}
+
+	return strings.Join(append([]string{fmt.Sprintf("Versions of %s:", args)}, versions...), "\r  ")
+}
+
+// cmdRollback replaces a file with one of its prior versions
+func cmdRollback(cc *ClientConn, args string) string {
+	id, filePath, _ := strings.Cut(args, " ")
+	filePath = strings.TrimSpace(filePath)
+	if id == "" || filePath == "" {
+		return "Usage: /rollback <version> <path>"
+	}
+
+	if err := cc.Server.RollbackFile(cc.adminFilePath(filePath), id); err != nil {
+		return fmt.Sprintf("Cannot roll back %s: %v.", filePath, err)
+	}
+	cc.Server.Logger.Infow("Rolled back file", "path", filePath, "version", id, "login", cc.Account.Login)
+
+	return fmt.Sprintf("Rolled back %s to version %s.", filePath, id)
+}
+
+// cmdTransfers lists the file transfers of all users
+func cmdTransfers(cc *ClientConn, _ string) string {
+	transfers := cc.Server.Transfers()
+	if len(transfers) == 0 {
+		return "There are no file transfers."
+	}
+
+	lines := []string{"Transfers:"}
+	for _, ts := range transfers {
+		lines = append(lines, fmt.Sprintf("  %d  %s by %s: %s", ts.ID, ts.Type, ts.UserName, ts))
+	}
+
+	return strings.Join(lines, "\r")
+}
+
+// cmdCancel cancels a file transfer
+func cmdCancel(cc *ClientConn, args string) string {
+	id, err := strconv.ParseUint(args, 10, 32)
+	if err != nil {
+		return "Usage: /cancel <transfer ID>"
+	}
+
+	if err := cc.Server.CancelTransfer(uint32(id)); err != nil {
+		return fmt.Sprintf("Cannot cancel transfer %s: %v.", args, err)
+	}
+	cc.Server.Logger.Infow("Cancelled transfer", "id", id, "login", cc.Account.Login)
+
+	return fmt.Sprintf("Cancelled transfer %s.", args)
+}
+
+// cmdResetQuota resets the bytes uploaded by an account, giving it its full upload quota again
+func cmdResetQuota(cc *ClientConn, args string) string {
+	if args == "" || strings.Contains(args, " ") {
+		return "Usage: /resetquota <login>"
+	}
+
+	if err := cc.Server.ResetUploadedBytes(args); err != nil {
+		return fmt.Sprintf("Cannot reset the upload quota of %s: %v.", args, err)
+	}
+	cc.Server.Logger.Infow("Reset upload quota", "account", args, "login", cc.Account.Login)
+
+	return fmt.Sprintf("Reset the upload quota of %s.", args)
+}
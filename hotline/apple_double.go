@@ -0,0 +1,213 @@
+package hotline
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// Macintosh files have a resource fork, Finder info and comment in addition to the data fork stored in the file itself.
+// These are kept in an AppleDouble (RFC 1740) sidecar named "._<file name>" in the same folder as the file or folder,
+// the same convention used by macOS on file systems without native fork support.  Because the sidecar is moved along
+// with its file, the metadata survives renames and moves.
+const (
+	appleDoublePrefix  = "._"
+	appleDoubleMagic   = 0x00051607
+	appleDoubleVersion = 0x00020000
+
+	appleDoubleResourceFork = 2 // Entry ID of the resource fork
+	appleDoubleComment      = 4 // Entry ID of the Get Info comment
+	appleDoubleFinderInfo   = 9 // Entry ID of the 32 byte Finder info
+)
+
+var errInvalidAppleDouble = errors.New("invalid AppleDouble file")
+
+// appleDouble is the content of an AppleDouble sidecar file
+type appleDouble struct {
+	FinderInfo   [32]byte // FInfo followed by FXInfo; only type, creator and Finder flags are used
+	ResourceFork []byte
+	Comment      []byte
+}
+
+// newAppleDouble returns the sidecar content for a file uploaded with information fork ffif and resource fork rsrcFork
+func newAppleDouble(ffif FlatFileInformationFork, rsrcFork []byte) *appleDouble {
+	ad := appleDouble{ResourceFork: rsrcFork, Comment: ffif.Comment}
+	copy(ad.FinderInfo[0:4], ffif.TypeSignature)
+	copy(ad.FinderInfo[4:8], ffif.CreatorSignature)
+	if len(ffif.PlatformFlags) == 4 {
+		copy(ad.FinderInfo[8:10], ffif.PlatformFlags[2:4])
+	}
+
+	return &ad
+}
+
+func (ad *appleDouble) TypeCode() []byte    { return ad.FinderInfo[0:4] }
+func (ad *appleDouble) CreatorCode() []byte { return ad.FinderInfo[4:8] }
+func (ad *appleDouble) FinderFlags() []byte { return ad.FinderInfo[8:10] }
+
+// appleDoublePath returns the path of the sidecar file for filePath
+func appleDoublePath(filePath string) string {
+	dir, name := path.Split(filePath)
+	return dir + appleDoublePrefix + name
+}
+
+// isAppleDouble reports whether name is the name of a sidecar file.  Sidecar files are never shown to clients.
+func isAppleDouble(name string) bool {
+	return strings.HasPrefix(name, appleDoublePrefix)
+}
+
+func (ad *appleDouble) MarshalBinary() ([]byte, error) {
+	type entry struct {
+		ID   uint32
+		Data []byte
+	}
+	entries := []entry{{appleDoubleFinderInfo, ad.FinderInfo[:]}}
+	if len(ad.Comment) > 0 {
+		entries = append(entries, entry{appleDoubleComment, ad.Comment})
+	}
+	if len(ad.ResourceFork) > 0 {
+		entries = append(entries, entry{appleDoubleResourceFork, ad.ResourceFork})
+	}
+
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, binary.BigEndian, []uint32{appleDoubleMagic, appleDoubleVersion})
+	buf.Write(make([]byte, 16)) // filler
+	_ = binary.Write(&buf, binary.BigEndian, uint16(len(entries)))
+
+	offset := uint32(26 + 12*len(entries))
+	for _, e := range entries {
+		_ = binary.Write(&buf, binary.BigEndian, []uint32{e.ID, offset, uint32(len(e.Data))})
+		offset += uint32(len(e.Data))
+	}
+	for _, e := range entries {
+		buf.Write(e.Data)
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (ad *appleDouble) UnmarshalBinary(b []byte) error {
+	if len(b) < 26 || binary.BigEndian.Uint32(b[0:4]) != appleDoubleMagic {
+		return errInvalidAppleDouble
+	}
+
+	entryCount := int(binary.BigEndian.Uint16(b[24:26]))
+	if len(b) < 26+12*entryCount {
+		return errInvalidAppleDouble
+	}
+
+	for i := 0; i < entryCount; i++ {
+		e := b[26+12*i : 38+12*i]
+		id := binary.BigEndian.Uint32(e[0:4])
+		offset := uint64(binary.BigEndian.Uint32(e[4:8]))
+		length := uint64(binary.BigEndian.Uint32(e[8:12]))
+		if offset+length > uint64(len(b)) {
+			return errInvalidAppleDouble
+		}
+		data := b[offset : offset+length]
+
+		switch id {
+		case appleDoubleFinderInfo:
+			copy(ad.FinderInfo[:], data)
+		case appleDoubleResourceFork:
+			ad.ResourceFork = data
+		case appleDoubleComment:
+			ad.Comment = data
+		}
+	}
+
+	return nil
+}
+
+// readAppleDouble returns the sidecar content for filePath.  The error wraps fs.ErrNotExist if there is no sidecar.
+func readAppleDouble(fileStore FileStore, filePath string) (*appleDouble, error) {
+	b, err := readFile(fileStore, appleDoublePath(filePath))
+	if err != nil {
+		return nil, err
+	}
+
+	var ad appleDouble
+	if err := ad.UnmarshalBinary(b); err != nil {
+		return nil, err
+	}
+
+	return &ad, nil
+}
+
+// resourceForkLen returns the length of the resource fork stored in the sidecar at sidecarPath.  Only the header and
+// entry table are read, not the whole sidecar.
+func resourceForkLen(fileStore FileStore, sidecarPath string) (uint64, error) {
+	f, err := fileStore.Open(sidecarPath)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = f.Close() }()
+
+	header := make([]byte, 26)
+	if _, err := io.ReadFull(f, header); err != nil || binary.BigEndian.Uint32(header[0:4]) != appleDoubleMagic {
+		return 0, errInvalidAppleDouble
+	}
+
+	entries := make([]byte, 12*int(binary.BigEndian.Uint16(header[24:26])))
+	if _, err := io.ReadFull(f, entries); err != nil {
+		return 0, errInvalidAppleDouble
+	}
+	for i := 0; i < len(entries); i += 12 {
+		if binary.BigEndian.Uint32(entries[i:i+4]) == appleDoubleResourceFork {
+			return uint64(binary.BigEndian.Uint32(entries[i+8 : i+12])), nil
+		}
+	}
+
+	return 0, nil
+}
+
+// writeAppleDouble saves the metadata of a file to its sidecar.  If there is no metadata to save, any stale sidecar is
+// removed instead.
+func writeAppleDouble(fileStore FileStore, filePath string, ad *appleDouble) error {
+	if len(ad.ResourceFork) == 0 && len(ad.Comment) == 0 && ad.TypeCode()[0] == 0 {
+		return removeAppleDouble(fileStore, filePath)
+	}
+
+	b, err := ad.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	return fileStore.WriteFile(appleDoublePath(filePath), b, 0644)
+}
+
+// renameAppleDouble moves the sidecar of oldpath, if there is one, along with the file
+func renameAppleDouble(fileStore FileStore, oldpath, newpath string) error {
+	if _, err := fileStore.Stat(appleDoublePath(oldpath)); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	return fileStore.Rename(appleDoublePath(oldpath), appleDoublePath(newpath))
+}
+
+// removeAppleDouble deletes the sidecar of filePath, if there is one
+func removeAppleDouble(fileStore FileStore, filePath string) error {
+	if err := fileStore.Remove(appleDoublePath(filePath)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// setComment stores the Get Info comment of the file or folder at filePath, keeping any other metadata in its sidecar
+func setComment(fileStore FileStore, filePath string, comment []byte) error {
+	ad, err := readAppleDouble(fileStore, filePath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, errInvalidAppleDouble) {
+		return err
+	}
+	if ad == nil {
+		ad = &appleDouble{}
+	}
+	ad.Comment = comment
+
+	return writeAppleDouble(fileStore, filePath, ad)
+}
@@ -0,0 +1,76 @@
+package hotline
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func TestAppleDouble_MarshalBinary(t *testing.T) {
+	ad := &appleDouble{ResourceFork: []byte("resource fork"), Comment: []byte("comment")}
+	copy(ad.FinderInfo[:], "SIT!SIT!")
+
+	b, err := ad.MarshalBinary()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x00, 0x05, 0x16, 0x07, 0x00, 0x02, 0x00, 0x00}, b[0:8])
+	assert.Len(t, b, 26+3*12+32+len("comment")+len("resource fork"))
+
+	var got appleDouble
+	assert.NoError(t, got.UnmarshalBinary(b))
+	assert.Equal(t, ad, &got)
+
+	assert.ErrorIs(t, got.UnmarshalBinary([]byte("not an AppleDouble file")), errInvalidAppleDouble)
+	assert.ErrorIs(t, got.UnmarshalBinary(b[:60]), errInvalidAppleDouble, "entries past the end of the file are invalid")
+}
+
+func Test_writeAppleDouble(t *testing.T) {
+	newStore := func() *MemFileStore {
+		mfs := NewMemFileStore()
+		_ = mfs.MkdirAll("/Files", 0777)
+		_ = mfs.WriteFile("/Files/readme.txt", []byte("hello"), 0644)
+		return mfs
+	}
+
+	t.Run("stores forks in a sidecar", func(t *testing.T) {
+		mfs := newStore()
+
+		ffif := NewFlatFileInformationFork("readme.txt", make([]byte, 8), "ttro", "ttxt")
+		ffif.Comment = []byte("Read me first")
+		assert.NoError(t, writeAppleDouble(mfs, "/Files/readme.txt", newAppleDouble(ffif, []byte("rsrc"))))
+
+		got, err := readAppleDouble(mfs, "/Files/readme.txt")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("ttro"), got.TypeCode())
+		assert.Equal(t, []byte("ttxt"), got.CreatorCode())
+		assert.Equal(t, []byte{1, 0}, got.FinderFlags())
+		assert.Equal(t, []byte("rsrc"), got.ResourceFork)
+		assert.Equal(t, []byte("Read me first"), got.Comment)
+	})
+
+	t.Run("removes stale sidecars when there is no metadata to store", func(t *testing.T) {
+		mfs := newStore()
+		_ = mfs.WriteFile("/Files/._readme.txt", []byte("stale"), 0644)
+
+		ad := newAppleDouble(NewFlatFileInformationFork("readme.txt", make([]byte, 8), "\x00\x00\x00\x00", "\x00\x00\x00\x00"), nil)
+		assert.NoError(t, writeAppleDouble(mfs, "/Files/readme.txt", ad))
+
+		_, err := mfs.Stat("/Files/._readme.txt")
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("moves and removes sidecars with their files", func(t *testing.T) {
+		mfs := newStore()
+		_ = mfs.WriteFile("/Files/._readme.txt", []byte("sidecar"), 0644)
+
+		assert.NoError(t, renameAppleDouble(mfs, "/Files/readme.txt", "/Files/renamed.txt"))
+		_, err := mfs.Stat("/Files/._renamed.txt")
+		assert.NoError(t, err)
+
+		assert.NoError(t, removeAppleDouble(mfs, "/Files/renamed.txt"))
+		_, err = mfs.Stat("/Files/._renamed.txt")
+		assert.True(t, os.IsNotExist(err))
+
+		assert.NoError(t, renameAppleDouble(mfs, "/Files/missing.txt", "/Files/other.txt"), "files without sidecars are ignored")
+		assert.NoError(t, removeAppleDouble(mfs, "/Files/missing.txt"))
+	})
+}
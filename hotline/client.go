@@ -16,6 +16,7 @@ import (
 	"net"
 	"os"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -83,6 +84,9 @@ type Client struct {
 	activeTasks map[uint32]*Transaction
 	serverName  string
 
+	folderTransfers    map[uint32]string // Local folders of requested folder transfers by transaction ID
+	folderTransfersMux sync.Mutex
+
 	pref *ClientPrefs
 
 	Handlers map[uint16]clientTHandler
@@ -193,6 +197,14 @@ var clientHandlers = map[uint16]clientTHandler{
 		Name:    "tranGetFileNameList",
 		Handler: handleGetFileNameList,
 	},
+	tranDownloadFldr: clientTransaction{
+		Name:    "tranDownloadFldr",
+		Handler: handleClientDownloadFolder,
+	},
+	tranUploadFldr: clientTransaction{
+		Name:    "tranUploadFldr",
+		Handler: handleClientUploadFolder,
+	},
 	tranServerMsg: clientTransaction{
 		Name:    "tranServerMsg",
 		Handler: handleTranServerMsg,
@@ -247,6 +259,14 @@ func handleGetFileNameList(c *Client, t *Transaction) (res []Transaction, err er
 		case tcell.KeyEscape:
 			c.UI.Pages.RemovePage("files")
 			c.filePath = []string{}
+		case tcell.KeyRune:
+			// d downloads the selected folder into the current directory
+			entry, ok := fTree.GetCurrentNode().GetReference().(*FileNameWithInfo)
+			if event.Rune() == 'd' && ok && bytes.Equal(entry.Type[:], []byte("fldr")) {
+				if err := c.DownloadFolder(string(entry.name), strings.Join(c.filePath, "/"), string(entry.name)); err != nil {
+					c.Logger.Errorw("err", "err", err)
+				}
+			}
 		case tcell.KeyEnter:
 			selectedNode := fTree.GetCurrentNode()
 
@@ -5,6 +5,7 @@ import (
 	"golang.org/x/crypto/bcrypt"
 	"io"
 	"math/big"
+	"time"
 )
 
 type byClientID []*ClientConn
@@ -64,6 +65,11 @@ type ClientConn struct {
 	AutoReply  []byte
 	Transfers  map[int][]*FileTransfer
 	Agreed     bool
+
+	lastSeen        time.Time // time data was last received from the client
+	lastProbe       time.Time // time a liveness probe was last sent to the client
+	sendsKeepalives bool      // true once the client has sent a keepalive transaction
+	largeFiles      bool      // true if the client supports 64-bit file sizes
 }
 
 func (cc *ClientConn) sendAll(t int, fields ...Field) {
@@ -74,7 +80,7 @@ func (cc *ClientConn) sendAll(t int, fields ...Field) {
 
 func (cc *ClientConn) handleTransaction(transaction *Transaction) error {
 	requestNum := binary.BigEndian.Uint16(transaction.Type)
-	if handler, ok := TransactionHandlers[requestNum]; ok {
+	if handler, ok := cc.Server.transactionType(requestNum); ok && handler.Handler != nil {
 		for _, reqField := range handler.RequiredFields {
 			field := transaction.GetField(reqField.ID)
 
@@ -87,13 +93,32 @@ func (cc *ClientConn) handleTransaction(transaction *Transaction) error {
 				return nil
 			}
 
-			if len(field.Data) < reqField.minLen {
+			if len(field.Data) < reqField.MinLen {
 				cc.Server.Logger.Infow(
 					"Field does not meet minLen",
 					"Account", cc.Account.Login, "UserName", string(cc.UserName), "RequestType", handler.Name, "FieldID", reqField.ID,
 				)
 				return nil
 			}
+
+			if reqField.MaxLen > 0 && len(field.Data) > reqField.MaxLen {
+				cc.Server.Logger.Infow(
+					"Field exceeds maxLen",
+					"Account", cc.Account.Login, "UserName", string(cc.UserName), "RequestType", handler.Name, "FieldID", reqField.ID,
+				)
+				return nil
+			}
+		}
+
+		for _, accessBit := range handler.Access {
+			if !authorize(cc.Account.Access, accessBit) {
+				denyMsg := handler.DenyMsg
+				if denyMsg == "" {
+					denyMsg = "You are not allowed to do that."
+				}
+				cc.Server.outbox <- cc.NewErrReply(transaction, denyMsg)
+				return nil
+			}
 		}
 
 		cc.Server.Logger.Infow(
@@ -120,31 +145,48 @@ func (cc *ClientConn) handleTransaction(transaction *Transaction) error {
 	cc.Server.mux.Lock()
 	defer cc.Server.mux.Unlock()
 
-	if requestNum != tranKeepAlive {
+	if requestNum == tranKeepAlive {
+		cc.sendsKeepalives = true
+	} else {
 		// reset the user idle timer
 		cc.IdleTime = 0
 
 		// if user was previously idle, mark as not idle and notify other connected clients that
 		// the user is no longer away
 		if cc.Idle {
-			flagBitmap := big.NewInt(int64(binary.BigEndian.Uint16(*cc.Flags)))
-			flagBitmap.SetBit(flagBitmap, userFlagAway, 0)
-			binary.BigEndian.PutUint16(*cc.Flags, uint16(flagBitmap.Int64()))
-			cc.Idle = false
-
-			cc.sendAll(
-				tranNotifyChangeUser,
-				NewField(fieldUserID, *cc.ID),
-				NewField(fieldUserFlags, *cc.Flags),
-				NewField(fieldUserName, cc.UserName),
-				NewField(fieldUserIconID, *cc.Icon),
-			)
+			cc.setIdle(false)
 		}
 	}
 
 	return nil
 }
 
+// setIdle sets or clears the away flag for an idle client and notifies connected clients of the change
+func (cc *ClientConn) setIdle(idle bool) {
+	var bit uint
+	if idle {
+		bit = 1
+	}
+
+	flagBitmap := big.NewInt(int64(binary.BigEndian.Uint16(*cc.Flags)))
+	flagBitmap.SetBit(flagBitmap, userFlagAway, bit)
+	binary.BigEndian.PutUint16(*cc.Flags, uint16(flagBitmap.Int64()))
+	cc.Idle = idle
+
+	cc.sendAll(
+		tranNotifyChangeUser,
+		NewField(fieldUserID, *cc.ID),
+		NewField(fieldUserFlags, *cc.Flags),
+		NewField(fieldUserName, cc.UserName),
+		NewField(fieldUserIconID, *cc.Icon),
+	)
+}
+
+// idleExempt returns true if the client's account is exempt from idle disconnect
+func (cc *ClientConn) idleExempt() bool {
+	return cc.Account.IdleExempt || authorize(cc.Account.Access, accessCannotBeDiscon)
+}
+
 func (cc *ClientConn) Authenticate(login string, password []byte) bool {
 	if account, ok := cc.Server.Accounts[login]; ok {
 		return bcrypt.CompareHashAndPassword([]byte(account.Password), password) == nil
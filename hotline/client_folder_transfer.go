@@ -0,0 +1,299 @@
+package hotline
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"time"
+)
+
+// The client requests a folder download or upload with a transaction.  Once the server replies with the reference
+// number of the transfer, the client connects to the file transfer port and runs the receiving side of a download or
+// the sending side of an upload, using the same folderReceiver and folderSender as the server.  Local files are read
+// and written through a FileStore, with resource forks and Finder info kept in AppleDouble sidecars as on the server.
+
+// fileTransferAddr returns the address of the file transfer port of the server at address, which is the port after
+// the one used for transactions
+func fileTransferAddr(address string) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(p+1)), nil
+}
+
+// writeHTXF starts the file transfer with reference number ref
+func writeHTXF(w io.Writer, ref []byte) error {
+	b := make([]byte, 16)
+	copy(b[0:4], HTXF[:])
+	copy(b[4:8], ref)
+
+	_, err := w.Write(b)
+	return err
+}
+
+// clientFolderDestination stores the items of a folder download in a local folder
+type clientFolderDestination struct {
+	fileStore FileStore
+	root      string // Path of the local folder that receives the items
+}
+
+// itemAction creates folders, skips files that have been downloaded already and resumes files that were partially
+// downloaded.  As with uploads to the server, only the data fork of a partial file is resumed.
+func (d *clientFolderDestination) itemAction(item folderItem) (int, *FileResumeData, error) {
+	itemPath := path.Join(d.root, item.Path)
+
+	if item.IsFolder {
+		if err := mkdirAll(d.fileStore, itemPath); err != nil {
+			return 0, nil, err
+		}
+		return dlFldrActionNextFile, nil, nil
+	}
+
+	incomplete, err := d.fileStore.Stat(itemPath + incompleteFileSuffix)
+	if err == nil {
+		return dlFldrActionResumeFile, NewFileResumeData([]ForkInfoList{*newDataForkInfoList(uint64(incomplete.Size()))}), nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return 0, nil, err
+	}
+
+	_, err = d.fileStore.Stat(itemPath)
+	if err == nil {
+		return dlFldrActionNextFile, nil, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return 0, nil, err
+	}
+
+	return dlFldrActionSendFile, nil, nil
+}
+
+// receiveFile stores the file in an incomplete file that is renamed once all of it has been received.  The incomplete
+// file is kept when the transfer fails so that the download can be resumed.
+func (d *clientFolderDestination) receiveFile(r io.Reader, item folderItem, frd *FileResumeData) error {
+	filePath := path.Join(d.root, item.Path)
+
+	var file File
+	var err error
+	if frd != nil {
+		file, err = d.fileStore.OpenFile(filePath+incompleteFileSuffix, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	} else {
+		file, err = d.fileStore.Create(filePath + incompleteFileSuffix)
+	}
+	if err != nil {
+		return err
+	}
+
+	var infoFork, rsrcFork bytes.Buffer
+	if err := receiveFile(r, file, &rsrcFork, &infoFork, false); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	if err := d.fileStore.Rename(filePath+incompleteFileSuffix, filePath); err != nil {
+		return err
+	}
+
+	return saveForks(d.fileStore, nil, filePath, infoFork.Bytes(), rsrcFork.Bytes())
+}
+
+// clientFolderSource sends the files of a local folder for a folder upload
+type clientFolderSource struct {
+	fileStore FileStore
+	root      string // Path of the local folder being uploaded
+}
+
+func (src *clientFolderSource) sendFile(w io.Writer, item folderItem, frd *FileResumeData) error {
+	filePath := path.Join(src.root, item.Path)
+
+	var dataOffset, rsrcOffset int64
+	if frd != nil {
+		dataOffset, rsrcOffset = frd.forkOffsets(false)
+	}
+
+	ffo, err := NewFlattenedFileObject(src.fileStore, nil, path.Dir(filePath), nil, []byte(path.Base(filePath)), dataOffset)
+	if err != nil {
+		return err
+	}
+	ffo.resumeResourceFork(rsrcOffset)
+
+	if _, err := w.Write(ffo.TransferSize()); err != nil {
+		return err
+	}
+
+	return sendFile(w, src.fileStore, filePath, ffo, dataOffset, rsrcOffset, false)
+}
+
+// receiveFolder receives the folder download with reference number ref and itemCount items over conn into the folder
+// at localPath
+func receiveFolder(conn io.ReadWriter, ref []byte, itemCount int, fileStore FileStore, localPath string) error {
+	if err := mkdirAll(fileStore, localPath); err != nil {
+		return err
+	}
+	if err := writeHTXF(conn, ref); err != nil {
+		return err
+	}
+
+	return newFolderReceiver(conn, itemCount, &clientFolderDestination{fileStore: fileStore, root: localPath}).run()
+}
+
+// sendFolder sends items of the folder at localPath over conn for the folder upload with reference number ref
+func sendFolder(conn io.ReadWriter, ref []byte, items []folderItem, fileStore FileStore, localPath string) error {
+	if err := writeHTXF(conn, ref); err != nil {
+		return err
+	}
+
+	return newFolderSender(conn, items, &clientFolderSource{fileStore: fileStore, root: localPath}).run()
+}
+
+// DownloadFolder asks the server for the folder name in the folder at serverPath.  Once the server accepts, the folder
+// is downloaded into the local folder localPath in the background.
+func (c *Client) DownloadFolder(name, serverPath, localPath string) error {
+	t := NewTransaction(tranDownloadFldr, nil,
+		NewField(fieldFileName, []byte(name)),
+		NewField(fieldFilePath, EncodeFilePath(serverPath)),
+	)
+	c.addFolderTransfer(t, localPath)
+
+	return c.Send(*t)
+}
+
+// UploadFolder asks the server to accept the local folder localPath as the folder name in the folder at serverPath.
+// Once the server accepts, the folder is uploaded in the background.
+func (c *Client) UploadFolder(localPath, name, serverPath string) error {
+	fileStore := &OSFileStore{}
+	items, err := folderItems(fileStore, localPath, nil)
+	if err != nil {
+		return err
+	}
+	size, _, err := folderSize(fileStore, localPath, nil)
+	if err != nil {
+		return err
+	}
+	itemCount := make([]byte, 2)
+	binary.BigEndian.PutUint16(itemCount, uint16(len(items)))
+
+	t := NewTransaction(tranUploadFldr, nil,
+		NewField(fieldFileName, []byte(name)),
+		NewField(fieldFilePath, EncodeFilePath(serverPath)),
+		NewField(fieldTransferSize, size32(size)),
+		NewField(fieldFolderItemCount, itemCount),
+	)
+	c.addFolderTransfer(t, localPath)
+
+	return c.Send(*t)
+}
+
+// addFolderTransfer remembers the local folder of the folder transfer requested by t until the server replies
+func (c *Client) addFolderTransfer(t *Transaction, localPath string) {
+	c.folderTransfersMux.Lock()
+	defer c.folderTransfersMux.Unlock()
+
+	if c.folderTransfers == nil {
+		c.folderTransfers = make(map[uint32]string)
+	}
+	c.folderTransfers[binary.BigEndian.Uint32(t.ID)] = localPath
+}
+
+// takeFolderTransfer returns and forgets the local folder of the folder transfer that t is the reply to
+func (c *Client) takeFolderTransfer(t *Transaction) (string, bool) {
+	c.folderTransfersMux.Lock()
+	defer c.folderTransfersMux.Unlock()
+
+	id := binary.BigEndian.Uint32(t.ID)
+	localPath, ok := c.folderTransfers[id]
+	delete(c.folderTransfers, id)
+
+	return localPath, ok
+}
+
+// dialFileTransfer connects to the file transfer port of the server
+func (c *Client) dialFileTransfer() (net.Conn, error) {
+	addr, err := fileTransferAddr(c.Connection.RemoteAddr().String())
+	if err != nil {
+		return nil, err
+	}
+
+	return net.DialTimeout("tcp", addr, 5*time.Second)
+}
+
+func handleClientDownloadFolder(c *Client, t *Transaction) (res []Transaction, err error) {
+	localPath, ok := c.takeFolderTransfer(t)
+	if !ok {
+		return res, err
+	}
+	if !bytes.Equal(t.ErrorCode, []byte{0, 0, 0, 0}) {
+		c.Logger.Errorw("Folder download refused", "path", localPath, "err", string(t.GetField(fieldError).Data))
+		return res, err
+	}
+
+	ref := t.GetField(fieldRefNum).Data
+	itemCount := int(binary.BigEndian.Uint16(t.GetField(fieldFolderItemCount).Data))
+	go func() {
+		conn, err := c.dialFileTransfer()
+		if err != nil {
+			c.Logger.Errorw("Folder download failed", "path", localPath, "err", err)
+			return
+		}
+		defer func() { _ = conn.Close() }()
+
+		if err := receiveFolder(conn, ref, itemCount, &OSFileStore{}, localPath); err != nil {
+			c.Logger.Errorw("Folder download failed", "path", localPath, "err", err)
+			return
+		}
+		c.Logger.Infow("Folder download complete", "path", localPath)
+	}()
+
+	return res, err
+}
+
+func handleClientUploadFolder(c *Client, t *Transaction) (res []Transaction, err error) {
+	localPath, ok := c.takeFolderTransfer(t)
+	if !ok {
+		return res, err
+	}
+	if !bytes.Equal(t.ErrorCode, []byte{0, 0, 0, 0}) {
+		c.Logger.Errorw("Folder upload refused", "path", localPath, "err", string(t.GetField(fieldError).Data))
+		return res, err
+	}
+
+	ref := t.GetField(fieldRefNum).Data
+	go func() {
+		fileStore := &OSFileStore{}
+		items, err := folderItems(fileStore, localPath, nil)
+		if err != nil {
+			c.Logger.Errorw("Folder upload failed", "path", localPath, "err", err)
+			return
+		}
+
+		conn, err := c.dialFileTransfer()
+		if err != nil {
+			c.Logger.Errorw("Folder upload failed", "path", localPath, "err", err)
+			return
+		}
+		defer func() { _ = conn.Close() }()
+
+		if err := sendFolder(conn, ref, items, fileStore, localPath); err != nil {
+			c.Logger.Errorw("Folder upload failed", "path", localPath, "err", err)
+			return
+		}
+		c.Logger.Infow("Folder upload complete", "path", localPath)
+	}()
+
+	return res, err
+}
@@ -0,0 +1,107 @@
+package hotline
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+)
+
+func Test_fileTransferAddr(t *testing.T) {
+	addr, err := fileTransferAddr("127.0.0.1:5500")
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:5501", addr)
+
+	addr, err = fileTransferAddr("[::1]:5500")
+	assert.NoError(t, err)
+	assert.Equal(t, "[::1]:5501", addr)
+
+	_, err = fileTransferAddr("localhost")
+	assert.Error(t, err)
+}
+
+func Test_receiveFolder(t *testing.T) {
+	t.Run("downloads the folder with resource forks", func(t *testing.T) {
+		s := newTransferTestServer(newFolderTestStore(t), &FileTransfer{Type: FolderDownload, FileName: []byte("Docs")})
+		local := NewMemFileStore()
+
+		client, server := net.Pipe()
+		errs := make(chan error, 1)
+		go func() { errs <- s.handleFileTransfer(server) }()
+
+		assert.NoError(t, receiveFolder(client, []byte{0, 0, 0, 1}, 3, local, "/Downloads/Docs"))
+		_ = client.Close()
+		assert.NoError(t, <-errs)
+
+		data, err := readFile(local, "/Downloads/Docs/a.txt")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("aaaaa"), data)
+		data, err = readFile(local, "/Downloads/Docs/Sub/b.txt")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("bb"), data)
+
+		ad, err := readAppleDouble(local, "/Downloads/Docs/a.txt")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("rsrc"), ad.ResourceFork)
+		assert.Equal(t, []byte("TEXT"), ad.TypeCode())
+	})
+
+	t.Run("skips complete files and resumes partial ones", func(t *testing.T) {
+		s := newTransferTestServer(newFolderTestStore(t), &FileTransfer{Type: FolderDownload, FileName: []byte("Docs")})
+		local := NewMemFileStore()
+		_ = local.MkdirAll("/Downloads/Docs/Sub", 0777)
+		_ = local.WriteFile("/Downloads/Docs/a.txt"+incompleteFileSuffix, []byte("aa"), 0644)
+		_ = local.WriteFile("/Downloads/Docs/Sub/b.txt", []byte("mine"), 0644)
+
+		client, server := net.Pipe()
+		errs := make(chan error, 1)
+		go func() { errs <- s.handleFileTransfer(server) }()
+
+		assert.NoError(t, receiveFolder(client, []byte{0, 0, 0, 1}, 3, local, "/Downloads/Docs"))
+		_ = client.Close()
+		assert.NoError(t, <-errs)
+
+		data, err := readFile(local, "/Downloads/Docs/a.txt")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("aaaaa"), data)
+		data, err = readFile(local, "/Downloads/Docs/Sub/b.txt")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("mine"), data)
+		assert.Equal(t, 1, s.Stats.DownloadCounter)
+	})
+}
+
+func Test_sendFolder(t *testing.T) {
+	mfs := NewMemFileStore()
+	_ = mfs.MkdirAll("/Files/Uploads", 0777)
+	s := newTransferTestServer(mfs, &FileTransfer{
+		Type:            FolderUpload,
+		FileName:        []byte("Docs"),
+		FilePath:        EncodeFilePath("Uploads"),
+		FolderItemCount: []byte{0, 3},
+	})
+
+	local := newFolderTestStore(t)
+	items, err := folderItems(local, "/Files/Docs", nil)
+	assert.NoError(t, err)
+	assert.Len(t, items, 3)
+
+	client, server := net.Pipe()
+	errs := make(chan error, 1)
+	go func() { errs <- s.handleFileTransfer(server) }()
+
+	assert.NoError(t, sendFolder(client, []byte{0, 0, 0, 1}, items, local, "/Files/Docs"))
+	_ = client.Close()
+	assert.NoError(t, <-errs)
+
+	data, err := readFile(mfs, "/Files/Uploads/Docs/a.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("aaaaa"), data)
+	data, err = readFile(mfs, "/Files/Uploads/Docs/Sub/b.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("bb"), data)
+
+	ad, err := readAppleDouble(mfs, "/Files/Uploads/Docs/a.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("rsrc"), ad.ResourceFork)
+	assert.Equal(t, 2, s.Stats.UploadCounter)
+}
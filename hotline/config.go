@@ -1,15 +1,63 @@
 package hotline
 
+import "time"
+
 type Config struct {
-	Name                      string   `yaml:"Name" validate:"required,max=50"`         // Name used for Tracker registration
-	Description               string   `yaml:"Description" validate:"required,max=200"` // Description used for Tracker registration
-	BannerID                  int      `yaml:"BannerID"`                                // Unimplemented
-	FileRoot                  string   `yaml:"FileRoot" validate:"required"`            // Path to Files
-	EnableTrackerRegistration bool     `yaml:"EnableTrackerRegistration"`               // Toggle Tracker Registration
-	Trackers                  []string `yaml:"Trackers" validate:"dive,hostname_port"`  // List of trackers that the server should register with
-	NewsDelimiter             string   `yaml:"NewsDelimiter"`                           // String used to separate news posts
-	NewsDateFormat            string   `yaml:"NewsDateFormat"`                          // Go template string to customize news date format
-	MaxDownloads              int      `yaml:"MaxDownloads"`                            // Global simultaneous download limit
-	MaxDownloadsPerClient     int      `yaml:"MaxDownloadsPerClient"`                   // Per client simultaneous download limit
-	MaxConnectionsPerIP       int      `yaml:"MaxConnectionsPerIP"`                     // Max connections per IP
+	Name                      string              `yaml:"Name" validate:"required,max=50"`         // Name used for Tracker registration
+	Description               string              `yaml:"Description" validate:"required,max=200"` // Description used for Tracker registration
+	BannerID                  int                 `yaml:"BannerID"`                                // Unimplemented
+	FileRoot                  string              `yaml:"FileRoot" validate:"required"`            // Path to Files
+	EnableTrackerRegistration bool                `yaml:"EnableTrackerRegistration"`               // Toggle Tracker Registration
+	Trackers                  []string            `yaml:"Trackers" validate:"dive,hostname_port"`  // List of trackers that the server should register with
+	NewsDelimiter             string              `yaml:"NewsDelimiter"`                           // String used to separate news posts
+	NewsDateFormat            string              `yaml:"NewsDateFormat"`                          // Go template string to customize news date format
+	MaxDownloads              int                 `yaml:"MaxDownloads"`                            // Global simultaneous download limit
+	MaxDownloadsPerClient     int                 `yaml:"MaxDownloadsPerClient"`                   // Per client simultaneous download limit
+	MaxConnectionsPerIP       int                 `yaml:"MaxConnectionsPerIP"`                     // Max connections per IP
+	IdleAwayTime              int                 `yaml:"IdleAwayTime"`                            // Seconds of inactivity before a user is marked away; 0 uses the default of 300, -1 disables
+	IdleDisconnectTime        int                 `yaml:"IdleDisconnectTime"`                      // Seconds of inactivity before a user is disconnected; 0 disables
+	ReadTimeout               int                 `yaml:"ReadTimeout"`                             // Seconds to wait for data from a client before the connection is considered dead; 0 disables
+	WriteTimeout              int                 `yaml:"WriteTimeout"`                            // Seconds to wait for a write to a client to complete; 0 disables
+	TCPKeepAlive              int                 `yaml:"TCPKeepAlive"`                            // Seconds between TCP keepalive probes; 0 uses the Go default, -1 disables
+	ProxyProtocol             bool                `yaml:"ProxyProtocol"`                           // Read PROXY protocol v1/v2 headers from connections that originate from TrustedProxies
+	TrustedProxies            []string            `yaml:"TrustedProxies" validate:"dive,cidr"`     // CIDR ranges of load balancers allowed to send PROXY protocol headers
+	FileTypes                 map[string]FileType `yaml:"FileTypes,omitempty" validate:"dive"`     // Type and creator codes by file extension, added to the built-in table
+	MIMETypes                 map[string]FileType `yaml:"MIMETypes,omitempty" validate:"dive"`     // Type and creator codes by MIME type for files without an extension
+	NotifyDropBoxUploads      bool                `yaml:"NotifyDropBoxUploads"`                    // Send a message to users who can view drop boxes when a file is uploaded to one
+	UploadFolders             []string            `yaml:"UploadFolders"`                           // Paths, relative to FileRoot, of additional folders that users without Upload Anywhere can upload to
+	Mounts                    []Mount             `yaml:"Mounts" validate:"dive"`                  // Directories served as top-level folders of the file area in addition to FileRoot
+	EnableTrash               bool                `yaml:"EnableTrash"`                             // Move deleted files and folders to the trash instead of removing them
+	TrashRetention            int                 `yaml:"TrashRetention"`                          // Days deleted items are kept in the trash before they are purged; 0 keeps them until restored
+	KeepVersions              int                 `yaml:"KeepVersions"`                            // Number of prior versions kept of files replaced by uploads; 0 keeps none
+	StaleUploadAge            int                 `yaml:"StaleUploadAge"`                          // Hours after which incomplete uploads that are not being resumed are cleaned up; 0 disables
+	QuarantineStaleUploads    bool                `yaml:"QuarantineStaleUploads"`                  // Move stale incomplete uploads to the trash instead of removing them, if EnableTrash is set
+	MaxUploadSize             int64               `yaml:"MaxUploadSize"`                           // Size in bytes of the largest file that can be uploaded; 0 is unlimited
+	MinFreeSpace              int64               `yaml:"MinFreeSpace"`                            // Bytes of disk space to keep free; uploads that would leave less are refused; 0 disables
+	GroupUploadQuotas         map[string]int64    `yaml:"GroupUploadQuotas,omitempty"`             // Bytes the accounts of each group may upload, for accounts without an UploadQuota of their own
+	MaxTransferRate           int64               `yaml:"MaxTransferRate"`                         // Bytes per second shared by all file transfers; 0 is unlimited
+	MaxRatePerTransfer        int64               `yaml:"MaxRatePerTransfer"`                      // Bytes per second of each file transfer; 0 is unlimited
+	GroupTransferRates        map[string]int64    `yaml:"GroupTransferRates,omitempty"`            // Bytes per second shared by the transfers of each account of a group, for accounts without a TransferRate of their own
+}
+
+const defaultIdleAwayTime = 300 // default time in seconds before an inactive user is marked away
+
+// idleAwayTime returns the number of seconds of inactivity after which a user is marked away, or 0 if disabled.
+func (c *Config) idleAwayTime() int {
+	switch {
+	case c.IdleAwayTime == 0:
+		return defaultIdleAwayTime
+	case c.IdleAwayTime < 0:
+		return 0
+	}
+	return c.IdleAwayTime
+}
+
+// readTimeout returns the configured ReadTimeout as a time.Duration
+func (c *Config) readTimeout() time.Duration {
+	return time.Duration(c.ReadTimeout) * time.Second
+}
+
+// writeTimeout returns the configured WriteTimeout as a time.Duration
+func (c *Config) writeTimeout() time.Duration {
+	return time.Duration(c.WriteTimeout) * time.Second
 }
@@ -0,0 +1,86 @@
+package hotline
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+// timeoutConn wraps a net.Conn and pushes its read and write deadlines forward before each operation.  A peer that
+// stops sending or receiving for longer than the timeout causes the blocked Read or Write to fail instead of hanging
+// forever.  A zero timeout disables the deadline for that direction.
+type timeoutConn struct {
+	net.Conn
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+}
+
+func newTimeoutConn(conn net.Conn, readTimeout, writeTimeout time.Duration) *timeoutConn {
+	return &timeoutConn{Conn: conn, readTimeout: readTimeout, writeTimeout: writeTimeout}
+}
+
+func (c *timeoutConn) Read(p []byte) (int, error) {
+	var deadline time.Time
+	if c.readTimeout > 0 {
+		deadline = time.Now().Add(c.readTimeout)
+	}
+	if err := c.Conn.SetReadDeadline(deadline); err != nil {
+		return 0, err
+	}
+
+	return c.Conn.Read(p)
+}
+
+func (c *timeoutConn) Write(p []byte) (int, error) {
+	var deadline time.Time
+	if c.writeTimeout > 0 {
+		deadline = time.Now().Add(c.writeTimeout)
+	}
+	if err := c.Conn.SetWriteDeadline(deadline); err != nil {
+		return 0, err
+	}
+
+	return c.Conn.Write(p)
+}
+
+// copyChunkSize is the number of bytes ReadFrom copies between pushes of the write deadline
+const copyChunkSize = 1 << 20
+
+// ReadFrom copies r to the connection in chunks, pushing the write deadline forward before each.  The chunks are
+// written to the underlying connection, rather than a wrapper such as a PROXY protocol connection, so that a
+// *net.TCPConn can send files with sendfile.
+func (c *timeoutConn) ReadFrom(r io.Reader) (int64, error) {
+	dst := c.Conn
+	if wrapped, ok := dst.(interface{ NetConn() net.Conn }); ok {
+		dst = wrapped.NetConn()
+	}
+
+	return copyChunks(dst, r, func() (int64, error) {
+		var deadline time.Time
+		if c.writeTimeout > 0 {
+			deadline = time.Now().Add(c.writeTimeout)
+		}
+
+		return copyChunkSize, c.Conn.SetWriteDeadline(deadline)
+	}, nil)
+}
+
+// setKeepAlive applies the configured TCP keepalive settings to an accepted connection
+func (s *Server) setKeepAlive(conn net.Conn) {
+	if wrapped, ok := conn.(interface{ NetConn() net.Conn }); ok {
+		conn = wrapped.NetConn()
+	}
+
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+
+	switch {
+	case s.Config.TCPKeepAlive < 0:
+		_ = tcpConn.SetKeepAlive(false)
+	case s.Config.TCPKeepAlive > 0:
+		_ = tcpConn.SetKeepAlive(true)
+		_ = tcpConn.SetKeepAlivePeriod(time.Duration(s.Config.TCPKeepAlive) * time.Second)
+	}
+}
@@ -0,0 +1,80 @@
+package hotline
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTimeoutConn(t *testing.T) {
+	t.Run("read fails when the peer sends nothing before the timeout", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+
+		conn := newTimeoutConn(server, 10*time.Millisecond, 0)
+		_, err := conn.Read(make([]byte, 1))
+		assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	})
+
+	t.Run("write fails when the peer reads nothing before the timeout", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+
+		conn := newTimeoutConn(server, 0, 10*time.Millisecond)
+		_, err := conn.Write([]byte("hello"))
+		assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	})
+
+	t.Run("deadline is extended before each read", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+
+		go func() {
+			for i := 0; i < 3; i++ {
+				time.Sleep(30 * time.Millisecond)
+				_, _ = client.Write([]byte{byte(i)})
+			}
+		}()
+
+		conn := newTimeoutConn(server, 200*time.Millisecond, 0)
+		for i := 0; i < 3; i++ {
+			buf := make([]byte, 1)
+			_, err := conn.Read(buf)
+			assert.NoError(t, err)
+			assert.Equal(t, byte(i), buf[0])
+		}
+	})
+
+	t.Run("zero timeout disables the deadline", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			_, _ = client.Write([]byte{1})
+		}()
+
+		conn := newTimeoutConn(server, 0, 0)
+		_, err := conn.Read(make([]byte, 1))
+		assert.NoError(t, err)
+	})
+
+	t.Run("ReadFrom pushes the deadline forward for each chunk", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+
+		data := bytes.Repeat([]byte{1}, copyChunkSize+10)
+		go func() {
+			_, _ = newTimeoutConn(server, 0, time.Second).ReadFrom(io.LimitReader(bytes.NewReader(data), int64(len(data))))
+			_ = server.Close()
+		}()
+
+		got, err := io.ReadAll(client)
+		assert.NoError(t, err)
+		assert.Equal(t, data, got)
+	})
+}
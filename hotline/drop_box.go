@@ -0,0 +1,97 @@
+package hotline
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// A drop box is a folder that anyone with upload rights can upload to, but whose contents can only be seen by accounts
+// with accessViewDropBoxes.  A folder is a drop box if its name contains "drop box", as with the original Hotline
+// server, or if it contains a dropBoxMarker file.  The marker lets any folder be made a drop box without renaming it.
+const dropBoxMarker = ".dropbox"
+
+// isHiddenFile reports whether name is a server metadata file that is never shown to or transferred to clients
+func isHiddenFile(name string) bool {
+	return isAppleDouble(name) || name == dropBoxMarker || name == folderACLFile || name == trashFolder || name == versionsFolder
+}
+
+// isDropBox reports whether the folder at folderPath is a drop box.  The top-level folders of upload-only mounts are
+// drop boxes.
+func isDropBox(fileStore FileStore, folderPath string) bool {
+	if strings.Contains(strings.ToLower(path.Base(folderPath)), "drop box") {
+		return true
+	}
+	if isMountPoint(fileStore, folderPath) && mountAt(fileStore, folderPath).UploadOnly {
+		return true
+	}
+
+	_, err := fileStore.Stat(path.Join(folderPath, dropBoxMarker))
+	return err == nil
+}
+
+// inDropBox reports whether the folder at folderPath is a drop box or is inside of one.  Folders above fileRoot are not
+// considered.
+func inDropBox(fileStore FileStore, fileRoot, folderPath string) bool {
+	fileRoot = path.Join("/", fileRoot)
+	for p := path.Join("/", folderPath); p != fileRoot && isWithin(fileRoot, p); p = path.Dir(p) {
+		if isDropBox(fileStore, p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// walkFolder walks the folder at root like walk, skipping server metadata files other than AppleDouble sidecars, the
+// contents of folders inside of root for which include returns false and the symbolic links for which it returns false.
+// It is used for folder transfers so that drop boxes, folders denied by ACLs and aliases leading outside of the file
+// root are not sent to users.  A nil include includes everything.
+func walkFolder(fileStore FileStore, root string, include func(folderPath string) bool, fn filepath.WalkFunc) error {
+	return walk(fileStore, root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return fn(p, info, err)
+		}
+
+		if isHiddenFile(info.Name()) && !isAppleDouble(info.Name()) {
+			return nil
+		}
+
+		if include != nil && path.Clean(p) != path.Clean(root) {
+			if info.IsDir() && !include(p) {
+				return filepath.SkipDir
+			}
+			if info.Mode()&os.ModeSymlink != 0 && !include(p) {
+				return nil
+			}
+		}
+
+		return fn(p, info, err)
+	})
+}
+
+// notifyDropBoxUpload tells the connected users who can view drop boxes that fileName was uploaded to the drop box
+// at folderPath, if NotifyDropBoxUploads is enabled.
+func (s *Server) notifyDropBoxUpload(uploader *ClientConn, folderPath, fileName string) {
+	if !s.Config.NotifyDropBoxUploads || !inDropBox(s.FS, s.Config.FileRoot, folderPath) {
+		return
+	}
+
+	userName := "Someone"
+	if uploader != nil {
+		userName = string(uploader.UserName)
+	}
+	msg := fmt.Sprintf("%s uploaded \"%s\" to the drop box \"%s\".", userName, fileName, areaPath(s.Config.FileRoot, folderPath))
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	for _, c := range sortedClients(s.Clients) {
+		if !c.Agreed || c == uploader || !authorize(c.Account.Access, accessViewDropBoxes) {
+			continue
+		}
+		s.outbox <- *NewTransaction(tranServerMsg, c.ID, NewField(fieldData, []byte(msg)), NewField(fieldChatOptions, []byte{0}))
+	}
+}
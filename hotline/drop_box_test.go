@@ -0,0 +1,234 @@
+package hotline
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func newDropBoxTestFS() *MemFileStore {
+	mfs := NewMemFileStore()
+	_ = mfs.MkdirAll("/Files/Public/Drop Box/Sub", 0777)
+	_ = mfs.MkdirAll("/Files/Public/Submissions", 0777)
+	_ = mfs.WriteFile("/Files/Public/readme.txt", []byte("hello"), 0644)
+	_ = mfs.WriteFile("/Files/Public/Drop Box/secret.txt", []byte("secret"), 0644)
+	_ = mfs.WriteFile("/Files/Public/Drop Box/Sub/nested.txt", []byte("nested"), 0644)
+	_ = mfs.WriteFile("/Files/Public/Submissions/"+dropBoxMarker, []byte{}, 0644)
+	_ = mfs.WriteFile("/Files/Public/Submissions/entry.txt", []byte("entry"), 0644)
+	return mfs
+}
+
+func Test_inDropBox(t *testing.T) {
+	mfs := newDropBoxTestFS()
+
+	tests := []struct {
+		folderPath string
+		want       bool
+	}{
+		{folderPath: "/Files", want: false},
+		{folderPath: "/Files/Public", want: false},
+		{folderPath: "/Files/Public/Drop Box", want: true},
+		{folderPath: "/Files/Public/Drop Box/Sub", want: true},
+		{folderPath: "/Files/Public/Submissions", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.folderPath, func(t *testing.T) {
+			assert.Equal(t, tt.want, inDropBox(mfs, "/Files", tt.folderPath))
+		})
+	}
+
+	t.Run("folders above the file root are not considered", func(t *testing.T) {
+		assert.False(t, inDropBox(mfs, "/Files/Public/Drop Box", "/Files/Public/Drop Box/Sub"))
+	})
+
+	t.Run("when the file root is /", func(t *testing.T) {
+		mfs := NewMemFileStore()
+		_ = mfs.MkdirAll("/Drop Box/Sub", 0777)
+		_ = mfs.MkdirAll("/Public", 0777)
+
+		assert.True(t, inDropBox(mfs, "/", "/Drop Box"))
+		assert.True(t, inDropBox(mfs, "/", "/Drop Box/Sub"))
+		assert.False(t, inDropBox(mfs, "/", "/Public"))
+		assert.False(t, inDropBox(mfs, "/", "/"))
+	})
+}
+
+func TestDropBoxes(t *testing.T) {
+	newClient := func(accessBits ...int) *ClientConn {
+		var bits accessBitmap
+		for _, bit := range accessBits {
+			bits.Set(bit)
+		}
+		access := bits[:]
+
+		return &ClientConn{
+			ID:        &[]byte{0, 1},
+			Account:   &Account{Access: &access},
+			Transfers: make(map[int][]*FileTransfer),
+			Server: &Server{
+				FS:            newDropBoxTestFS(),
+				FileTransfers: make(map[uint32]*FileTransfer),
+				Config:        &Config{FileRoot: "/Files"},
+				Logger:        NewTestLogger(),
+			},
+		}
+	}
+
+	t.Run("contents are not listed without accessViewDropBoxes", func(t *testing.T) {
+		for _, p := range []string{"Public/Drop Box", "Public/Drop Box/Sub", "Public/Submissions"} {
+			res, err := HandleGetFileNameList(newClient(), NewTransaction(tranGetFileNameList, &[]byte{0, 1},
+				NewField(fieldFilePath, EncodeFilePath(p)),
+			))
+			assert.NoError(t, err)
+			assert.Empty(t, res[0].Fields, p)
+		}
+	})
+
+	t.Run("contents are listed with accessViewDropBoxes and the marker is hidden", func(t *testing.T) {
+		res, err := HandleGetFileNameList(newClient(accessViewDropBoxes), NewTransaction(tranGetFileNameList, &[]byte{0, 1},
+			NewField(fieldFilePath, EncodeFilePath("Public/Submissions")),
+		))
+		assert.NoError(t, err)
+		assert.Len(t, res[0].Fields, 1)
+	})
+
+	t.Run("files cannot be downloaded without accessViewDropBoxes", func(t *testing.T) {
+		cc := newClient(accessDownloadFile)
+		res, err := HandleDownloadFile(cc, NewTransaction(tranDownloadFile, &[]byte{0, 1},
+			NewField(fieldFileName, []byte("nested.txt")),
+			NewField(fieldFilePath, EncodeFilePath("Public/Drop Box/Sub")),
+		))
+		assert.NoError(t, err)
+		assert.Equal(t, "You are not allowed to download files from drop boxes.", string(res[0].GetField(fieldError).Data))
+		assert.Empty(t, cc.Server.FileTransfers)
+	})
+
+	t.Run("files can be downloaded with accessViewDropBoxes", func(t *testing.T) {
+		cc := newClient(accessDownloadFile, accessViewDropBoxes)
+		res, err := HandleDownloadFile(cc, NewTransaction(tranDownloadFile, &[]byte{0, 1},
+			NewField(fieldFileName, []byte("secret.txt")),
+			NewField(fieldFilePath, EncodeFilePath("Public/Drop Box")),
+		))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{0, 0, 0, 0}, res[0].ErrorCode)
+		assert.Len(t, cc.Server.FileTransfers, 1)
+	})
+
+	t.Run("file info is not shown without accessViewDropBoxes", func(t *testing.T) {
+		res, err := HandleGetFileInfo(newClient(), NewTransaction(tranGetFileInfo, &[]byte{0, 1},
+			NewField(fieldFileName, []byte("entry.txt")),
+			NewField(fieldFilePath, EncodeFilePath("Public/Submissions")),
+		))
+		assert.NoError(t, err)
+		assert.Equal(t, "You are not allowed to view drop boxes.", string(res[0].GetField(fieldError).Data))
+	})
+
+	t.Run("comments and names cannot be changed without accessViewDropBoxes", func(t *testing.T) {
+		cc := newClient(accessSetFileComment, accessRenameFile)
+		for _, field := range []Field{NewField(fieldFileComment, []byte("hello")), NewField(fieldFileNewName, []byte("renamed.txt"))} {
+			res, err := HandleSetFileInfo(cc, NewTransaction(tranSetFileInfo, &[]byte{0, 1},
+				NewField(fieldFileName, []byte("entry.txt")),
+				NewField(fieldFilePath, EncodeFilePath("Public/Submissions")),
+				field,
+			))
+			assert.NoError(t, err)
+			assert.Equal(t, "You are not allowed to view drop boxes.", string(res[0].GetField(fieldError).Data))
+		}
+
+		_, err := cc.Server.FS.Stat("/Files/Public/Submissions/entry.txt")
+		assert.NoError(t, err)
+		_, err = cc.Server.FS.Stat(appleDoublePath("/Files/Public/Submissions/entry.txt"))
+		assert.Error(t, err, "no sidecar holding a comment is written")
+	})
+
+	t.Run("files cannot be moved out of drop boxes without accessViewDropBoxes", func(t *testing.T) {
+		cc := newClient(accessMoveFile)
+		res, err := HandleMoveFile(cc, NewTransaction(tranMoveFile, &[]byte{0, 1},
+			NewField(fieldFileName, []byte("entry.txt")),
+			NewField(fieldFilePath, EncodeFilePath("Public/Submissions")),
+			NewField(fieldFileNewPath, EncodeFilePath("Public")),
+		))
+		assert.NoError(t, err)
+		assert.Equal(t, "You are not allowed to view drop boxes.", string(res[0].GetField(fieldError).Data))
+
+		_, err = cc.Server.FS.Stat("/Files/Public/Submissions/entry.txt")
+		assert.NoError(t, err)
+	})
+
+	t.Run("aliases to files in drop boxes cannot be made without accessViewDropBoxes", func(t *testing.T) {
+		cc := newClient(accessMakeAlias)
+		res, err := HandleMakeAlias(cc, NewTransaction(tranMakeFileAlias, &[]byte{0, 1},
+			NewField(fieldFileName, []byte("secret.txt")),
+			NewField(fieldFilePath, EncodeFilePath("Public/Drop Box")),
+			NewField(fieldFileNewPath, EncodeFilePath("Public")),
+		))
+		assert.NoError(t, err)
+		assert.Equal(t, "You are not allowed to view drop boxes.", string(res[0].GetField(fieldError).Data))
+
+		_, err = cc.Server.FS.Lstat("/Files/Public/secret.txt")
+		assert.Error(t, err)
+	})
+
+	t.Run("drop box folders cannot be downloaded without accessViewDropBoxes", func(t *testing.T) {
+		res, err := HandleDownloadFolder(newClient(accessDownloadFile), NewTransaction(tranDownloadFldr, &[]byte{0, 1},
+			NewField(fieldFileName, []byte("Drop Box")),
+			NewField(fieldFilePath, EncodeFilePath("Public")),
+		))
+		assert.NoError(t, err)
+		assert.Equal(t, "You are not allowed to download folders from drop boxes.", string(res[0].GetField(fieldError).Data))
+	})
+
+	t.Run("drop boxes are left out of folder downloads without accessViewDropBoxes", func(t *testing.T) {
+		res, err := HandleDownloadFolder(newClient(accessDownloadFile), NewTransaction(tranDownloadFldr, &[]byte{0, 1},
+			NewField(fieldFileName, []byte("Public")),
+			NewField(fieldFilePath, []byte{0, 0}),
+		))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{0, 1}, res[0].GetField(fieldFolderItemCount).Data)
+		assert.Equal(t, []byte{0, 0, 0, 5}, res[0].GetField(fieldTransferSize).Data)
+	})
+
+	t.Run("drop boxes are included in folder downloads with accessViewDropBoxes", func(t *testing.T) {
+		res, err := HandleDownloadFolder(newClient(accessDownloadFile, accessViewDropBoxes), NewTransaction(tranDownloadFldr, &[]byte{0, 1},
+			NewField(fieldFileName, []byte("Public")),
+			NewField(fieldFilePath, []byte{0, 0}),
+		))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{0, 7}, res[0].GetField(fieldFolderItemCount).Data)
+	})
+}
+
+func TestServer_notifyDropBoxUpload(t *testing.T) {
+	newAccount := func(accessBits ...int) *Account {
+		var bits accessBitmap
+		for _, bit := range accessBits {
+			bits.Set(bit)
+		}
+		access := bits[:]
+		return &Account{Access: &access}
+	}
+
+	uploader := &ClientConn{ID: &[]byte{0, 1}, Agreed: true, UserName: []byte("Alice"), Account: newAccount()}
+	admin := &ClientConn{ID: &[]byte{0, 2}, Agreed: true, UserName: []byte("Admin"), Account: newAccount(accessViewDropBoxes)}
+	other := &ClientConn{ID: &[]byte{0, 3}, Agreed: true, UserName: []byte("Bob"), Account: newAccount()}
+
+	s := &Server{
+		FS:      newDropBoxTestFS(),
+		Config:  &Config{FileRoot: "/Files", NotifyDropBoxUploads: true},
+		Clients: map[uint16]*ClientConn{1: uploader, 2: admin, 3: other},
+		outbox:  make(chan Transaction, 10),
+	}
+
+	s.notifyDropBoxUpload(uploader, "/Files/Public", "readme.txt")
+	assert.Empty(t, s.outbox, "uploads outside of drop boxes are not notified")
+
+	s.notifyDropBoxUpload(uploader, "/Files/Public/Drop Box", "report.txt")
+	if assert.Len(t, s.outbox, 1) {
+		got := <-s.outbox
+		assert.Equal(t, admin.ID, got.clientID)
+		assert.Equal(t, `Alice uploaded "report.txt" to the drop box "/Public/Drop Box".`, string(got.GetField(fieldData).Data))
+	}
+
+	s.Config.NotifyDropBoxUploads = false
+	s.notifyDropBoxUpload(uploader, "/Files/Public/Drop Box", "report.txt")
+	assert.Empty(t, s.outbox)
+}
@@ -61,16 +61,27 @@ const fieldNewsArtParentArt = 335
 const fieldNewsArt1stChildArt = 336
 const fieldNewsArtRecurseDel = 337
 
+// Large file extension.  Clients that set capLargeFiles in fieldCapabilities at login are sent 64-bit sizes in these
+// fields alongside the 32-bit ones, and flattened file object fork headers and resume data carry the high 32 bits of
+// sizes and offsets in their reserved fields.  Clients that don't are never sent these fields, and the fields and
+// reserved bits are ignored when they send them.
+const fieldCapabilities = 0x01F0   // DATA_CAPABILITIES
+const fieldFileSize64 = 0x01F4     // DATA_FILESIZE64
+const fieldTransferSize64 = 0x01F6 // DATA_XFERSIZE64
+
+const capLargeFiles = 0x0001 // fieldCapabilities bit for 64-bit file sizes
+
 type Field struct {
 	ID        []byte // Type of field
 	FieldSize []byte // Size of the data part
 	Data      []byte // Actual field content
 }
 
-type requiredField struct {
-	ID     int
-	minLen int
-	maxLen int
+// RequiredField describes a field that must be present in a transaction before its handler is called
+type RequiredField struct {
+	ID     int // Field ID
+	MinLen int // Minimum length of the field data
+	MaxLen int // Maximum length of the field data; 0 means no limit
 }
 
 func NewField(id uint16, data []byte) Field {
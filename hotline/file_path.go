@@ -4,7 +4,10 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"io/fs"
+	"os"
 	"path"
 	"strings"
 )
@@ -58,22 +61,6 @@ func (fp *FilePath) UnmarshalBinary(b []byte) error {
 	return nil
 }
 
-func (fp *FilePath) IsDropbox() bool {
-	if fp.Len() == 0 {
-		return false
-	}
-
-	return strings.Contains(strings.ToLower(string(fp.Items[fp.Len()-1].Name)), "drop box")
-}
-
-func (fp *FilePath) IsUploadDir() bool {
-	if fp.Len() == 0 {
-		return false
-	}
-
-	return strings.Contains(strings.ToLower(string(fp.Items[fp.Len()-1].Name)), "upload")
-}
-
 func (fp *FilePath) Len() uint16 {
 	return binary.BigEndian.Uint16(fp.ItemCount[:])
 }
@@ -96,6 +83,32 @@ func ReadFilePath(filePathFieldData []byte) string {
 	return fp.String()
 }
 
+var (
+	errInvalidPath     = errors.New("invalid file path")
+	errPathEscapesRoot = errors.New("file path resolves outside of the file root")
+)
+
+// maxSymlinks is the number of symbolic links that are followed when resolving a path before giving up
+const maxSymlinks = 40
+
+// checkPathItem returns errInvalidPath if name cannot safely be used as a single file or folder name.  Names that
+// refer to a parent folder or contain a path separator could otherwise be used to reach files outside of the file
+// root.  Hidden files are managed by the server: the trash and versions folders, folder ACLs, drop box markers and
+// AppleDouble sidecars, which hold the resource fork, type, creator and comment of another file.  Empty names are
+// ignored by path.Join and are allowed.
+func checkPathItem(name []byte) error {
+	switch {
+	case string(name) == "." || string(name) == ".." || isHiddenFile(string(name)):
+		return fmt.Errorf("%w: %q", errInvalidPath, name)
+	case bytes.ContainsAny(name, pathSeparator+"\x00"):
+		return fmt.Errorf("%w: %q", errInvalidPath, name)
+	}
+
+	return nil
+}
+
+// readPath returns the path of the file or folder fileName in the folder filePath, relative to fileRoot.  It returns
+// errInvalidPath if any of the path items or fileName is not a valid name.
 func readPath(fileRoot string, filePath, fileName []byte) (fullPath string, err error) {
 	var fp FilePath
 	if filePath != nil {
@@ -104,6 +117,15 @@ func readPath(fileRoot string, filePath, fileName []byte) (fullPath string, err
 		}
 	}
 
+	for _, item := range fp.Items {
+		if err := checkPathItem(item.Name); err != nil {
+			return "", err
+		}
+	}
+	if err := checkPathItem(fileName); err != nil {
+		return "", err
+	}
+
 	fullPath = path.Join(
 		"/",
 		fileRoot,
@@ -113,3 +135,95 @@ func readPath(fileRoot string, filePath, fileName []byte) (fullPath string, err
 
 	return fullPath, nil
 }
+
+// isWithin reports whether filePath is root or is inside of root.  Both must be clean.
+func isWithin(root, filePath string) bool {
+	return filePath == root || strings.HasPrefix(filePath, root+"/") || root == "/"
+}
+
+// areaPath returns filePath, which must be inside of fileRoot, as a path from the top of the file area, e.g.
+// "/Uploads/a.txt" for the file a.txt in the Uploads folder of fileRoot.
+func areaPath(fileRoot, filePath string) string {
+	return path.Join("/", strings.TrimPrefix(path.Clean(filePath), path.Join("/", fileRoot)))
+}
+
+// confinePath returns errPathEscapesRoot if filePath, with all symbolic links along the way resolved, is not inside of
+// fileRoot.  Aliases made by clients are symbolic links, so this keeps an alias or a link placed in the file area by
+// other means from exposing files outside of it.  Parts of filePath that do not exist yet are not checked further.
+func confinePath(fileStore FileStore, fileRoot, filePath string) error {
+	root := path.Join("/", fileRoot)
+	filePath = path.Clean(filePath)
+	if !isWithin(root, filePath) {
+		return errPathEscapesRoot
+	}
+
+	resolved := root
+	remaining := strings.Split(strings.TrimPrefix(filePath, root), "/")
+	for links := 0; len(remaining) > 0; {
+		name := remaining[0]
+		remaining = remaining[1:]
+		if name == "" {
+			continue
+		}
+
+		next := path.Join(resolved, name)
+		fi, err := fileStore.Lstat(next)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		if links++; links > maxSymlinks {
+			return errPathEscapesRoot
+		}
+		target, err := fileStore.Readlink(next)
+		if err != nil {
+			return err
+		}
+		if !path.IsAbs(target) {
+			target = path.Join(resolved, target)
+		}
+		target = path.Clean(target)
+		if !isWithin(root, target) {
+			return errPathEscapesRoot
+		}
+
+		// Resolve the link target from the file root, as it may itself go through links
+		remaining = append(strings.Split(strings.TrimPrefix(target, root), "/"), remaining...)
+		resolved = root
+	}
+
+	return nil
+}
+
+// resolvePath returns the path of the file or folder fileName in the folder filePath, as sent by a client.  It returns
+// errInvalidPath for names that are not valid and errPathEscapesRoot if the path leads outside of the file root
+// through symbolic links.  The returned path is not itself resolved, so that operations on aliases apply to the alias.
+func (s *Server) resolvePath(filePath, fileName []byte) (string, error) {
+	fullPath, err := readPath(s.Config.FileRoot, filePath, fileName)
+	if err != nil {
+		return "", err
+	}
+
+	if err := confinePath(s.FS, s.Config.FileRoot, fullPath); err != nil {
+		return "", err
+	}
+
+	return fullPath, nil
+}
+
+// pathErrReply returns an error reply to t for the errors returned by resolvePath for paths that are not allowed, and
+// returns other errors unchanged.
+func (cc *ClientConn) pathErrReply(t *Transaction, err error) ([]Transaction, error) {
+	if errors.Is(err, errInvalidPath) || errors.Is(err, errPathEscapesRoot) {
+		return []Transaction{cc.NewErrReply(t, "Cannot complete the request because the file path is not valid.")}, nil
+	}
+
+	return nil, err
+}
@@ -1,6 +1,7 @@
 package hotline
 
 import (
+	"bytes"
 	"github.com/stretchr/testify/assert"
 	"testing"
 )
@@ -108,7 +109,8 @@ func Test_readPath(t *testing.T) {
 				filePath: nil,
 				fileName: []byte("../../../foo"),
 			},
-			want: "/usr/local/var/mobius/Files/foo",
+			want:    "",
+			wantErr: true,
 		},
 		{
 			name: "when filePath contains .. ",
@@ -125,7 +127,8 @@ func Test_readPath(t *testing.T) {
 				},
 				fileName: []byte("foo"),
 			},
-			want: "/usr/local/var/mobius/Files/A SubDir/foo",
+			want:    "",
+			wantErr: true,
 		},
 		{
 			name: "when a filePath entry contains .. ",
@@ -139,7 +142,38 @@ func Test_readPath(t *testing.T) {
 				},
 				fileName: []byte("foo"),
 			},
-			want: "/usr/local/var/mobius/Files/A SubDir/foo",
+			want:    "",
+			wantErr: true,
+		},
+		{
+			name: "when fileName contains a path separator",
+			args: args{
+				fileRoot: "/usr/local/var/mobius/Files",
+				filePath: nil,
+				fileName: []byte("A SubDir/foo"),
+			},
+			want:    "",
+			wantErr: true,
+		},
+		{
+			name: "when fileName contains a NUL byte",
+			args: args{
+				fileRoot: "/usr/local/var/mobius/Files",
+				filePath: nil,
+				fileName: []byte("foo\x00.txt"),
+			},
+			want:    "",
+			wantErr: true,
+		},
+		{
+			name: "when a filePath entry is .",
+			args: args{
+				fileRoot: "/usr/local/var/mobius/Files",
+				filePath: EncodeFilePath("."),
+				fileName: []byte("foo"),
+			},
+			want:    "",
+			wantErr: true,
 		},
 		{
 			name: "when filePath and fileName are nil",
@@ -164,3 +198,188 @@ func Test_readPath(t *testing.T) {
 		})
 	}
 }
+
+func Test_confinePath(t *testing.T) {
+	mfs := NewMemFileStore()
+	_ = mfs.MkdirAll("/Files/Public/Sub", 0777)
+	_ = mfs.MkdirAll("/Secret", 0777)
+	_ = mfs.WriteFile("/Files/Public/readme.txt", []byte("hello"), 0644)
+	_ = mfs.WriteFile("/Secret/passwords.txt", []byte("hunter2"), 0644)
+	_ = mfs.Symlink("/Files/Public/readme.txt", "/Files/Public/Sub/readme alias")
+	_ = mfs.Symlink("../Public", "/Files/Public/Sub/up")
+	_ = mfs.Symlink("/Secret", "/Files/Public/secret")
+	_ = mfs.Symlink("../../Secret", "/Files/Public/relative secret")
+	_ = mfs.Symlink("/Files/Public/secret", "/Files/Public/indirect secret")
+	_ = mfs.Symlink("/Files/Public/loop", "/Files/Public/loop")
+
+	tests := []struct {
+		filePath string
+		wantErr  error
+	}{
+		{filePath: "/Files", wantErr: nil},
+		{filePath: "/Files/Public/readme.txt", wantErr: nil},
+		{filePath: "/Files/Public/new.txt", wantErr: nil},
+		{filePath: "/Files/Public/Sub/readme alias", wantErr: nil},
+		{filePath: "/Files/Public/Sub/up/readme.txt", wantErr: nil},
+		{filePath: "/Secret/passwords.txt", wantErr: errPathEscapesRoot},
+		{filePath: "/Files/Public/secret", wantErr: errPathEscapesRoot},
+		{filePath: "/Files/Public/secret/passwords.txt", wantErr: errPathEscapesRoot},
+		{filePath: "/Files/Public/relative secret/passwords.txt", wantErr: errPathEscapesRoot},
+		{filePath: "/Files/Public/indirect secret", wantErr: errPathEscapesRoot},
+		{filePath: "/Files/Public/loop", wantErr: errPathEscapesRoot},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filePath, func(t *testing.T) {
+			err := confinePath(mfs, "/Files", tt.filePath)
+			if tt.wantErr == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_areaPath(t *testing.T) {
+	tests := []struct {
+		fileRoot string
+		filePath string
+		want     string
+	}{
+		{fileRoot: "/Files", filePath: "/Files", want: "/"},
+		{fileRoot: "/Files", filePath: "/Files/Uploads/a.txt", want: "/Uploads/a.txt"},
+		{fileRoot: "/Files/", filePath: "/Files/Uploads", want: "/Uploads"},
+		{fileRoot: "/", filePath: "/", want: "/"},
+		{fileRoot: "/", filePath: "/Uploads/a.txt", want: "/Uploads/a.txt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fileRoot+" "+tt.filePath, func(t *testing.T) {
+			assert.Equal(t, tt.want, areaPath(tt.fileRoot, tt.filePath))
+		})
+	}
+}
+
+func TestPathTraversal(t *testing.T) {
+	newClient := func() *ClientConn {
+		var bits accessBitmap
+		for _, bit := range []int{accessDownloadFile, accessUploadFile, accessUploadAnywhere, accessDeleteFile, accessCreateFolder, accessRenameFile} {
+			bits.Set(bit)
+		}
+		access := bits[:]
+
+		mfs := NewMemFileStore()
+		_ = mfs.MkdirAll("/Files/Public", 0777)
+		_ = mfs.MkdirAll("/Secret", 0777)
+		_ = mfs.WriteFile("/Files/Public/readme.txt", []byte("hello"), 0644)
+		_ = mfs.WriteFile("/Secret/passwords.txt", []byte("hunter2"), 0644)
+		_ = mfs.Symlink("/Secret", "/Files/Public/secret")
+		_ = mfs.Symlink("/Files/Public/readme.txt", "/Files/Public/readme alias")
+
+		return &ClientConn{
+			ID:        &[]byte{0, 1},
+			Account:   &Account{Access: &access},
+			Transfers: make(map[int][]*FileTransfer),
+			Server: &Server{
+				FS:            mfs,
+				FileTransfers: make(map[uint32]*FileTransfer),
+				Config:        &Config{FileRoot: "/Files"},
+				Logger:        NewTestLogger(),
+			},
+		}
+	}
+	const invalidPath = "Cannot complete the request because the file path is not valid."
+
+	t.Run("parent folder names are rejected", func(t *testing.T) {
+		cc := newClient()
+		res, err := HandleDownloadFile(cc, NewTransaction(tranDownloadFile, &[]byte{0, 1},
+			NewField(fieldFileName, []byte("passwords.txt")),
+			NewField(fieldFilePath, EncodeFilePath("../Secret")),
+		))
+		assert.NoError(t, err)
+		assert.Equal(t, invalidPath, string(res[0].GetField(fieldError).Data))
+		assert.Empty(t, cc.Server.FileTransfers)
+	})
+
+	t.Run("file names with path separators are rejected", func(t *testing.T) {
+		cc := newClient()
+		res, err := HandleDeleteFile(cc, NewTransaction(tranDeleteFile, &[]byte{0, 1},
+			NewField(fieldFileName, []byte("../../Secret/passwords.txt")),
+		))
+		assert.NoError(t, err)
+		assert.Equal(t, invalidPath, string(res[0].GetField(fieldError).Data))
+
+		_, err = cc.Server.FS.Stat("/Secret/passwords.txt")
+		assert.NoError(t, err)
+	})
+
+	t.Run("names reserved for hidden files are rejected", func(t *testing.T) {
+		for _, name := range []string{folderACLFile, dropBoxMarker, appleDoublePrefix + "readme.txt", trashFolder, versionsFolder} {
+			t.Run(name, func(t *testing.T) {
+				cc := newClient()
+				res, err := HandleUploadFile(cc, NewTransaction(tranUploadFile, &[]byte{0, 1},
+					NewField(fieldFileName, []byte(name)),
+					NewField(fieldFilePath, EncodeFilePath("Public")),
+				))
+				assert.NoError(t, err)
+				assert.Equal(t, invalidPath, string(res[0].GetField(fieldError).Data))
+				assert.Empty(t, cc.Server.FileTransfers)
+
+				res, err = HandleSetFileInfo(cc, NewTransaction(tranSetFileInfo, &[]byte{0, 1},
+					NewField(fieldFileName, []byte("readme.txt")),
+					NewField(fieldFilePath, EncodeFilePath("Public")),
+					NewField(fieldFileNewName, []byte(name)),
+				))
+				assert.NoError(t, err)
+				assert.Equal(t, invalidPath, string(res[0].GetField(fieldError).Data))
+				_, err = cc.Server.FS.Stat("/Files/Public/readme.txt")
+				assert.NoError(t, err)
+
+				_, err = readFolderItem(bytes.NewReader(folderItem{Path: "Sub/" + name}.header()))
+				assert.ErrorIs(t, err, errInvalidPath, "folder upload items")
+			})
+		}
+	})
+
+	t.Run("aliases leading outside of the file root are not followed", func(t *testing.T) {
+		cc := newClient()
+		res, err := HandleDownloadFile(cc, NewTransaction(tranDownloadFile, &[]byte{0, 1},
+			NewField(fieldFileName, []byte("passwords.txt")),
+			NewField(fieldFilePath, EncodeFilePath("Public/secret")),
+		))
+		assert.NoError(t, err)
+		assert.Equal(t, invalidPath, string(res[0].GetField(fieldError).Data))
+		assert.Empty(t, cc.Server.FileTransfers)
+
+		res, err = HandleUploadFile(cc, NewTransaction(tranUploadFile, &[]byte{0, 1},
+			NewField(fieldFileName, []byte("new.txt")),
+			NewField(fieldFilePath, EncodeFilePath("Public/secret")),
+		))
+		assert.NoError(t, err)
+		assert.Equal(t, invalidPath, string(res[0].GetField(fieldError).Data))
+		assert.Empty(t, cc.Server.FileTransfers)
+	})
+
+	t.Run("aliases leading outside of the file root are not listed", func(t *testing.T) {
+		res, err := HandleGetFileNameList(newClient(), NewTransaction(tranGetFileNameList, &[]byte{0, 1},
+			NewField(fieldFilePath, EncodeFilePath("Public")),
+		))
+		assert.NoError(t, err)
+
+		var names []string
+		for _, f := range res[0].Fields {
+			var fnwi FileNameWithInfo
+			assert.NoError(t, fnwi.UnmarshalBinary(f.Data))
+			names = append(names, string(fnwi.name))
+		}
+		assert.Equal(t, []string{"readme alias", "readme.txt"}, names)
+	})
+
+	t.Run("aliases leading outside of the file root are left out of folder downloads", func(t *testing.T) {
+		res, err := HandleDownloadFolder(newClient(), NewTransaction(tranDownloadFldr, &[]byte{0, 1},
+			NewField(fieldFileName, []byte("Public")),
+			NewField(fieldFilePath, []byte{0, 0}),
+		))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{0, 2}, res[0].GetField(fieldFolderItemCount).Data)
+	})
+}
@@ -3,6 +3,7 @@ package hotline
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 )
 
 // FileResumeData is sent when a client or server would like to resume a transfer from an offset
@@ -17,10 +18,44 @@ type FileResumeData struct {
 type ForkInfoList struct {
 	Fork     [4]byte // "DATA" or "MACR"
 	DataSize [4]byte // offset from which to resume the transfer of data
-	RSVDA    [4]byte // Unused
+	RSVDA    [4]byte // High 32 bits of the offset for clients that support large files; otherwise unused
 	RSVDB    [4]byte // Unused
 }
 
+// offset returns the offset from which to resume the transfer.  The reserved field holds the high 32 bits of the offset
+// only for clients with large file support; other clients may send anything in it.
+func (fil *ForkInfoList) offset(largeFiles bool) uint64 {
+	offset := uint64(binary.BigEndian.Uint32(fil.DataSize[:]))
+	if largeFiles {
+		offset |= uint64(binary.BigEndian.Uint32(fil.RSVDA[:])) << 32
+	}
+
+	return offset
+}
+
+// forkOffsets returns the offsets from which to resume the data and resource forks
+func (frd *FileResumeData) forkOffsets(largeFiles bool) (data, rsrc int64) {
+	for _, fil := range frd.ForkInfoList {
+		switch fil.Fork {
+		case [4]byte{0x44, 0x41, 0x54, 0x41}: // DATA
+			data = int64(fil.offset(largeFiles))
+		case [4]byte{0x4d, 0x41, 0x43, 0x52}: // MACR
+			rsrc = int64(fil.offset(largeFiles))
+		}
+	}
+
+	return data, rsrc
+}
+
+// newDataForkInfoList returns the fork info for resuming the data fork at offset
+func newDataForkInfoList(offset uint64) *ForkInfoList {
+	fil := NewForkInfoList(make([]byte, 4))
+	binary.BigEndian.PutUint32(fil.RSVDA[:], uint32(offset>>32))
+	binary.BigEndian.PutUint32(fil.DataSize[:], uint32(offset))
+
+	return fil
+}
+
 func NewForkInfoList(b []byte) *ForkInfoList {
 	return &ForkInfoList{
 		Fork:     [4]byte{0x44, 0x41, 0x54, 0x41},
@@ -54,6 +89,9 @@ func (frd *FileResumeData) BinaryMarshal() ([]byte, error) {
 }
 
 func (frd *FileResumeData) UnmarshalBinary(b []byte) error {
+	if len(b) < 42 {
+		return errors.New("file resume data too short")
+	}
 	frd.Format = [4]byte{b[0], b[1], b[2], b[3]}
 	frd.Version = [2]byte{b[4], b[5]}
 	frd.ForkCount = [2]byte{b[40], b[41]}
@@ -62,6 +100,9 @@ func (frd *FileResumeData) UnmarshalBinary(b []byte) error {
 		var fil ForkInfoList
 		start := 42 + i*16
 		end := start + 16
+		if end > len(b) {
+			return errors.New("file resume data too short")
+		}
 
 		r := bytes.NewReader(b[start:end])
 		if err := binary.Read(r, binary.BigEndian, &fil); err != nil {
@@ -0,0 +1,18 @@
+package hotline
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestFileResumeData_forkOffsets(t *testing.T) {
+	frd := resumeData(5<<32|3, 1<<32|2)
+
+	data, rsrc := frd.forkOffsets(true)
+	assert.Equal(t, int64(5<<32|3), data)
+	assert.Equal(t, int64(1<<32|2), rsrc)
+
+	data, rsrc = frd.forkOffsets(false)
+	assert.Equal(t, int64(3), data, "the reserved field is ignored without large file support")
+	assert.Equal(t, int64(2), rsrc)
+}
@@ -1,22 +1,99 @@
 package hotline
 
 import (
+	"fmt"
 	"github.com/stretchr/testify/mock"
+	"io"
 	"io/fs"
+	"net/url"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 )
 
+// File is an open file handle returned by a FileStore.  *os.File satisfies this interface.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Seeker
+	io.Closer
+	Stat() (os.FileInfo, error)
+}
+
+// FileStore is the storage backend for the server file area.  All file system access made on behalf of clients goes
+// through the FileStore so that alternative storage backends can be used in place of the local file system.
 type FileStore interface {
 	Mkdir(name string, perm os.FileMode) error
 	Stat(name string) (os.FileInfo, error)
-	Open(name string) (*os.File, error)
+	Lstat(name string) (os.FileInfo, error)
+	Open(name string) (File, error)
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Create(name string) (File, error)
+	ReadDir(name string) ([]os.FileInfo, error) // returns entries sorted by name, without following symlinks
+	Readlink(name string) (string, error)
 	Symlink(oldname, newname string) error
+	Rename(oldpath, newpath string) error
 	Remove(name string) error
-	Create(name string) (*os.File, error)
+	RemoveAll(path string) error
 	WriteFile(name string, data []byte, perm fs.FileMode) error
-	// TODO: implement these
-	// Rename(oldpath string, newpath string) error
-	// RemoveAll(path string) error
+}
+
+// isFileStoreURL reports whether fileRoot selects a storage backend with a URL scheme rather than naming a local path
+func isFileStoreURL(fileRoot string) bool {
+	return strings.Contains(fileRoot, "://")
+}
+
+// newFileStore returns the FileStore selected by the scheme of fileRoot and the root of the file area within it.
+// A plain path, or a file:// URL, selects the local file system.  Other supported schemes are:
+//
+//	mem://                                                   an empty in-memory file area
+//	s3://bucket/prefix?endpoint=http://host:9000&region=...  an S3-compatible bucket
+//
+// S3 credentials are read from the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables.  When no
+// endpoint is given the AWS endpoint for the region is used.  The file area of mem:// and s3:// stores is their root,
+// "/".
+func newFileStore(fileRoot string) (FileStore, string, error) {
+	if !isFileStoreURL(fileRoot) {
+		return &OSFileStore{}, fileRoot, nil
+	}
+
+	u, err := url.Parse(fileRoot)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid FileRoot %q: %w", fileRoot, err)
+	}
+
+	switch u.Scheme {
+	case "file":
+		return &OSFileStore{}, u.Path, nil
+	case "mem":
+		return NewMemFileStore(), "/", nil
+	case "s3":
+		if u.Host == "" {
+			return nil, "", fmt.Errorf("invalid FileRoot %q: missing bucket name", fileRoot)
+		}
+
+		region := u.Query().Get("region")
+		if region == "" {
+			region = "us-east-1"
+		}
+		endpoint := u.Query().Get("endpoint")
+		if endpoint == "" {
+			endpoint = "https://s3." + region + ".amazonaws.com"
+		}
+
+		return NewS3FileStore(
+			endpoint,
+			u.Host,
+			u.Path,
+			region,
+			os.Getenv("AWS_ACCESS_KEY_ID"),
+			os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		), "/", nil
+	default:
+		return nil, "", fmt.Errorf("invalid FileRoot %q: unsupported scheme %q", fileRoot, u.Scheme)
+	}
 }
 
 type OSFileStore struct{}
@@ -29,26 +106,114 @@ func (fs *OSFileStore) Stat(name string) (os.FileInfo, error) {
 	return os.Stat(name)
 }
 
-func (fs *OSFileStore) Open(name string) (*os.File, error) {
+func (fs *OSFileStore) Lstat(name string) (os.FileInfo, error) {
+	return os.Lstat(name)
+}
+
+func (fs *OSFileStore) Open(name string) (File, error) {
 	return os.Open(name)
 }
 
+func (fs *OSFileStore) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+func (fs *OSFileStore) Create(name string) (File, error) {
+	return os.Create(name)
+}
+
+func (fs *OSFileStore) ReadDir(name string) ([]os.FileInfo, error) {
+	entries, err := os.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+
+	return infos, nil
+}
+
+func (fs *OSFileStore) Readlink(name string) (string, error) {
+	return os.Readlink(name)
+}
+
 func (fs *OSFileStore) Symlink(oldname, newname string) error {
 	return os.Symlink(oldname, newname)
 }
 
+func (fs *OSFileStore) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
 func (fs *OSFileStore) Remove(name string) error {
 	return os.Remove(name)
 }
 
-func (fs *OSFileStore) Create(name string) (*os.File, error) {
-	return os.Create(name)
+func (fs *OSFileStore) RemoveAll(path string) error {
+	return os.RemoveAll(path)
 }
 
 func (fs *OSFileStore) WriteFile(name string, data []byte, perm fs.FileMode) error {
 	return os.WriteFile(name, data, perm)
 }
 
+// readFile reads the named file from fileStore
+func readFile(fileStore FileStore, name string) ([]byte, error) {
+	fh, err := fileStore.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = fh.Close() }()
+
+	return io.ReadAll(fh)
+}
+
+// walk walks the file tree rooted at root in the same way as filepath.Walk, but reads from fileStore.  Like
+// filepath.Walk, it does not follow symbolic links.
+func walk(fileStore FileStore, root string, fn filepath.WalkFunc) error {
+	info, err := fileStore.Lstat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = walkDir(fileStore, root, info, fn)
+	}
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+func walkDir(fileStore FileStore, path string, info os.FileInfo, fn filepath.WalkFunc) error {
+	if !info.IsDir() {
+		return fn(path, info, nil)
+	}
+
+	entries, err := fileStore.ReadDir(path)
+	err1 := fn(path, info, err)
+	if err != nil || err1 != nil {
+		return err1
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	for _, entry := range entries {
+		if err := walkDir(fileStore, filepath.Join(path, entry.Name()), entry, fn); err != nil {
+			if !entry.IsDir() || err != filepath.SkipDir {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
 type MockFileStore struct {
 	mock.Mock
 }
@@ -67,9 +232,49 @@ func (mfs *MockFileStore) Stat(name string) (os.FileInfo, error) {
 	return args.Get(0).(os.FileInfo), args.Error(1)
 }
 
-func (mfs *MockFileStore) Open(name string) (*os.File, error) {
+func (mfs *MockFileStore) Lstat(name string) (os.FileInfo, error) {
 	args := mfs.Called(name)
-	return args.Get(0).(*os.File), args.Error(1)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(os.FileInfo), args.Error(1)
+}
+
+func (mfs *MockFileStore) Open(name string) (File, error) {
+	args := mfs.Called(name)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(File), args.Error(1)
+}
+
+func (mfs *MockFileStore) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	args := mfs.Called(name, flag, perm)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(File), args.Error(1)
+}
+
+func (mfs *MockFileStore) Create(name string) (File, error) {
+	args := mfs.Called(name)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(File), args.Error(1)
+}
+
+func (mfs *MockFileStore) ReadDir(name string) ([]os.FileInfo, error) {
+	args := mfs.Called(name)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]os.FileInfo), args.Error(1)
+}
+
+func (mfs *MockFileStore) Readlink(name string) (string, error) {
+	args := mfs.Called(name)
+	return args.String(0), args.Error(1)
 }
 
 func (mfs *MockFileStore) Symlink(oldname, newname string) error {
@@ -77,14 +282,19 @@ func (mfs *MockFileStore) Symlink(oldname, newname string) error {
 	return args.Error(0)
 }
 
+func (mfs *MockFileStore) Rename(oldpath, newpath string) error {
+	args := mfs.Called(oldpath, newpath)
+	return args.Error(0)
+}
+
 func (mfs *MockFileStore) Remove(name string) error {
 	args := mfs.Called(name)
 	return args.Error(0)
 }
 
-func (mfs *MockFileStore) Create(name string) (*os.File, error) {
-	args := mfs.Called(name)
-	return args.Get(0).(*os.File), args.Error(1)
+func (mfs *MockFileStore) RemoveAll(path string) error {
+	args := mfs.Called(path)
+	return args.Error(0)
 }
 
 func (mfs *MockFileStore) WriteFile(name string, data []byte, perm fs.FileMode) error {
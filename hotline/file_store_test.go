@@ -0,0 +1,34 @@
+package hotline
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_walk(t *testing.T) {
+	root := "test/config/Files"
+
+	var want []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		want = append(want, path)
+		return err
+	})
+	assert.NoError(t, err)
+
+	var got []string
+	err = walk(&OSFileStore{}, root, func(path string, info os.FileInfo, err error) error {
+		got = append(got, path)
+		return err
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, want, got)
+
+	t.Run("returns the error for a missing root", func(t *testing.T) {
+		err := walk(&OSFileStore{}, "test/config/missing", func(path string, info os.FileInfo, err error) error {
+			return err
+		})
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+}
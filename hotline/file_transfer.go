@@ -2,8 +2,8 @@ package hotline
 
 import (
 	"encoding/binary"
-	"fmt"
 	"strings"
+	"time"
 )
 
 // File transfer types
@@ -19,19 +19,47 @@ type FileTransfer struct {
 	FilePath        []byte
 	ReferenceNumber []byte
 	Type            int
-	TransferSize    []byte // total size of all items in the folder. Only used in FolderUpload action
+	TransferSize    []byte // size of an upload as sent by the client; for folders, the total size of all items in the folder
 	FolderItemCount []byte
-	BytesSent       int
 	clientID        uint16
+	clientConn      *ClientConn // client that requested the transfer
 	fileResumeData  *FileResumeData
 	options         []byte
+	created         time.Time         // time the transfer was requested; used to reclaim transfers that are never started
+	active          bool              // true once a client has connected to the file transfer port for this transfer
+	progress        *transferProgress // bytes transferred once the transfer has started
+	cancel          func()            // disconnects the transfer once it has started
 }
 
+// String formats the status of the transfer.  It takes the lock of the server that the transfer belongs to, so it must
+// not be called with the lock held; use status instead.
 func (ft *FileTransfer) String() string {
-	percentComplete := 10
-	out := fmt.Sprintf("%s\t %v", ft.FileName, percentComplete)
+	var s *Server
+	if ft.clientConn != nil {
+		s = ft.clientConn.Server
+	}
+	if s == nil {
+		return ft.status(time.Now()).String()
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return ft.status(s.now()).String()
+}
+
+// account returns the account of the client that requested the transfer, or nil if it is not known
+func (ft *FileTransfer) account() *Account {
+	if ft.clientConn == nil {
+		return nil
+	}
 
-	return out
+	return ft.clientConn.Account
+}
+
+// largeFiles reports whether the client that requested the transfer supports 64-bit file sizes
+func (ft *FileTransfer) largeFiles() bool {
+	return ft.clientConn != nil && ft.clientConn.largeFiles
 }
 
 func (ft *FileTransfer) ItemCount() int {
@@ -45,6 +73,26 @@ type folderUpload struct {
 	FileNamePath  []byte
 }
 
+// checkPath returns errInvalidPath if the item path is malformed or contains names that are not valid
+func (fu *folderUpload) checkPath() error {
+	pathData := fu.FileNamePath
+	for i := uint16(0); i < binary.BigEndian.Uint16(fu.PathItemCount[:]); i++ {
+		if len(pathData) < 3 || len(pathData) < 3+int(pathData[2]) {
+			return errInvalidPath
+		}
+		name := pathData[3 : 3+pathData[2]]
+		if len(name) == 0 {
+			return errInvalidPath
+		}
+		if err := checkPathItem(name); err != nil {
+			return err
+		}
+		pathData = pathData[3+len(name):]
+	}
+
+	return nil
+}
+
 func (fu *folderUpload) FormattedPath() string {
 	pathItemLen := binary.BigEndian.Uint16(fu.PathItemCount[:])
 
@@ -1,16 +1,25 @@
 package hotline
 
-type fileType struct {
-	TypeCode    string // 4 byte type code used in file transfers
-	CreatorCode string // 4 byte creator code used in file transfers
+import (
+	"io"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// FileType is the pair of Macintosh type and creator codes that clients use to pick an icon and application for a file
+type FileType struct {
+	TypeCode    string `yaml:"TypeCode" validate:"len=4"`    // 4 byte type code used in file transfers
+	CreatorCode string `yaml:"CreatorCode" validate:"len=4"` // 4 byte creator code used in file transfers
 }
 
-var defaultFileType = fileType{
+var defaultFileType = FileType{
 	TypeCode:    "TEXT",
 	CreatorCode: "TTXT",
 }
 
-var fileTypes = map[string]fileType{
+// fileTypes maps lowercase file name extensions to file types
+var fileTypes = map[string]FileType{
 	"sit": {
 		TypeCode:    "SIT!",
 		CreatorCode: "SIT!",
@@ -61,6 +70,102 @@ var fileTypes = map[string]fileType{
 	},
 }
 
+// mimeFileTypes maps the MIME types detected by http.DetectContentType to file types.  It is used for files that have
+// no extension.
+var mimeFileTypes = map[string]FileType{
+	"text/plain":         {TypeCode: "TEXT", CreatorCode: "ttxt"},
+	"text/html":          {TypeCode: "TEXT", CreatorCode: "MOSS"},
+	"application/pdf":    {TypeCode: "PDF ", CreatorCode: "CARO"},
+	"application/zip":    {TypeCode: "ZIP ", CreatorCode: "SITx"},
+	"application/x-gzip": {TypeCode: "Gzip", CreatorCode: "SITx"},
+	"image/gif":          {TypeCode: "GIFf", CreatorCode: "ogle"},
+	"image/jpeg":         {TypeCode: "JPEG", CreatorCode: "ogle"},
+	"image/png":          {TypeCode: "PNGf", CreatorCode: "ogle"},
+	"image/bmp":          {TypeCode: "BMPf", CreatorCode: "ogle"},
+	"audio/mpeg":         {TypeCode: "MPG3", CreatorCode: "TVOD"},
+	"audio/wave":         {TypeCode: "WAVE", CreatorCode: "TVOD"},
+	"video/mp4":          {TypeCode: "mpg4", CreatorCode: "TVOD"},
+}
+
+// fileTypeMap infers the file type of files that have no type stored in their metadata, from the file name extension
+// or, for files without an extension, from the file content.
+type fileTypeMap struct {
+	extensions map[string]FileType
+	mimeTypes  map[string]FileType
+}
+
+// defaultFileTypes is used by servers that have no file type configuration
+var defaultFileTypes = newFileTypeMap(nil, nil)
+
+// newFileTypeMap returns a fileTypeMap with the built-in mappings extended, or overridden, by extensions and mimeTypes
+func newFileTypeMap(extensions, mimeTypes map[string]FileType) *fileTypeMap {
+	m := fileTypeMap{
+		extensions: make(map[string]FileType),
+		mimeTypes:  make(map[string]FileType),
+	}
+	for ext, ft := range fileTypes {
+		m.extensions[ext] = ft
+	}
+	for ext, ft := range extensions {
+		m.extensions[strings.ToLower(strings.TrimPrefix(ext, "."))] = ft
+	}
+	for mimeType, ft := range mimeFileTypes {
+		m.mimeTypes[mimeType] = ft
+	}
+	for mimeType, ft := range mimeTypes {
+		m.mimeTypes[strings.ToLower(mimeType)] = ft
+	}
+
+	return &m
+}
+
+// fromFilename returns the file type for the extension of fileName
+func (m *fileTypeMap) fromFilename(fileName string) FileType {
+	if m == nil {
+		m = defaultFileTypes
+	}
+	if ft, ok := m.extensions[downcaseFileExtension(fileName)]; ok {
+		return ft
+	}
+	return defaultFileType
+}
+
+// fromContent returns the file type for the MIME type detected from the first bytes of a file
+func (m *fileTypeMap) fromContent(head []byte) FileType {
+	if m == nil {
+		m = defaultFileTypes
+	}
+	mimeType, _, _ := strings.Cut(http.DetectContentType(head), ";")
+	if ft, ok := m.mimeTypes[mimeType]; ok {
+		return ft
+	}
+	return defaultFileType
+}
+
+// detectsFromContent reports whether detect identifies the file at filePath by its content, which it does for files
+// without an extension
+func detectsFromContent(filePath string) bool {
+	return !strings.Contains(path.Base(filePath), ".")
+}
+
+// detect returns the file type of the file at filePath.  Files without an extension are identified by their content.
+func (m *fileTypeMap) detect(fileStore FileStore, filePath string) FileType {
+	if !detectsFromContent(filePath) {
+		return m.fromFilename(path.Base(filePath))
+	}
+
+	file, err := fileStore.Open(filePath)
+	if err != nil {
+		return m.fromFilename(path.Base(filePath))
+	}
+	defer func() { _ = file.Close() }()
+
+	head := make([]byte, 512) // http.DetectContentType considers at most 512 bytes
+	n, _ := io.ReadFull(file, head)
+
+	return m.fromContent(head[:n])
+}
+
 // A small number of type codes are displayed in the GetInfo window with a friendly name instead of the 4 letter code
 var friendlyCreatorNames = map[string]string{
 	"fldr": "Folder",
@@ -0,0 +1,145 @@
+package hotline
+
+import (
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+)
+
+func TestFileTypeMap(t *testing.T) {
+	mfs := NewMemFileStore()
+	_ = mfs.MkdirAll("/Files", 0777)
+	_ = mfs.WriteFile("/Files/photo", []byte("\x89PNG\x0D\x0A\x1A\x0A"), 0644)
+	_ = mfs.WriteFile("/Files/README", []byte("Read me first"), 0644)
+	_ = mfs.WriteFile("/Files/disk.DSK", nil, 0644)
+	_ = mfs.WriteFile("/Files/archive.sit", nil, 0644)
+	_ = mfs.WriteFile("/Files/upload.incomplete", nil, 0644)
+
+	fileTypes := newFileTypeMap(
+		map[string]FileType{
+			".dsk": {TypeCode: "dImg", CreatorCode: "dCpy"},
+			"sit":  {TypeCode: "SITD", CreatorCode: "SIT!"},
+		},
+		map[string]FileType{
+			"image/png": {TypeCode: "PNG ", CreatorCode: "GKON"},
+		},
+	)
+
+	tests := []struct {
+		name      string
+		fileTypes *fileTypeMap
+		filePath  string
+		want      FileType
+	}{
+		{"built-in extension", nil, "/Files/archive.sit", FileType{"SIT!", "SIT!"}},
+		{"configured extension", fileTypes, "/Files/disk.DSK", FileType{"dImg", "dCpy"}},
+		{"overridden extension", fileTypes, "/Files/archive.sit", FileType{"SITD", "SIT!"}},
+		{"unknown extension", nil, "/Files/disk.DSK", defaultFileType},
+		{"incomplete upload", fileTypes, "/Files/upload.incomplete", FileType{"HTft", "HTLC"}},
+		{"detected MIME type", nil, "/Files/photo", FileType{"PNGf", "ogle"}},
+		{"configured MIME type", fileTypes, "/Files/photo", FileType{"PNG ", "GKON"}},
+		{"plain text", nil, "/Files/README", FileType{"TEXT", "ttxt"}},
+		{"missing file", nil, "/Files/missing", defaultFileType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.fileTypes.detect(mfs, tt.filePath))
+		})
+	}
+}
+
+func Test_getFileNameList_storedFileTypes(t *testing.T) {
+	mfs := NewMemFileStore()
+	_ = mfs.MkdirAll("/Files", 0777)
+	_ = mfs.WriteFile("/Files/App", []byte("data"), 0644)
+	_ = mfs.WriteFile("/Files/notes.txt", []byte("notes"), 0644)
+
+	ad := &appleDouble{}
+	copy(ad.FinderInfo[:], "APPLMACS")
+	sidecar, _ := ad.MarshalBinary()
+	_ = mfs.WriteFile("/Files/._App", sidecar, 0644)
+
+	fields, err := getFileNameList(mfs, nil, "/Files", "/Files", nil)
+	assert.NoError(t, err)
+	assert.Len(t, fields, 2, "sidecars are not listed")
+
+	var app, notes FileNameWithInfo
+	_ = app.UnmarshalBinary(fields[0].Data)
+	_ = notes.UnmarshalBinary(fields[1].Data)
+
+	assert.Equal(t, "App", string(app.name))
+	assert.Equal(t, [4]byte{'A', 'P', 'P', 'L'}, app.Type)
+	assert.Equal(t, [4]byte{'M', 'A', 'C', 'S'}, app.Creator)
+	assert.Equal(t, [4]byte{'T', 'E', 'X', 'T'}, notes.Type)
+}
+
+// openCountingFileStore is a MemFileStore that counts the times each file is opened
+type openCountingFileStore struct {
+	*MemFileStore
+	opens map[string]int
+}
+
+func (fs *openCountingFileStore) Open(name string) (File, error) {
+	fs.opens[name]++
+	return fs.MemFileStore.Open(name)
+}
+
+func Test_getFileNameList_doesNotWriteSidecars(t *testing.T) {
+	mfs := NewMemFileStore()
+	_ = mfs.MkdirAll("/Files", 0777)
+	_ = mfs.WriteFile("/Files/photo", []byte("\x89PNG\x0D\x0A\x1A\x0A"), 0644)
+
+	fields, err := getFileNameList(mfs, nil, "/Files", "/Files", nil)
+	assert.NoError(t, err)
+	if !assert.Len(t, fields, 1) {
+		return
+	}
+
+	var photo FileNameWithInfo
+	_ = photo.UnmarshalBinary(fields[0].Data)
+	assert.Equal(t, [4]byte{'P', 'N', 'G', 'f'}, photo.Type)
+
+	_, err = mfs.Stat(appleDoublePath("/Files/photo"))
+	assert.Error(t, err, "listings don't write sidecars")
+}
+
+func TestServer_handleFileTransfer_storesDetectedFileTypes(t *testing.T) {
+	mfs := &openCountingFileStore{MemFileStore: NewMemFileStore(), opens: map[string]int{}}
+	_ = mfs.MkdirAll("/Files", 0777)
+
+	s := newTransferTestServer(mfs, &FileTransfer{
+		Type:     FileUpload,
+		FileName: []byte("photo"),
+	})
+
+	// The client sends no type and creator codes
+	ffo := flattenedFileObject{
+		FlatFileHeader:          NewFlatFileHeader(),
+		FlatFileInformationFork: NewFlatFileInformationFork("photo", make([]byte, 8), "\x00\x00\x00\x00", "\x00\x00\x00\x00"),
+	}
+	ffo.FlatFileDataForkHeader.ForkType = [4]byte{0x44, 0x41, 0x54, 0x41} // DATA
+	data := []byte("\x89PNG\x0D\x0A\x1A\x0A")
+	binary.BigEndian.PutUint32(ffo.FlatFileDataForkHeader.DataSize[:], uint32(len(data)))
+
+	client, server := net.Pipe()
+	errs := make(chan error, 1)
+	go func() { errs <- s.handleFileTransfer(server) }()
+	_, _ = client.Write(append(append(htxf(), ffo.BinaryMarshal()...), data...))
+	assert.NoError(t, <-errs)
+
+	ad, err := readAppleDouble(mfs, "/Files/photo")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("PNGf"), ad.TypeCode())
+
+	opens := mfs.opens["/Files/photo"]
+	fields, err := getFileNameList(mfs, nil, "/Files", "/Files", nil)
+	assert.NoError(t, err)
+	if !assert.Len(t, fields, 1) {
+		return
+	}
+	var photo FileNameWithInfo
+	_ = photo.UnmarshalBinary(fields[0].Data)
+	assert.Equal(t, [4]byte{'P', 'N', 'G', 'f'}, photo.Type)
+	assert.Equal(t, opens, mfs.opens["/Files/photo"], "listings use the stored type rather than reading the file")
+}
@@ -4,9 +4,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"io/fs"
-	"io/ioutil"
 	"os"
-	"path/filepath"
 	"strings"
 )
 
@@ -21,43 +19,55 @@ func downcaseFileExtension(filename string) string {
 	return ext
 }
 
-func fileTypeFromFilename(fn string) fileType {
-	ft, ok := fileTypes[downcaseFileExtension(fn)]
-	if ok {
-		return ft
-	}
-	return defaultFileType
-}
-
-func fileTypeFromInfo(info os.FileInfo) (ft fileType, err error) {
-	if info.IsDir() {
-		ft.CreatorCode = "n/a "
-		ft.TypeCode = "fldr"
-	} else {
-		ft = fileTypeFromFilename(info.Name())
+// fileTypeOf returns the file type stored in the AppleDouble sidecar of the file at filePath, or the type inferred by
+// fileTypes if none is stored.  Callers that know the file has no sidecar pass false for hasSidecar to skip the lookup.
+// Listings never write sidecars; uploads store the detected type of files the client sent without one (see saveForks).
+func fileTypeOf(fileStore FileStore, fileTypes *fileTypeMap, filePath string, hasSidecar bool) FileType {
+	if hasSidecar {
+		if ad, err := readAppleDouble(fileStore, filePath); err == nil && ad.TypeCode()[0] != 0 {
+			return FileType{TypeCode: string(ad.TypeCode()), CreatorCode: string(ad.CreatorCode())}
+		}
 	}
 
-	return ft, nil
+	return fileTypes.detect(fileStore, filePath)
 }
 
-func getFileNameList(filePath string) (fields []Field, err error) {
-	files, err := ioutil.ReadDir(filePath)
+// getFileNameList returns the fieldFileNameWithInfo fields for the contents of the folder at filePath.  Folders for which
+// canList returns false and aliases that lead outside of fileRoot are left out; a nil canList lists every folder.
+func getFileNameList(fileStore FileStore, fileTypes *fileTypeMap, fileRoot, filePath string, canList func(folderPath string) bool) (fields []Field, err error) {
+	files, err := fileStore.ReadDir(filePath)
 	if err != nil {
 		return fields, nil
 	}
 
+	// Only files that have a sidecar can have a stored file type
+	sidecars := make(map[string]bool)
+	for _, file := range files {
+		if isAppleDouble(file.Name()) {
+			sidecars[strings.TrimPrefix(file.Name(), appleDoublePrefix)] = true
+		}
+	}
+
 	for _, file := range files {
+		if isHiddenFile(file.Name()) {
+			continue
+		}
+
 		var fnwi FileNameWithInfo
 
 		fileCreator := make([]byte, 4)
 
 		if file.Mode()&os.ModeSymlink != 0 {
-			resolvedPath, err := os.Readlink(filePath + "/" + file.Name())
+			// Aliases leading outside of the file root are not listed
+			err := confinePath(fileStore, fileRoot, filePath+"/"+file.Name())
+			if errors.Is(err, errPathEscapesRoot) {
+				continue
+			}
 			if err != nil {
 				return fields, err
 			}
 
-			rFile, err := os.Stat(filePath + "/" + resolvedPath)
+			rFile, err := fileStore.Stat(filePath + "/" + file.Name())
 			if errors.Is(err, os.ErrNotExist) {
 				continue
 			}
@@ -66,35 +76,41 @@ func getFileNameList(filePath string) (fields []Field, err error) {
 			}
 
 			if rFile.IsDir() {
-				dir, err := ioutil.ReadDir(filePath + "/" + file.Name())
+				if canList != nil && !canList(filePath+"/"+file.Name()) {
+					continue
+				}
+				dir, err := fileStore.ReadDir(filePath + "/" + file.Name())
 				if err != nil {
 					return fields, err
 				}
-				binary.BigEndian.PutUint32(fnwi.FileSize[:], uint32(len(dir)))
+				binary.BigEndian.PutUint32(fnwi.FileSize[:], uint32(visibleItemCount(dir)))
 				copy(fnwi.Type[:], []byte("fldr")[:])
 				copy(fnwi.Creator[:], fileCreator[:])
 			} else {
-				binary.BigEndian.PutUint32(fnwi.FileSize[:], uint32(rFile.Size()))
-				copy(fnwi.Type[:], []byte(fileTypeFromFilename(rFile.Name()).TypeCode)[:])
-				copy(fnwi.Creator[:], []byte(fileTypeFromFilename(rFile.Name()).CreatorCode)[:])
+				ft := fileTypeOf(fileStore, fileTypes, filePath+"/"+file.Name(), sidecars[file.Name()])
+				copy(fnwi.FileSize[:], size32(uint64(rFile.Size())))
+				copy(fnwi.Type[:], []byte(ft.TypeCode)[:])
+				copy(fnwi.Creator[:], []byte(ft.CreatorCode)[:])
 			}
 
 		} else if file.IsDir() {
-			dir, err := ioutil.ReadDir(filePath + "/" + file.Name())
+			if canList != nil && !canList(filePath+"/"+file.Name()) {
+				continue
+			}
+			dir, err := fileStore.ReadDir(filePath + "/" + file.Name())
 			if err != nil {
 				return fields, err
 			}
-			binary.BigEndian.PutUint32(fnwi.FileSize[:], uint32(len(dir)))
+			binary.BigEndian.PutUint32(fnwi.FileSize[:], uint32(visibleItemCount(dir)))
 			copy(fnwi.Type[:], []byte("fldr")[:])
 			copy(fnwi.Creator[:], fileCreator[:])
 		} else {
-			// the Hotline protocol does not support file sizes > 4GiB due to the 4 byte field size, so skip them
-			if file.Size() > 4294967296 {
-				continue
-			}
-			binary.BigEndian.PutUint32(fnwi.FileSize[:], uint32(file.Size()))
-			copy(fnwi.Type[:], []byte(fileTypeFromFilename(file.Name()).TypeCode)[:])
-			copy(fnwi.Creator[:], []byte(fileTypeFromFilename(file.Name()).CreatorCode)[:])
+			// Sizes of files over 4 GiB are clamped to the largest size the 32-bit field can hold.  The exact size is
+			// available to clients that support large files through Get Info.
+			ft := fileTypeOf(fileStore, fileTypes, filePath+"/"+file.Name(), sidecars[file.Name()])
+			copy(fnwi.FileSize[:], size32(uint64(file.Size())))
+			copy(fnwi.Type[:], []byte(ft.TypeCode)[:])
+			copy(fnwi.Creator[:], []byte(ft.CreatorCode)[:])
 		}
 
 		strippedName := strings.Replace(file.Name(), ".incomplete", "", -1)
@@ -115,9 +131,22 @@ func getFileNameList(filePath string) (fields []Field, err error) {
 	return fields, nil
 }
 
-func CalcTotalSize(filePath string) ([]byte, error) {
-	var totalSize uint32
-	err := filepath.Walk(filePath, func(path string, info os.FileInfo, err error) error {
+// visibleItemCount returns the number of entries that are shown to clients, which excludes AppleDouble sidecars
+func visibleItemCount(entries []os.FileInfo) int {
+	var count int
+	for _, entry := range entries {
+		if !isHiddenFile(entry.Name()) {
+			count++
+		}
+	}
+	return count
+}
+
+// folderSize returns the total size of the files in filePath and the size of the largest file.  Resource forks stored
+// in AppleDouble sidecars are included with the size of the fork header they are sent after.  Folders inside of
+// filePath for which include returns false are left out.
+func folderSize(fileStore FileStore, filePath string, include func(folderPath string) bool) (total, largest uint64, err error) {
+	err = walkFolder(fileStore, filePath, include, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -126,29 +155,52 @@ func CalcTotalSize(filePath string) ([]byte, error) {
 			return nil
 		}
 
-		totalSize += uint32(info.Size())
+		if isAppleDouble(info.Name()) {
+			rsrcLen, err := resourceForkLen(fileStore, path)
+			if err != nil && !errors.Is(err, errInvalidAppleDouble) {
+				return err
+			}
+			if rsrcLen > 0 {
+				total += forkHeaderLen + rsrcLen
+			}
+			return nil
+		}
+
+		total += uint64(info.Size())
+		if uint64(info.Size()) > largest {
+			largest = uint64(info.Size())
+		}
 
 		return nil
 	})
+
+	return total, largest, err
+}
+
+// CalcTotalSize returns the total size of the files in filePath as a 32-bit size field
+func CalcTotalSize(fileStore FileStore, filePath string) ([]byte, error) {
+	total, _, err := folderSize(fileStore, filePath, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	bs := make([]byte, 4)
-	binary.BigEndian.PutUint32(bs, totalSize)
-
-	return bs, nil
+	return size32(total), nil
 }
 
-func CalcItemCount(filePath string) ([]byte, error) {
+// folderItemCount returns the number of files and folders sent in a download of the folder at filePath.  Folders
+// inside of filePath for which include returns false are left out.
+func folderItemCount(fileStore FileStore, filePath string, include func(folderPath string) bool) ([]byte, error) {
 	var itemcount uint16
-	err := filepath.Walk(filePath, func(path string, info os.FileInfo, err error) error {
-		itemcount += 1
-
+	err := walkFolder(fileStore, filePath, include, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
 
+		// Resource forks are transferred with their files rather than as separate items
+		if !isAppleDouble(info.Name()) {
+			itemcount += 1
+		}
+
 		return nil
 	})
 	if err != nil {
@@ -161,6 +213,10 @@ func CalcItemCount(filePath string) ([]byte, error) {
 	return bs, nil
 }
 
+func CalcItemCount(fileStore FileStore, filePath string) ([]byte, error) {
+	return folderItemCount(fileStore, filePath, nil)
+}
+
 func EncodeFilePath(filePath string) []byte {
 	pathSections := strings.Split(filePath, "/")
 	pathItemCount := make([]byte, 2)
@@ -179,15 +235,15 @@ func EncodeFilePath(filePath string) []byte {
 	return bytes
 }
 
-// effectiveFile wraps os.Open to check for the presence of a partial file transfer as a fallback
-func effectiveFile(filePath string) (*os.File, error) {
-	file, err := os.Open(filePath)
+// effectiveFile wraps FileStore.Open to check for the presence of a partial file transfer as a fallback
+func effectiveFile(fileStore FileStore, filePath string) (File, error) {
+	file, err := fileStore.Open(filePath)
 	if err != nil && !errors.Is(err, fs.ErrNotExist) {
 		return nil, err
 	}
 
 	if errors.Is(err, fs.ErrNotExist) {
-		file, err = os.OpenFile(filePath+incompleteFileSuffix, os.O_APPEND|os.O_WRONLY, 0644)
+		file, err = fileStore.OpenFile(filePath+incompleteFileSuffix, os.O_APPEND|os.O_WRONLY, 0644)
 		if err != nil {
 			return nil, err
 		}
@@ -2,7 +2,6 @@ package hotline
 
 import (
 	"bytes"
-	"os"
 	"reflect"
 	"testing"
 )
@@ -44,10 +43,16 @@ func TestEncodeFilePath(t *testing.T) {
 }
 
 func TestCalcTotalSize(t *testing.T) {
-	cwd, _ := os.Getwd()
-	defer func() { _ = os.Chdir(cwd) }()
+	t.Parallel()
 
-	_ = os.Chdir("test/config/Files")
+	mfs := NewMemFileStore()
+	_ = mfs.MkdirAll("test/sub", 0777)
+	_ = mfs.WriteFile("test/testfile-1k", make([]byte, 1024), 0644)
+	_ = mfs.WriteFile("test/sub/testfile-5k", make([]byte, 5120), 0644)
+
+	_ = mfs.MkdirAll("rsrc", 0777)
+	_ = mfs.WriteFile("rsrc/app", make([]byte, 1024), 0644)
+	_ = writeAppleDouble(mfs, "rsrc/app", &appleDouble{ResourceFork: make([]byte, 100), Comment: []byte("comment")})
 
 	type args struct {
 		filePath string
@@ -66,11 +71,20 @@ func TestCalcTotalSize(t *testing.T) {
 			want:    []byte{0x00, 0x00, 0x18, 0x00},
 			wantErr: false,
 		},
+		{
+			name: "counts resource forks rather than their sidecars",
+			args: args{
+				filePath: "rsrc",
+			},
+			// 1024 byte data fork, plus the 16 byte fork header and 100 byte resource fork
+			want:    []byte{0x00, 0x00, 0x04, 0x74},
+			wantErr: false,
+		},
 		// TODO: Add more test cases.
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := CalcTotalSize(tt.args.filePath)
+			got, err := CalcTotalSize(mfs, tt.args.filePath)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("CalcTotalSize() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -2,7 +2,10 @@ package hotline
 
 import (
 	"encoding/binary"
-	"os"
+	"errors"
+	"io/fs"
+	"math"
+	"path"
 )
 
 type flattenedFileObject struct {
@@ -10,6 +13,7 @@ type flattenedFileObject struct {
 	FlatFileInformationForkHeader FlatFileInformationForkHeader
 	FlatFileInformationFork       FlatFileInformationFork
 	FlatFileDataForkHeader        FlatFileDataForkHeader
+	FlatFileResForkHeader         FlatFileDataForkHeader // Only sent when the header fork count is 3
 	FileData                      []byte
 }
 
@@ -57,18 +61,18 @@ type FlatFileInformationFork struct {
 
 func NewFlatFileInformationFork(fileName string, modifyTime []byte, typeSignature string, creatorSignature string) FlatFileInformationFork {
 	return FlatFileInformationFork{
-		Platform:         []byte("AMAC"),           // TODO: Remove hardcode to support "AWIN" Platform (maybe?)
-		TypeSignature:    []byte(typeSignature),    // TODO: Don't infer types from filename
-		CreatorSignature: []byte(creatorSignature), // TODO: Don't infer types from filename
-		Flags:            []byte{0, 0, 0, 0},       // TODO: What is this?
-		PlatformFlags:    []byte{0, 0, 1, 0},       // TODO: What is this?
-		RSVD:             make([]byte, 32),         // Unimplemented in Hotline Protocol
-		CreateDate:       modifyTime,               // some filesystems don't support createTime
+		Platform:         []byte("AMAC"), // TODO: Remove hardcode to support "AWIN" Platform (maybe?)
+		TypeSignature:    []byte(typeSignature),
+		CreatorSignature: []byte(creatorSignature),
+		Flags:            []byte{0, 0, 0, 0}, // TODO: What is this?
+		PlatformFlags:    []byte{0, 0, 1, 0}, // TODO: What is this?
+		RSVD:             make([]byte, 32),   // Unimplemented in Hotline Protocol
+		CreateDate:       modifyTime,         // some filesystems don't support createTime
 		ModifyDate:       modifyTime,
 		NameScript:       make([]byte, 2), // TODO: What is this?
 		Name:             []byte(fileName),
 		CommentSize:      []byte{0, 0},
-		Comment:          []byte{}, // TODO: implement (maybe?)
+		Comment:          []byte{}, // Set from the AppleDouble sidecar by NewFlattenedFileObject
 	}
 }
 
@@ -93,14 +97,73 @@ func (ffif *FlatFileInformationFork) DataSize() []byte {
 	return size
 }
 
+// hasResourceFork reports whether the flattened file object includes a resource fork after the data fork
+func (ffo *flattenedFileObject) hasResourceFork() bool {
+	return ffo.FlatFileHeader.ForkCount == [2]byte{0, 3}
+}
+
+// resumeResourceFork reduces the size of the resource fork to the bytes from offset, for a download that resumes the
+// resource fork from offset
+func (ffo *flattenedFileObject) resumeResourceFork(offset int64) {
+	size := int64(ffo.FlatFileResForkHeader.forkSize())
+	if offset > size {
+		offset = size
+	}
+	if offset > 0 {
+		ffo.FlatFileResForkHeader.setForkSize(uint64(size - offset))
+	}
+}
+
+// forkHeaderLen is the length of the header sent before each fork of a flattened file object
+const forkHeaderLen = 16
+
+// resForkHeader returns the resource fork header, which is sent after the data fork
+func (ffo *flattenedFileObject) resForkHeader() []byte {
+	var out []byte
+	out = append(out, ffo.FlatFileResForkHeader.ForkType[:]...)
+	out = append(out, ffo.FlatFileResForkHeader.CompressionType[:]...)
+	out = append(out, ffo.FlatFileResForkHeader.RSVD[:]...)
+	out = append(out, ffo.FlatFileResForkHeader.DataSize[:]...)
+
+	return out
+}
+
+// transferSize64 returns the number of bytes sent to transfer the flattened file object and its forks
+func (ffo *flattenedFileObject) transferSize64() uint64 {
+	size := uint64(len(ffo.BinaryMarshal())) + ffo.FlatFileDataForkHeader.forkSize()
+	if ffo.hasResourceFork() {
+		size += uint64(len(ffo.resForkHeader())) + ffo.FlatFileResForkHeader.forkSize()
+	}
+
+	return size
+}
+
+// TransferSize returns the transfer size as a 32-bit size field
 func (ffo *flattenedFileObject) TransferSize() []byte {
-	payloadSize := len(ffo.BinaryMarshal())
-	dataSize := binary.BigEndian.Uint32(ffo.FlatFileDataForkHeader.DataSize[:])
+	return size32(ffo.transferSize64())
+}
 
-	transferSize := make([]byte, 4)
-	binary.BigEndian.PutUint32(transferSize, dataSize+uint32(payloadSize))
+// maxFileSize32 is the largest size that fits in the 32-bit size fields of the original protocol
+const maxFileSize32 = math.MaxUint32
 
-	return transferSize
+// size32 encodes size as a 32-bit size field, clamped to the largest size the field can hold
+func size32(size uint64) []byte {
+	if size > maxFileSize32 {
+		size = maxFileSize32
+	}
+
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(size))
+
+	return b
+}
+
+// size64 encodes size as a 64-bit size field of the large file extension
+func size64(size uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, size)
+
+	return b
 }
 
 func (ffif *FlatFileInformationFork) ReadNameSize() []byte {
@@ -113,10 +176,21 @@ func (ffif *FlatFileInformationFork) ReadNameSize() []byte {
 type FlatFileDataForkHeader struct {
 	ForkType        [4]byte
 	CompressionType [4]byte
-	RSVD            [4]byte
+	RSVD            [4]byte // High 32 bits of the fork size for clients that support large files; otherwise zero
 	DataSize        [4]byte
 }
 
+// forkSize returns the 64-bit size of the fork
+func (ffdfh *FlatFileDataForkHeader) forkSize() uint64 {
+	return uint64(binary.BigEndian.Uint32(ffdfh.RSVD[:]))<<32 | uint64(binary.BigEndian.Uint32(ffdfh.DataSize[:]))
+}
+
+// setForkSize sets the fork size, using the reserved field for the high 32 bits of sizes over 4 GiB
+func (ffdfh *FlatFileDataForkHeader) setForkSize(size uint64) {
+	binary.BigEndian.PutUint32(ffdfh.RSVD[:], uint32(size>>32))
+	binary.BigEndian.PutUint32(ffdfh.DataSize[:], uint32(size))
+}
+
 func (ffif *FlatFileInformationFork) UnmarshalBinary(b []byte) error {
 	nameSize := b[70:72]
 	bs := binary.BigEndian.Uint16(nameSize)
@@ -181,38 +255,69 @@ func (f *flattenedFileObject) BinaryMarshal() []byte {
 	return out
 }
 
-func NewFlattenedFileObject(fileRoot string, filePath, fileName []byte, dataOffset int64) (*flattenedFileObject, error) {
+func NewFlattenedFileObject(fileStore FileStore, fileTypes *fileTypeMap, fileRoot string, filePath, fileName []byte, dataOffset int64) (*flattenedFileObject, error) {
 	fullFilePath, err := readPath(fileRoot, filePath, fileName)
 	if err != nil {
 		return nil, err
 	}
-	file, err := effectiveFile(fullFilePath)
+	file, err := effectiveFile(fileStore, fullFilePath)
 	if err != nil {
 		return nil, err
 	}
 
-	defer func(file *os.File) { _ = file.Close() }(file)
+	defer func(file File) { _ = file.Close() }(file)
 
 	fileInfo, err := file.Stat()
 	if err != nil {
 		return nil, err
 	}
 
-	dataSize := make([]byte, 4)
-	binary.BigEndian.PutUint32(dataSize, uint32(fileInfo.Size()-dataOffset))
-
 	mTime := toHotlineTime(fileInfo.ModTime())
 
-	ft, _ := fileTypeFromInfo(fileInfo)
+	// Use the file type, Finder flags, comment and resource fork from the AppleDouble sidecar, if the file has one.  A
+	// sidecar that can't be parsed is ignored rather than making the file impossible to download.
+	ad, err := readAppleDouble(fileStore, fullFilePath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, errInvalidAppleDouble) {
+		return nil, err
+	}
 
-	return &flattenedFileObject{
+	var ft FileType
+	switch {
+	case ad != nil && ad.TypeCode()[0] != 0:
+		ft = FileType{TypeCode: string(ad.TypeCode()), CreatorCode: string(ad.CreatorCode())}
+	case fileInfo.IsDir():
+		ft = FileType{TypeCode: "fldr", CreatorCode: "n/a "}
+	default:
+		// fileInfo is that of the incomplete file when a partial upload is being downloaded
+		ft = fileTypes.detect(fileStore, path.Join(path.Dir(fullFilePath), fileInfo.Name()))
+	}
+
+	ffo := &flattenedFileObject{
 		FlatFileHeader:          NewFlatFileHeader(),
 		FlatFileInformationFork: NewFlatFileInformationFork(string(fileName), mTime, ft.TypeCode, ft.CreatorCode),
 		FlatFileDataForkHeader: FlatFileDataForkHeader{
-			ForkType:        [4]byte{0x44, 0x41, 0x54, 0x41}, // "DATA"
-			CompressionType: [4]byte{},
-			RSVD:            [4]byte{},
-			DataSize:        [4]byte{dataSize[0], dataSize[1], dataSize[2], dataSize[3]},
+			ForkType: [4]byte{0x44, 0x41, 0x54, 0x41}, // "DATA"
 		},
-	}, nil
+	}
+	ffo.FlatFileDataForkHeader.setForkSize(uint64(fileInfo.Size() - dataOffset))
+
+	if ad != nil {
+		if ad.TypeCode()[0] != 0 {
+			ffo.FlatFileInformationFork.PlatformFlags = append([]byte{0, 0}, ad.FinderFlags()...)
+		}
+
+		if len(ad.Comment) > 0 {
+			ffo.FlatFileInformationFork.Comment = ad.Comment
+			ffo.FlatFileInformationFork.CommentSize = make([]byte, 2)
+			binary.BigEndian.PutUint16(ffo.FlatFileInformationFork.CommentSize, uint16(len(ad.Comment)))
+		}
+
+		if len(ad.ResourceFork) > 0 {
+			ffo.FlatFileHeader.ForkCount = [2]byte{0, 3}
+			ffo.FlatFileResForkHeader.ForkType = [4]byte{0x4d, 0x41, 0x43, 0x52} // "MACR"
+			ffo.FlatFileResForkHeader.setForkSize(uint64(len(ad.ResourceFork)))
+		}
+	}
+
+	return ffo, nil
 }
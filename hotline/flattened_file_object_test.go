@@ -1,6 +1,7 @@
 package hotline
 
 import (
+	"encoding/binary"
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"os"
@@ -52,7 +53,7 @@ func TestNewFlattenedFileObject(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := NewFlattenedFileObject(tt.args.fileRoot, tt.args.filePath, tt.args.fileName, 0)
+			got, err := NewFlattenedFileObject(&OSFileStore{}, nil, tt.args.fileRoot, tt.args.filePath, tt.args.fileName, 0)
 			if tt.wantErr(t, err, fmt.Sprintf("NewFlattenedFileObject(%v, %v, %v)", tt.args.fileRoot, tt.args.filePath, tt.args.fileName)) {
 				return
 			}
@@ -101,3 +102,28 @@ func TestFlatFileInformationFork_UnmarshalBinary(t *testing.T) {
 		})
 	}
 }
+
+func TestNewFlattenedFileObject_appleDouble(t *testing.T) {
+	mfs := NewMemFileStore()
+	_ = mfs.MkdirAll("/Files", 0777)
+	_ = mfs.WriteFile("/Files/App", []byte("data"), 0644)
+
+	ad := &appleDouble{ResourceFork: []byte("resource"), Comment: []byte("An application")}
+	copy(ad.FinderInfo[:], "APPLAPPL\x01\x00")
+	b, _ := ad.MarshalBinary()
+	_ = mfs.WriteFile("/Files/._App", b, 0644)
+
+	ffo, err := NewFlattenedFileObject(mfs, nil, "/Files", nil, []byte("App"), 0)
+	assert.NoError(t, err)
+
+	assert.Equal(t, [2]byte{0, 3}, ffo.FlatFileHeader.ForkCount)
+	assert.Equal(t, []byte("APPL"), ffo.FlatFileInformationFork.TypeSignature)
+	assert.Equal(t, []byte("APPL"), ffo.FlatFileInformationFork.CreatorSignature)
+	assert.Equal(t, []byte{0, 0, 1, 0}, ffo.FlatFileInformationFork.PlatformFlags)
+	assert.Equal(t, []byte("An application"), ffo.FlatFileInformationFork.Comment)
+	assert.Equal(t, []byte{0, 14}, ffo.FlatFileInformationFork.CommentSize)
+	assert.Equal(t, []byte("MACR\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x08"), ffo.resForkHeader())
+
+	// header + data fork + resource fork header + resource fork
+	assert.Equal(t, uint32(len(ffo.BinaryMarshal())+4+16+8), binary.BigEndian.Uint32(ffo.TransferSize()))
+}
@@ -0,0 +1,248 @@
+package hotline
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Folder access control lists grant or deny rights in a folder to specific accounts or groups, on top of the
+// privileges in the account Access bitmap.  The ACL of a folder is stored in a folderACLFile inside of it and applies to
+// the folder, its contents and its subfolders, unless a subfolder has an ACL of its own that decides the right.
+//
+// Example .access.yaml for a members-only folder:
+//
+//	Entries:
+//	  - Accounts: ["*"]
+//	    Deny: [list, download, upload, delete, rename]
+//	  - Groups: [members]
+//	    Allow: [list, download, upload]
+const folderACLFile = ".access.yaml"
+
+// folderRight is a right that can be granted or denied by a folder ACL
+type folderRight string
+
+const (
+	folderRightList     folderRight = "list"     // See the folder and list its contents
+	folderRightDownload folderRight = "download" // Download files and folders
+	folderRightUpload   folderRight = "upload"   // Upload files and folders, and create folders and aliases
+	folderRightDelete   folderRight = "delete"   // Delete files and folders
+	folderRightRename   folderRight = "rename"   // Rename and move files and folders, and set their comments
+)
+
+var folderRights = map[folderRight]bool{
+	folderRightList:     true,
+	folderRightDownload: true,
+	folderRightUpload:   true,
+	folderRightDelete:   true,
+	folderRightRename:   true,
+}
+
+const folderACLWildcard = "*" // Matches every account in FolderACLEntry.Accounts
+
+var (
+	errInvalidFolderACL   = errors.New("invalid folder ACL")
+	errFolderAccessDenied = errors.New("denied by folder ACL")
+)
+
+// FolderACL is the content of a folder ACL file
+type FolderACL struct {
+	Entries []FolderACLEntry `yaml:"Entries"`
+}
+
+// FolderACLEntry grants and denies rights to the accounts with one of Accounts as their login or one of Groups in their
+// Groups.  When several entries match an account, entries that name the account win over entries that match one of its
+// groups, which win over wildcard entries.  If entries of the same kind disagree, Deny wins.
+type FolderACLEntry struct {
+	Accounts []string      `yaml:"Accounts,omitempty"`
+	Groups   []string      `yaml:"Groups,omitempty"`
+	Allow    []folderRight `yaml:"Allow,omitempty"`
+	Deny     []folderRight `yaml:"Deny,omitempty"`
+}
+
+func (acl *FolderACL) UnmarshalBinary(b []byte) error {
+	if err := yaml.Unmarshal(b, acl); err != nil {
+		return fmt.Errorf("%w: %v", errInvalidFolderACL, err)
+	}
+
+	for _, e := range acl.Entries {
+		for _, r := range append(e.Allow, e.Deny...) {
+			if !folderRights[r] {
+				return fmt.Errorf("%w: unknown right %q", errInvalidFolderACL, r)
+			}
+		}
+	}
+
+	return nil
+}
+
+// match returns how specifically the entry matches account: 3 by login, 2 by group, 1 by wildcard and 0 if not at all
+func (e *FolderACLEntry) match(account *Account) int {
+	for _, login := range e.Accounts {
+		if login == account.Login {
+			return 3
+		}
+	}
+	for _, group := range e.Groups {
+		for _, g := range account.Groups {
+			if group == g {
+				return 2
+			}
+		}
+	}
+	for _, login := range e.Accounts {
+		if login == folderACLWildcard {
+			return 1
+		}
+	}
+
+	return 0
+}
+
+func containsRight(rights []folderRight, right folderRight) bool {
+	for _, r := range rights {
+		if r == right {
+			return true
+		}
+	}
+	return false
+}
+
+// decide returns whether the ACL allows right for account.  ok is false if no entry of the ACL decides the right.
+func (acl *FolderACL) decide(account *Account, right folderRight) (allowed, ok bool) {
+	var best int
+	for _, e := range acl.Entries {
+		m := e.match(account)
+		if m == 0 || m < best {
+			continue
+		}
+
+		deny, allow := containsRight(e.Deny, right), containsRight(e.Allow, right)
+		if !deny && !allow {
+			continue
+		}
+
+		if m > best {
+			best, allowed = m, allow && !deny
+			continue
+		}
+		allowed = allowed && !deny
+	}
+
+	return allowed, best > 0
+}
+
+// readFolderACL returns the ACL of the folder at folderPath, or nil if it does not have one
+func readFolderACL(fileStore FileStore, folderPath string) (*FolderACL, error) {
+	b, err := readFile(fileStore, path.Join(folderPath, folderACLFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var acl FolderACL
+	if err := acl.UnmarshalBinary(b); err != nil {
+		return nil, err
+	}
+
+	return &acl, nil
+}
+
+// folderAllowed reports whether the folder ACLs of folderPath and the folders above it, up to and including FileRoot,
+// allow right for account.  Rights that no ACL decides are allowed and left to the account Access bitmap.  A folder
+// with an unreadable or invalid ACL is denied to everyone, so that a mistake in an ACL file cannot expose the folder.
+// Read-only mounts deny every right that changes their contents, regardless of ACLs.
+func (s *Server) folderAllowed(account *Account, folderPath string, right folderRight) bool {
+	if m := mountAt(s.FS, folderPath); m != nil && m.ReadOnly {
+		switch right {
+		case folderRightUpload, folderRightDelete, folderRightRename:
+			return false
+		}
+	}
+
+	fileRoot := path.Join("/", s.Config.FileRoot)
+	p := path.Clean(folderPath)
+	if !isWithin(fileRoot, p) {
+		return true
+	}
+
+	for {
+		acl, err := readFolderACL(s.FS, p)
+		if err != nil {
+			return false
+		}
+		if acl != nil {
+			if allowed, ok := acl.decide(account, right); ok {
+				return allowed
+			}
+		}
+
+		if p == fileRoot {
+			return true
+		}
+		p = path.Dir(p)
+	}
+}
+
+// aclFolder returns the folder whose ACL applies to the file or folder at filePath: the folder itself for folders, and
+// the folder containing it for files.
+func aclFolder(fileStore FileStore, filePath string) string {
+	if fi, err := fileStore.Stat(filePath); err == nil && fi.IsDir() {
+		return filePath
+	}
+
+	return path.Dir(filePath)
+}
+
+// canTransferFolder reports whether the contents of the folder or alias at folderPath can be sent to cc in a folder
+// download
+func (cc *ClientConn) canTransferFolder(folderPath string) bool {
+	if confinePath(cc.Server.FS, cc.Server.Config.FileRoot, folderPath) != nil {
+		return false
+	}
+	if !authorize(cc.Account.Access, accessViewDropBoxes) && isDropBox(cc.Server.FS, folderPath) {
+		return false
+	}
+
+	return cc.Server.folderAllowed(cc.Account, folderPath, folderRightDownload)
+}
+
+// checkTransferACL returns errFolderAccessDenied if the folder ACLs no longer allow the client that requested ft to
+// perform the transfer.  ACLs are checked when a transfer is requested and again when it starts, as they may have
+// changed in between.
+func (s *Server) checkTransferACL(ft *FileTransfer) error {
+	if ft.clientConn == nil {
+		return nil
+	}
+
+	var folderPath string
+	var right folderRight
+	var err error
+	switch ft.Type {
+	case FileDownload:
+		folderPath, err = readPath(s.Config.FileRoot, ft.FilePath, ft.FileName)
+		folderPath, right = path.Dir(folderPath), folderRightDownload
+	case FolderDownload:
+		folderPath, err = readPath(s.Config.FileRoot, ft.FilePath, ft.FileName)
+		right = folderRightDownload
+	case FileUpload, FolderUpload:
+		folderPath, err = readPath(s.Config.FileRoot, ft.FilePath, nil)
+		right = folderRightUpload
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if !s.folderAllowed(ft.clientConn.Account, folderPath, right) {
+		return errFolderAccessDenied
+	}
+
+	return nil
+}
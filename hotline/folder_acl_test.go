@@ -0,0 +1,224 @@
+package hotline
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+const membersOnlyACL = `
+Entries:
+  - Accounts: ["*"]
+    Deny: [list, download, upload, delete, rename]
+  - Groups: [members]
+    Allow: [list, download, upload]
+  - Accounts: [banned]
+    Deny: [download]
+`
+
+func newFolderACLTestServer() *Server {
+	mfs := NewMemFileStore()
+	_ = mfs.MkdirAll("/Files/Public", 0777)
+	_ = mfs.MkdirAll("/Files/Members/Archive", 0777)
+	_ = mfs.MkdirAll("/Files/Members/Open", 0777)
+	_ = mfs.MkdirAll("/Files/Broken", 0777)
+	_ = mfs.WriteFile("/Files/Public/readme.txt", []byte("hello"), 0644)
+	_ = mfs.WriteFile("/Files/Members/notes.txt", []byte("members"), 0644)
+	_ = mfs.WriteFile("/Files/Members/Archive/old.txt", []byte("old"), 0644)
+	_ = mfs.WriteFile("/Files/Members/"+folderACLFile, []byte(membersOnlyACL), 0644)
+	_ = mfs.WriteFile("/Files/Members/Open/"+folderACLFile, []byte("Entries:\n  - Accounts: [\"*\"]\n    Allow: [list]\n"), 0644)
+	_ = mfs.WriteFile("/Files/Broken/"+folderACLFile, []byte("Entries:\n  - Accounts: [\"*\"]\n    Allow: [fly]\n"), 0644)
+
+	return &Server{
+		FS:            mfs,
+		FileTransfers: make(map[uint32]*FileTransfer),
+		Config:        &Config{FileRoot: "/Files"},
+		Logger:        NewTestLogger(),
+	}
+}
+
+func TestFolderACL_UnmarshalBinary(t *testing.T) {
+	var acl FolderACL
+	assert.NoError(t, acl.UnmarshalBinary([]byte(membersOnlyACL)))
+	assert.Len(t, acl.Entries, 3)
+	assert.Equal(t, []string{"members"}, acl.Entries[1].Groups)
+
+	assert.True(t, errors.Is(acl.UnmarshalBinary([]byte("Entries:\n  - Allow: [fly]\n")), errInvalidFolderACL))
+	assert.True(t, errors.Is(acl.UnmarshalBinary([]byte("Entries: [")), errInvalidFolderACL))
+}
+
+func TestServer_folderAllowed(t *testing.T) {
+	s := newFolderACLTestServer()
+	guest := &Account{Login: "guest"}
+	member := &Account{Login: "alice", Groups: []string{"members"}}
+	banned := &Account{Login: "banned", Groups: []string{"members"}}
+
+	tests := []struct {
+		name       string
+		account    *Account
+		folderPath string
+		right      folderRight
+		want       bool
+	}{
+		{name: "folders without ACLs are allowed", account: guest, folderPath: "/Files/Public", right: folderRightDownload, want: true},
+		{name: "wildcard deny", account: guest, folderPath: "/Files/Members", right: folderRightList, want: false},
+		{name: "group allow wins over wildcard deny", account: member, folderPath: "/Files/Members", right: folderRightList, want: true},
+		{name: "rights not granted to the group fall back to the wildcard", account: member, folderPath: "/Files/Members", right: folderRightDelete, want: false},
+		{name: "account deny wins over group allow", account: banned, folderPath: "/Files/Members", right: folderRightDownload, want: false},
+		{name: "subfolders inherit the ACL", account: guest, folderPath: "/Files/Members/Archive", right: folderRightDownload, want: false},
+		{name: "subfolder ACL overrides the inherited ACL", account: guest, folderPath: "/Files/Members/Open", right: folderRightList, want: true},
+		{name: "rights the subfolder ACL does not decide are inherited", account: guest, folderPath: "/Files/Members/Open", right: folderRightDownload, want: false},
+		{name: "invalid ACLs deny everything", account: member, folderPath: "/Files/Broken", right: folderRightList, want: false},
+		{name: "folders outside of the file root are not considered", account: guest, folderPath: "/Other", right: folderRightList, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, s.folderAllowed(tt.account, tt.folderPath, tt.right))
+		})
+	}
+}
+
+func TestServer_folderAllowed_rootFileRoot(t *testing.T) {
+	mfs := NewMemFileStore()
+	_ = mfs.MkdirAll("/Members/Archive", 0777)
+	_ = mfs.WriteFile("/Members/"+folderACLFile, []byte(membersOnlyACL), 0644)
+	s := &Server{FS: mfs, Config: &Config{FileRoot: "/"}, Logger: NewTestLogger()}
+
+	guest := &Account{Login: "guest"}
+	member := &Account{Login: "alice", Groups: []string{"members"}}
+
+	assert.False(t, s.folderAllowed(guest, "/Members", folderRightList))
+	assert.False(t, s.folderAllowed(guest, "/Members/Archive", folderRightDownload))
+	assert.True(t, s.folderAllowed(member, "/Members", folderRightList))
+	assert.True(t, s.folderAllowed(guest, "/", folderRightList))
+}
+
+func TestFolderACLs(t *testing.T) {
+	newClient := func(login string, groups ...string) *ClientConn {
+		var bits accessBitmap
+		for _, bit := range []int{accessDownloadFile, accessUploadFile, accessUploadAnywhere, accessDeleteFile, accessDeleteFolder, accessRenameFile, accessCreateFolder} {
+			bits.Set(bit)
+		}
+		access := bits[:]
+
+		return &ClientConn{
+			ID:        &[]byte{0, 1},
+			Account:   &Account{Login: login, Groups: groups, Access: &access},
+			Transfers: make(map[int][]*FileTransfer),
+			Server:    newFolderACLTestServer(),
+		}
+	}
+	listedNames := func(t *testing.T, res []Transaction) (names []string) {
+		for _, f := range res[0].Fields {
+			var fnwi FileNameWithInfo
+			assert.NoError(t, fnwi.UnmarshalBinary(f.Data))
+			names = append(names, string(fnwi.name))
+		}
+		return names
+	}
+
+	t.Run("denied folders are hidden from listings", func(t *testing.T) {
+		res, err := HandleGetFileNameList(newClient("guest"), NewTransaction(tranGetFileNameList, &[]byte{0, 1}))
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"Public"}, listedNames(t, res))
+
+		res, err = HandleGetFileNameList(newClient("alice", "members"), NewTransaction(tranGetFileNameList, &[]byte{0, 1}))
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"Members", "Public"}, listedNames(t, res))
+	})
+
+	t.Run("denied folders cannot be listed directly", func(t *testing.T) {
+		res, err := HandleGetFileNameList(newClient("guest"), NewTransaction(tranGetFileNameList, &[]byte{0, 1},
+			NewField(fieldFilePath, EncodeFilePath("Members")),
+		))
+		assert.NoError(t, err)
+		assert.Equal(t, "You are not allowed to view this folder.", string(res[0].GetField(fieldError).Data))
+	})
+
+	t.Run("file downloads are denied", func(t *testing.T) {
+		cc := newClient("banned", "members")
+		res, err := HandleDownloadFile(cc, NewTransaction(tranDownloadFile, &[]byte{0, 1},
+			NewField(fieldFileName, []byte("notes.txt")),
+			NewField(fieldFilePath, EncodeFilePath("Members")),
+		))
+		assert.NoError(t, err)
+		assert.Equal(t, "You are not allowed to download files from this folder.", string(res[0].GetField(fieldError).Data))
+		assert.Empty(t, cc.Server.FileTransfers)
+	})
+
+	t.Run("uploads are denied", func(t *testing.T) {
+		cc := newClient("guest")
+		res, err := HandleUploadFile(cc, NewTransaction(tranUploadFile, &[]byte{0, 1},
+			NewField(fieldFileName, []byte("new.txt")),
+			NewField(fieldFilePath, EncodeFilePath("Members/Archive")),
+		))
+		assert.NoError(t, err)
+		assert.Equal(t, "You are not allowed to upload to this folder.", string(res[0].GetField(fieldError).Data))
+		assert.Empty(t, cc.Server.FileTransfers)
+	})
+
+	t.Run("deletes are denied", func(t *testing.T) {
+		cc := newClient("alice", "members")
+		res, err := HandleDeleteFile(cc, NewTransaction(tranDeleteFile, &[]byte{0, 1},
+			NewField(fieldFileName, []byte("Archive")),
+			NewField(fieldFilePath, EncodeFilePath("Members")),
+		))
+		assert.NoError(t, err)
+		assert.Equal(t, "You are not allowed to delete items in this folder.", string(res[0].GetField(fieldError).Data))
+
+		_, err = cc.Server.FS.Stat("/Files/Members/Archive")
+		assert.NoError(t, err)
+	})
+
+	t.Run("renames are denied", func(t *testing.T) {
+		cc := newClient("guest")
+		res, err := HandleSetFileInfo(cc, NewTransaction(tranSetFileInfo, &[]byte{0, 1},
+			NewField(fieldFileName, []byte("notes.txt")),
+			NewField(fieldFilePath, EncodeFilePath("Members")),
+			NewField(fieldFileNewName, []byte("renamed.txt")),
+		))
+		assert.NoError(t, err)
+		assert.Equal(t, "You are not allowed to rename items in this folder.", string(res[0].GetField(fieldError).Data))
+	})
+
+	t.Run("comments are denied with renames", func(t *testing.T) {
+		cc := newClient("guest")
+		res, err := HandleSetFileInfo(cc, NewTransaction(tranSetFileInfo, &[]byte{0, 1},
+			NewField(fieldFileName, []byte("notes.txt")),
+			NewField(fieldFilePath, EncodeFilePath("Members")),
+			NewField(fieldFileComment, []byte("hello")),
+		))
+		assert.NoError(t, err)
+		assert.Equal(t, "You are not allowed to set comments for items in this folder.", string(res[0].GetField(fieldError).Data))
+
+		ad, err := readAppleDouble(cc.Server.FS, "/Files/Members/notes.txt")
+		assert.True(t, err != nil || len(ad.Comment) == 0, "the comment is not set")
+	})
+
+	t.Run("denied subfolders are left out of folder downloads", func(t *testing.T) {
+		cc := newClient("alice", "members")
+		_ = cc.Server.FS.WriteFile("/Files/Members/Archive/"+folderACLFile, []byte("Entries:\n  - Groups: [members]\n    Deny: [download]\n"), 0644)
+
+		res, err := HandleDownloadFolder(cc, NewTransaction(tranDownloadFldr, &[]byte{0, 1},
+			NewField(fieldFileName, []byte("Members")),
+			NewField(fieldFilePath, []byte{0, 0}),
+		))
+		assert.NoError(t, err)
+		// Members/notes.txt and Members/Open; Members/Archive is left out
+		assert.Equal(t, []byte{0, 2}, res[0].GetField(fieldFolderItemCount).Data)
+	})
+
+	t.Run("transfers are checked again when they start", func(t *testing.T) {
+		cc := newClient("alice", "members")
+		ft := &FileTransfer{
+			FileName:   []byte("notes.txt"),
+			FilePath:   EncodeFilePath("Members"),
+			Type:       FileDownload,
+			clientConn: cc,
+		}
+		assert.NoError(t, cc.Server.checkTransferACL(ft))
+
+		_ = cc.Server.FS.WriteFile("/Files/Members/"+folderACLFile, []byte("Entries:\n  - Accounts: [alice]\n    Deny: [download]\n"), 0644)
+		assert.ErrorIs(t, cc.Server.checkTransferACL(ft), errFolderAccessDenied)
+	})
+}
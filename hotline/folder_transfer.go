@@ -0,0 +1,489 @@
+package hotline
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+)
+
+// A folder transfer sends the items of a folder one at a time over the file transfer connection.  The same exchange is
+// used in both directions; the server is the sender of a folder download and the receiver of a folder upload.
+//
+//  1. The receiver asks for the first item with dlFldrActionNextFile.
+//  2. The sender sends the header of the item: its path relative to the folder and whether it is a folder.
+//  3. The receiver replies with the action for the item: dlFldrActionSendFile to transfer the file,
+//     dlFldrActionResumeFile followed by the size and content of the FileResumeData to transfer the rest of a partial
+//     file, or dlFldrActionNextFile to skip it.  Folders are always skipped, as the receiver creates them itself.
+//  4. For a file that is sent or resumed, the sender sends the 4-byte transfer size followed by the flattened file
+//     object, and the receiver then asks for the next item with dlFldrActionNextFile.
+//
+// Steps 2 to 4 repeat for each item.  folderSender and folderReceiver implement the two sides as state machines that
+// know nothing of where the items come from or go to, so that the client uses them as well as the server (see
+// client_folder_transfer.go).
+
+const dlFldrActionSendFile = 1
+const dlFldrActionResumeFile = 2
+const dlFldrActionNextFile = 3
+
+var errFolderAction = errors.New("unexpected folder transfer action")
+
+// folderItem is the header of an item of a folder transfer
+type folderItem struct {
+	Path     string // Path of the item relative to the folder being transferred
+	IsFolder bool
+}
+
+// header returns the item header as it is sent
+func (fi folderItem) header() []byte {
+	fh := NewFileHeader(fi.Path, fi.IsFolder)
+	return fh.Payload()
+}
+
+// readFolderItem reads an item header from r.  The path of the item is checked like any other path sent by a peer.
+func readFolderItem(r io.Reader) (folderItem, error) {
+	var fu folderUpload
+	if _, err := io.ReadFull(r, fu.DataSize[:]); err != nil {
+		return folderItem{}, err
+	}
+	size := binary.BigEndian.Uint16(fu.DataSize[:])
+	if size < 4 {
+		return folderItem{}, errInvalidPath
+	}
+	if _, err := io.ReadFull(r, fu.IsFolder[:]); err != nil {
+		return folderItem{}, err
+	}
+	if _, err := io.ReadFull(r, fu.PathItemCount[:]); err != nil {
+		return folderItem{}, err
+	}
+	fu.FileNamePath = make([]byte, size-4)
+	if _, err := io.ReadFull(r, fu.FileNamePath); err != nil {
+		return folderItem{}, err
+	}
+
+	if binary.BigEndian.Uint16(fu.PathItemCount[:]) == 0 {
+		return folderItem{}, errInvalidPath
+	}
+	if err := fu.checkPath(); err != nil {
+		return folderItem{}, err
+	}
+
+	return folderItem{Path: fu.FormattedPath(), IsFolder: fu.IsFolder == [2]byte{0, 1}}, nil
+}
+
+// writeFolderAction sends action to the peer, followed by the resume data frd for dlFldrActionResumeFile
+func writeFolderAction(w io.Writer, action int, frd *FileResumeData) error {
+	out := []byte{0, uint8(action)}
+	if action == dlFldrActionResumeFile {
+		b, err := frd.BinaryMarshal()
+		if err != nil {
+			return err
+		}
+		size := make([]byte, 2)
+		binary.BigEndian.PutUint16(size, uint16(len(b)))
+		out = append(out, size...)
+		out = append(out, b...)
+	}
+
+	_, err := w.Write(out)
+	return err
+}
+
+// readFolderAction reads an action from the peer, and the resume data that follows dlFldrActionResumeFile
+func readFolderAction(r io.Reader) (int, *FileResumeData, error) {
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, nil, err
+	}
+
+	action := int(binary.BigEndian.Uint16(b))
+	switch action {
+	case dlFldrActionSendFile, dlFldrActionNextFile:
+		return action, nil, nil
+	case dlFldrActionResumeFile:
+		if _, err := io.ReadFull(r, b); err != nil {
+			return 0, nil, err
+		}
+		resumeData := make([]byte, binary.BigEndian.Uint16(b))
+		if _, err := io.ReadFull(r, resumeData); err != nil {
+			return 0, nil, err
+		}
+
+		var frd FileResumeData
+		if err := frd.UnmarshalBinary(resumeData); err != nil {
+			return 0, nil, err
+		}
+
+		return action, &frd, nil
+	}
+
+	return 0, nil, fmt.Errorf("%w: %d", errFolderAction, action)
+}
+
+// folderSource supplies the files of a folder being sent
+type folderSource interface {
+	// sendFile writes the transfer size and flattened file object of item to w, resumed from frd if it is not nil
+	sendFile(w io.Writer, item folderItem, frd *FileResumeData) error
+}
+
+type folderSendState int
+
+const (
+	folderSendStart  folderSendState = iota // Waiting for the receiver to ask for the first item
+	folderSendItem                          // Sending the header of the next item
+	folderSendAction                        // Waiting for the receiver's action for the item
+	folderSendFile                          // Sending the file
+	folderSendNext                          // Waiting for the receiver to ask for the next item
+	folderSendDone                          // All items have been sent
+)
+
+// folderSender is the sending side of a folder transfer
+type folderSender struct {
+	conn   io.ReadWriter
+	items  []folderItem
+	source folderSource
+
+	state   folderSendState
+	current int             // Index of the item being sent
+	frd     *FileResumeData // Resume data for the current file, or nil to send all of it
+	files   int             // Files sent or resumed
+	skipped int             // Files skipped by the receiver
+}
+
+func newFolderSender(conn io.ReadWriter, items []folderItem, source folderSource) *folderSender {
+	return &folderSender{conn: conn, items: items, source: source}
+}
+
+// step performs the exchange of the current state and moves to the next state
+func (sender *folderSender) step() error {
+	switch sender.state {
+	case folderSendStart, folderSendNext:
+		action, _, err := readFolderAction(sender.conn)
+		if err != nil {
+			return err
+		}
+		if action != dlFldrActionNextFile {
+			return fmt.Errorf("%w: %d", errFolderAction, action)
+		}
+		if sender.state == folderSendNext {
+			sender.current += 1
+		}
+		sender.state = folderSendItem
+	case folderSendItem:
+		if sender.current == len(sender.items) {
+			sender.state = folderSendDone
+			return nil
+		}
+		if _, err := sender.conn.Write(sender.items[sender.current].header()); err != nil {
+			return err
+		}
+		sender.state = folderSendAction
+	case folderSendAction:
+		action, frd, err := readFolderAction(sender.conn)
+		if err != nil {
+			return err
+		}
+		item := sender.items[sender.current]
+		if item.IsFolder || action == dlFldrActionNextFile {
+			if !item.IsFolder {
+				sender.skipped += 1
+			}
+			sender.current += 1
+			sender.state = folderSendItem
+			return nil
+		}
+		sender.frd = frd
+		sender.state = folderSendFile
+	case folderSendFile:
+		if err := sender.source.sendFile(sender.conn, sender.items[sender.current], sender.frd); err != nil {
+			return err
+		}
+		sender.files += 1
+		sender.state = folderSendNext
+	}
+
+	return nil
+}
+
+// run sends the folder
+func (sender *folderSender) run() error {
+	for sender.state != folderSendDone {
+		if err := sender.step(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// folderDestination stores the items of a folder being received
+type folderDestination interface {
+	// itemAction returns the action for item, with the resume data for dlFldrActionResumeFile.  Folders are created
+	// by itemAction.
+	itemAction(item folderItem) (int, *FileResumeData, error)
+
+	// receiveFile reads the flattened file object of item from r.  frd is the resume data sent for the file, if any.
+	receiveFile(r io.Reader, item folderItem, frd *FileResumeData) error
+}
+
+type folderReceiveState int
+
+const (
+	folderReceiveStart  folderReceiveState = iota // Asking for the first item
+	folderReceiveItem                             // Waiting for the header of the next item
+	folderReceiveAction                           // Sending the action for the item
+	folderReceiveFile                             // Receiving the file
+	folderReceiveNext                             // Asking for the next item
+	folderReceiveDone                             // All items have been received
+)
+
+// folderReceiver is the receiving side of a folder transfer
+type folderReceiver struct {
+	conn  io.ReadWriter
+	count int // Number of items in the folder
+	dest  folderDestination
+
+	state    folderReceiveState
+	received int // Item headers received
+	item     folderItem
+	frd      *FileResumeData
+	files    int // Files received or resumed
+	skipped  int // Files skipped
+}
+
+func newFolderReceiver(conn io.ReadWriter, count int, dest folderDestination) *folderReceiver {
+	return &folderReceiver{conn: conn, count: count, dest: dest}
+}
+
+// step performs the exchange of the current state and moves to the next state
+func (receiver *folderReceiver) step() error {
+	switch receiver.state {
+	case folderReceiveStart, folderReceiveNext:
+		if err := writeFolderAction(receiver.conn, dlFldrActionNextFile, nil); err != nil {
+			return err
+		}
+		receiver.state = folderReceiveItem
+	case folderReceiveItem:
+		if receiver.received == receiver.count {
+			receiver.state = folderReceiveDone
+			return nil
+		}
+		item, err := readFolderItem(receiver.conn)
+		if err != nil {
+			return err
+		}
+		receiver.item = item
+		receiver.received += 1
+		receiver.state = folderReceiveAction
+	case folderReceiveAction:
+		action, frd, err := receiver.dest.itemAction(receiver.item)
+		if err != nil {
+			return err
+		}
+		if receiver.item.IsFolder {
+			action = dlFldrActionNextFile
+		}
+		if err := writeFolderAction(receiver.conn, action, frd); err != nil {
+			return err
+		}
+		if action == dlFldrActionNextFile {
+			if !receiver.item.IsFolder {
+				receiver.skipped += 1
+			}
+			receiver.state = folderReceiveItem
+			return nil
+		}
+		receiver.frd = frd
+		receiver.state = folderReceiveFile
+	case folderReceiveFile:
+		// The transfer size is clamped for files over 4 GiB, so the sizes in the flattened file object are used instead
+		if _, err := io.ReadFull(receiver.conn, make([]byte, 4)); err != nil {
+			return err
+		}
+		if err := receiver.dest.receiveFile(receiver.conn, receiver.item, receiver.frd); err != nil {
+			return err
+		}
+		receiver.files += 1
+		receiver.state = folderReceiveNext
+	}
+
+	return nil
+}
+
+// run receives the folder
+func (receiver *folderReceiver) run() error {
+	for receiver.state != folderReceiveDone {
+		if err := receiver.step(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// folderItems returns the items of the folder at root in the order they are sent.  Resource forks are sent with their
+// files rather than as items, and folders for which include returns false are left out.
+func folderItems(fileStore FileStore, root string, include func(folderPath string) bool) ([]folderItem, error) {
+	var items []folderItem
+	err := walkFolder(fileStore, root+"/", include, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path.Clean(p) == path.Clean(root) || isAppleDouble(info.Name()) {
+			return nil
+		}
+
+		items = append(items, folderItem{Path: strings.TrimPrefix(p, root+"/"), IsFolder: info.IsDir()})
+
+		return nil
+	})
+
+	return items, err
+}
+
+// folderDownloadSource sends the files of a folder download from the server's FileStore
+type folderDownloadSource struct {
+	server *Server
+	ft     *FileTransfer
+	root   string // Full path of the folder being downloaded
+}
+
+func (src *folderDownloadSource) sendFile(w io.Writer, item folderItem, frd *FileResumeData) error {
+	s := src.server
+	filePath := src.root + "/" + item.Path
+
+	var dataOffset, rsrcOffset int64
+	if frd != nil {
+		dataOffset, rsrcOffset = frd.forkOffsets(src.ft.largeFiles())
+	}
+
+	ffo, err := NewFlattenedFileObject(s.FS, s.fileTypes, path.Dir(filePath), nil, []byte(path.Base(filePath)), dataOffset)
+	if err != nil {
+		return err
+	}
+	ffo.resumeResourceFork(rsrcOffset)
+
+	s.Logger.Infow("File download started",
+		"fileName", item.Path,
+		"transactionRef", src.ft.ReferenceNumber,
+		"TransferSize", fmt.Sprintf("%x", ffo.TransferSize()),
+	)
+
+	// The transfer size is clamped for files over 4 GiB; clients that support large files use the 64-bit size from the
+	// fork header instead.
+	if _, err := w.Write(ffo.TransferSize()); err != nil {
+		return err
+	}
+
+	return sendFile(w, s.FS, filePath, ffo, dataOffset, rsrcOffset, false)
+}
+
+// folderUploadDestination stores the items of a folder upload in the server's FileStore
+type folderUploadDestination struct {
+	server *Server
+	ft     *FileTransfer
+	root   string // Full path of the folder being uploaded
+	budget *uploadBudget
+}
+
+// itemAction creates folders, skips items the folder ACLs deny and files that have been uploaded already, and resumes
+// files that were partially uploaded.  Only the data fork of a partial file is resumed; the resource fork is stored when the file is complete,
+// so the client sends all of it again.
+func (d *folderUploadDestination) itemAction(item folderItem) (int, *FileResumeData, error) {
+	s := d.server
+	itemPath := d.root + "/" + item.Path
+	if err := confinePath(s.FS, s.Config.FileRoot, itemPath); err != nil {
+		return 0, nil, err
+	}
+
+	s.Logger.Infow("Folder upload continued",
+		"transactionRef", fmt.Sprintf("%x", d.ft.ReferenceNumber),
+		"FormattedPath", item.Path,
+		"IsFolder", item.IsFolder,
+	)
+
+	// The folder ACLs of the subfolders are checked as well as that of the folder the upload was requested for.  Items
+	// in folders that deny uploads are skipped, as are the items inside of skipped folders since they are denied by the
+	// same ACL.
+	if account := d.ft.account(); account != nil && !s.folderAllowed(account, path.Dir(itemPath), folderRightUpload) {
+		s.Logger.Infow("Folder upload item denied by folder ACL", "transactionRef", fmt.Sprintf("%x", d.ft.ReferenceNumber), "FormattedPath", item.Path)
+		return dlFldrActionNextFile, nil, nil
+	}
+
+	if item.IsFolder {
+		if _, err := s.FS.Stat(itemPath); errors.Is(err, fs.ErrNotExist) {
+			if err := s.FS.Mkdir(itemPath, 0777); err != nil {
+				return 0, nil, err
+			}
+		}
+		return dlFldrActionNextFile, nil, nil
+	}
+
+	incomplete, err := s.FS.Stat(itemPath + incompleteFileSuffix)
+	if err == nil {
+		return dlFldrActionResumeFile, NewFileResumeData([]ForkInfoList{*newDataForkInfoList(uint64(incomplete.Size()))}), nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return 0, nil, err
+	}
+
+	_, err = s.FS.Stat(itemPath)
+	if err == nil {
+		return dlFldrActionNextFile, nil, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return 0, nil, err
+	}
+
+	return dlFldrActionSendFile, nil, nil
+}
+
+// receiveFile stores the file in an incomplete file that is renamed once all of it has been received.  The incomplete
+// file is kept when the transfer fails so that the upload can be resumed.
+func (d *folderUploadDestination) receiveFile(r io.Reader, item folderItem, frd *FileResumeData) error {
+	s := d.server
+	filePath := d.root + "/" + item.Path
+
+	var file File
+	var err error
+	var offset int64
+	if frd != nil {
+		offset, _ = frd.forkOffsets(true) // frd is made by itemAction
+		file, err = s.FS.OpenFile(filePath+incompleteFileSuffix, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	} else {
+		file, err = s.FS.Create(filePath + incompleteFileSuffix)
+	}
+	if err != nil {
+		return err
+	}
+
+	s.Logger.Infow("Starting file transfer", "path", filePath, "offset", offset)
+
+	d.budget.startFile(uint64(offset))
+	var infoFork, rsrcFork bytes.Buffer
+	if err := receiveFile(r, d.budget.writer(file), d.budget.writer(&rsrcFork), &infoFork, d.ft.largeFiles()); err != nil {
+		_ = file.Close()
+		if errors.Is(err, errUploadLimit) {
+			s.stopUpload(d.ft, "folder", filePath+incompleteFileSuffix, err)
+		}
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	if err := s.FS.Rename(filePath+incompleteFileSuffix, filePath); err != nil {
+		return err
+	}
+
+	if err := saveForks(s.FS, s.fileTypes, filePath, infoFork.Bytes(), rsrcFork.Bytes()); err != nil {
+		s.Logger.Error(err)
+	}
+
+	return nil
+}
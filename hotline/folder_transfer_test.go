@@ -0,0 +1,432 @@
+package hotline
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/fs"
+	"net"
+	"testing"
+)
+
+// memFolderDestination is a client side folderDestination that keeps the received files in memory
+type memFolderDestination struct {
+	actions  map[string]int             // Action for each file; files not listed are sent
+	resume   map[string]*FileResumeData // Resume data for the files resumed
+	folders  []string
+	data     map[string][]byte
+	rsrc     map[string][]byte
+	resumed  map[string]*FileResumeData // Resume data passed to receiveFile
+	failWith error
+}
+
+func newMemFolderDestination() *memFolderDestination {
+	return &memFolderDestination{
+		actions: map[string]int{},
+		resume:  map[string]*FileResumeData{},
+		data:    map[string][]byte{},
+		rsrc:    map[string][]byte{},
+		resumed: map[string]*FileResumeData{},
+	}
+}
+
+func (d *memFolderDestination) itemAction(item folderItem) (int, *FileResumeData, error) {
+	if item.IsFolder {
+		d.folders = append(d.folders, item.Path)
+		return dlFldrActionNextFile, nil, nil
+	}
+	if action, ok := d.actions[item.Path]; ok {
+		return action, d.resume[item.Path], nil
+	}
+
+	return dlFldrActionSendFile, nil, nil
+}
+
+func (d *memFolderDestination) receiveFile(r io.Reader, item folderItem, frd *FileResumeData) error {
+	if d.failWith != nil {
+		return d.failWith
+	}
+
+	var data, rsrc, info bytes.Buffer
+	if err := receiveFile(r, &data, &rsrc, &info, true); err != nil {
+		return err
+	}
+	d.data[item.Path] = data.Bytes()
+	d.rsrc[item.Path] = rsrc.Bytes()
+	d.resumed[item.Path] = frd
+
+	return nil
+}
+
+// newFolderTestStore returns a file store with the folder /Files/Docs:
+//
+//	Docs/a.txt      "aaaaa" with the resource fork "rsrc"
+//	Docs/Sub/       folder
+//	Docs/Sub/b.txt  "bb"
+func newFolderTestStore(t *testing.T) *MemFileStore {
+	mfs := NewMemFileStore()
+	_ = mfs.MkdirAll("/Files/Docs/Sub", 0777)
+	_ = mfs.WriteFile("/Files/Docs/a.txt", []byte("aaaaa"), 0644)
+	_ = mfs.WriteFile("/Files/Docs/Sub/b.txt", []byte("bb"), 0644)
+	ad := newAppleDouble(NewFlatFileInformationFork("a.txt", make([]byte, 8), "TEXT", "ttxt"), []byte("rsrc"))
+	assert.NoError(t, writeAppleDouble(mfs, "/Files/Docs/a.txt", ad))
+
+	return mfs
+}
+
+// resumeData returns resume data for the data and resource fork offsets
+func resumeData(data, rsrc uint64) *FileResumeData {
+	dataFork := newDataForkInfoList(data)
+	rsrcFork := newDataForkInfoList(rsrc)
+	rsrcFork.Fork = [4]byte{0x4d, 0x41, 0x43, 0x52} // MACR
+
+	return NewFileResumeData([]ForkInfoList{*dataFork, *rsrcFork})
+}
+
+// transferFolder runs a folder sender and receiver against each other over a pipe
+func transferFolder(sender *folderSender, receiver *folderReceiver, client, server net.Conn) (sendErr, receiveErr error) {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- sender.run()
+		_ = server.Close()
+	}()
+	receiveErr = receiver.run()
+	_ = client.Close()
+
+	return <-errs, receiveErr
+}
+
+func Test_folderItems(t *testing.T) {
+	items, err := folderItems(newFolderTestStore(t), "/Files/Docs", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []folderItem{
+		{Path: "Sub", IsFolder: true},
+		{Path: "Sub/b.txt"},
+		{Path: "a.txt"},
+	}, items)
+
+	items, err = folderItems(newFolderTestStore(t), "/Files/Docs", func(folderPath string) bool { return false })
+	assert.NoError(t, err)
+	assert.Equal(t, []folderItem{{Path: "a.txt"}}, items, "folders that are not included are left out")
+}
+
+func Test_readFolderItem(t *testing.T) {
+	item, err := readFolderItem(bytes.NewReader(folderItem{Path: "Sub/b.txt"}.header()))
+	assert.NoError(t, err)
+	assert.Equal(t, folderItem{Path: "Sub/b.txt"}, item)
+
+	item, err = readFolderItem(bytes.NewReader(folderItem{Path: "Sub", IsFolder: true}.header()))
+	assert.NoError(t, err)
+	assert.Equal(t, folderItem{Path: "Sub", IsFolder: true}, item)
+
+	_, err = readFolderItem(bytes.NewReader(folderItem{Path: "Sub/../../etc"}.header()))
+	assert.ErrorIs(t, err, errInvalidPath)
+
+	_, err = readFolderItem(bytes.NewReader([]byte{0, 2, 0, 0}))
+	assert.ErrorIs(t, err, errInvalidPath)
+}
+
+func Test_folderAction(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, writeFolderAction(&buf, dlFldrActionResumeFile, resumeData(3, 2)))
+	assert.NoError(t, writeFolderAction(&buf, dlFldrActionNextFile, nil))
+
+	action, frd, err := readFolderAction(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, dlFldrActionResumeFile, action)
+	data, rsrc := frd.forkOffsets(false)
+	assert.Equal(t, int64(3), data)
+	assert.Equal(t, int64(2), rsrc)
+
+	action, frd, err = readFolderAction(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, dlFldrActionNextFile, action)
+	assert.Nil(t, frd)
+
+	_, _, err = readFolderAction(bytes.NewReader([]byte{0, 9}))
+	assert.ErrorIs(t, err, errFolderAction)
+}
+
+func TestFolderTransfer(t *testing.T) {
+	// newTransfer returns a sender of /Files/Docs and a receiver into dest, connected by a pipe
+	newTransfer := func(t *testing.T, mfs *MemFileStore, dest folderDestination) (*folderSender, *folderReceiver, net.Conn, net.Conn) {
+		s := newTransferTestServer(mfs, &FileTransfer{})
+		items, err := folderItems(mfs, "/Files/Docs", nil)
+		assert.NoError(t, err)
+
+		client, server := net.Pipe()
+		sender := newFolderSender(server, items, &folderDownloadSource{server: s, ft: s.FileTransfers[1], root: "/Files/Docs"})
+		receiver := newFolderReceiver(client, len(items), dest)
+
+		return sender, receiver, client, server
+	}
+
+	t.Run("sends every file with its resource fork", func(t *testing.T) {
+		dest := newMemFolderDestination()
+		sender, receiver, client, server := newTransfer(t, newFolderTestStore(t), dest)
+
+		sendErr, receiveErr := transferFolder(sender, receiver, client, server)
+		assert.NoError(t, sendErr)
+		assert.NoError(t, receiveErr)
+
+		assert.Equal(t, []string{"Sub"}, dest.folders)
+		assert.Equal(t, map[string][]byte{"Sub/b.txt": []byte("bb"), "a.txt": []byte("aaaaa")}, dest.data)
+		assert.Equal(t, []byte("rsrc"), dest.rsrc["a.txt"])
+		assert.Equal(t, 2, sender.files, "folders are not counted as files")
+		assert.Equal(t, 2, receiver.files)
+		assert.Equal(t, folderSendDone, sender.state)
+		assert.Equal(t, folderReceiveDone, receiver.state)
+	})
+
+	t.Run("skips files the receiver already has", func(t *testing.T) {
+		dest := newMemFolderDestination()
+		dest.actions["a.txt"] = dlFldrActionNextFile
+		sender, receiver, client, server := newTransfer(t, newFolderTestStore(t), dest)
+
+		sendErr, receiveErr := transferFolder(sender, receiver, client, server)
+		assert.NoError(t, sendErr)
+		assert.NoError(t, receiveErr)
+
+		assert.Equal(t, map[string][]byte{"Sub/b.txt": []byte("bb")}, dest.data)
+		assert.Equal(t, 1, sender.files)
+		assert.Equal(t, 1, sender.skipped)
+		assert.Equal(t, 1, receiver.skipped)
+	})
+
+	t.Run("resumes both forks of a partial file", func(t *testing.T) {
+		dest := newMemFolderDestination()
+		dest.actions["a.txt"] = dlFldrActionResumeFile
+		dest.resume["a.txt"] = resumeData(3, 2)
+		sender, receiver, client, server := newTransfer(t, newFolderTestStore(t), dest)
+
+		sendErr, receiveErr := transferFolder(sender, receiver, client, server)
+		assert.NoError(t, sendErr)
+		assert.NoError(t, receiveErr)
+
+		assert.Equal(t, []byte("aa"), dest.data["a.txt"])
+		assert.Equal(t, []byte("rc"), dest.rsrc["a.txt"])
+		assert.NotNil(t, dest.resumed["a.txt"])
+		assert.Equal(t, []byte("bb"), dest.data["Sub/b.txt"])
+		assert.Equal(t, 2, sender.files)
+	})
+
+	t.Run("stops when the receiver fails to store a file", func(t *testing.T) {
+		dest := newMemFolderDestination()
+		dest.failWith = errInvalidPath
+		sender, receiver, client, server := newTransfer(t, newFolderTestStore(t), dest)
+
+		sendErr, receiveErr := transferFolder(sender, receiver, client, server)
+		assert.ErrorIs(t, receiveErr, errInvalidPath)
+		assert.Error(t, sendErr, "the sender sees the connection close")
+		assert.Equal(t, folderReceiveFile, receiver.state)
+	})
+
+	t.Run("stops when the file can't be sent", func(t *testing.T) {
+		mfs := newFolderTestStore(t)
+		dest := newMemFolderDestination()
+		sender, receiver, client, server := newTransfer(t, mfs, dest)
+		_ = mfs.Remove("/Files/Docs/Sub/b.txt")
+
+		sendErr, receiveErr := transferFolder(sender, receiver, client, server)
+		assert.Error(t, sendErr)
+		assert.Error(t, receiveErr)
+		assert.Equal(t, folderSendFile, sender.state)
+		assert.Empty(t, dest.data)
+	})
+
+	t.Run("the sender rejects an unexpected action", func(t *testing.T) {
+		_, _, client, server := newTransfer(t, newFolderTestStore(t), nil)
+		sender := newFolderSender(server, []folderItem{{Path: "a.txt"}}, nil)
+
+		go func() { _, _ = client.Write([]byte{0, dlFldrActionSendFile}) }()
+		assert.ErrorIs(t, sender.run(), errFolderAction)
+		assert.Equal(t, folderSendStart, sender.state)
+	})
+}
+
+// folderUploadClient runs a folderSender for the items as a client uploading a folder to s
+func folderUploadClient(t *testing.T, s *Server, items []folderItem, source folderSource) (*folderSender, error) {
+	client, server := net.Pipe()
+	errs := make(chan error, 1)
+	go func() { errs <- s.handleFileTransfer(server) }()
+
+	_, _ = client.Write(htxf())
+	sender := newFolderSender(client, items, source)
+	sendErr := sender.run()
+	assert.NoError(t, sendErr)
+	_ = client.Close()
+
+	return sender, <-errs
+}
+
+// memFolderSource is a client side folderSource that sends files from memory
+type memFolderSource struct {
+	data    map[string][]byte
+	resumed map[string]*FileResumeData
+}
+
+func (src *memFolderSource) sendFile(w io.Writer, item folderItem, frd *FileResumeData) error {
+	data := src.data[item.Path]
+	if frd != nil {
+		offset, _ := frd.forkOffsets(true)
+		data = data[offset:]
+		src.resumed[item.Path] = frd
+	}
+	file := flatFile(item.Path, data)
+
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, uint32(len(file)))
+	_, err := w.Write(append(size, file...))
+
+	return err
+}
+
+func TestServer_folderTransfers(t *testing.T) {
+	t.Run("folder downloads count the files sent", func(t *testing.T) {
+		mfs := newFolderTestStore(t)
+		s := newTransferTestServer(mfs, &FileTransfer{Type: FolderDownload, FileName: []byte("Docs")})
+
+		client, server := net.Pipe()
+		errs := make(chan error, 1)
+		go func() { errs <- s.handleFileTransfer(server) }()
+
+		_, _ = client.Write(htxf())
+		dest := newMemFolderDestination()
+		dest.actions["Sub/b.txt"] = dlFldrActionNextFile
+		assert.NoError(t, newFolderReceiver(client, 3, dest).run())
+		_ = client.Close()
+		assert.NoError(t, <-errs)
+
+		assert.Equal(t, map[string][]byte{"a.txt": []byte("aaaaa")}, dest.data)
+		assert.Equal(t, 1, s.Stats.DownloadCounter, "folders and skipped files are not counted")
+	})
+
+	t.Run("folder uploads skip complete files and resume partial ones", func(t *testing.T) {
+		mfs := NewMemFileStore()
+		_ = mfs.MkdirAll("/Files/Uploads/Docs", 0777)
+		_ = mfs.WriteFile("/Files/Uploads/Docs/done.txt", []byte("done"), 0644)
+		_ = mfs.WriteFile("/Files/Uploads/Docs/part.txt"+incompleteFileSuffix, []byte("par"), 0644)
+
+		s := newTransferTestServer(mfs, &FileTransfer{
+			Type:            FolderUpload,
+			FileName:        []byte("Docs"),
+			FilePath:        EncodeFilePath("Uploads"),
+			FolderItemCount: []byte{0, 4},
+		})
+
+		source := &memFolderSource{
+			data:    map[string][]byte{"done.txt": []byte("other"), "part.txt": []byte("partial"), "Sub/new.txt": []byte("new")},
+			resumed: map[string]*FileResumeData{},
+		}
+		sender, err := folderUploadClient(t, s, []folderItem{
+			{Path: "Sub", IsFolder: true},
+			{Path: "Sub/new.txt"},
+			{Path: "done.txt"},
+			{Path: "part.txt"},
+		}, source)
+		assert.NoError(t, err)
+
+		for name, want := range map[string]string{"Sub/new.txt": "new", "done.txt": "done", "part.txt": "partial"} {
+			got, err := readFile(mfs, "/Files/Uploads/Docs/"+name)
+			assert.NoError(t, err)
+			assert.Equal(t, want, string(got), name)
+		}
+		assert.Contains(t, source.resumed, "part.txt")
+		assert.Equal(t, 1, sender.skipped)
+		assert.Equal(t, 2, s.Stats.UploadCounter, "folders and skipped files are not counted")
+	})
+
+	t.Run("folder uploads skip items in subfolders whose ACLs deny uploads", func(t *testing.T) {
+		mfs := NewMemFileStore()
+		_ = mfs.MkdirAll("/Files/Uploads/Docs/Locked", 0777)
+		_ = mfs.WriteFile("/Files/Uploads/Docs/Locked/"+folderACLFile, []byte("Entries:\n  - Accounts: [\"*\"]\n    Deny: [upload]\n"), 0644)
+
+		s := newTransferTestServer(mfs, &FileTransfer{
+			Type:            FolderUpload,
+			FileName:        []byte("Docs"),
+			FilePath:        EncodeFilePath("Uploads"),
+			FolderItemCount: []byte{0, 5},
+			clientConn:      &ClientConn{Account: &Account{Login: "guest"}},
+		})
+
+		source := &memFolderSource{
+			data:    map[string][]byte{"Locked/x.txt": []byte("x"), "Locked/New/y.txt": []byte("y"), "ok.txt": []byte("ok")},
+			resumed: map[string]*FileResumeData{},
+		}
+		sender, err := folderUploadClient(t, s, []folderItem{
+			{Path: "Locked", IsFolder: true},
+			{Path: "Locked/New", IsFolder: true},
+			{Path: "Locked/New/y.txt"},
+			{Path: "Locked/x.txt"},
+			{Path: "ok.txt"},
+		}, source)
+		assert.NoError(t, err)
+
+		for _, name := range []string{"Locked/x.txt", "Locked/New"} {
+			_, err := mfs.Stat("/Files/Uploads/Docs/" + name)
+			assert.True(t, errors.Is(err, fs.ErrNotExist), name)
+		}
+		got, err := readFile(mfs, "/Files/Uploads/Docs/ok.txt")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("ok"), got)
+		assert.Equal(t, 2, sender.skipped)
+		assert.Equal(t, 1, s.Stats.UploadCounter)
+	})
+
+	t.Run("folder uploads keep the incomplete file when the transfer fails", func(t *testing.T) {
+		mfs := NewMemFileStore()
+		_ = mfs.MkdirAll("/Files/Uploads", 0777)
+
+		s := newTransferTestServer(mfs, &FileTransfer{
+			Type:            FolderUpload,
+			FileName:        []byte("Docs"),
+			FilePath:        EncodeFilePath("Uploads"),
+			FolderItemCount: []byte{0, 1},
+		})
+
+		client, server := net.Pipe()
+		errs := make(chan error, 1)
+		go func() { errs <- s.handleFileTransfer(server) }()
+
+		_, _ = client.Write(htxf())
+		_, _, _ = readFolderAction(client)
+		_, _ = client.Write(folderItem{Path: "a.txt"}.header())
+		action, _, _ := readFolderAction(client)
+		assert.Equal(t, dlFldrActionSendFile, action)
+
+		file := flatFile("a.txt", []byte("aaaaa"))
+		_, _ = client.Write(append([]byte{0, 0, 0, byte(len(file))}, file[:len(file)-2]...))
+		_ = client.Close()
+
+		assert.Error(t, <-errs)
+		got, err := readFile(mfs, "/Files/Uploads/Docs/a.txt"+incompleteFileSuffix)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("aaa"), got)
+		assert.Equal(t, 0, s.Stats.UploadCounter)
+	})
+
+	t.Run("folder uploads reject items outside of the folder", func(t *testing.T) {
+		mfs := NewMemFileStore()
+		_ = mfs.MkdirAll("/Files/Uploads", 0777)
+
+		s := newTransferTestServer(mfs, &FileTransfer{
+			Type:            FolderUpload,
+			FileName:        []byte("Docs"),
+			FilePath:        EncodeFilePath("Uploads"),
+			FolderItemCount: []byte{0, 1},
+		})
+
+		client, server := net.Pipe()
+		errs := make(chan error, 1)
+		go func() { errs <- s.handleFileTransfer(server) }()
+
+		_, _ = client.Write(htxf())
+		_, _, _ = readFolderAction(client)
+		_, _ = client.Write(folderItem{Path: "../../etc"}.header())
+
+		assert.ErrorIs(t, <-errs, errInvalidPath)
+		_ = client.Close()
+	})
+}
@@ -0,0 +1,15 @@
+//go:build linux || darwin
+
+package hotline
+
+import "syscall"
+
+// FreeSpace returns the number of bytes available to unprivileged users on the file system containing name
+func (fs *OSFileStore) FreeSpace(name string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(name, &st); err != nil {
+		return 0, err
+	}
+
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
@@ -0,0 +1,118 @@
+package hotline
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The upload janitor cleans up the incomplete files left behind by interrupted uploads.  Incomplete files that have not
+// been written to for StaleUploadAge hours are removed, or moved to the trash if QuarantineStaleUploads is set.  They
+// are only quarantined when EnableTrash is set as well, since the trash is otherwise never purged.  Files of uploads that are still waiting to start or in progress are kept so that they can be resumed.
+
+const janitorInterval = 3600 // seconds between checks for stale incomplete uploads
+
+// pendingUploads returns the paths of the incomplete files of file uploads that have been requested and not yet
+// completed, and the destination folders of such folder uploads.
+func (s *Server) pendingUploads() (files map[string]bool, folders []string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	files = make(map[string]bool)
+	for _, ft := range s.FileTransfers {
+		switch ft.Type {
+		case FileUpload:
+			if p, err := readPath(s.Config.FileRoot, ft.FilePath, ft.FileName); err == nil {
+				files[p+incompleteFileSuffix] = true
+			}
+		case FolderUpload:
+			if p, err := readPath(s.Config.FileRoot, ft.FilePath, ft.FileName); err == nil {
+				folders = append(folders, p)
+			}
+		}
+	}
+
+	return files, folders
+}
+
+// removeStaleUploads removes or quarantines the stale incomplete uploads in the file area
+func (s *Server) removeStaleUploads() {
+	if s.Config.StaleUploadAge <= 0 {
+		return
+	}
+
+	pendingFiles, pendingFolders := s.pendingUploads()
+	cutoff := s.now().Add(-time.Duration(s.Config.StaleUploadAge) * time.Hour)
+
+	var stale []string
+	fileRoot := path.Join("/", s.Config.FileRoot)
+	err := walk(s.FS, fileRoot, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			if p != fileRoot && (info.Name() == trashFolder || info.Name() == versionsFolder) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() || !strings.HasSuffix(info.Name(), incompleteFileSuffix) {
+			return nil
+		}
+		if !info.ModTime().Before(cutoff) || pendingFiles[p] {
+			return nil
+		}
+		for _, folder := range pendingFolders {
+			if strings.HasPrefix(p, folder+"/") {
+				return nil
+			}
+		}
+
+		stale = append(stale, p)
+		return nil
+	})
+	if err != nil {
+		s.Logger.Errorw("Error looking for stale uploads", "err", err)
+	}
+
+	for _, p := range stale {
+		if s.Config.QuarantineStaleUploads && s.Config.EnableTrash {
+			item, err := s.moveToTrash(p, "(janitor)")
+			if err != nil {
+				s.Logger.Errorw("Error quarantining stale upload", "path", p, "err", err)
+				continue
+			}
+			s.Logger.Infow("Moved stale upload to the trash", "path", p, "id", item.ID)
+		} else {
+			if err := s.FS.Remove(p); err != nil {
+				s.Logger.Errorw("Error removing stale upload", "path", p, "err", err)
+				continue
+			}
+			s.Logger.Infow("Removed stale upload", "path", p)
+		}
+
+		s.mux.Lock()
+		s.Stats.StaleUploadsRemoved += 1
+		s.mux.Unlock()
+	}
+}
+
+// uploadJanitor removes stale incomplete uploads every janitorInterval seconds until ctx is done
+func (s *Server) uploadJanitor(ctx context.Context) {
+	ticker := time.NewTicker(janitorInterval * time.Second)
+	defer ticker.Stop()
+
+	for {
+		s.removeStaleUploads()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package hotline
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io/fs"
+	"testing"
+	"time"
+)
+
+func TestServer_removeStaleUploads(t *testing.T) {
+	now := time.Date(2023, time.March, 10, 12, 0, 0, 0, time.UTC)
+
+	newServer := func() *Server {
+		mfs := NewMemFileStore()
+		_ = mfs.MkdirAll("/Files/Uploads/Album", 0777)
+
+		mfs.Clock = fixedClock{t: now.Add(-72 * time.Hour)}
+		_ = mfs.WriteFile("/Files/Uploads/stale.zip.incomplete", []byte("sta"), 0644)
+		_ = mfs.WriteFile("/Files/Uploads/resuming.zip.incomplete", []byte("res"), 0644)
+		_ = mfs.WriteFile("/Files/Uploads/Album/track.mp3.incomplete", []byte("tra"), 0644)
+		_ = mfs.WriteFile("/Files/Uploads/finished.zip", []byte("finished"), 0644)
+
+		mfs.Clock = fixedClock{t: now.Add(-1 * time.Hour)}
+		_ = mfs.WriteFile("/Files/Uploads/recent.zip.incomplete", []byte("rec"), 0644)
+
+		return &Server{
+			FS:     mfs,
+			Config: &Config{FileRoot: "/Files", StaleUploadAge: 48},
+			Clock:  fixedClock{t: now},
+			Stats:  &Stats{},
+			Logger: NewTestLogger(),
+			FileTransfers: map[uint32]*FileTransfer{
+				1: {Type: FileUpload, FileName: []byte("resuming.zip"), FilePath: EncodeFilePath("Uploads")},
+			},
+		}
+	}
+	exists := func(s *Server, p string) bool {
+		_, err := s.FS.Stat(p)
+		return !errors.Is(err, fs.ErrNotExist)
+	}
+
+	t.Run("stale uploads are removed", func(t *testing.T) {
+		s := newServer()
+		s.removeStaleUploads()
+
+		assert.False(t, exists(s, "/Files/Uploads/stale.zip.incomplete"))
+		assert.False(t, exists(s, "/Files/Uploads/Album/track.mp3.incomplete"))
+		assert.True(t, exists(s, "/Files/Uploads/recent.zip.incomplete"), "recently written uploads can still be resumed")
+		assert.True(t, exists(s, "/Files/Uploads/resuming.zip.incomplete"), "uploads being resumed are kept")
+		assert.True(t, exists(s, "/Files/Uploads/finished.zip"))
+		assert.Equal(t, 2, s.Stats.StaleUploadsRemoved)
+	})
+
+	t.Run("incomplete files in pending folder uploads are kept", func(t *testing.T) {
+		s := newServer()
+		s.FileTransfers[2] = &FileTransfer{Type: FolderUpload, FileName: []byte("Album"), FilePath: EncodeFilePath("Uploads")}
+		s.removeStaleUploads()
+
+		assert.True(t, exists(s, "/Files/Uploads/Album/track.mp3.incomplete"))
+		assert.Equal(t, 1, s.Stats.StaleUploadsRemoved)
+	})
+
+	t.Run("stale uploads can be quarantined in the trash", func(t *testing.T) {
+		s := newServer()
+		s.Config.QuarantineStaleUploads = true
+		s.Config.EnableTrash = true
+		s.removeStaleUploads()
+
+		assert.False(t, exists(s, "/Files/Uploads/stale.zip.incomplete"))
+		items, err := s.TrashItems()
+		assert.NoError(t, err)
+		if assert.Len(t, items, 2) {
+			assert.Equal(t, "/Uploads/Album/track.mp3.incomplete", items[0].Path)
+			assert.Equal(t, "(janitor)", items[0].DeletedBy)
+		}
+
+		// Quarantined uploads are not cleaned up again from the trash
+		s.removeStaleUploads()
+		assert.Equal(t, 2, s.Stats.StaleUploadsRemoved)
+	})
+
+	t.Run("stale uploads are removed rather than quarantined when the trash is disabled", func(t *testing.T) {
+		s := newServer()
+		s.Config.QuarantineStaleUploads = true
+		s.removeStaleUploads()
+
+		assert.False(t, exists(s, "/Files/Uploads/stale.zip.incomplete"))
+		assert.False(t, exists(s, s.trashPath()), "nothing is moved into a trash that is never purged")
+		assert.Equal(t, 2, s.Stats.StaleUploadsRemoved)
+	})
+
+	t.Run("the janitor is disabled by default", func(t *testing.T) {
+		s := newServer()
+		s.Config.StaleUploadAge = 0
+		s.removeStaleUploads()
+
+		assert.True(t, exists(s, "/Files/Uploads/stale.zip.incomplete"))
+	})
+}
@@ -0,0 +1,565 @@
+package hotline
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxSymlinkHops = 40 // maximum number of symlinks followed when resolving a path
+
+// MemFileStore is a FileStore that keeps the file tree in memory.  It supports directories, files, symlinks and
+// modification times, so handlers and file transfers can be exercised without touching the disk.  It is also useful
+// for throwaway servers that should not persist anything.
+//
+// Paths are cleaned with path.Clean and the root directory "/" always exists.  Relative paths are resolved against
+// the root.
+type MemFileStore struct {
+	Clock Clock // source of modification times; defaults to the system clock
+
+	mux   sync.RWMutex
+	nodes map[string]*memNode
+}
+
+type memNode struct {
+	mode    fs.FileMode
+	data    []byte
+	target  string // symlink target
+	modTime time.Time
+}
+
+// NewMemFileStore returns an empty MemFileStore containing only the root directory
+func NewMemFileStore() *MemFileStore {
+	mfs := &MemFileStore{}
+	mfs.init()
+	return mfs
+}
+
+func (mfs *MemFileStore) init() {
+	if mfs.nodes == nil {
+		mfs.nodes = map[string]*memNode{
+			"/": {mode: fs.ModeDir | 0777, modTime: mfs.now()},
+		}
+	}
+}
+
+func (mfs *MemFileStore) now() time.Time {
+	if mfs.Clock != nil {
+		return mfs.Clock.Now()
+	}
+	return time.Now()
+}
+
+// cleanPath returns the canonical key for name
+func cleanPath(name string) string {
+	return path.Clean("/" + name)
+}
+
+// resolve returns the canonical path of name with all symlinks in its directory components resolved.  If followLast
+// is true a symlink in the final component is also resolved.
+func (mfs *MemFileStore) resolve(name string, followLast bool) (string, error) {
+	p := cleanPath(name)
+
+	for hops := 0; hops <= maxSymlinkHops; hops++ {
+		resolved, target, rest, err := mfs.resolveOnce(p, followLast)
+		if err != nil || target == "" {
+			return resolved, err
+		}
+		p = cleanPath(path.Join(append([]string{target}, rest...)...))
+	}
+
+	return "", errors.New("too many levels of symbolic links")
+}
+
+// resolveOnce walks the components of the clean path p until it reaches the first symlink that must be followed.
+// It returns the symlink's absolute target along with the remaining path components, or the resolved path if no
+// symlink was found.
+func (mfs *MemFileStore) resolveOnce(p string, followLast bool) (resolved, target string, rest []string, err error) {
+	parts := strings.Split(strings.TrimPrefix(p, "/"), "/")
+	resolved = "/"
+	for i, part := range parts {
+		if part == "" {
+			continue
+		}
+		last := i == len(parts)-1
+		next := path.Join(resolved, part)
+
+		node, ok := mfs.nodes[next]
+		if !ok {
+			if !last {
+				return "", "", nil, fs.ErrNotExist
+			}
+			return next, "", nil, nil
+		}
+
+		if node.mode&fs.ModeSymlink != 0 && (!last || followLast) {
+			target = node.target
+			if !path.IsAbs(target) {
+				target = path.Join(resolved, target)
+			}
+			return "", target, parts[i+1:], nil
+		}
+
+		if !last && !node.mode.IsDir() {
+			return "", "", nil, fs.ErrNotExist
+		}
+		resolved = next
+	}
+
+	return resolved, "", nil, nil
+}
+
+// lookup resolves name and returns its canonical path and node
+func (mfs *MemFileStore) lookup(op, name string, followLast bool) (string, *memNode, error) {
+	p, err := mfs.resolve(name, followLast)
+	if err != nil {
+		return "", nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	node, ok := mfs.nodes[p]
+	if !ok {
+		return p, nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return p, node, nil
+}
+
+// parentDir returns an error unless the parent of the resolved path p is an existing directory
+func (mfs *MemFileStore) parentDir(op, name, p string) error {
+	parent, ok := mfs.nodes[path.Dir(p)]
+	if !ok {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	if !parent.mode.IsDir() {
+		return &fs.PathError{Op: op, Path: name, Err: errors.New("not a directory")}
+	}
+	return nil
+}
+
+// children returns the canonical paths of the direct children of dir
+func (mfs *MemFileStore) children(dir string) []string {
+	prefix := dir + "/"
+	if dir == "/" {
+		prefix = "/"
+	}
+
+	var names []string
+	for p := range mfs.nodes {
+		if p != "/" && strings.HasPrefix(p, prefix) && !strings.Contains(p[len(prefix):], "/") {
+			names = append(names, p)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (mfs *MemFileStore) Mkdir(name string, perm os.FileMode) error {
+	mfs.mux.Lock()
+	defer mfs.mux.Unlock()
+	mfs.init()
+
+	p, err := mfs.resolve(name, false)
+	if err != nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+	if _, ok := mfs.nodes[p]; ok {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+	}
+	if err := mfs.parentDir("mkdir", name, p); err != nil {
+		return err
+	}
+
+	mfs.nodes[p] = &memNode{mode: fs.ModeDir | perm.Perm(), modTime: mfs.now()}
+	return nil
+}
+
+// MkdirAll creates a directory named path along with any necessary parents
+func (mfs *MemFileStore) MkdirAll(name string, perm os.FileMode) error {
+	p := cleanPath(name)
+	if p == "/" {
+		return nil
+	}
+	if err := mfs.MkdirAll(path.Dir(p), perm); err != nil {
+		return err
+	}
+
+	err := mfs.Mkdir(p, perm)
+	if errors.Is(err, fs.ErrExist) {
+		if info, statErr := mfs.Stat(p); statErr == nil && info.IsDir() {
+			return nil
+		}
+	}
+	return err
+}
+
+func (mfs *MemFileStore) Stat(name string) (os.FileInfo, error) {
+	mfs.mux.RLock()
+	defer mfs.mux.RUnlock()
+
+	if mfs.nodes == nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	p, node, err := mfs.lookup("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return node.info(path.Base(p)), nil
+}
+
+func (mfs *MemFileStore) Lstat(name string) (os.FileInfo, error) {
+	mfs.mux.RLock()
+	defer mfs.mux.RUnlock()
+
+	if mfs.nodes == nil {
+		return nil, &fs.PathError{Op: "lstat", Path: name, Err: fs.ErrNotExist}
+	}
+	p, node, err := mfs.lookup("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return node.info(path.Base(p)), nil
+}
+
+func (mfs *MemFileStore) Open(name string) (File, error) {
+	return mfs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (mfs *MemFileStore) Create(name string) (File, error) {
+	return mfs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (mfs *MemFileStore) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	mfs.mux.Lock()
+	defer mfs.mux.Unlock()
+	mfs.init()
+
+	p, err := mfs.resolve(name, true)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	node, ok := mfs.nodes[p]
+	switch {
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	case !ok:
+		if err := mfs.parentDir("open", name, p); err != nil {
+			return nil, err
+		}
+		node = &memNode{mode: perm.Perm(), modTime: mfs.now()}
+		mfs.nodes[p] = node
+	}
+
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	if node.mode.IsDir() && writable {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+	}
+	if flag&os.O_TRUNC != 0 && writable {
+		node.data = nil
+		node.modTime = mfs.now()
+	}
+
+	return &memFile{
+		store:    mfs,
+		node:     node,
+		name:     path.Base(p),
+		path:     name,
+		readable: flag&os.O_WRONLY == 0,
+		writable: writable,
+		append:   flag&os.O_APPEND != 0,
+	}, nil
+}
+
+func (mfs *MemFileStore) ReadDir(name string) ([]os.FileInfo, error) {
+	mfs.mux.RLock()
+	defer mfs.mux.RUnlock()
+
+	if mfs.nodes == nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	p, node, err := mfs.lookup("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if !node.mode.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+
+	var infos []os.FileInfo
+	for _, child := range mfs.children(p) {
+		infos = append(infos, mfs.nodes[child].info(path.Base(child)))
+	}
+	return infos, nil
+}
+
+func (mfs *MemFileStore) Readlink(name string) (string, error) {
+	mfs.mux.RLock()
+	defer mfs.mux.RUnlock()
+
+	if mfs.nodes == nil {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrNotExist}
+	}
+	_, node, err := mfs.lookup("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if node.mode&fs.ModeSymlink == 0 {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: errors.New("invalid argument")}
+	}
+	return node.target, nil
+}
+
+func (mfs *MemFileStore) Symlink(oldname, newname string) error {
+	mfs.mux.Lock()
+	defer mfs.mux.Unlock()
+	mfs.init()
+
+	p, err := mfs.resolve(newname, false)
+	if err != nil {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: err}
+	}
+	if _, ok := mfs.nodes[p]; ok {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: fs.ErrExist}
+	}
+	if err := mfs.parentDir("symlink", newname, p); err != nil {
+		return err
+	}
+
+	mfs.nodes[p] = &memNode{mode: fs.ModeSymlink | 0777, target: oldname, modTime: mfs.now()}
+	return nil
+}
+
+func (mfs *MemFileStore) Rename(oldpath, newpath string) error {
+	mfs.mux.Lock()
+	defer mfs.mux.Unlock()
+	mfs.init()
+
+	src, node, err := mfs.lookup("rename", oldpath, false)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrNotExist}
+	}
+	dst, err := mfs.resolve(newpath, false)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+	}
+	if src == dst {
+		return nil
+	}
+	if src == "/" || strings.HasPrefix(dst, src+"/") {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: errors.New("invalid argument")}
+	}
+	if err := mfs.parentDir("rename", newpath, dst); err != nil {
+		return err
+	}
+	if existing, ok := mfs.nodes[dst]; ok {
+		if existing.mode.IsDir() && (!node.mode.IsDir() || len(mfs.children(dst)) > 0) {
+			return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrExist}
+		}
+		if !existing.mode.IsDir() && node.mode.IsDir() {
+			return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: errors.New("not a directory")}
+		}
+	}
+
+	moved := map[string]*memNode{dst: node}
+	for p, n := range mfs.nodes {
+		if strings.HasPrefix(p, src+"/") {
+			moved[dst+p[len(src):]] = n
+			delete(mfs.nodes, p)
+		}
+	}
+	delete(mfs.nodes, src)
+	for p, n := range moved {
+		mfs.nodes[p] = n
+	}
+
+	return nil
+}
+
+func (mfs *MemFileStore) Remove(name string) error {
+	mfs.mux.Lock()
+	defer mfs.mux.Unlock()
+	mfs.init()
+
+	p, node, err := mfs.lookup("remove", name, false)
+	if err != nil {
+		return err
+	}
+	if node.mode.IsDir() && len(mfs.children(p)) > 0 {
+		return &fs.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+	}
+	if p == "/" {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrPermission}
+	}
+
+	delete(mfs.nodes, p)
+	return nil
+}
+
+func (mfs *MemFileStore) RemoveAll(name string) error {
+	mfs.mux.Lock()
+	defer mfs.mux.Unlock()
+	mfs.init()
+
+	p, err := mfs.resolve(name, false)
+	if err != nil {
+		// Like os.RemoveAll, a path that does not exist is not an error
+		return nil
+	}
+	if p == "/" {
+		return &fs.PathError{Op: "removeall", Path: name, Err: fs.ErrPermission}
+	}
+
+	for child := range mfs.nodes {
+		if strings.HasPrefix(child, p+"/") {
+			delete(mfs.nodes, child)
+		}
+	}
+	delete(mfs.nodes, p)
+
+	return nil
+}
+
+func (mfs *MemFileStore) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	f, err := mfs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
+
+func (n *memNode) info(name string) os.FileInfo {
+	return &memFileInfo{name: name, size: int64(len(n.data)), mode: n.mode, modTime: n.modTime}
+}
+
+// memFileInfo implements os.FileInfo for MemFileStore entries
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (fi *memFileInfo) Name() string       { return fi.name }
+func (fi *memFileInfo) Size() int64        { return fi.size }
+func (fi *memFileInfo) Mode() fs.FileMode  { return fi.mode }
+func (fi *memFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *memFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *memFileInfo) Sys() interface{}   { return nil }
+
+// memFile is an open handle to a MemFileStore file.  Writes are visible to other handles immediately.
+type memFile struct {
+	store    *MemFileStore
+	node     *memNode
+	name     string
+	path     string
+	offset   int64
+	readable bool
+	writable bool
+	append   bool
+	closed   bool
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, &fs.PathError{Op: "read", Path: f.path, Err: fs.ErrClosed}
+	}
+	if !f.readable || f.node.mode.IsDir() {
+		return 0, &fs.PathError{Op: "read", Path: f.path, Err: errors.New("bad file descriptor")}
+	}
+	if off < 0 {
+		return 0, &fs.PathError{Op: "read", Path: f.path, Err: errors.New("negative offset")}
+	}
+
+	f.store.mux.RLock()
+	defer f.store.mux.RUnlock()
+
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if f.closed {
+		return 0, &fs.PathError{Op: "write", Path: f.path, Err: fs.ErrClosed}
+	}
+	if !f.writable {
+		return 0, &fs.PathError{Op: "write", Path: f.path, Err: errors.New("bad file descriptor")}
+	}
+
+	f.store.mux.Lock()
+	defer f.store.mux.Unlock()
+
+	if f.append {
+		f.offset = int64(len(f.node.data))
+	}
+	end := f.offset + int64(len(p))
+	if end > int64(len(f.node.data)) {
+		// append grows the capacity geometrically, so a file written in many small pieces is not copied on every write
+		f.node.data = append(f.node.data, make([]byte, end-int64(len(f.node.data)))...)
+	}
+	copy(f.node.data[f.offset:], p)
+	f.offset = end
+	f.node.modTime = f.store.now()
+
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.store.mux.RLock()
+	size := int64(len(f.node.data))
+	f.store.mux.RUnlock()
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += size
+	default:
+		return 0, &fs.PathError{Op: "seek", Path: f.path, Err: errors.New("invalid whence")}
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.path, Err: errors.New("negative offset")}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memFile) Close() error {
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.path, Err: fs.ErrClosed}
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.store.mux.RLock()
+	defer f.store.mux.RUnlock()
+
+	return f.node.info(f.name), nil
+}
@@ -0,0 +1,184 @@
+package hotline
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMemFileStore(t *testing.T) {
+	t.Parallel()
+
+	modTime := time.Date(1996, time.May, 1, 0, 0, 0, 0, time.UTC)
+	newStore := func() *MemFileStore {
+		mfs := &MemFileStore{Clock: fixedClock{t: modTime}}
+		_ = mfs.MkdirAll("/Files/Uploads", 0777)
+		_ = mfs.WriteFile("/Files/readme.txt", []byte("hello"), 0644)
+		return mfs
+	}
+
+	t.Run("stats files and directories", func(t *testing.T) {
+		mfs := newStore()
+
+		info, err := mfs.Stat("/Files/readme.txt")
+		assert.NoError(t, err)
+		assert.Equal(t, "readme.txt", info.Name())
+		assert.Equal(t, int64(5), info.Size())
+		assert.Equal(t, modTime, info.ModTime())
+		assert.False(t, info.IsDir())
+
+		info, err = mfs.Stat("Files/Uploads/")
+		assert.NoError(t, err)
+		assert.True(t, info.IsDir())
+
+		_, err = mfs.Stat("/Files/missing.txt")
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("reads, writes, appends and seeks", func(t *testing.T) {
+		mfs := newStore()
+
+		f, err := mfs.OpenFile("/Files/readme.txt", os.O_APPEND|os.O_WRONLY, 0644)
+		assert.NoError(t, err)
+		_, err = f.Write([]byte(" world"))
+		assert.NoError(t, err)
+		_, err = f.Read(make([]byte, 1))
+		assert.Error(t, err, "write-only handles are not readable")
+		assert.NoError(t, f.Close())
+
+		f, err = mfs.Open("/Files/readme.txt")
+		assert.NoError(t, err)
+		data, err := io.ReadAll(f)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello world", string(data))
+
+		buf := make([]byte, 5)
+		n, err := f.ReadAt(buf, 6)
+		assert.NoError(t, err)
+		assert.Equal(t, "world", string(buf[:n]))
+
+		_, err = f.Seek(-5, io.SeekEnd)
+		assert.NoError(t, err)
+		data, _ = io.ReadAll(f)
+		assert.Equal(t, "world", string(data))
+
+		_, err = f.Write([]byte("x"))
+		assert.Error(t, err, "read-only handles are not writable")
+	})
+
+	t.Run("fills the gap when writing past the end", func(t *testing.T) {
+		mfs := newStore()
+
+		f, err := mfs.OpenFile("/Files/readme.txt", os.O_WRONLY, 0644)
+		assert.NoError(t, err)
+		_, err = f.Seek(7, io.SeekStart)
+		assert.NoError(t, err)
+		_, err = f.Write([]byte("!"))
+		assert.NoError(t, err)
+		assert.NoError(t, f.Close())
+
+		data, err := readFile(mfs, "/Files/readme.txt")
+		assert.NoError(t, err)
+		assert.Equal(t, "hello\x00\x00!", string(data))
+	})
+
+	t.Run("create requires an existing parent directory", func(t *testing.T) {
+		mfs := newStore()
+
+		_, err := mfs.Create("/Files/missing/file.txt")
+		assert.True(t, os.IsNotExist(err))
+
+		f, err := mfs.Create("/Files/Uploads/new.txt")
+		assert.NoError(t, err)
+		assert.NoError(t, f.Close())
+	})
+
+	t.Run("lists directory entries sorted by name", func(t *testing.T) {
+		mfs := newStore()
+		_ = mfs.WriteFile("/Files/a.txt", []byte("a"), 0644)
+
+		entries, err := mfs.ReadDir("/Files")
+		assert.NoError(t, err)
+
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		assert.Equal(t, []string{"Uploads", "a.txt", "readme.txt"}, names)
+	})
+
+	t.Run("follows symlinks", func(t *testing.T) {
+		mfs := newStore()
+
+		assert.NoError(t, mfs.Symlink("/Files/readme.txt", "/Files/Uploads/alias"))
+		assert.NoError(t, mfs.Symlink("Uploads", "/Files/up"))
+
+		target, err := mfs.Readlink("/Files/Uploads/alias")
+		assert.NoError(t, err)
+		assert.Equal(t, "/Files/readme.txt", target)
+
+		info, err := mfs.Lstat("/Files/Uploads/alias")
+		assert.NoError(t, err)
+		assert.Equal(t, os.ModeSymlink, info.Mode()&os.ModeSymlink)
+
+		info, err = mfs.Stat("/Files/up/alias")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(5), info.Size())
+
+		assert.NoError(t, mfs.Symlink("/Files/loop", "/Files/loop"))
+		_, err = mfs.Stat("/Files/loop")
+		assert.Error(t, err)
+	})
+
+	t.Run("renames directories with their contents", func(t *testing.T) {
+		mfs := newStore()
+		_ = mfs.WriteFile("/Files/Uploads/a.txt", []byte("a"), 0644)
+
+		assert.NoError(t, mfs.Rename("/Files/Uploads", "/Files/Dropbox"))
+
+		_, err := mfs.Stat("/Files/Uploads/a.txt")
+		assert.True(t, os.IsNotExist(err))
+		_, err = mfs.Stat("/Files/Dropbox/a.txt")
+		assert.NoError(t, err)
+
+		err = mfs.Rename("/Files/missing", "/Files/other")
+		assert.True(t, os.IsNotExist(err))
+
+		assert.Error(t, mfs.Rename("/Files", "/Files/Dropbox/Files"))
+	})
+
+	t.Run("removes files and directories", func(t *testing.T) {
+		mfs := newStore()
+		_ = mfs.WriteFile("/Files/Uploads/a.txt", []byte("a"), 0644)
+
+		assert.Error(t, mfs.Remove("/Files/Uploads"), "directory is not empty")
+		assert.NoError(t, mfs.Remove("/Files/Uploads/a.txt"))
+		assert.NoError(t, mfs.Remove("/Files/Uploads"))
+
+		assert.NoError(t, mfs.RemoveAll("/Files"))
+		assert.NoError(t, mfs.RemoveAll("/Files"))
+		_, err := mfs.Stat("/Files/readme.txt")
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("mkdir fails when the directory exists", func(t *testing.T) {
+		mfs := newStore()
+
+		assert.True(t, os.IsExist(mfs.Mkdir("/Files", 0777)))
+		assert.True(t, os.IsNotExist(mfs.Mkdir("/missing/dir", 0777)))
+	})
+}
+
+func BenchmarkMemFile_Write(b *testing.B) {
+	chunk := make([]byte, 4096)
+	for i := 0; i < b.N; i++ {
+		mfs := NewMemFileStore()
+		f, _ := mfs.Create("/large")
+		for j := 0; j < 4096; j++ {
+			_, _ = f.Write(chunk)
+		}
+		_ = f.Close()
+	}
+}
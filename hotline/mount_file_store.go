@@ -0,0 +1,393 @@
+package hotline
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Mount maps a top-level folder of the file area to a directory elsewhere, so that files kept on several disks can be
+// served as a single file tree.
+type Mount struct {
+	Name       string `yaml:"Name" validate:"required"` // Name of the top-level folder the mount appears as
+	Path       string `yaml:"Path" validate:"required"` // Directory, or file store URL (see newFileStore), that is mounted
+	ReadOnly   bool   `yaml:"ReadOnly"`                 // Refuse uploads, new folders, deletes, renames and moves in the mount
+	Hidden     bool   `yaml:"Hidden"`                   // Leave the mount out of the top-level listing; it can still be reached by path
+	UploadOnly bool   `yaml:"UploadOnly"`               // Treat the mount as a drop box: anyone who can upload can, but only users with View Drop Boxes see its contents
+}
+
+var (
+	errReadOnlyMount = errors.New("mount is read-only")
+	errMountPoint    = errors.New("mount points cannot be removed or renamed")
+)
+
+type mountPoint struct {
+	Mount
+	fileStore FileStore
+	dir       string // root of the mount within fileStore
+}
+
+// MountFileStore is a FileStore that presents the file area in base at fileRoot with other FileStores mounted as
+// top-level folders.  Paths passed to a MountFileStore are paths in the combined file tree, and are translated to the
+// store and directory of the mount they fall in.  Symlinks made through the MountFileStore store translated targets,
+// and Readlink translates them back, so aliases work across mounts.  Files and folders moved between mounts are
+// copied and then deleted, as they cannot simply be renamed.
+type MountFileStore struct {
+	base     FileStore
+	fileRoot string
+	mounts   []*mountPoint
+}
+
+// NewMountFileStore returns a MountFileStore serving base at fileRoot, without any mounts
+func NewMountFileStore(base FileStore, fileRoot string) *MountFileStore {
+	return &MountFileStore{base: base, fileRoot: path.Join("/", fileRoot)}
+}
+
+// Mount mounts the directory dir of fileStore as the top-level folder mount.Name
+func (m *MountFileStore) Mount(mount Mount, fileStore FileStore, dir string) error {
+	if mount.Name == "" || checkPathItem([]byte(mount.Name)) != nil {
+		return fmt.Errorf("invalid mount name %q", mount.Name)
+	}
+	for _, mp := range m.mounts {
+		if mp.Name == mount.Name {
+			return fmt.Errorf("duplicate mount name %q", mount.Name)
+		}
+	}
+
+	m.mounts = append(m.mounts, &mountPoint{Mount: mount, fileStore: fileStore, dir: path.Clean(dir)})
+
+	return nil
+}
+
+// mountOf returns the mount that name falls in and the part of name below the mount point, or nil for names outside
+// of the mounts.
+func (m *MountFileStore) mountOf(name string) (*mountPoint, string) {
+	name = path.Join("/", name)
+	for _, mp := range m.mounts {
+		mountPath := path.Join(m.fileRoot, mp.Name)
+		if name == mountPath {
+			return mp, ""
+		}
+		if strings.HasPrefix(name, mountPath+"/") {
+			return mp, strings.TrimPrefix(name, mountPath)
+		}
+	}
+
+	return nil, name
+}
+
+// resolve returns the FileStore and the path within it for name
+func (m *MountFileStore) resolve(name string) (FileStore, string, *mountPoint) {
+	mp, rest := m.mountOf(name)
+	if mp == nil {
+		return m.base, name, nil
+	}
+
+	return mp.fileStore, path.Join(mp.dir, rest), mp
+}
+
+// resolveWrite is resolve for operations that modify name.  It returns errReadOnlyMount for names in read-only mounts.
+func (m *MountFileStore) resolveWrite(op, name string) (FileStore, string, error) {
+	fileStore, p, mp := m.resolve(name)
+	if mp != nil && mp.ReadOnly {
+		return nil, "", &fs.PathError{Op: op, Path: name, Err: errReadOnlyMount}
+	}
+
+	return fileStore, p, nil
+}
+
+// isMountPoint reports whether name is the top-level folder of a mount
+func (m *MountFileStore) isMountPoint(name string) bool {
+	mp, rest := m.mountOf(name)
+	return mp != nil && rest == ""
+}
+
+// virtualPath translates target, a path in fileStore, back to a path in the combined file tree
+func (m *MountFileStore) virtualPath(fileStore FileStore, target string) string {
+	for _, mp := range m.mounts {
+		if !sameFileStore(mp.fileStore, fileStore) {
+			continue
+		}
+		if target == mp.dir || strings.HasPrefix(target, mp.dir+"/") {
+			return path.Join(m.fileRoot, mp.Name, strings.TrimPrefix(target, mp.dir))
+		}
+	}
+
+	return target
+}
+
+// sameFileStore reports whether a and b can rename and link files between each other
+func sameFileStore(a, b FileStore) bool {
+	_, aOS := a.(*OSFileStore)
+	_, bOS := b.(*OSFileStore)
+
+	return a == b || aOS && bOS
+}
+
+// mountInfo is the FileInfo of a mount directory, named after the mount
+type mountInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (mi mountInfo) Name() string { return mi.name }
+
+func (m *MountFileStore) Mkdir(name string, perm os.FileMode) error {
+	fileStore, p, err := m.resolveWrite("mkdir", name)
+	if err != nil {
+		return err
+	}
+
+	return fileStore.Mkdir(p, perm)
+}
+
+func (m *MountFileStore) Stat(name string) (os.FileInfo, error) {
+	fileStore, p, mp := m.resolve(name)
+	fi, err := fileStore.Stat(p)
+	if err != nil || mp == nil || !m.isMountPoint(name) {
+		return fi, err
+	}
+
+	return mountInfo{FileInfo: fi, name: mp.Name}, nil
+}
+
+func (m *MountFileStore) Lstat(name string) (os.FileInfo, error) {
+	// Mount points are always folders, even if the mounted directory is reached through a symlink
+	if m.isMountPoint(name) {
+		return m.Stat(name)
+	}
+
+	fileStore, p, _ := m.resolve(name)
+	return fileStore.Lstat(p)
+}
+
+func (m *MountFileStore) Open(name string) (File, error) {
+	fileStore, p, _ := m.resolve(name)
+	return fileStore.Open(p)
+}
+
+func (m *MountFileStore) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_APPEND|os.O_TRUNC) == 0 {
+		return m.Open(name)
+	}
+
+	fileStore, p, err := m.resolveWrite("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	return fileStore.OpenFile(p, flag, perm)
+}
+
+func (m *MountFileStore) Create(name string) (File, error) {
+	fileStore, p, err := m.resolveWrite("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	return fileStore.Create(p)
+}
+
+// FreeSpace returns the free space of the FileStore that name is stored in
+func (m *MountFileStore) FreeSpace(name string) (uint64, error) {
+	fileStore, p, _ := m.resolve(name)
+	return freeSpace(fileStore, p)
+}
+
+// ReadDir returns the entries of the folder name.  The file root lists the mounts that are not hidden in place of any
+// file or folder of the same name.
+func (m *MountFileStore) ReadDir(name string) ([]os.FileInfo, error) {
+	fileStore, p, _ := m.resolve(name)
+	entries, err := fileStore.ReadDir(p)
+	if err != nil || path.Join("/", name) != m.fileRoot {
+		return entries, err
+	}
+
+	mounted := make(map[string]bool)
+	for _, mp := range m.mounts {
+		mounted[mp.Name] = true
+	}
+
+	var infos []os.FileInfo
+	for _, entry := range entries {
+		if !mounted[entry.Name()] {
+			infos = append(infos, entry)
+		}
+	}
+	for _, mp := range m.mounts {
+		if mp.Hidden {
+			continue
+		}
+		fi, err := mp.fileStore.Stat(mp.dir)
+		if err != nil {
+			continue
+		}
+		infos = append(infos, mountInfo{FileInfo: fi, name: mp.Name})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+
+	return infos, nil
+}
+
+func (m *MountFileStore) Readlink(name string) (string, error) {
+	fileStore, p, _ := m.resolve(name)
+	target, err := fileStore.Readlink(p)
+	if err != nil || !path.IsAbs(target) {
+		return target, err
+	}
+
+	return m.virtualPath(fileStore, target), nil
+}
+
+// Symlink makes newname a symlink to oldname.  Absolute targets are translated to the store of the mount they fall in,
+// which must be able to link to the store of newname.
+func (m *MountFileStore) Symlink(oldname, newname string) error {
+	fileStore, p, err := m.resolveWrite("symlink", newname)
+	if err != nil {
+		return err
+	}
+
+	target := oldname
+	if path.IsAbs(oldname) {
+		var targetStore FileStore
+		targetStore, target, _ = m.resolve(oldname)
+		if !sameFileStore(targetStore, fileStore) {
+			return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: errors.New("cannot link across file stores")}
+		}
+	}
+
+	return fileStore.Symlink(target, p)
+}
+
+// Rename renames oldpath to newpath.  Files and folders moved to another mount are copied and then removed.
+func (m *MountFileStore) Rename(oldpath, newpath string) error {
+	if m.isMountPoint(oldpath) || m.isMountPoint(newpath) {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: errMountPoint}
+	}
+
+	oldStore, oldp, err := m.resolveWrite("rename", oldpath)
+	if err != nil {
+		return err
+	}
+	newStore, newp, err := m.resolveWrite("rename", newpath)
+	if err != nil {
+		return err
+	}
+	oldMount, _ := m.mountOf(oldpath)
+	newMount, _ := m.mountOf(newpath)
+	if oldMount == newMount {
+		return oldStore.Rename(oldp, newp)
+	}
+
+	if _, err := newStore.Lstat(newp); err == nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrExist}
+	}
+	if err := m.copyAll(oldpath, newpath); err != nil {
+		_ = m.RemoveAll(newpath)
+		return err
+	}
+
+	return m.RemoveAll(oldpath)
+}
+
+// copyAll copies the file, folder or symlink at src and everything in it to dst
+func (m *MountFileStore) copyAll(src, dst string) error {
+	return walk(m, src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		target := path.Join(dst, strings.TrimPrefix(p, src))
+		switch {
+		case info.IsDir():
+			return m.Mkdir(target, info.Mode().Perm())
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := m.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return m.Symlink(link, target)
+		default:
+			return m.copyFile(p, target, info.Mode().Perm())
+		}
+	})
+}
+
+func (m *MountFileStore) copyFile(src, dst string, perm os.FileMode) error {
+	in, err := m.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = in.Close() }()
+
+	out, err := m.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+func (m *MountFileStore) Remove(name string) error {
+	if m.isMountPoint(name) {
+		return &fs.PathError{Op: "remove", Path: name, Err: errMountPoint}
+	}
+
+	fileStore, p, err := m.resolveWrite("remove", name)
+	if err != nil {
+		return err
+	}
+
+	return fileStore.Remove(p)
+}
+
+func (m *MountFileStore) RemoveAll(name string) error {
+	if m.isMountPoint(name) {
+		return &fs.PathError{Op: "removeall", Path: name, Err: errMountPoint}
+	}
+
+	fileStore, p, err := m.resolveWrite("removeall", name)
+	if err != nil {
+		return err
+	}
+
+	return fileStore.RemoveAll(p)
+}
+
+func (m *MountFileStore) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	fileStore, p, err := m.resolveWrite("open", name)
+	if err != nil {
+		return err
+	}
+
+	return fileStore.WriteFile(p, data, perm)
+}
+
+// mountAt returns the options of the mount that filePath falls in, or nil if filePath is not in a mount
+func mountAt(fileStore FileStore, filePath string) *Mount {
+	m, ok := fileStore.(*MountFileStore)
+	if !ok {
+		return nil
+	}
+	mp, _ := m.mountOf(filePath)
+	if mp == nil {
+		return nil
+	}
+
+	return &mp.Mount
+}
+
+// isMountPoint reports whether filePath is the top-level folder of a mount
+func isMountPoint(fileStore FileStore, filePath string) bool {
+	m, ok := fileStore.(*MountFileStore)
+	return ok && m.isMountPoint(filePath)
+}
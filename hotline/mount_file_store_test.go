@@ -0,0 +1,234 @@
+package hotline
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io/fs"
+	"testing"
+)
+
+// newMountTestFS returns a MountFileStore with three mounts on a shared in-memory store, and a fourth on a store of its
+// own, so that links can be made between the first three but not to the fourth.
+func newMountTestFS() (*MountFileStore, *MemFileStore, *MemFileStore) {
+	disks := NewMemFileStore()
+	_ = disks.MkdirAll("/Files/Local", 0777)
+	_ = disks.MkdirAll("/Disk1/Music/Albums", 0777)
+	_ = disks.MkdirAll("/Disk2/Archive", 0777)
+	_ = disks.MkdirAll("/Disk3/Private", 0777)
+	_ = disks.WriteFile("/Files/readme.txt", []byte("hello"), 0644)
+	_ = disks.WriteFile("/Disk1/Music/song.mp3", []byte("la la la"), 0644)
+	_ = disks.WriteFile("/Disk1/Music/Albums/track.mp3", []byte("dum dum"), 0644)
+	_ = disks.WriteFile("/Disk2/Archive/old.txt", []byte("old"), 0644)
+
+	other := NewMemFileStore()
+	_ = other.MkdirAll("/Incoming", 0777)
+
+	m := NewMountFileStore(disks, "/Files")
+	_ = m.Mount(Mount{Name: "Music"}, disks, "/Disk1/Music")
+	_ = m.Mount(Mount{Name: "Archive", ReadOnly: true}, disks, "/Disk2/Archive")
+	_ = m.Mount(Mount{Name: "Private", Hidden: true}, disks, "/Disk3/Private")
+	_ = m.Mount(Mount{Name: "Incoming", UploadOnly: true}, other, "/Incoming")
+
+	return m, disks, other
+}
+
+func TestMountFileStore(t *testing.T) {
+	t.Run("mounts are listed in the file root", func(t *testing.T) {
+		m, _, _ := newMountTestFS()
+		entries, err := m.ReadDir("/Files")
+		assert.NoError(t, err)
+
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		assert.Equal(t, []string{"Archive", "Incoming", "Local", "Music", "readme.txt"}, names)
+	})
+
+	t.Run("hidden mounts can be reached by path", func(t *testing.T) {
+		m, _, _ := newMountTestFS()
+		fi, err := m.Stat("/Files/Private")
+		assert.NoError(t, err)
+		assert.True(t, fi.IsDir())
+		assert.Equal(t, "Private", fi.Name())
+	})
+
+	t.Run("paths are translated to the mounted directory", func(t *testing.T) {
+		m, disks, _ := newMountTestFS()
+		b, err := readFile(m, "/Files/Music/Albums/track.mp3")
+		assert.NoError(t, err)
+		assert.Equal(t, "dum dum", string(b))
+
+		assert.NoError(t, m.WriteFile("/Files/Music/new.mp3", []byte("new"), 0644))
+		_, err = disks.Stat("/Disk1/Music/new.mp3")
+		assert.NoError(t, err)
+	})
+
+	t.Run("read-only mounts refuse changes", func(t *testing.T) {
+		m, _, _ := newMountTestFS()
+		assert.ErrorIs(t, m.WriteFile("/Files/Archive/new.txt", []byte("new"), 0644), errReadOnlyMount)
+		assert.ErrorIs(t, m.Remove("/Files/Archive/old.txt"), errReadOnlyMount)
+		assert.ErrorIs(t, m.Rename("/Files/Archive/old.txt", "/Files/old.txt"), errReadOnlyMount)
+		assert.ErrorIs(t, m.Mkdir("/Files/Archive/New", 0777), errReadOnlyMount)
+
+		b, err := readFile(m, "/Files/Archive/old.txt")
+		assert.NoError(t, err)
+		assert.Equal(t, "old", string(b))
+	})
+
+	t.Run("mount points cannot be removed or renamed", func(t *testing.T) {
+		m, _, _ := newMountTestFS()
+		assert.ErrorIs(t, m.RemoveAll("/Files/Music"), errMountPoint)
+		assert.ErrorIs(t, m.Rename("/Files/Music", "/Files/Tunes"), errMountPoint)
+	})
+
+	t.Run("moves within a mount are renames", func(t *testing.T) {
+		m, disks, _ := newMountTestFS()
+		assert.NoError(t, m.Rename("/Files/Music/song.mp3", "/Files/Music/Albums/song.mp3"))
+		_, err := disks.Stat("/Disk1/Music/Albums/song.mp3")
+		assert.NoError(t, err)
+	})
+
+	t.Run("moves across mounts copy and then delete", func(t *testing.T) {
+		m, disks, other := newMountTestFS()
+		assert.NoError(t, m.Rename("/Files/Music/Albums", "/Files/Incoming/Albums"))
+
+		b, err := readFile(other, "/Incoming/Albums/track.mp3")
+		assert.NoError(t, err)
+		assert.Equal(t, "dum dum", string(b))
+		_, err = disks.Stat("/Disk1/Music/Albums")
+		assert.True(t, errors.Is(err, fs.ErrNotExist))
+	})
+
+	t.Run("moves across mounts do not replace existing files", func(t *testing.T) {
+		m, _, _ := newMountTestFS()
+		_ = m.WriteFile("/Files/song.mp3", []byte("other"), 0644)
+		assert.ErrorIs(t, m.Rename("/Files/Music/song.mp3", "/Files/song.mp3"), fs.ErrExist)
+
+		b, err := readFile(m, "/Files/Music/song.mp3")
+		assert.NoError(t, err)
+		assert.Equal(t, "la la la", string(b))
+	})
+
+	t.Run("aliases work across mounts", func(t *testing.T) {
+		m, disks, _ := newMountTestFS()
+		assert.NoError(t, m.Symlink("/Files/Music/song.mp3", "/Files/Local/song alias"))
+
+		target, err := disks.Readlink("/Files/Local/song alias")
+		assert.NoError(t, err)
+		assert.Equal(t, "/Disk1/Music/song.mp3", target)
+
+		target, err = m.Readlink("/Files/Local/song alias")
+		assert.NoError(t, err)
+		assert.Equal(t, "/Files/Music/song.mp3", target)
+		assert.NoError(t, confinePath(m, "/Files", "/Files/Local/song alias"))
+
+		b, err := readFile(m, "/Files/Local/song alias")
+		assert.NoError(t, err)
+		assert.Equal(t, "la la la", string(b))
+	})
+
+	t.Run("links to directories outside of the file root and the mounts escape the root", func(t *testing.T) {
+		m, disks, _ := newMountTestFS()
+		_ = disks.Symlink("/Disk2", "/Files/Local/disk")
+		assert.ErrorIs(t, confinePath(m, "/Files", "/Files/Local/disk/Archive/old.txt"), errPathEscapesRoot)
+	})
+}
+
+func TestMounts(t *testing.T) {
+	newClient := func() *ClientConn {
+		var bits accessBitmap
+		for _, bit := range []int{accessDownloadFile, accessUploadFile, accessUploadAnywhere, accessDeleteFile, accessDeleteFolder, accessRenameFolder, accessMoveFile, accessCreateFolder} {
+			bits.Set(bit)
+		}
+		access := bits[:]
+		m, _, _ := newMountTestFS()
+
+		return &ClientConn{
+			ID:        &[]byte{0, 1},
+			Account:   &Account{Access: &access},
+			Transfers: make(map[int][]*FileTransfer),
+			Server: &Server{
+				FS:            m,
+				FileTransfers: make(map[uint32]*FileTransfer),
+				Config:        &Config{FileRoot: "/Files"},
+				Logger:        NewTestLogger(),
+			},
+		}
+	}
+
+	t.Run("uploads to read-only mounts are refused", func(t *testing.T) {
+		cc := newClient()
+		res, err := HandleUploadFile(cc, NewTransaction(tranUploadFile, &[]byte{0, 1},
+			NewField(fieldFileName, []byte("new.txt")),
+			NewField(fieldFilePath, EncodeFilePath("Archive")),
+		))
+		assert.NoError(t, err)
+		assert.Equal(t, "You are not allowed to upload to this folder.", string(res[0].GetField(fieldError).Data))
+		assert.Empty(t, cc.Server.FileTransfers)
+	})
+
+	t.Run("mount points cannot be deleted", func(t *testing.T) {
+		cc := newClient()
+		res, err := HandleDeleteFile(cc, NewTransaction(tranDeleteFile, &[]byte{0, 1},
+			NewField(fieldFileName, []byte("Music")),
+		))
+		assert.NoError(t, err)
+		assert.Equal(t, "Cannot delete folder Music because it is a mount point.", string(res[0].GetField(fieldError).Data))
+	})
+
+	t.Run("files can be moved across mounts", func(t *testing.T) {
+		cc := newClient()
+		res, err := HandleMoveFile(cc, NewTransaction(tranMoveFile, &[]byte{0, 1},
+			NewField(fieldFileName, []byte("song.mp3")),
+			NewField(fieldFilePath, EncodeFilePath("Music")),
+			NewField(fieldFileNewPath, EncodeFilePath("Local")),
+		))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{0, 0, 0, 0}, res[0].ErrorCode)
+
+		_, err = cc.Server.FS.Stat("/Files/Local/song.mp3")
+		assert.NoError(t, err)
+		_, err = cc.Server.FS.Stat("/Files/Music/song.mp3")
+		assert.True(t, errors.Is(err, fs.ErrNotExist))
+	})
+
+	t.Run("upload-only mounts are drop boxes", func(t *testing.T) {
+		cc := newClient()
+		_ = cc.Server.FS.WriteFile("/Files/Incoming/entry.txt", []byte("entry"), 0644)
+		res, err := HandleGetFileNameList(cc, NewTransaction(tranGetFileNameList, &[]byte{0, 1},
+			NewField(fieldFilePath, EncodeFilePath("Incoming")),
+		))
+		assert.NoError(t, err)
+		assert.Empty(t, res[0].Fields)
+		assert.True(t, cc.Server.inUploadFolder("/Files/Incoming"))
+	})
+}
+
+func TestNew_mounts(t *testing.T) {
+	srv, err := New(WithConfig(&Config{
+		Name:        "Test",
+		Description: "Test server",
+		FileRoot:    "mem://",
+		Mounts:      []Mount{{Name: "Scratch", Path: "mem://"}},
+	}))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.NoError(t, srv.FS.WriteFile("/Scratch/a.txt", []byte("a"), 0644))
+	entries, err := srv.FS.ReadDir("/")
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "Scratch", entries[0].Name())
+		assert.True(t, entries[0].IsDir())
+	}
+
+	_, err = New(WithConfig(&Config{
+		Name:        "Test",
+		Description: "Test server",
+		FileRoot:    "mem://",
+		Mounts:      []Mount{{Name: "a/b", Path: "mem://"}},
+	}))
+	assert.Error(t, err)
+}
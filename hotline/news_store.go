@@ -0,0 +1,106 @@
+package hotline
+
+import (
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FlatNewsStore persists the flat news (message board) shown to v1.2.3 style clients
+type FlatNewsStore interface {
+	Load() ([]byte, error)
+	Save(news []byte) error
+}
+
+// ThreadedNewsStore persists the threaded news categories and articles
+type ThreadedNewsStore interface {
+	Load() (*ThreadedNews, error)
+	Save(news *ThreadedNews) error
+}
+
+// FlatNewsFile stores the flat news as a plain text file
+type FlatNewsFile struct {
+	Path string
+	FS   FileStore
+}
+
+func (f *FlatNewsFile) Load() ([]byte, error) {
+	return readFile(f.FS, f.Path)
+}
+
+func (f *FlatNewsFile) Save(news []byte) error {
+	return f.FS.WriteFile(f.Path, news, 0644)
+}
+
+// ThreadedNewsFile stores the threaded news as a YAML file
+type ThreadedNewsFile struct {
+	Path string
+	FS   FileStore
+}
+
+func (f *ThreadedNewsFile) Load() (*ThreadedNews, error) {
+	fh, err := f.FS.Open(f.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = fh.Close() }()
+
+	news := &ThreadedNews{}
+	if err := yaml.NewDecoder(fh).Decode(news); err != nil {
+		return nil, err
+	}
+	return news, nil
+}
+
+func (f *ThreadedNewsFile) Save(news *ThreadedNews) error {
+	out, err := yaml.Marshal(news)
+	if err != nil {
+		return err
+	}
+	return f.FS.WriteFile(f.Path, out, 0666)
+}
+
+// MemFlatNewsStore keeps the flat news in memory only
+type MemFlatNewsStore struct {
+	news []byte
+	mux  sync.Mutex
+}
+
+func (m *MemFlatNewsStore) Load() ([]byte, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	return append([]byte{}, m.news...), nil
+}
+
+func (m *MemFlatNewsStore) Save(news []byte) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	m.news = append([]byte{}, news...)
+	return nil
+}
+
+// MemThreadedNewsStore keeps the threaded news in memory only
+type MemThreadedNewsStore struct {
+	news *ThreadedNews
+	mux  sync.Mutex
+}
+
+func (m *MemThreadedNewsStore) Load() (*ThreadedNews, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if m.news == nil {
+		return &ThreadedNews{Categories: make(map[string]NewsCategoryListData15)}, nil
+	}
+	return m.news, nil
+}
+
+func (m *MemThreadedNewsStore) Save(news *ThreadedNews) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	m.news = news
+	return nil
+}
@@ -0,0 +1,242 @@
+package hotline
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PROXY protocol support allows the server to run behind a TCP load balancer such as HAProxy while still seeing the
+// real address of each client.  The proxy prepends a header to each connection that describes the original source
+// and destination addresses.  Both the human-readable v1 format and the binary v2 format are supported.
+//
+// Headers are only accepted from connections that originate from a trusted proxy address.  Connections from other
+// addresses are passed through unchanged, so an untrusted client can not spoof its address by sending a header.
+//
+// Spec: https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt
+
+const (
+	proxyHeaderTimeout = 5 * time.Second // time allowed for a trusted proxy to send the PROXY header
+	proxyV1MaxLen      = 107             // maximum length of a v1 header including the trailing CRLF
+)
+
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+	errInvalidProxyHeader = errors.New("invalid PROXY protocol header")
+)
+
+// proxyListener wraps a net.Listener and returns connections that read a PROXY protocol header from trusted proxies
+type proxyListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+// newProxyListener returns a listener that accepts PROXY protocol headers from addresses in trustedCIDRs
+func newProxyListener(ln net.Listener, trustedCIDRs []string) (*proxyListener, error) {
+	pl := &proxyListener{Listener: ln}
+	for _, cidr := range trustedCIDRs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		pl.trusted = append(pl.trusted, ipNet)
+	}
+
+	return pl, nil
+}
+
+func (pl *proxyListener) Accept() (net.Conn, error) {
+	conn, err := pl.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if !pl.isTrusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+
+	return &proxyConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+func (pl *proxyListener) isTrusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	for _, ipNet := range pl.trusted {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// proxyConn is a connection from a trusted proxy.  The PROXY header is read on the first call to Read or RemoteAddr
+// so that a slow proxy does not block the listener's Accept loop.
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		defer func() { _ = c.Conn.SetReadDeadline(time.Time{}) }()
+
+		c.remoteAddr, c.err = readProxyHeader(c.reader)
+	})
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	return c.reader.Read(p)
+}
+
+// RemoteAddr returns the client address from the PROXY header, or the address of the proxy if the header did not
+// contain one
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+
+	return c.Conn.RemoteAddr()
+}
+
+// NetConn returns the underlying connection from the proxy
+func (c *proxyConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// readProxyHeader reads a v1 or v2 PROXY header from r and returns the source address it contains.  A nil address
+// with a nil error means the header was valid but did not describe a proxied connection (e.g. a health check).
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	prefix, err := r.Peek(len(proxyV1Prefix))
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(prefix, proxyV1Prefix) {
+		return readProxyHeaderV1(r)
+	}
+	if bytes.Equal(prefix, proxyV2Signature[:len(prefix)]) {
+		return readProxyHeaderV2(r)
+	}
+
+	return nil, errInvalidProxyHeader
+}
+
+// readProxyHeaderV1 parses the text format, for example:
+// PROXY TCP4 192.0.2.1 198.51.100.1 56324 5500\r\n
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= proxyV1MaxLen {
+			return nil, errInvalidProxyHeader
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errInvalidProxyHeader
+	}
+
+	parts := strings.Split(string(line[:len(line)-2]), " ")
+	if len(parts) < 2 {
+		return nil, errInvalidProxyHeader
+	}
+
+	switch parts[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+		if len(parts) != 6 {
+			return nil, errInvalidProxyHeader
+		}
+	default:
+		return nil, errInvalidProxyHeader
+	}
+
+	ip := net.ParseIP(parts[2])
+	if ip == nil || (parts[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, errInvalidProxyHeader
+	}
+
+	port, err := strconv.ParseUint(parts[4], 10, 16)
+	if err != nil {
+		return nil, errInvalidProxyHeader
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyHeaderV2 parses the binary format:
+// [12]byte signature
+// [1]byte  version (high 4 bits) and command (low 4 bits)
+// [1]byte  address family (high 4 bits) and transport protocol (low 4 bits)
+// [2]byte  length of the address block that follows
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(header[:12], proxyV2Signature) || header[12]>>4 != 2 {
+		return nil, errInvalidProxyHeader
+	}
+
+	addrs := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, addrs); err != nil {
+		return nil, err
+	}
+
+	switch header[12] & 0x0F {
+	case 0x0: // LOCAL: connection was established by the proxy itself
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, errInvalidProxyHeader
+	}
+
+	switch header[13] {
+	case 0x11: // TCP over IPv4
+		if len(addrs) < 12 {
+			return nil, errInvalidProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(addrs[0:4]), Port: int(binary.BigEndian.Uint16(addrs[8:10]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(addrs) < 36 {
+			return nil, errInvalidProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(addrs[0:16]), Port: int(binary.BigEndian.Uint16(addrs[32:34]))}, nil
+	default:
+		// Unspecified or unsupported address family; fall back to the proxy address
+		return nil, nil
+	}
+}
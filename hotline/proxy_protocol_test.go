@@ -0,0 +1,178 @@
+package hotline
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"testing"
+)
+
+func proxyV2Header(cmd, family byte, addrs []byte) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|cmd, family, byte(len(addrs)>>8), byte(len(addrs)))
+	return append(header, addrs...)
+}
+
+func Test_readProxyHeader(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   []byte
+		want     net.Addr
+		wantErr  assert.ErrorAssertionFunc
+		wantRest []byte
+	}{
+		{
+			name:     "v1 TCP4",
+			header:   []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 5500\r\nTRTP"),
+			want:     &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324},
+			wantErr:  assert.NoError,
+			wantRest: []byte("TRTP"),
+		},
+		{
+			name:     "v1 TCP6",
+			header:   []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 5500\r\nTRTP"),
+			want:     &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324},
+			wantErr:  assert.NoError,
+			wantRest: []byte("TRTP"),
+		},
+		{
+			name:     "v1 UNKNOWN",
+			header:   []byte("PROXY UNKNOWN\r\nTRTP"),
+			want:     nil,
+			wantErr:  assert.NoError,
+			wantRest: []byte("TRTP"),
+		},
+		{
+			name:    "v1 with mismatched address family",
+			header:  []byte("PROXY TCP4 2001:db8::1 2001:db8::2 56324 5500\r\n"),
+			wantErr: assert.Error,
+		},
+		{
+			name:    "v1 without CRLF",
+			header:  []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 5500\n"),
+			wantErr: assert.Error,
+		},
+		{
+			name: "v2 TCP over IPv4",
+			header: append(proxyV2Header(0x1, 0x11, []byte{
+				192, 0, 2, 1, // source address
+				198, 51, 100, 1, // destination address
+				0xdc, 0x04, // source port
+				0x15, 0x7c, // destination port
+			}), []byte("TRTP")...),
+			want:     &net.TCPAddr{IP: net.IP{192, 0, 2, 1}, Port: 56324},
+			wantErr:  assert.NoError,
+			wantRest: []byte("TRTP"),
+		},
+		{
+			name: "v2 TCP over IPv6",
+			header: proxyV2Header(0x1, 0x21, bytes.Join([][]byte{
+				net.ParseIP("2001:db8::1"), // source address
+				net.ParseIP("2001:db8::2"), // destination address
+				{0xdc, 0x04, 0x15, 0x7c},   // source and destination ports
+			}, nil)),
+			want:    &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324},
+			wantErr: assert.NoError,
+		},
+		{
+			name:     "v2 LOCAL",
+			header:   append(proxyV2Header(0x0, 0x00, nil), []byte("TRTP")...),
+			want:     nil,
+			wantErr:  assert.NoError,
+			wantRest: []byte("TRTP"),
+		},
+		{
+			name:    "v2 with short address block",
+			header:  proxyV2Header(0x1, 0x11, []byte{192, 0, 2, 1}),
+			wantErr: assert.Error,
+		},
+		{
+			name:    "missing header",
+			header:  []byte("TRTPHOTL\x00\x01\x00\x02"),
+			wantErr: assert.Error,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(bytes.NewReader(tt.header))
+			got, err := readProxyHeader(r)
+			if !tt.wantErr(t, err) || err != nil {
+				return
+			}
+			assert.Equal(t, tt.want, got)
+
+			rest, _ := io.ReadAll(r)
+			assert.Equal(t, string(tt.wantRest), string(rest))
+		})
+	}
+}
+
+func TestProxyListener(t *testing.T) {
+	accept := func(t *testing.T, trusted []string, payload []byte) net.Conn {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = ln.Close() })
+
+		pl, err := newProxyListener(ln, trusted)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		client, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = client.Close() })
+
+		if _, err := client.Write(payload); err != nil {
+			t.Fatal(err)
+		}
+
+		conn, err := pl.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = conn.Close() })
+
+		return conn
+	}
+
+	t.Run("uses the address from a trusted proxy", func(t *testing.T) {
+		conn := accept(t, []string{"127.0.0.0/8"}, []byte("PROXY TCP4 192.0.2.1 127.0.0.1 56324 5500\r\nTRTP"))
+
+		assert.Equal(t, "192.0.2.1:56324", conn.RemoteAddr().String())
+
+		buf := make([]byte, 4)
+		_, err := io.ReadFull(conn, buf)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("TRTP"), buf)
+	})
+
+	t.Run("ignores headers from untrusted addresses", func(t *testing.T) {
+		conn := accept(t, []string{"10.0.0.0/8"}, []byte("PROXY TCP4 192.0.2.1 127.0.0.1 56324 5500\r\n"))
+
+		assert.Contains(t, conn.RemoteAddr().String(), "127.0.0.1:")
+
+		buf := make([]byte, 6)
+		_, err := io.ReadFull(conn, buf)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("PROXY "), buf)
+	})
+
+	t.Run("rejects a trusted connection without a header", func(t *testing.T) {
+		conn := accept(t, []string{"127.0.0.0/8"}, []byte("TRTPHOTL\x00\x01\x00\x02"))
+
+		_, err := conn.Read(make([]byte, 12))
+		assert.ErrorIs(t, err, errInvalidProxyHeader)
+		assert.Contains(t, conn.RemoteAddr().String(), "127.0.0.1:")
+	})
+
+	t.Run("rejects an invalid trusted proxy CIDR", func(t *testing.T) {
+		_, err := newProxyListener(nil, []string{"not a cidr"})
+		assert.Error(t, err)
+	})
+}
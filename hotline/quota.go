@@ -0,0 +1,342 @@
+package hotline
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+)
+
+// Uploads are limited by MaxUploadSize, the size of the largest file that can be uploaded, by the upload quotas of
+// accounts, and by MinFreeSpace, the disk space that is kept free in the file area.  The limits are checked against the
+// transfer size sent by the client when it requests an upload, and enforced again while the upload is received in case
+// the client sent the wrong size.
+//
+// The quota of an account is its UploadQuota, or else the largest of the GroupUploadQuotas of its groups.  Bytes
+// uploaded by the account, including those of uploads that fail part way, are counted in its UploadedBytes.  The count
+// is shared by all uploads of the account and is reserved under s.mux before each write, so uploads running in
+// parallel cannot exceed the quota together whatever sizes their clients declared.  Quotas are lifetime caps rather
+// than limits on the space used: deleting or replacing files does not give bytes back.  Admins reset the count with
+// the /resetquota command.
+
+var (
+	errUploadLimit    = errors.New("upload limit exceeded")
+	errUploadTooLarge = fmt.Errorf("%w: file is larger than the maximum upload size", errUploadLimit)
+	errUploadQuota    = fmt.Errorf("%w: upload quota exceeded", errUploadLimit)
+	errLowDiskSpace   = fmt.Errorf("%w: not enough free disk space", errUploadLimit)
+)
+
+var (
+	errFreeSpaceUnknown = errors.New("free space is not known")
+	errAccountNotFound  = errors.New("account not found")
+)
+
+// freeSpacer is implemented by FileStores that can report how much space is free on the disk storing a file
+type freeSpacer interface {
+	FreeSpace(name string) (uint64, error)
+}
+
+// freeSpace returns the free space of the disk storing name, or errFreeSpaceUnknown if fileStore can't tell
+func freeSpace(fileStore FileStore, name string) (uint64, error) {
+	fsp, ok := fileStore.(freeSpacer)
+	if !ok {
+		return 0, errFreeSpaceUnknown
+	}
+
+	return fsp.FreeSpace(name)
+}
+
+// transferSize decodes the 4 or 8 byte transfer size of a transaction field
+func transferSize(b []byte) uint64 {
+	switch len(b) {
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b))
+	case 8:
+		return binary.BigEndian.Uint64(b)
+	}
+
+	return 0
+}
+
+// requestedTransferSize returns the transfer size field of an upload request, preferring the 64-bit size if present and
+// the client supports large files
+func (cc *ClientConn) requestedTransferSize(t *Transaction) []byte {
+	if size := t.GetField(fieldTransferSize64).Data; cc.largeFiles && len(size) == 8 {
+		return size
+	}
+
+	return t.GetField(fieldTransferSize).Data
+}
+
+// formatBytes formats n as a human readable size, e.g. "1.5 MB"
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d bytes", n)
+	}
+
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// uploadQuota returns the upload quota of account in bytes, or 0 if it has none
+func (s *Server) uploadQuota(account *Account) int64 {
+	if account == nil {
+		return 0
+	}
+	if account.UploadQuota > 0 {
+		return account.UploadQuota
+	}
+
+	var quota int64
+	for _, group := range account.Groups {
+		if q := s.Config.GroupUploadQuotas[group]; q > quota {
+			quota = q
+		}
+	}
+
+	return quota
+}
+
+// uploadBudget tracks the bytes received by an upload against the limits that apply to it
+type uploadBudget struct {
+	maxFileSize uint64 // size of the largest file that can be received; 0 is unlimited
+	limit       uint64 // bytes that can be received in total
+	limitErr    error  // error returned when more than limit bytes are received; nil if there is no limit
+
+	server  *Server
+	account *Account // account whose UploadedBytes are reserved as the upload is received
+	quota   uint64   // upload quota of account; 0 is unlimited
+
+	fileSize uint64 // bytes of the file being received, including the part received before a resume
+	received uint64 // bytes received in total
+}
+
+// newUploadBudget returns the budget for the upload ft by account to the folder at folderPath.  ft is nil when an
+// upload is requested, in which case the quota is checked against the sizes declared for the pending uploads of
+// account; during the transfer it is checked against the bytes actually received by all of them.
+func (s *Server) newUploadBudget(account *Account, folderPath string, ft *FileTransfer) *uploadBudget {
+	b := &uploadBudget{server: s}
+	if s.Config.MaxUploadSize > 0 {
+		b.maxFileSize = uint64(s.Config.MaxUploadSize)
+	}
+
+	quota := s.uploadQuota(account)
+	switch {
+	case ft != nil:
+		b.account = account
+		b.quota = uint64(quota)
+	case quota > 0:
+		b.restrict(uint64(quota), s.usedQuota(account), errUploadQuota)
+	}
+
+	if s.Config.MinFreeSpace > 0 {
+		free, err := freeSpace(s.FS, folderPath)
+		switch {
+		case err == nil:
+			b.restrict(free, uint64(s.Config.MinFreeSpace), errLowDiskSpace)
+		case !errors.Is(err, errFreeSpaceUnknown):
+			s.Logger.Errorw("Error checking free disk space", "path", folderPath, "err", err)
+		}
+	}
+
+	return b
+}
+
+// usedQuota returns the bytes uploaded by account plus the declared size of its uploads that have been requested but
+// not yet started
+func (s *Server) usedQuota(account *Account) uint64 {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	used := uint64(account.UploadedBytes)
+	for _, ft := range s.FileTransfers {
+		if ft.active || ft.clientConn == nil || ft.clientConn.Account == nil || ft.clientConn.Account.Login != account.Login {
+			continue
+		}
+		if ft.Type == FileUpload || ft.Type == FolderUpload {
+			used += transferSize(ft.TransferSize)
+		}
+	}
+
+	return used
+}
+
+// restrict limits the bytes that can be received to available minus used, if that is lower than the current limit
+func (b *uploadBudget) restrict(available, used uint64, err error) {
+	var remaining uint64
+	if available > used {
+		remaining = available - used
+	}
+
+	if b.limitErr == nil || remaining < b.limit {
+		b.limit = remaining
+		b.limitErr = err
+	}
+}
+
+// check returns the error for the limit that an upload of total bytes, the largest file of which is fileSize bytes,
+// would exceed
+func (b *uploadBudget) check(fileSize, total uint64) error {
+	if b.maxFileSize > 0 && fileSize > b.maxFileSize {
+		return errUploadTooLarge
+	}
+	if b.limitErr != nil && total > b.limit {
+		return b.limitErr
+	}
+
+	return nil
+}
+
+// reserve adds n bytes to the UploadedBytes of the account, unless that would exceed its quota.  The caller must not
+// hold s.mux.
+func (b *uploadBudget) reserve(n uint64) error {
+	if b.account == nil {
+		return nil
+	}
+
+	b.server.mux.Lock()
+	defer b.server.mux.Unlock()
+
+	if b.quota > 0 && uint64(b.account.UploadedBytes)+n > b.quota {
+		return errUploadQuota
+	}
+	b.account.UploadedBytes += int64(n)
+
+	return nil
+}
+
+// release gives back n bytes reserved by an upload that were not received
+func (b *uploadBudget) release(n uint64) {
+	if b.account == nil || n == 0 {
+		return
+	}
+
+	b.server.mux.Lock()
+	defer b.server.mux.Unlock()
+
+	b.account.UploadedBytes -= int64(n)
+	if b.account.UploadedBytes < 0 {
+		b.account.UploadedBytes = 0
+	}
+}
+
+// startFile starts counting the size of a new file.  offset is the size of the part of the file already received when
+// the upload is resumed.
+func (b *uploadBudget) startFile(offset uint64) {
+	b.fileSize = offset
+}
+
+// writer returns a Writer that writes to w until the budget is exceeded
+func (b *uploadBudget) writer(w io.Writer) io.Writer {
+	return &budgetWriter{budget: b, w: w}
+}
+
+type budgetWriter struct {
+	budget *uploadBudget
+	w      io.Writer
+}
+
+func (bw *budgetWriter) Write(p []byte) (int, error) {
+	b := bw.budget
+	if err := b.check(b.fileSize+uint64(len(p)), b.received+uint64(len(p))); err != nil {
+		return 0, err
+	}
+	if err := b.reserve(uint64(len(p))); err != nil {
+		return 0, err
+	}
+
+	n, err := bw.w.Write(p)
+	b.release(uint64(len(p) - n))
+	b.fileSize += uint64(n)
+	b.received += uint64(n)
+
+	return n, err
+}
+
+// save stores the UploadedBytes of the account once the upload has ended
+func (b *uploadBudget) save() {
+	if b.account == nil || b.received == 0 {
+		return
+	}
+
+	_ = b.server.saveUploadedBytes(b.account)
+}
+
+// ResetUploadedBytes sets the bytes uploaded by the account login back to zero, giving it its full upload quota again
+func (s *Server) ResetUploadedBytes(login string) error {
+	s.mux.Lock()
+	account, ok := s.Accounts[login]
+	if ok {
+		account.UploadedBytes = 0
+	}
+	s.mux.Unlock()
+
+	if !ok {
+		return errAccountNotFound
+	}
+	return s.saveUploadedBytes(account)
+}
+
+// saveUploadedBytes stores account so that its UploadedBytes survive a restart.  The account store is written without
+// holding s.mux.  Saves are serialized instead, and each copies the account once it is its turn, so the last save
+// always stores the latest count.
+func (s *Server) saveUploadedBytes(account *Account) error {
+	s.uploadedBytesMux.Lock()
+	defer s.uploadedBytesMux.Unlock()
+
+	s.mux.Lock()
+	saved := *account
+	s.mux.Unlock()
+
+	if err := s.AccountStore.Put(&saved); err != nil {
+		s.Logger.Errorw("Error saving uploaded bytes", "login", account.Login, "err", err)
+		return err
+	}
+	return nil
+}
+
+// uploadLimitMsg returns the message shown to account when the upload of the file or folder name exceeds a limit
+func (s *Server) uploadLimitMsg(account *Account, kind, name string, err error) string {
+	var reason string
+	switch {
+	case errors.Is(err, errUploadTooLarge):
+		reason = fmt.Sprintf("it is larger than the maximum upload size of %s", formatBytes(uint64(s.Config.MaxUploadSize)))
+		if kind == "folder" {
+			reason = fmt.Sprintf("it contains a file larger than the maximum upload size of %s", formatBytes(uint64(s.Config.MaxUploadSize)))
+		}
+	case errors.Is(err, errUploadQuota):
+		reason = fmt.Sprintf("it would exceed your upload quota of %s", formatBytes(uint64(s.uploadQuota(account))))
+	default:
+		reason = "the server does not have enough free disk space"
+	}
+
+	return fmt.Sprintf("Cannot accept upload of the %s \"%s\" because %s.", kind, name, reason)
+}
+
+// notifyUploadLimit tells the client that uploaded ft that the upload was stopped because it exceeded a limit
+func (s *Server) notifyUploadLimit(ft *FileTransfer, kind string, err error) {
+	cc := ft.clientConn
+	if cc == nil {
+		return
+	}
+
+	msg := s.uploadLimitMsg(cc.Account, kind, string(ft.FileName), err)
+	s.outbox <- *NewTransaction(tranServerMsg, cc.ID, NewField(fieldData, []byte(msg)), NewField(fieldChatOptions, []byte{0}))
+}
+
+// stopUpload removes the incomplete file of an upload that exceeded a limit and tells the client why it was stopped
+func (s *Server) stopUpload(ft *FileTransfer, kind, incompletePath string, err error) {
+	s.Logger.Infow("Upload stopped", "path", incompletePath, "reason", err)
+	if err := s.FS.Remove(incompletePath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		s.Logger.Errorw("Error removing incomplete upload", "path", incompletePath, "err", err)
+	}
+
+	s.notifyUploadLimit(ft, kind, err)
+}
@@ -0,0 +1,297 @@
+package hotline
+
+import (
+	"bytes"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io/fs"
+	"net"
+	"testing"
+)
+
+// lowSpaceFileStore is a MemFileStore that reports free bytes of free disk space
+type lowSpaceFileStore struct {
+	*MemFileStore
+	free uint64
+}
+
+func (fs *lowSpaceFileStore) FreeSpace(string) (uint64, error) {
+	return fs.free, nil
+}
+
+func newQuotaTestClient(account *Account) *ClientConn {
+	var bits accessBitmap
+	bits.Set(accessUploadFile)
+	bits.Set(accessUploadAnywhere)
+	access := bits[:]
+	account.Access = &access
+
+	mfs := NewMemFileStore()
+	_ = mfs.MkdirAll("/Files/Uploads", 0777)
+
+	s := newTransferTestServer(&lowSpaceFileStore{MemFileStore: mfs, free: 1 << 30}, &FileTransfer{})
+	s.FileTransfers = map[uint32]*FileTransfer{}
+	s.AccountStore = NewMemAccountStore()
+	s.outbox = make(chan Transaction, 1)
+
+	return &ClientConn{ID: &[]byte{0, 1}, Account: account, Server: s}
+}
+
+func TestUploadLimits(t *testing.T) {
+	tests := []struct {
+		name      string
+		account   Account
+		config    Config
+		free      uint64
+		handler   func(*ClientConn, *Transaction) ([]Transaction, error)
+		size      []byte
+		wantError string
+	}{
+		{
+			name:    "file within all limits",
+			account: Account{Login: "user", UploadQuota: 1000, UploadedBytes: 400},
+			config:  Config{MaxUploadSize: 600, MinFreeSpace: 1000},
+			free:    1600,
+			handler: HandleUploadFile,
+			size:    []byte{0, 0, 2, 0x58},
+		},
+		{
+			name:      "file larger than the maximum upload size",
+			account:   Account{Login: "user"},
+			config:    Config{MaxUploadSize: 10 << 20},
+			handler:   HandleUploadFile,
+			size:      size64(10<<20 + 1),
+			wantError: "Cannot accept upload of the file \"a.zip\" because it is larger than the maximum upload size of 10.0 MB.",
+		},
+		{
+			name:      "file over the account's quota",
+			account:   Account{Login: "user", UploadQuota: 1000, UploadedBytes: 400},
+			handler:   HandleUploadFile,
+			size:      []byte{0, 0, 2, 0x59},
+			wantError: "Cannot accept upload of the file \"a.zip\" because it would exceed your upload quota of 1000 bytes.",
+		},
+		{
+			name:      "file over the quota of the account's group",
+			account:   Account{Login: "user", Groups: []string{"guests", "members"}},
+			config:    Config{GroupUploadQuotas: map[string]int64{"guests": 1024, "members": 2048}},
+			handler:   HandleUploadFile,
+			size:      []byte{0, 0, 0x08, 0x01},
+			wantError: "Cannot accept upload of the file \"a.zip\" because it would exceed your upload quota of 2.0 KB.",
+		},
+		{
+			name:      "file that would leave less than the minimum free space",
+			account:   Account{Login: "user"},
+			config:    Config{MinFreeSpace: 1000},
+			free:      1500,
+			handler:   HandleUploadFile,
+			size:      []byte{0, 0, 2, 0x01},
+			wantError: "Cannot accept upload of the file \"a.zip\" because the server does not have enough free disk space.",
+		},
+		{
+			name:      "folder over the account's quota",
+			account:   Account{Login: "user", UploadQuota: 1000},
+			handler:   HandleUploadFolder,
+			size:      []byte{0, 0, 0x03, 0xe9},
+			wantError: "Cannot accept upload of the folder \"a.zip\" because it would exceed your upload quota of 1000 bytes.",
+		},
+		{
+			name:    "maximum upload size applies to the files in a folder",
+			account: Account{Login: "user"},
+			config:  Config{MaxUploadSize: 100},
+			handler: HandleUploadFolder,
+			size:    []byte{0, 0, 0x03, 0xe9},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			account := tt.account
+			cc := newQuotaTestClient(&account)
+			cc.Server.Config.MaxUploadSize = tt.config.MaxUploadSize
+			cc.Server.Config.MinFreeSpace = tt.config.MinFreeSpace
+			cc.Server.Config.GroupUploadQuotas = tt.config.GroupUploadQuotas
+			if tt.free > 0 {
+				cc.Server.FS.(*lowSpaceFileStore).free = tt.free
+			}
+
+			sizeField := fieldTransferSize
+			if len(tt.size) == 8 {
+				sizeField = fieldTransferSize64
+				cc.largeFiles = true
+			}
+			res, err := tt.handler(cc, NewTransaction(tranUploadFile, &[]byte{0, 1},
+				NewField(fieldFileName, []byte("a.zip")),
+				NewField(fieldFilePath, EncodeFilePath("Uploads")),
+				NewField(uint16(sizeField), tt.size),
+			))
+			assert.NoError(t, err)
+
+			if tt.wantError != "" {
+				assert.Equal(t, tt.wantError, string(res[0].GetField(fieldError).Data))
+				assert.Empty(t, cc.Server.FileTransfers)
+				return
+			}
+			assert.Equal(t, []byte{0, 0, 0, 0}, res[0].ErrorCode)
+			assert.Len(t, cc.Server.FileTransfers, 1)
+		})
+	}
+
+	t.Run("64-bit sizes are ignored without large file support", func(t *testing.T) {
+		cc := newQuotaTestClient(&Account{Login: "user"})
+		cc.Server.Config.MaxUploadSize = 1000
+
+		res, err := HandleUploadFile(cc, NewTransaction(tranUploadFile, &[]byte{0, 1},
+			NewField(fieldFileName, []byte("a.zip")),
+			NewField(fieldFilePath, EncodeFilePath("Uploads")),
+			NewField(fieldTransferSize, []byte{0, 0, 0x03, 0xe8}),
+			NewField(fieldTransferSize64, []byte{0, 0, 0, 1, 0, 0, 0, 0}),
+		))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{0, 0, 0, 0}, res[0].ErrorCode)
+	})
+
+	t.Run("pending uploads count toward the quota", func(t *testing.T) {
+		cc := newQuotaTestClient(&Account{Login: "user", UploadQuota: 1000})
+		upload := func() []Transaction {
+			res, err := HandleUploadFile(cc, NewTransaction(tranUploadFile, &[]byte{0, 1},
+				NewField(fieldFileName, []byte("a.zip")),
+				NewField(fieldFilePath, EncodeFilePath("Uploads")),
+				NewField(fieldTransferSize, []byte{0, 0, 0x02, 0x58}),
+			))
+			assert.NoError(t, err)
+			return res
+		}
+
+		assert.Equal(t, []byte{0, 0, 0, 0}, upload()[0].ErrorCode)
+		assert.Equal(t, []byte{0, 0, 0, 1}, upload()[0].ErrorCode)
+	})
+}
+
+func TestUploadLimitsDuringTransfer(t *testing.T) {
+	// upload sends data for a.zip to the file transfer port after the client has declared a size of 1 byte
+	upload := func(cc *ClientConn, data []byte) error {
+		cc.Server.FileTransfers[1] = &FileTransfer{
+			Type:            FileUpload,
+			FileName:        []byte("a.zip"),
+			FilePath:        EncodeFilePath("Uploads"),
+			ReferenceNumber: []byte{0, 0, 0, 1},
+			TransferSize:    []byte{0, 0, 0, 1},
+			clientConn:      cc,
+		}
+
+		client, server := net.Pipe()
+		errs := make(chan error, 1)
+		go func() { errs <- cc.Server.handleFileTransfer(server) }()
+		go func() {
+			_, _ = client.Write(append(htxf(), flatFile("a.zip", data)...))
+			_ = client.Close()
+		}()
+
+		err := <-errs
+		_ = server.Close()
+		return err
+	}
+
+	t.Run("uploads larger than declared are stopped at the maximum upload size", func(t *testing.T) {
+		cc := newQuotaTestClient(&Account{Login: "user"})
+		cc.Server.Config.MaxUploadSize = 8
+
+		assert.ErrorIs(t, upload(cc, []byte("more than eight bytes")), errUploadTooLarge)
+
+		_, err := cc.Server.FS.Stat("/Files/Uploads/a.zip" + incompleteFileSuffix)
+		assert.True(t, errors.Is(err, fs.ErrNotExist), "the incomplete file is removed")
+		_, err = cc.Server.FS.Stat("/Files/Uploads/a.zip")
+		assert.True(t, errors.Is(err, fs.ErrNotExist))
+
+		msg := <-cc.Server.outbox
+		assert.Equal(t, "Cannot accept upload of the file \"a.zip\" because it is larger than the maximum upload size of 8 bytes.", string(msg.GetField(fieldData).Data))
+	})
+
+	t.Run("uploads are counted toward the quota", func(t *testing.T) {
+		account := &Account{Login: "user", UploadQuota: 20}
+		cc := newQuotaTestClient(account)
+
+		assert.NoError(t, upload(cc, []byte("twelve bytes")))
+		assert.Equal(t, int64(12), account.UploadedBytes)
+
+		stored, err := cc.Server.AccountStore.List()
+		assert.NoError(t, err)
+		if assert.Len(t, stored, 1) {
+			assert.Equal(t, int64(12), stored[0].UploadedBytes)
+		}
+
+		assert.ErrorIs(t, upload(cc, []byte("twelve bytes")), errUploadQuota)
+		assert.LessOrEqual(t, account.UploadedBytes, int64(20))
+	})
+
+	t.Run("uploads running in parallel share the quota", func(t *testing.T) {
+		account := &Account{Login: "user", UploadQuota: 20}
+		cc := newQuotaTestClient(account)
+
+		var first, second bytes.Buffer
+		w1 := cc.Server.newUploadBudget(account, "/Files/Uploads", &FileTransfer{}).writer(&first)
+		w2 := cc.Server.newUploadBudget(account, "/Files/Uploads", &FileTransfer{}).writer(&second)
+
+		_, err := w1.Write([]byte("twelve bytes"))
+		assert.NoError(t, err)
+		_, err = w2.Write([]byte("twelve bytes"))
+		assert.ErrorIs(t, err, errUploadQuota)
+		_, err = w2.Write([]byte("eight by"))
+		assert.NoError(t, err)
+		_, err = w1.Write([]byte("x"))
+		assert.ErrorIs(t, err, errUploadQuota)
+
+		assert.Equal(t, int64(20), account.UploadedBytes)
+	})
+
+	t.Run("admins can reset the quota", func(t *testing.T) {
+		account := &Account{Login: "user", UploadQuota: 20}
+		cc := newQuotaTestClient(account)
+		cc.Server.Accounts = map[string]*Account{"user": account}
+		assert.NoError(t, upload(cc, []byte("twelve bytes")))
+
+		var bits accessBitmap
+		bits.Set(accessDisconUser)
+		access := bits[:]
+		admin := &ClientConn{ID: &[]byte{0, 2}, Account: &Account{Login: "admin", Access: &access}, Server: cc.Server}
+
+		reply, ok := admin.runAdminCommand([]byte("/resetquota user"))
+		assert.True(t, ok)
+		assert.Equal(t, "Reset the upload quota of user.", reply)
+		assert.Equal(t, int64(0), account.UploadedBytes)
+
+		stored, err := cc.Server.AccountStore.List()
+		assert.NoError(t, err)
+		if assert.Len(t, stored, 1) {
+			assert.Equal(t, int64(0), stored[0].UploadedBytes)
+		}
+
+		assert.NoError(t, upload(cc, []byte("twelve bytes")), "the full quota is available again")
+
+		reply, _ = admin.runAdminCommand([]byte("/resetquota nobody"))
+		assert.Equal(t, "Cannot reset the upload quota of nobody: account not found.", reply)
+	})
+
+	t.Run("uploads are stopped at the minimum free space", func(t *testing.T) {
+		cc := newQuotaTestClient(&Account{Login: "user"})
+		cc.Server.Config.MinFreeSpace = 100
+		cc.Server.FS.(*lowSpaceFileStore).free = 105
+
+		assert.ErrorIs(t, upload(cc, []byte("twelve bytes")), errLowDiskSpace)
+	})
+}
+
+func Test_formatBytes(t *testing.T) {
+	tests := []struct {
+		n    uint64
+		want string
+	}{
+		{n: 0, want: "0 bytes"},
+		{n: 1023, want: "1023 bytes"},
+		{n: 1024, want: "1.0 KB"},
+		{n: 1536 << 10, want: "1.5 MB"},
+		{n: 5 << 30, want: "5.0 GB"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, formatBytes(tt.n))
+	}
+}
@@ -0,0 +1,192 @@
+package hotline
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// File transfers are throttled by token buckets, in both directions and for every kind of transfer.  A transfer waits
+// for the buckets of all the limits that apply to it: MaxTransferRate shared by all transfers, the transfer rate of the
+// account shared by all of its transfers, and MaxRatePerTransfer for each transfer on its own.  The rate of an account
+// is its TransferRate, or else the largest of the GroupTransferRates of its groups.  Rates are in bytes per second and
+// are read each time a transfer waits, so that changes made by ReloadConfig apply to transfers in progress.
+
+// throttleChunkSize is the largest number of bytes read or written between waits for tokens
+const throttleChunkSize = 16 * 1024
+
+// tokenBucket is a token bucket of bytes that fills at a rate of bytes per second, up to a burst of one second's worth.
+// Tokens are taken before they are available, leaving the bucket in debt that later takers wait out.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take takes n tokens at time now and returns how long the taker must wait for them.  A rate of 0 is unlimited.
+func (b *tokenBucket) take(now time.Time, n int, rate int64) time.Duration {
+	if rate <= 0 {
+		b.tokens, b.last = 0, time.Time{}
+		return 0
+	}
+
+	if b.last.IsZero() {
+		b.tokens = float64(rate)
+	} else if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * float64(rate)
+	}
+	if b.tokens > float64(rate) {
+		b.tokens = float64(rate)
+	}
+	b.last = now
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / float64(rate) * float64(time.Second))
+}
+
+// rateLimiter throttles the file transfers of a Server
+type rateLimiter struct {
+	mu       sync.Mutex
+	config   *Config
+	clock    Clock
+	sleep    func(time.Duration)
+	global   tokenBucket
+	accounts map[string]*tokenBucket
+}
+
+func newRateLimiter(config *Config, clock Clock) *rateLimiter {
+	return &rateLimiter{
+		config:   config,
+		clock:    clock,
+		sleep:    time.Sleep,
+		accounts: make(map[string]*tokenBucket),
+	}
+}
+
+// accountRate returns the transfer rate of account, or 0 if it is unlimited.  l.mu must be held.
+func (l *rateLimiter) accountRate(account *Account) int64 {
+	if account.TransferRate > 0 {
+		return account.TransferRate
+	}
+
+	var rate int64
+	for _, group := range account.Groups {
+		if r := l.config.GroupTransferRates[group]; r > rate {
+			rate = r
+		}
+	}
+
+	return rate
+}
+
+// reload applies the rate limits of config and of the stored accounts to the config and accounts in use
+func (l *rateLimiter) reload(config *Config, stored []*Account, accounts map[string]*Account) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.config.MaxTransferRate = config.MaxTransferRate
+	l.config.MaxRatePerTransfer = config.MaxRatePerTransfer
+	l.config.GroupTransferRates = config.GroupTransferRates
+	for _, a := range stored {
+		if account, ok := accounts[a.Login]; ok {
+			account.TransferRate = a.TransferRate
+		}
+	}
+}
+
+// transferThrottle throttles one file transfer
+type transferThrottle struct {
+	limiter *rateLimiter
+	account *Account
+	bucket  tokenBucket
+}
+
+// newThrottle returns the throttle for a transfer by account, which may be nil if the account is not known
+func (l *rateLimiter) newThrottle(account *Account) *transferThrottle {
+	return &transferThrottle{limiter: l, account: account}
+}
+
+// wait blocks until n bytes may be transferred
+func (t *transferThrottle) wait(n int) {
+	l := t.limiter
+
+	l.mu.Lock()
+	now := l.clock.Now()
+	delay := l.global.take(now, n, l.config.MaxTransferRate)
+	if t.account != nil {
+		bucket, ok := l.accounts[t.account.Login]
+		if !ok {
+			bucket = &tokenBucket{}
+			l.accounts[t.account.Login] = bucket
+		}
+		if d := bucket.take(now, n, l.accountRate(t.account)); d > delay {
+			delay = d
+		}
+	}
+	if d := t.bucket.take(now, n, l.config.MaxRatePerTransfer); d > delay {
+		delay = d
+	}
+	l.mu.Unlock()
+
+	if delay > 0 {
+		l.sleep(delay)
+	}
+}
+
+// conn returns conn throttled in both directions
+func (t *transferThrottle) conn(conn io.ReadWriteCloser) io.ReadWriteCloser {
+	return &throttledConn{ReadWriteCloser: conn, throttle: t}
+}
+
+type throttledConn struct {
+	io.ReadWriteCloser
+	throttle *transferThrottle
+}
+
+func (c *throttledConn) Read(p []byte) (int, error) {
+	if len(p) > throttleChunkSize {
+		p = p[:throttleChunkSize]
+	}
+
+	n, err := c.ReadWriteCloser.Read(p)
+	if n > 0 {
+		c.throttle.wait(n)
+	}
+
+	return n, err
+}
+
+func (c *throttledConn) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > throttleChunkSize {
+			chunk = chunk[:throttleChunkSize]
+		}
+		c.throttle.wait(len(chunk))
+
+		n, err := c.ReadWriteCloser.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+// ReadFrom waits for tokens after each chunk of r, as Read does, while still letting the underlying connection copy
+// the chunks itself
+func (c *throttledConn) ReadFrom(r io.Reader) (int64, error) {
+	return copyChunks(c.ReadWriteCloser, r, func() (int64, error) {
+		return throttleChunkSize, nil
+	}, func(n int64) {
+		if n > 0 {
+			c.throttle.wait(int(n))
+		}
+	})
+}
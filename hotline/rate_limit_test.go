@@ -0,0 +1,140 @@
+package hotline
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// sleepClock is a Clock whose time only moves when sleep is called
+type sleepClock struct {
+	t     time.Time
+	slept time.Duration
+}
+
+func (c *sleepClock) Now() time.Time {
+	return c.t
+}
+
+func (c *sleepClock) sleep(d time.Duration) {
+	c.t = c.t.Add(d)
+	c.slept += d
+}
+
+func newTestRateLimiter(config *Config) (*rateLimiter, *sleepClock) {
+	clock := &sleepClock{t: time.Date(2023, time.March, 1, 12, 0, 0, 0, time.UTC)}
+	l := newRateLimiter(config, clock)
+	l.sleep = clock.sleep
+
+	return l, clock
+}
+
+// nopCloser is a buffer that can be used as the connection of a throttled transfer
+type nopCloser struct {
+	bytes.Buffer
+}
+
+func (*nopCloser) Close() error { return nil }
+
+func Test_tokenBucket_take(t *testing.T) {
+	now := time.Date(2023, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+	var b tokenBucket
+	assert.Equal(t, time.Duration(0), b.take(now, 1000, 1000), "a new bucket allows a burst of one second")
+	assert.Equal(t, 500*time.Millisecond, b.take(now, 500, 1000))
+	assert.Equal(t, 500*time.Millisecond, b.take(now.Add(500*time.Millisecond), 500, 1000), "debt is carried over")
+	assert.Equal(t, time.Duration(0), b.take(now.Add(time.Hour), 1000, 1000), "the burst is capped at one second")
+	assert.Equal(t, time.Duration(0), b.take(now.Add(time.Hour), 1<<30, 0), "a rate of 0 is unlimited")
+}
+
+func TestRateLimiter(t *testing.T) {
+	data := make([]byte, 64*1024)
+
+	t.Run("transfers are limited to the per-transfer rate", func(t *testing.T) {
+		l, clock := newTestRateLimiter(&Config{MaxRatePerTransfer: 16 * 1024})
+
+		conn := l.newThrottle(nil).conn(&nopCloser{})
+		n, err := conn.Write(data)
+		assert.NoError(t, err)
+		assert.Equal(t, len(data), n)
+		assert.Equal(t, 3*time.Second, clock.slept)
+
+		// A new transfer starts with its own burst
+		clock.slept = 0
+		_, _ = l.newThrottle(nil).conn(&nopCloser{}).Write(data[:16*1024])
+		assert.Equal(t, time.Duration(0), clock.slept)
+	})
+
+	t.Run("the global rate is shared by all transfers", func(t *testing.T) {
+		l, clock := newTestRateLimiter(&Config{MaxTransferRate: 32 * 1024})
+
+		_, _ = l.newThrottle(nil).conn(&nopCloser{}).Write(data[:32*1024])
+		_, _ = l.newThrottle(nil).conn(&nopCloser{}).Write(data[:32*1024])
+		assert.Equal(t, time.Second, clock.slept)
+	})
+
+	t.Run("the account rate is shared by the transfers of an account", func(t *testing.T) {
+		l, clock := newTestRateLimiter(&Config{GroupTransferRates: map[string]int64{"guests": 16 * 1024}})
+		guest := &Account{Login: "guest", Groups: []string{"guests"}}
+		admin := &Account{Login: "admin", Groups: []string{"admins"}}
+
+		_, _ = l.newThrottle(guest).conn(&nopCloser{}).Write(data[:32*1024])
+		assert.Equal(t, time.Second, clock.slept)
+		_, _ = l.newThrottle(admin).conn(&nopCloser{}).Write(data)
+		assert.Equal(t, time.Second, clock.slept, "accounts in groups without a rate are not limited")
+
+		guest.TransferRate = 32 * 1024
+		clock.t = clock.t.Add(time.Minute)
+		_, _ = l.newThrottle(guest).conn(&nopCloser{}).Write(data)
+		assert.Equal(t, 2*time.Second, clock.slept, "the account's own rate overrides its groups")
+	})
+
+	t.Run("uploads are throttled", func(t *testing.T) {
+		l, clock := newTestRateLimiter(&Config{MaxRatePerTransfer: 16 * 1024})
+
+		conn := &nopCloser{}
+		_, _ = conn.Write(data)
+		got, err := io.ReadAll(l.newThrottle(nil).conn(conn))
+		assert.NoError(t, err)
+		assert.Equal(t, data, got)
+		assert.Equal(t, 3*time.Second, clock.slept)
+	})
+}
+
+func TestServer_ReloadConfig(t *testing.T) {
+	dir := t.TempDir()
+	writeConfig := func(config string) {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, "config.yaml"), []byte("Name: Test\nDescription: Test\nFileRoot: mem://\n"+config), 0644))
+	}
+	writeConfig("MaxTransferRate: 1000\n")
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, agreementFile), nil, 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "MessageBoard.txt"), nil, 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "ThreadedNews.yaml"), []byte("Categories: {}\n"), 0644))
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "Users"), 0755))
+	accounts := NewYAMLAccountStore(filepath.Join(dir, "Users"), &OSFileStore{})
+	access := []byte{0, 0, 0, 0, 0, 0, 0, 0}
+	assert.NoError(t, accounts.Put(&Account{Login: "guest", Name: "Guest", Access: &access}))
+
+	srv, err := New(WithConfigDir(dir))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, int64(1000), srv.Config.MaxTransferRate)
+
+	writeConfig("MaxTransferRate: 2000\nMaxRatePerTransfer: 500\nGroupTransferRates:\n  guests: 100\n")
+	assert.NoError(t, accounts.Put(&Account{Login: "guest", Name: "Guest", Access: &access, TransferRate: 250}))
+
+	assert.NoError(t, srv.ReloadConfig())
+	assert.Equal(t, int64(2000), srv.Config.MaxTransferRate)
+	assert.Equal(t, int64(500), srv.Config.MaxRatePerTransfer)
+	assert.Equal(t, map[string]int64{"guests": 100}, srv.Config.GroupTransferRates)
+	assert.Equal(t, int64(250), srv.Accounts["guest"].TransferRate)
+
+	writeConfig("MaxTransferRate: [")
+	assert.Error(t, srv.ReloadConfig())
+	assert.Equal(t, int64(2000), srv.Config.MaxTransferRate, "a config with errors is not applied")
+}
@@ -0,0 +1,917 @@
+package hotline
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3FileStore is a FileStore backed by an S3-compatible object storage service such as AWS S3 or MinIO.
+//
+// Object storage has no real directories, so folders are represented by zero length "marker" objects whose key ends
+// in a slash, the same convention used by the AWS console.  Folders that only exist implicitly because objects are
+// stored beneath them are also recognized.  Symlinks are not supported.
+//
+// Files opened for writing are spooled to a local temporary file and uploaded when the file is closed.  Reads are
+// served directly from the object store with ranged GET requests, so downloads can be resumed from any offset.
+// Objects larger than a single PutObject or CopyObject request allows are uploaded and copied in parts.
+type S3FileStore struct {
+	Endpoint  string // Base URL of the service, e.g. https://s3.us-east-1.amazonaws.com or http://localhost:9000
+	Bucket    string
+	Prefix    string // Key prefix under which the file area is stored
+	Region    string
+	AccessKey string
+	SecretKey string
+
+	HTTPClient *http.Client
+
+	// maxPutSize and partSize override s3MaxPutSize and s3PartSize when set
+	maxPutSize int64
+	partSize   int64
+}
+
+const (
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+	s3TimeFormat      = "20060102T150405Z"
+
+	s3MaxPutSize = 5 << 30  // Largest object that a single PutObject or CopyObject request can create
+	s3PartSize   = 64 << 20 // Default size of each part of a multipart upload or copy
+	s3MaxParts   = 10000    // Most parts a multipart upload can have
+)
+
+var errS3SymlinkUnsupported = errors.New("symlinks are not supported by the S3 file store")
+
+// NewS3FileStore returns a FileStore that stores files in bucket under prefix
+func NewS3FileStore(endpoint, bucket, prefix, region, accessKey, secretKey string) *S3FileStore {
+	return &S3FileStore{
+		Endpoint:  strings.TrimSuffix(endpoint, "/"),
+		Bucket:    bucket,
+		Prefix:    strings.Trim(prefix, "/"),
+		Region:    region,
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+	}
+}
+
+// key returns the object key for name
+func (s *S3FileStore) key(name string) string {
+	return strings.TrimPrefix(path.Join(s.Prefix, cleanPath(name)), "/")
+}
+
+// dirPrefix returns the key prefix of objects stored beneath the directory name
+func (s *S3FileStore) dirPrefix(name string) string {
+	if k := s.key(name); k != "" {
+		return k + "/"
+	}
+	return ""
+}
+
+func (s *S3FileStore) client() *http.Client {
+	if s.HTTPClient != nil {
+		return s.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// s3Error is the error document returned by the service for failed requests
+type s3Error struct {
+	StatusCode int    `xml:"-"`
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("s3: %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// Is reports a missing object as fs.ErrNotExist so that os.IsNotExist and errors.Is work with S3FileStore errors
+func (e *s3Error) Is(target error) bool {
+	return target == fs.ErrNotExist && e.StatusCode == http.StatusNotFound
+}
+
+// do sends a signed request for key and returns the response.  Responses with a non-2xx status are closed and
+// returned as an *s3Error.
+func (s *S3FileStore) do(method, key string, query url.Values, header http.Header, body io.Reader, contentLength int64) (*http.Response, error) {
+	u := s.Endpoint + "/" + s3EscapePath(s.Bucket+"/"+key)
+	if len(query) > 0 {
+		u += "?" + s3CanonicalQuery(query)
+	}
+
+	// An empty body is sent as no body at all, since a non-nil body of unknown length would be sent chunked
+	if contentLength == 0 {
+		body = nil
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.ContentLength = contentLength
+	}
+
+	signV4(req, s.AccessKey, s.SecretKey, s.Region, s3UnsignedPayload, time.Now())
+
+	resp, err := s.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer func() { _ = resp.Body.Close() }()
+
+		s3Err := &s3Error{StatusCode: resp.StatusCode}
+		if b, err := io.ReadAll(resp.Body); err == nil && len(b) > 0 {
+			_ = xml.Unmarshal(b, s3Err)
+		}
+		if s3Err.Code == "" {
+			s3Err.Code = http.StatusText(resp.StatusCode)
+		}
+		return nil, s3Err
+	}
+
+	return resp, nil
+}
+
+// head returns information about the object stored at key
+func (s *S3FileStore) head(key string) (size int64, modTime time.Time, err error) {
+	resp, err := s.do(http.MethodHead, key, nil, nil, nil, 0)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	_ = resp.Body.Close()
+
+	modTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+
+	return resp.ContentLength, modTime, nil
+}
+
+func (s *S3FileStore) put(key string, body io.Reader, size int64) error {
+	resp, err := s.do(http.MethodPut, key, nil, nil, body, size)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// putFile uploads size bytes of r to key, in parts if the object is too large for a single request
+func (s *S3FileStore) putFile(key string, r io.ReaderAt, size int64) error {
+	if size <= s.maxPut() {
+		return s.put(key, io.NewSectionReader(r, 0, size), size)
+	}
+
+	return s.multipart(key, size, func(query url.Values, offset, length int64) (string, error) {
+		resp, err := s.do(http.MethodPut, key, query, nil, io.NewSectionReader(r, offset, length), length)
+		if err != nil {
+			return "", err
+		}
+		_ = resp.Body.Close()
+
+		return resp.Header.Get("ETag"), nil
+	})
+}
+
+// copyObject copies the object at srcKey, which is size bytes long, to dstKey.  Objects too large for CopyObject are
+// copied in parts with UploadPartCopy.
+func (s *S3FileStore) copyObject(srcKey, dstKey string, size int64) error {
+	header := http.Header{}
+	header.Set("X-Amz-Copy-Source", "/"+s3EscapePath(s.Bucket+"/"+srcKey))
+
+	if size <= s.maxPut() {
+		resp, err := s.do(http.MethodPut, dstKey, nil, header, nil, 0)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+
+	return s.multipart(dstKey, size, func(query url.Values, offset, length int64) (string, error) {
+		partHeader := header.Clone()
+		partHeader.Set("X-Amz-Copy-Source-Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+
+		resp, err := s.do(http.MethodPut, dstKey, query, partHeader, nil, 0)
+		if err != nil {
+			return "", err
+		}
+		defer func() { _ = resp.Body.Close() }()
+
+		var result struct {
+			ETag string `xml:"ETag"`
+		}
+		if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+			return "", err
+		}
+		return result.ETag, nil
+	})
+}
+
+func (s *S3FileStore) maxPut() int64 {
+	if s.maxPutSize > 0 {
+		return s.maxPutSize
+	}
+	return s3MaxPutSize
+}
+
+// partSizeFor returns the part size used for a multipart upload of size bytes
+func (s *S3FileStore) partSizeFor(size int64) int64 {
+	partSize := int64(s3PartSize)
+	if s.partSize > 0 {
+		partSize = s.partSize
+	}
+
+	// Very large objects need bigger parts to stay within the part count limit
+	if minSize := (size + s3MaxParts - 1) / s3MaxParts; partSize < minSize {
+		partSize = minSize
+	}
+	return partSize
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// multipart creates the size byte object at key with a multipart upload.  uploadPart is called for each part with the
+// partNumber and uploadId query of the request that uploads it and returns the ETag of the uploaded part.  The upload
+// is aborted if any step fails so that the service does not keep the parts that were already stored.
+func (s *S3FileStore) multipart(key string, size int64, uploadPart func(query url.Values, offset, length int64) (string, error)) error {
+	resp, err := s.do(http.MethodPost, key, url.Values{"uploads": {""}}, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	_ = resp.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	if err := s.completeMultipart(key, initiated.UploadID, size, uploadPart); err != nil {
+		if resp, abortErr := s.do(http.MethodDelete, key, url.Values{"uploadId": {initiated.UploadID}}, nil, nil, 0); abortErr == nil {
+			_ = resp.Body.Close()
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *S3FileStore) completeMultipart(key, uploadID string, size int64, uploadPart func(query url.Values, offset, length int64) (string, error)) error {
+	var complete struct {
+		XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+		Parts   []s3CompletedPart `xml:"Part"`
+	}
+
+	partSize := s.partSizeFor(size)
+	for offset := int64(0); offset < size; offset += partSize {
+		length := partSize
+		if size-offset < length {
+			length = size - offset
+		}
+
+		partNumber := len(complete.Parts) + 1
+		query := url.Values{"partNumber": {strconv.Itoa(partNumber)}, "uploadId": {uploadID}}
+		etag, err := uploadPart(query, offset, length)
+		if err != nil {
+			return err
+		}
+		complete.Parts = append(complete.Parts, s3CompletedPart{PartNumber: partNumber, ETag: etag})
+	}
+
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(http.MethodPost, key, url.Values{"uploadId": {uploadID}}, nil, bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	// CompleteMultipartUpload can fail after the 200 OK status has been sent, in which case the body is an error
+	// document instead of the result
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	s3Err := &s3Error{StatusCode: resp.StatusCode}
+	if xml.Unmarshal(b, s3Err) == nil && s3Err.Code != "" {
+		return s3Err
+	}
+	return nil
+}
+
+func (s *S3FileStore) deleteObject(key string) error {
+	resp, err := s.do(http.MethodDelete, key, nil, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+type s3Object struct {
+	Key          string    `xml:"Key"`
+	Size         int64     `xml:"Size"`
+	LastModified time.Time `xml:"LastModified"`
+}
+
+type s3ListBucketResult struct {
+	Contents              []s3Object                `xml:"Contents"`
+	CommonPrefixes        []struct{ Prefix string } `xml:"CommonPrefixes"`
+	IsTruncated           bool                      `xml:"IsTruncated"`
+	NextContinuationToken string                    `xml:"NextContinuationToken"`
+}
+
+// list returns the objects and common prefixes stored under prefix.  If maxKeys is greater than zero, at most one
+// page of results is returned.
+func (s *S3FileStore) list(prefix, delimiter string, maxKeys int) (objects []s3Object, prefixes []string, err error) {
+	var token string
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if delimiter != "" {
+			query.Set("delimiter", delimiter)
+		}
+		if maxKeys > 0 {
+			query.Set("max-keys", strconv.Itoa(maxKeys))
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := s.do(http.MethodGet, "", query, nil, nil, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var result s3ListBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		_ = resp.Body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		objects = append(objects, result.Contents...)
+		for _, p := range result.CommonPrefixes {
+			prefixes = append(prefixes, p.Prefix)
+		}
+
+		if !result.IsTruncated || maxKeys > 0 {
+			return objects, prefixes, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// stat returns information about the file or directory name
+func (s *S3FileStore) stat(op, name string) (os.FileInfo, error) {
+	p := cleanPath(name)
+	if p == "/" {
+		return &memFileInfo{name: "/", mode: fs.ModeDir | 0777}, nil
+	}
+
+	size, modTime, err := s.head(s.key(p))
+	if err == nil {
+		return &memFileInfo{name: path.Base(p), size: size, mode: 0644, modTime: modTime}, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+
+	objects, prefixes, err := s.list(s.dirPrefix(p), "/", 1)
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	if len(objects) == 0 && len(prefixes) == 0 {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+
+	info := &memFileInfo{name: path.Base(p), mode: fs.ModeDir | 0777}
+	if len(objects) > 0 && objects[0].Key == s.dirPrefix(p) {
+		info.modTime = objects[0].LastModified
+	}
+	return info, nil
+}
+
+// checkParent returns an error unless the parent of name is an existing directory
+func (s *S3FileStore) checkParent(op, name string) error {
+	info, err := s.stat(op, path.Dir(cleanPath(name)))
+	if err != nil {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	if !info.IsDir() {
+		return &fs.PathError{Op: op, Path: name, Err: errors.New("not a directory")}
+	}
+	return nil
+}
+
+func (s *S3FileStore) Mkdir(name string, perm os.FileMode) error {
+	if _, err := s.stat("mkdir", name); err == nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+	}
+	if err := s.checkParent("mkdir", name); err != nil {
+		return err
+	}
+
+	if err := s.put(s.dirPrefix(name), bytes.NewReader(nil), 0); err != nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+	return nil
+}
+
+func (s *S3FileStore) Stat(name string) (os.FileInfo, error) {
+	return s.stat("stat", name)
+}
+
+// Lstat is the same as Stat because the S3 file store does not support symlinks
+func (s *S3FileStore) Lstat(name string) (os.FileInfo, error) {
+	return s.stat("lstat", name)
+}
+
+func (s *S3FileStore) Open(name string) (File, error) {
+	return s.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (s *S3FileStore) Create(name string) (File, error) {
+	return s.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (s *S3FileStore) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	info, err := s.stat("open", name)
+	exists := err == nil
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	switch {
+	case exists && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case !exists && (!writable || flag&os.O_CREATE == 0):
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	case exists && info.IsDir() && writable:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+	case !exists:
+		if err := s.checkParent("open", name); err != nil {
+			return nil, err
+		}
+	}
+
+	f := &s3File{store: s, key: s.key(name), name: name, info: info}
+	if !writable {
+		return f, nil
+	}
+
+	// Objects can not be modified in place, so writes go to a local spool file that is uploaded on Close
+	f.spool, err = os.CreateTemp("", "mobius-s3-")
+	if err != nil {
+		return nil, err
+	}
+	if exists && flag&os.O_TRUNC == 0 {
+		if err := f.download(); err != nil {
+			_ = f.discardSpool()
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+	}
+	if flag&os.O_APPEND != 0 {
+		if _, err := f.spool.Seek(0, io.SeekEnd); err != nil {
+			_ = f.discardSpool()
+			return nil, err
+		}
+	}
+	f.info = &memFileInfo{name: path.Base(cleanPath(name)), mode: perm.Perm()}
+	f.dirty = !exists || flag&os.O_TRUNC != 0
+
+	return f, nil
+}
+
+func (s *S3FileStore) ReadDir(name string) ([]os.FileInfo, error) {
+	prefix := s.dirPrefix(name)
+	objects, prefixes, err := s.list(prefix, "/", 0)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+
+	var infos []os.FileInfo
+	for _, p := range prefixes {
+		infos = append(infos, &memFileInfo{
+			name: strings.TrimSuffix(strings.TrimPrefix(p, prefix), "/"),
+			mode: fs.ModeDir | 0777,
+		})
+	}
+	for _, obj := range objects {
+		if obj.Key == prefix {
+			continue // directory marker
+		}
+		infos = append(infos, &memFileInfo{
+			name:    strings.TrimPrefix(obj.Key, prefix),
+			size:    obj.Size,
+			mode:    0644,
+			modTime: obj.LastModified,
+		})
+	}
+
+	if len(infos) == 0 {
+		info, err := s.stat("readdir", name)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+		}
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+
+	return infos, nil
+}
+
+func (s *S3FileStore) Readlink(name string) (string, error) {
+	return "", &fs.PathError{Op: "readlink", Path: name, Err: errS3SymlinkUnsupported}
+}
+
+func (s *S3FileStore) Symlink(oldname, newname string) error {
+	return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: errS3SymlinkUnsupported}
+}
+
+// Rename copies the object, or every object beneath a directory, to the new key and deletes the original
+func (s *S3FileStore) Rename(oldpath, newpath string) error {
+	info, err := s.stat("rename", oldpath)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrNotExist}
+	}
+	if err := s.checkParent("rename", newpath); err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		if err := s.copyObject(s.key(oldpath), s.key(newpath), info.Size()); err != nil {
+			return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+		}
+		return s.deleteObject(s.key(oldpath))
+	}
+
+	srcPrefix, dstPrefix := s.dirPrefix(oldpath), s.dirPrefix(newpath)
+	if strings.HasPrefix(dstPrefix, srcPrefix) {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: errors.New("invalid argument")}
+	}
+
+	objects, _, err := s.list(srcPrefix, "", 0)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+	}
+	for _, obj := range objects {
+		if err := s.copyObject(obj.Key, dstPrefix+strings.TrimPrefix(obj.Key, srcPrefix), obj.Size); err != nil {
+			return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+		}
+	}
+	for _, obj := range objects {
+		if err := s.deleteObject(obj.Key); err != nil {
+			return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+		}
+	}
+
+	return nil
+}
+
+func (s *S3FileStore) Remove(name string) error {
+	info, err := s.stat("remove", name)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return s.deleteObject(s.key(name))
+	}
+
+	prefix := s.dirPrefix(name)
+	objects, prefixes, err := s.list(prefix, "/", 2)
+	if err != nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: err}
+	}
+	if len(prefixes) > 0 || len(objects) > 1 || (len(objects) == 1 && objects[0].Key != prefix) {
+		return &fs.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+	}
+
+	return s.deleteObject(prefix)
+}
+
+func (s *S3FileStore) RemoveAll(name string) error {
+	if cleanPath(name) == "/" {
+		return &fs.PathError{Op: "removeall", Path: name, Err: fs.ErrPermission}
+	}
+
+	objects, _, err := s.list(s.dirPrefix(name), "", 0)
+	if err != nil {
+		return &fs.PathError{Op: "removeall", Path: name, Err: err}
+	}
+	for _, obj := range objects {
+		if err := s.deleteObject(obj.Key); err != nil {
+			return &fs.PathError{Op: "removeall", Path: name, Err: err}
+		}
+	}
+
+	// Deleting a key that does not exist is not an error in S3
+	return s.deleteObject(s.key(name))
+}
+
+func (s *S3FileStore) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	if err := s.checkParent("open", name); err != nil {
+		return err
+	}
+	return s.put(s.key(name), bytes.NewReader(data), int64(len(data)))
+}
+
+// s3File is an open S3FileStore file.  Read-only files read directly from the object store; writable files read
+// and write a local spool file that is uploaded when the file is closed.
+type s3File struct {
+	store *S3FileStore
+	key   string
+	name  string
+	info  os.FileInfo
+
+	// read-only state
+	offset int64
+	body   io.ReadCloser // response body of the current sequential read, starting at bodyOffset
+	bodyAt int64
+
+	// writable state
+	spool *os.File
+	dirty bool
+
+	closed bool
+}
+
+func (f *s3File) download() error {
+	resp, err := f.store.do(http.MethodGet, f.key, nil, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if _, err := io.Copy(f.spool, resp.Body); err != nil {
+		return err
+	}
+	_, err = f.spool.Seek(0, io.SeekStart)
+	return err
+}
+
+func (f *s3File) discardSpool() error {
+	err := f.spool.Close()
+	_ = os.Remove(f.spool.Name())
+	return err
+}
+
+func (f *s3File) Read(p []byte) (int, error) {
+	if f.spool != nil {
+		return f.spool.Read(p)
+	}
+	if f.info.IsDir() {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: errors.New("is a directory")}
+	}
+	if f.offset >= f.info.Size() {
+		return 0, io.EOF
+	}
+
+	if f.body == nil || f.bodyAt != f.offset {
+		if f.body != nil {
+			_ = f.body.Close()
+		}
+
+		header := http.Header{}
+		header.Set("Range", fmt.Sprintf("bytes=%d-", f.offset))
+		resp, err := f.store.do(http.MethodGet, f.key, nil, header, nil, 0)
+		if err != nil {
+			return 0, &fs.PathError{Op: "read", Path: f.name, Err: err}
+		}
+		f.body = resp.Body
+		f.bodyAt = f.offset
+	}
+
+	n, err := f.body.Read(p)
+	f.offset += int64(n)
+	f.bodyAt += int64(n)
+	if err == io.EOF && f.offset < f.info.Size() {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (f *s3File) ReadAt(p []byte, off int64) (int, error) {
+	if f.spool != nil {
+		return f.spool.ReadAt(p, off)
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if off >= f.info.Size() {
+		return 0, io.EOF
+	}
+
+	header := http.Header{}
+	header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1))
+	resp, err := f.store.do(http.MethodGet, f.key, nil, header, nil, 0)
+	if err != nil {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: err}
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	n, err := io.ReadFull(resp.Body, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (f *s3File) Write(p []byte) (int, error) {
+	if f.spool == nil {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: errors.New("bad file descriptor")}
+	}
+	f.dirty = true
+	return f.spool.Write(p)
+}
+
+func (f *s3File) Seek(offset int64, whence int) (int64, error) {
+	if f.spool != nil {
+		return f.spool.Seek(offset, whence)
+	}
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.Size()
+	default:
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: errors.New("invalid whence")}
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: errors.New("negative offset")}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *s3File) Stat() (os.FileInfo, error) {
+	if f.spool == nil {
+		return f.info, nil
+	}
+
+	spoolInfo, err := f.spool.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &memFileInfo{name: f.info.Name(), size: spoolInfo.Size(), mode: f.info.Mode(), modTime: spoolInfo.ModTime()}, nil
+}
+
+// Close uploads the contents of a writable file and releases its spool file
+func (f *s3File) Close() error {
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.name, Err: fs.ErrClosed}
+	}
+	f.closed = true
+
+	if f.spool == nil {
+		if f.body != nil {
+			return f.body.Close()
+		}
+		return nil
+	}
+	defer func() { _ = f.discardSpool() }()
+
+	if !f.dirty {
+		return nil
+	}
+
+	size, err := f.spool.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	return f.store.putFile(f.key, f.spool, size)
+}
+
+// signV4 signs req using AWS Signature Version 4.  The host, range and x-amz-* headers are included in the signature.
+// See https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func signV4(req *http.Request, accessKey, secretKey, region, payloadHash string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format(s3TimeFormat)
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		if lk == "range" || strings.HasPrefix(lk, "x-amz-") {
+			headers[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	var names []string
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hexSHA256([]byte(canonicalRequest)),
+	}, "\n")
+
+	signingKey := hmacSHA256([]byte("AWS4"+secretKey), date)
+	signingKey = hmacSHA256(signingKey, region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature,
+	))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func hexSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// s3Escape percent-encodes s as required by Signature Version 4, leaving only unreserved characters as-is
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && keepSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3EscapePath encodes the raw, unescaped object path p.  Keys may legitimately contain sequences such as "%41", so
+// p is never decoded first.
+func s3EscapePath(p string) string {
+	return s3Escape(p, true)
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	var keys []string
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, k := range keys {
+		values := append([]string{}, query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			pairs = append(pairs, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
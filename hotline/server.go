@@ -10,31 +10,26 @@ import (
 	"go.uber.org/zap"
 	"io"
 	"io/fs"
-	"io/ioutil"
-	"math/big"
 	"math/rand"
 	"net"
 	"os"
 	"path"
-	"path/filepath"
 	"runtime/debug"
 	"sort"
-	"strings"
 	"sync"
 	"time"
-
-	"gopkg.in/yaml.v3"
 )
 
 const (
-	userIdleSeconds        = 300 // time in seconds before an inactive user is marked idle
-	idleCheckInterval      = 10  // time in seconds to check for idle users
-	trackerUpdateFrequency = 300 // time in seconds between tracker re-registration
+	idleCheckInterval        = 10  // time in seconds to check for idle users
+	trackerUpdateFrequency   = 300 // time in seconds between tracker re-registration
+	fileTransferClaimTimeout = 300 // time in seconds a requested file transfer waits for the client to connect
 )
 
 var nostalgiaVersion = []byte{0, 0, 2, 0x2c} // version ID used by the Nostalgia client
 
 type Server struct {
+	NetInterface  string
 	Port          int
 	Accounts      map[string]*Account
 	Agreement     []byte
@@ -50,15 +45,33 @@ type Server struct {
 	TrackerPassID [4]byte
 	Stats         *Stats
 
-	FS FileStore
+	FS                FileStore
+	AccountStore      AccountStore
+	FlatNewsStore     FlatNewsStore
+	ThreadedNewsStore ThreadedNewsStore
+	Clock             Clock
 
-	// newsReader io.Reader
-	// newsWriter io.WriteCloser
+	// Listen creates the transaction and file transfer listeners; defaults to net.Listen
+	Listen func(network, address string) (net.Listener, error)
 
 	outbox chan Transaction
 
+	// fileTypes infers the type and creator codes of files that have none stored; built from Config by New
+	fileTypes *fileTypeMap
+
+	// rateLimiter throttles file transfers; created by New.  Transfers are not throttled if it is nil.
+	rateLimiter *rateLimiter
+
+	// handlers contains transaction types registered with RegisterTransactionType.  These take precedence over the
+	// built-in TransactionHandlers.
+	handlers    map[uint16]TransactionType
+	handlersMux sync.RWMutex
+
 	mux         sync.Mutex
 	flatNewsMux sync.Mutex
+
+	// uploadedBytesMux serializes saving the UploadedBytes of accounts, which is done without holding mux
+	uploadedBytesMux sync.Mutex
 }
 
 type PrivateChat struct {
@@ -69,36 +82,80 @@ type PrivateChat struct {
 func (s *Server) ListenAndServe(ctx context.Context, cancelRoot context.CancelFunc) error {
 	s.Logger.Infow("Hotline server started",
 		"version", VERSION,
-		"API port", fmt.Sprintf(":%v", s.Port),
-		"Transfer port", fmt.Sprintf(":%v", s.Port+1),
+		"API port", fmt.Sprintf("%s:%v", s.NetInterface, s.Port),
+		"Transfer port", fmt.Sprintf("%s:%v", s.NetInterface, s.Port+1),
 	)
 
-	var wg sync.WaitGroup
+	if s.Config.EnableTrackerRegistration {
+		go s.registerWithTrackers(ctx)
+	}
 
-	wg.Add(1)
-	go func() {
-		ln, err := net.Listen("tcp", fmt.Sprintf("%s:%v", "", s.Port))
-		if err != nil {
-			s.Logger.Fatal(err)
-		}
+	// Start Client Keepalive go routine
+	go s.keepaliveHandler(ctx)
 
-		s.Logger.Fatal(s.Serve(ctx, cancelRoot, ln))
-	}()
+	if s.Config.EnableTrash {
+		go s.trashPurger(ctx)
+	}
+	if s.Config.StaleUploadAge > 0 {
+		go s.uploadJanitor(ctx)
+	}
 
-	wg.Add(1)
+	ln, err := s.listen("tcp", fmt.Sprintf("%s:%v", s.NetInterface, s.Port))
+	if err != nil {
+		return err
+	}
+	fileLn, err := s.listen("tcp", fmt.Sprintf("%s:%v", s.NetInterface, s.Port+1))
+	if err != nil {
+		_ = ln.Close()
+		return err
+	}
+
+	// Closing the listeners is what stops both accept loops
 	go func() {
-		ln, err := net.Listen("tcp", fmt.Sprintf("%s:%v", "", s.Port+1))
-		if err != nil {
-			s.Logger.Fatal(err)
+		<-ctx.Done()
+		_ = ln.Close()
+		_ = fileLn.Close()
+	}()
 
-		}
+	errs := make(chan error, 2)
+	go func() { errs <- s.Serve(ctx, cancelRoot, ln) }()
+	go func() { errs <- s.ServeFileTransfers(fileLn) }()
 
-		s.Logger.Fatal(s.ServeFileTransfers(ln))
-	}()
+	// If either listener fails the other is shut down too, so the server never runs half up
+	err = <-errs
+	_ = ln.Close()
+	_ = fileLn.Close()
+	<-errs
 
-	wg.Wait()
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
 
-	return nil
+// listen creates a listener with the configured listener provider, falling back to net.Listen.  If PROXY protocol
+// support is enabled the listener is wrapped to read the real client address from trusted proxies.
+func (s *Server) listen(network, address string) (net.Listener, error) {
+	var ln net.Listener
+	var err error
+	if s.Listen != nil {
+		ln, err = s.Listen(network, address)
+	} else {
+		ln, err = net.Listen(network, address)
+	}
+	if err != nil || !s.Config.ProxyProtocol {
+		return ln, err
+	}
+
+	return newProxyListener(ln, s.Config.TrustedProxies)
+}
+
+// now returns the current time from the server Clock
+func (s *Server) now() time.Time {
+	if s.Clock != nil {
+		return s.Clock.Now()
+	}
+	return time.Now()
 }
 
 func (s *Server) ServeFileTransfers(ln net.Listener) error {
@@ -107,9 +164,10 @@ func (s *Server) ServeFileTransfers(ln net.Listener) error {
 		if err != nil {
 			return err
 		}
+		s.setKeepAlive(conn)
 
 		go func() {
-			if err := s.handleFileTransfer(conn); err != nil {
+			if err := s.handleFileTransfer(newTimeoutConn(conn, s.Config.readTimeout(), s.Config.writeTimeout())); err != nil {
 				s.Logger.Errorw("file transfer error", "reason", err)
 			}
 		}()
@@ -132,7 +190,7 @@ func (s *Server) sendTransaction(t Transaction) error {
 	userName := string(client.UserName)
 	login := client.Account.Login
 
-	handler := TransactionHandlers[requestNum]
+	handler, _ := s.transactionType(requestNum)
 
 	b, err := t.MarshalBinary()
 	if err != nil {
@@ -140,6 +198,9 @@ func (s *Server) sendTransaction(t Transaction) error {
 	}
 	var n int
 	if n, err = client.Connection.Write(b); err != nil {
+		// A failed write means the client is gone; closing the connection ends its read loop and removes it from
+		// the user list.
+		_ = client.Connection.Close()
 		return err
 	}
 	s.Logger.Debugw("Sent Transaction",
@@ -153,13 +214,25 @@ func (s *Server) sendTransaction(t Transaction) error {
 	return nil
 }
 
+// acceptRetryDelay is how long Serve waits before accepting again after an Accept error
+const acceptRetryDelay = 100 * time.Millisecond
+
+// Serve accepts Hotline client connections on ln until ln is closed or ctx is cancelled.
 func (s *Server) Serve(ctx context.Context, cancelRoot context.CancelFunc, ln net.Listener) error {
 
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) || ctx.Err() != nil {
+				return err
+			}
+			// Temporary failures such as running out of file descriptors are retried after a pause rather
+			// than in a tight loop
 			s.Logger.Errorw("error accepting connection", "err", err)
+			time.Sleep(acceptRetryDelay)
+			continue
 		}
+		s.setKeepAlive(conn)
 
 		go func() {
 			for {
@@ -187,88 +260,175 @@ const (
 	agreementFile = "Agreement.txt"
 )
 
-// NewServer constructs a new Server from a config dir
+// NewServer constructs a new Server from a config dir.  If FS is nil the file area backend is selected by the
+// FileRoot config setting.
 func NewServer(configDir, netInterface string, netPort int, logger *zap.SugaredLogger, FS FileStore) (*Server, error) {
+	return New(
+		WithConfigDir(configDir),
+		WithInterface(netInterface),
+		WithPort(netPort),
+		WithLogger(logger),
+		WithFileStore(FS),
+	)
+}
+
+// New constructs a new Server configured by opts.  Stores that are not provided default to in-memory
+// implementations and the file area defaults to the backend selected by Config.FileRoot (see newFileStore).  No listeners or background goroutines are
+// started until ListenAndServe is called.
+func New(opts ...Option) (*Server, error) {
 	server := Server{
-		Port:          netPort,
 		Accounts:      make(map[string]*Account),
 		Config:        new(Config),
 		Clients:       make(map[uint16]*ClientConn),
 		FileTransfers: make(map[uint32]*FileTransfer),
 		PrivateChats:  make(map[uint32]*PrivateChat),
-		ConfigDir:     configDir,
-		Logger:        logger,
 		NextGuestID:   new(uint16),
 		outbox:        make(chan Transaction),
-		Stats:         &Stats{StartTime: time.Now()},
 		ThreadedNews:  &ThreadedNews{},
-		FS:            FS,
 	}
 
-	var err error
+	for _, opt := range opts {
+		if err := opt(&server); err != nil {
+			return nil, err
+		}
+	}
 
-	// generate a new random passID for tracker registration
-	if _, err := rand.Read(server.TrackerPassID[:]); err != nil {
-		return nil, err
+	if server.Logger == nil {
+		server.Logger = zap.NewNop().Sugar()
+	}
+	if server.FS == nil {
+		fileStore, fileRoot, err := newFileStore(server.Config.FileRoot)
+		if err != nil {
+			return nil, err
+		}
+		server.FS = fileStore
+		server.Config.FileRoot = fileRoot
+	}
+	if server.AccountStore == nil {
+		server.AccountStore = NewMemAccountStore()
+	}
+	if server.FlatNewsStore == nil {
+		server.FlatNewsStore = &MemFlatNewsStore{}
+	}
+	if server.ThreadedNewsStore == nil {
+		server.ThreadedNewsStore = &MemThreadedNewsStore{}
+	}
+	if server.Clock == nil {
+		server.Clock = realClock{}
 	}
 
-	server.Agreement, err = os.ReadFile(configDir + agreementFile)
-	if err != nil {
+	if err := validator.New().Struct(server.Config); err != nil {
 		return nil, err
 	}
+	server.fileTypes = newFileTypeMap(server.Config.FileTypes, server.Config.MIMETypes)
+	server.rateLimiter = newRateLimiter(server.Config, server.Clock)
 
-	if server.FlatNews, err = os.ReadFile(configDir + "MessageBoard.txt"); err != nil {
-		return nil, err
+	if len(server.Config.Mounts) > 0 {
+		mountFS := NewMountFileStore(server.FS, server.Config.FileRoot)
+		for _, mount := range server.Config.Mounts {
+			fileStore, dir, err := newFileStore(mount.Path)
+			if err != nil {
+				return nil, fmt.Errorf("mount %q: %w", mount.Name, err)
+			}
+			if err := mountFS.Mount(mount, fileStore, dir); err != nil {
+				return nil, err
+			}
+		}
+		server.FS = mountFS
 	}
 
-	if err := server.loadThreadedNews(configDir + "ThreadedNews.yaml"); err != nil {
+	server.Stats = &Stats{StartTime: server.now()}
+
+	var err error
+
+	// generate a new random passID for tracker registration
+	if _, err := rand.Read(server.TrackerPassID[:]); err != nil {
 		return nil, err
 	}
 
-	if err := server.loadConfig(configDir + "config.yaml"); err != nil {
+	accounts, err := server.AccountStore.List()
+	if err != nil {
 		return nil, err
 	}
+	for _, account := range accounts {
+		server.Accounts[account.Login] = account
+	}
 
-	if err := server.loadAccounts(configDir + "Users/"); err != nil {
+	if server.FlatNews, err = server.FlatNewsStore.Load(); err != nil {
 		return nil, err
 	}
 
-	server.Config.FileRoot = configDir + "Files/"
+	if server.ThreadedNews, err = server.ThreadedNewsStore.Load(); err != nil {
+		return nil, err
+	}
 
 	*server.NextGuestID = 1
 
-	if server.Config.EnableTrackerRegistration {
-		server.Logger.Infow(
-			"Tracker registration enabled",
-			"frequency", fmt.Sprintf("%vs", trackerUpdateFrequency),
-			"trackers", server.Config.Trackers,
-		)
+	return &server, nil
+}
 
-		go func() {
-			for {
-				tr := &TrackerRegistration{
-					UserCount:   server.userCount(),
-					PassID:      server.TrackerPassID[:],
-					Name:        server.Config.Name,
-					Description: server.Config.Description,
-				}
-				binary.BigEndian.PutUint16(tr.Port[:], uint16(server.Port))
-				for _, t := range server.Config.Trackers {
-					if err := register(t, tr); err != nil {
-						server.Logger.Errorw("unable to register with tracker %v", "error", err)
-					}
-					server.Logger.Infow("Sent Tracker registration", "data", tr)
-				}
+// registerWithTrackers periodically sends a tracker registration to each configured tracker until ctx is done
+func (s *Server) registerWithTrackers(ctx context.Context) {
+	s.Logger.Infow(
+		"Tracker registration enabled",
+		"frequency", fmt.Sprintf("%vs", trackerUpdateFrequency),
+		"trackers", s.Config.Trackers,
+	)
+
+	ticker := time.NewTicker(trackerUpdateFrequency * time.Second)
+	defer ticker.Stop()
 
-				time.Sleep(trackerUpdateFrequency * time.Second)
+	for {
+		tr := &TrackerRegistration{
+			UserCount:   s.userCount(),
+			PassID:      s.TrackerPassID[:],
+			Name:        s.Config.Name,
+			Description: s.Config.Description,
+		}
+		binary.BigEndian.PutUint16(tr.Port[:], uint16(s.Port))
+		for _, t := range s.Config.Trackers {
+			if err := register(t, tr); err != nil {
+				s.Logger.Errorw("unable to register with tracker %v", "error", err)
 			}
-		}()
+			s.Logger.Infow("Sent Tracker registration", "data", tr)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
 	}
+}
 
-	// Start Client Keepalive go routine
-	go server.keepaliveHandler()
+// RegisterTransactionType adds a transaction type to the server, replacing any existing handler for the same ID.
+// This allows programs that embed the hotline package to handle custom transactions or override the built-in
+// handlers without modifying the package-level TransactionHandlers map.
+func (s *Server) RegisterTransactionType(id uint16, tt TransactionType) {
+	s.handlersMux.Lock()
+	defer s.handlersMux.Unlock()
 
-	return &server, nil
+	if s.handlers == nil {
+		s.handlers = make(map[uint16]TransactionType)
+	}
+	if tt.Name == "" {
+		tt.Name = fmt.Sprintf("tran%d", id)
+	}
+	s.handlers[id] = tt
+}
+
+// transactionType looks up the TransactionType for id, preferring types registered on the server over the built-in
+// TransactionHandlers
+func (s *Server) transactionType(id uint16) (TransactionType, bool) {
+	s.handlersMux.RLock()
+	tt, ok := s.handlers[id]
+	s.handlersMux.RUnlock()
+	if ok {
+		return tt, true
+	}
+
+	tt, ok = TransactionHandlers[id]
+	return tt, ok
 }
 
 func (s *Server) userCount() int {
@@ -278,30 +438,106 @@ func (s *Server) userCount() int {
 	return len(s.Clients)
 }
 
-func (s *Server) keepaliveHandler() {
+func (s *Server) keepaliveHandler(ctx context.Context) {
+	ticker := time.NewTicker(idleCheckInterval * time.Second)
+	defer ticker.Stop()
+
 	for {
-		time.Sleep(idleCheckInterval * time.Second)
-		s.mux.Lock()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.checkIdleUsers(idleCheckInterval)
+		s.checkLiveness()
+		s.reclaimFileTransfers()
+	}
+}
+
+// checkLiveness sends a probe to clients that have been silent for longer than the configured ReadTimeout.  Clients
+// that send keepalives are disconnected by their read deadline instead, but older clients such as HL 1.2.3 never send
+// keepalives, so a write is the only way to find out if their connection is dead.  A probe that fails to write closes
+// the connection.
+func (s *Server) checkLiveness() {
+	timeout := s.Config.readTimeout()
+	if timeout == 0 {
+		return
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	now := s.now()
+	for _, c := range sortedClients(s.Clients) {
+		if c.sendsKeepalives || !c.Agreed {
+			continue
+		}
+		if now.Sub(c.lastSeen) < timeout || now.Sub(c.lastProbe) < timeout {
+			continue
+		}
+
+		c.lastProbe = now
+		s.outbox <- *NewTransaction(tranKeepAlive, c.ID)
+	}
+}
+
+// reclaimFileTransfers removes file transfers that were requested but never started by the client
+func (s *Server) reclaimFileTransfers() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	now := s.now()
+	for refNum, ft := range s.FileTransfers {
+		if ft.active || now.Sub(ft.created) < fileTransferClaimTimeout*time.Second {
+			continue
+		}
+
+		s.Logger.Infow("Reclaiming unclaimed file transfer", "transactionRef", ft.ReferenceNumber, "fileName", string(ft.FileName))
+		delete(s.FileTransfers, refNum)
+		s.removeClientTransfer(ft)
+	}
+}
+
+// removeClientTransfer removes ft from the list of transfers of the client that requested it.  The caller must hold
+// s.mux.
+func (s *Server) removeClientTransfer(ft *FileTransfer) {
+	c := ft.clientConn
+	if c == nil {
+		return
+	}
 
-		for _, c := range s.Clients {
-			c.IdleTime += idleCheckInterval
-			if c.IdleTime > userIdleSeconds && !c.Idle {
-				c.Idle = true
-
-				flagBitmap := big.NewInt(int64(binary.BigEndian.Uint16(*c.Flags)))
-				flagBitmap.SetBit(flagBitmap, userFlagAway, 1)
-				binary.BigEndian.PutUint16(*c.Flags, uint16(flagBitmap.Int64()))
-
-				c.sendAll(
-					tranNotifyChangeUser,
-					NewField(fieldUserID, *c.ID),
-					NewField(fieldUserFlags, *c.Flags),
-					NewField(fieldUserName, c.UserName),
-					NewField(fieldUserIconID, *c.Icon),
-				)
+	transfers := c.Transfers[ft.Type]
+	for i, t := range transfers {
+		if t == ft {
+			c.Transfers[ft.Type] = append(transfers[:i], transfers[i+1:]...)
+			return
+		}
+	}
+}
+
+// checkIdleUsers advances the idle timer of each connected client by elapsed seconds, marks clients that have passed
+// the configured away threshold as away, and disconnects clients that have passed the idle disconnect threshold.
+func (s *Server) checkIdleUsers(elapsed int) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	awayTime := s.Config.idleAwayTime()
+	disconnectTime := s.Config.IdleDisconnectTime
+
+	for _, c := range s.Clients {
+		c.IdleTime += elapsed
+
+		if disconnectTime > 0 && c.IdleTime > disconnectTime && !c.idleExempt() {
+			s.Logger.Infow("Disconnecting idle user", "login", c.Account.Login, "name", string(c.UserName), "IdleTime", c.IdleTime)
+			if err := c.Connection.Close(); err != nil {
+				s.Logger.Errorw("error closing client connection", "RemoteAddr", c.RemoteAddr)
 			}
+			continue
+		}
+
+		if awayTime > 0 && c.IdleTime > awayTime && !c.Idle {
+			c.setIdle(true)
 		}
-		s.mux.Unlock()
 	}
 }
 
@@ -309,16 +545,7 @@ func (s *Server) writeThreadedNews() error {
 	s.mux.Lock()
 	defer s.mux.Unlock()
 
-	out, err := yaml.Marshal(s.ThreadedNews)
-	if err != nil {
-		return err
-	}
-	err = ioutil.WriteFile(
-		s.ConfigDir+"ThreadedNews.yaml",
-		out,
-		0666,
-	)
-	return err
+	return s.ThreadedNewsStore.Save(s.ThreadedNews)
 }
 
 func (s *Server) NewClientConn(conn net.Conn, remoteAddr string) *ClientConn {
@@ -358,13 +585,12 @@ func (s *Server) NewUser(login, name, password string, access []byte) error {
 		Password: hashAndSalt([]byte(password)),
 		Access:   &access,
 	}
-	out, err := yaml.Marshal(&account)
-	if err != nil {
+	if err := s.AccountStore.Put(&account); err != nil {
 		return err
 	}
 	s.Accounts[login] = &account
 
-	return s.FS.WriteFile(s.ConfigDir+"Users/"+login+".yaml", out, 0666)
+	return nil
 }
 
 func (s *Server) UpdateUser(login, newLogin, name, password string, access []byte) error {
@@ -373,11 +599,11 @@ func (s *Server) UpdateUser(login, newLogin, name, password string, access []byt
 
 	// update renames the user login
 	if login != newLogin {
-		err := os.Rename(s.ConfigDir+"Users/"+login+".yaml", s.ConfigDir+"Users/"+newLogin+".yaml")
-		if err != nil {
+		if err := s.AccountStore.Rename(login, newLogin); err != nil {
 			return err
 		}
 		s.Accounts[newLogin] = s.Accounts[login]
+		s.Accounts[newLogin].Login = newLogin
 		delete(s.Accounts, login)
 	}
 
@@ -386,15 +612,7 @@ func (s *Server) UpdateUser(login, newLogin, name, password string, access []byt
 	account.Name = name
 	account.Password = password
 
-	out, err := yaml.Marshal(&account)
-	if err != nil {
-		return err
-	}
-	if err := os.WriteFile(s.ConfigDir+"Users/"+newLogin+".yaml", out, 0666); err != nil {
-		return err
-	}
-
-	return nil
+	return s.AccountStore.Put(account)
 }
 
 // DeleteUser deletes the user account
@@ -404,7 +622,7 @@ func (s *Server) DeleteUser(login string) error {
 
 	delete(s.Accounts, login)
 
-	return s.FS.Remove(s.ConfigDir + "Users/" + login + ".yaml")
+	return s.AccountStore.Delete(login)
 }
 
 func (s *Server) connectedUsers() []Field {
@@ -427,65 +645,6 @@ func (s *Server) connectedUsers() []Field {
 	return connectedUsers
 }
 
-// loadThreadedNews loads the threaded news data from disk
-func (s *Server) loadThreadedNews(threadedNewsPath string) error {
-	fh, err := os.Open(threadedNewsPath)
-	if err != nil {
-		return err
-	}
-	decoder := yaml.NewDecoder(fh)
-
-	return decoder.Decode(s.ThreadedNews)
-}
-
-// loadAccounts loads account data from disk
-func (s *Server) loadAccounts(userDir string) error {
-	matches, err := filepath.Glob(path.Join(userDir, "*.yaml"))
-	if err != nil {
-		return err
-	}
-
-	if len(matches) == 0 {
-		return errors.New("no user accounts found in " + userDir)
-	}
-
-	for _, file := range matches {
-		fh, err := s.FS.Open(file)
-		if err != nil {
-			return err
-		}
-
-		account := Account{}
-		decoder := yaml.NewDecoder(fh)
-		if err := decoder.Decode(&account); err != nil {
-			return err
-		}
-
-		s.Accounts[account.Login] = &account
-	}
-	return nil
-}
-
-func (s *Server) loadConfig(path string) error {
-	fh, err := s.FS.Open(path)
-	if err != nil {
-		return err
-	}
-
-	decoder := yaml.NewDecoder(fh)
-	err = decoder.Decode(s.Config)
-	if err != nil {
-		return err
-	}
-
-	validate := validator.New()
-	err = validate.Struct(s.Config)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
 const (
 	minTransactionLen = 22 // minimum length of any transaction
 )
@@ -500,9 +659,13 @@ func dontPanic(logger *zap.SugaredLogger) {
 }
 
 // handleNewConnection takes a new net.Conn and performs the initial login sequence
-func (s *Server) handleNewConnection(conn net.Conn, remoteAddr string) error {
+func (s *Server) handleNewConnection(rawConn net.Conn, remoteAddr string) error {
 	defer dontPanic(s.Logger)
 
+	// The read deadline applies to the login sequence for every client, and afterwards only to clients known to send
+	// keepalives.  Clients that never send keepalives are checked by checkLiveness instead.
+	conn := newTimeoutConn(rawConn, s.Config.readTimeout(), s.Config.writeTimeout())
+
 	if err := Handshake(conn); err != nil {
 		return err
 	}
@@ -566,11 +729,19 @@ func (s *Server) handleNewConnection(conn net.Conn, remoteAddr string) error {
 
 	s.Logger.Infow("Client connection received", "login", login, "version", *c.Version, "RemoteAddr", remoteAddr)
 
-	s.outbox <- c.NewReply(clientLogin,
+	replyFields := []Field{
 		NewField(fieldVersion, []byte{0x00, 0xbe}),
 		NewField(fieldCommunityBannerID, []byte{0x00, 0x01}),
 		NewField(fieldServerName, []byte(s.Config.Name)),
-	)
+	}
+
+	// Clients that support large files announce it in the capabilities field, which the server echoes back to confirm
+	if caps := clientLogin.GetField(fieldCapabilities).Data; len(caps) == 2 && binary.BigEndian.Uint16(caps)&capLargeFiles != 0 {
+		c.largeFiles = true
+		replyFields = append(replyFields, NewField(fieldCapabilities, []byte{0x00, capLargeFiles}))
+	}
+
+	s.outbox <- c.NewReply(clientLogin, replyFields...)
 
 	// Send user access privs so client UI knows how to behave
 	c.Server.outbox <- *NewTransaction(tranUserAccess, c.ID, NewField(fieldUserAccess, *c.Account.Access))
@@ -603,10 +774,20 @@ func (s *Server) handleNewConnection(conn net.Conn, remoteAddr string) error {
 		buf = make([]byte, readBuffSize)
 		tranBuff = tranBuff[tReadlen:]
 
+		if !c.sendsKeepalives {
+			conn.readTimeout = 0
+		} else {
+			conn.readTimeout = s.Config.readTimeout()
+		}
+
 		readLen, err := c.Connection.Read(buf)
 		if err != nil {
 			return err
 		}
+
+		s.mux.Lock()
+		c.lastSeen = s.now()
+		s.mux.Unlock()
 		tranBuff = append(tranBuff, buf[:readLen]...)
 
 		// We may have read multiple requests worth of bytes from Connection.Read.  readTransactions splits them
@@ -652,10 +833,6 @@ func (s *Server) NewPrivateChat(cc *ClientConn) []byte {
 	return randID
 }
 
-const dlFldrActionSendFile = 1
-const dlFldrActionResumeFile = 2
-const dlFldrActionNextFile = 3
-
 // handleFileTransfer receives a client net.Conn from the file transfer server, performs the requested transfer type, then closes the connection
 func (s *Server) handleFileTransfer(conn io.ReadWriteCloser) error {
 	defer func() {
@@ -678,288 +855,163 @@ func (s *Server) handleFileTransfer(conn io.ReadWriteCloser) error {
 	}
 
 	transferRefNum := binary.BigEndian.Uint32(t.ReferenceNumber[:])
-	defer func() {
-		s.mux.Lock()
-		delete(s.FileTransfers, transferRefNum)
-		s.mux.Unlock()
-	}()
+
+	progress := &transferProgress{start: s.now()}
+	cancelConn := conn
 
 	s.mux.Lock()
 	fileTransfer, ok := s.FileTransfers[transferRefNum]
+	if ok {
+		fileTransfer.active = true
+		fileTransfer.progress = progress
+		fileTransfer.cancel = func() { _ = cancelConn.Close() }
+		s.Stats.ActiveTransfers += 1
+	}
 	s.mux.Unlock()
 	if !ok {
 		return errors.New("invalid transaction ID")
 	}
 
+	defer func() {
+		s.mux.Lock()
+		delete(s.FileTransfers, transferRefNum)
+		s.removeClientTransfer(fileTransfer)
+		s.Stats.ActiveTransfers -= 1
+		s.mux.Unlock()
+	}()
+
+	if err := s.checkTransferACL(fileTransfer); err != nil {
+		return err
+	}
+
+	conn = progress.conn(conn)
+	if s.rateLimiter != nil {
+		conn = s.rateLimiter.newThrottle(fileTransfer.account()).conn(conn)
+	}
+
 	switch fileTransfer.Type {
 	case FileDownload:
 		s.Stats.DownloadCounter += 1
 
-		fullFilePath, err := readPath(s.Config.FileRoot, fileTransfer.FilePath, fileTransfer.FileName)
+		fullFilePath, err := s.resolvePath(fileTransfer.FilePath, fileTransfer.FileName)
 		if err != nil {
 			return err
 		}
 
-		var dataOffset int64
+		var dataOffset, rsrcOffset int64
 		if fileTransfer.fileResumeData != nil {
-			dataOffset = int64(binary.BigEndian.Uint32(fileTransfer.fileResumeData.ForkInfoList[0].DataSize[:]))
+			dataOffset, rsrcOffset = fileTransfer.fileResumeData.forkOffsets(fileTransfer.largeFiles())
 		}
 
-		ffo, err := NewFlattenedFileObject(s.Config.FileRoot, fileTransfer.FilePath, fileTransfer.FileName, dataOffset)
+		ffo, err := NewFlattenedFileObject(s.FS, s.fileTypes, s.Config.FileRoot, fileTransfer.FilePath, fileTransfer.FileName, dataOffset)
 		if err != nil {
 			return err
 		}
+		ffo.resumeResourceFork(rsrcOffset)
 
 		s.Logger.Infow("File download started", "filePath", fullFilePath, "transactionRef", fileTransfer.ReferenceNumber)
 
-		if fileTransfer.options == nil {
-			// Start by sending flat file object to client
-			if _, err := conn.Write(ffo.BinaryMarshal()); err != nil {
-				return err
-			}
-		}
-
-		file, err := s.FS.Open(fullFilePath)
-		if err != nil {
+		// A file preview is the data fork alone, without the flat file object
+		if err := sendFile(conn, s.FS, fullFilePath, ffo, dataOffset, rsrcOffset, fileTransfer.options != nil); err != nil {
 			return err
 		}
-
-		sendBuffer := make([]byte, 1048576)
-		var totalSent int64
-		for {
-			var bytesRead int
-			if bytesRead, err = file.ReadAt(sendBuffer, dataOffset+totalSent); err == io.EOF {
-				if _, err := conn.Write(sendBuffer[:bytesRead]); err != nil {
-					return err
-				}
-				break
-			}
-			if err != nil {
-				return err
-			}
-			totalSent += int64(bytesRead)
-
-			fileTransfer.BytesSent += bytesRead
-
-			if _, err := conn.Write(sendBuffer[:bytesRead]); err != nil {
-				return err
-			}
-		}
 	case FileUpload:
 		s.Stats.UploadCounter += 1
 
-		destinationFile := s.Config.FileRoot + ReadFilePath(fileTransfer.FilePath) + "/" + string(fileTransfer.FileName)
+		destinationFile, err := s.resolvePath(fileTransfer.FilePath, fileTransfer.FileName)
+		if err != nil {
+			return err
+		}
 
-		var file *os.File
+		var file File
+		budget := s.newUploadBudget(fileTransfer.account(), path.Dir(destinationFile), fileTransfer)
 
 		// A file upload has three possible cases:
 		// 1) Upload a new file
 		// 2) Resume a partially transferred file
 		// 3) Replace a fully uploaded file
-		// Unfortunately we have to infer which case applies by inspecting what is already on the file system
-
-		// 1) Check for existing file:
-		_, err := os.Stat(destinationFile)
-		if err == nil {
-			// If found, that means this upload is intended to replace the file
-			if err = os.Remove(destinationFile); err != nil {
+		// A resumed upload is one the client was sent resume data for; it appends to the incomplete file whether or not
+		// it replaces an existing file.  Otherwise we have to infer which case applies by inspecting what is already on
+		// the file system.
+		_, err = s.FS.Stat(destinationFile)
+		switch {
+		case fileTransfer.fileResumeData != nil || errors.Is(err, fs.ErrNotExist):
+			// Open or create the incomplete file and append to it
+			if fi, err := s.FS.Stat(destinationFile + incompleteFileSuffix); err == nil {
+				budget.startFile(uint64(fi.Size()))
+			}
+			file, err = s.FS.OpenFile(destinationFile+incompleteFileSuffix, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+			if err != nil {
 				return err
 			}
-			file, err = os.Create(destinationFile + incompleteFileSuffix)
-		}
-		if errors.Is(err, fs.ErrNotExist) {
-			// If not found, open or create a new incomplete file
-			file, err = os.OpenFile(destinationFile+incompleteFileSuffix, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		case err == nil:
+			// The upload replaces the existing file, which is kept until the replacement is complete
+			file, err = s.FS.Create(destinationFile + incompleteFileSuffix)
 			if err != nil {
 				return err
 			}
+		default:
+			return err
 		}
 
-		defer func() { _ = file.Close() }()
-
 		s.Logger.Infow("File upload started", "transactionRef", fileTransfer.ReferenceNumber, "dstFile", destinationFile)
 
-		// TODO: replace io.Discard with a real file when ready to implement storing of resource fork data
-		if err := receiveFile(conn, file, io.Discard); err != nil {
+		// The incomplete file is closed before it is renamed; some FileStores only persist writes on Close.  It is
+		// kept when the transfer fails so that the upload can be resumed.
+		var infoFork, rsrcFork bytes.Buffer
+		err = receiveFile(conn, budget.writer(file), budget.writer(&rsrcFork), &infoFork, fileTransfer.largeFiles())
+		budget.save()
+		if err != nil {
+			_ = file.Close()
+			if errors.Is(err, errUploadLimit) {
+				s.stopUpload(fileTransfer, "file", destinationFile+incompleteFileSuffix, err)
+			}
+			return err
+		}
+		if err := file.Close(); err != nil {
 			return err
 		}
 
-		if err := os.Rename(destinationFile+".incomplete", destinationFile); err != nil {
+		if err := s.replaceFile(destinationFile+incompleteFileSuffix, destinationFile); err != nil {
+			return err
+		}
+
+		if err := saveForks(s.FS, s.fileTypes, destinationFile, infoFork.Bytes(), rsrcFork.Bytes()); err != nil {
 			return err
 		}
 
 		s.Logger.Infow("File upload complete", "transactionRef", fileTransfer.ReferenceNumber, "dstFile", destinationFile)
+
+		s.notifyDropBoxUpload(fileTransfer.clientConn, path.Dir(destinationFile), string(fileTransfer.FileName))
 	case FolderDownload:
-		// Folder Download flow:
-		// 1. Get filePath from the transfer
-		// 2. Iterate over files
-		// 3. For each file:
-		// 	 Send file header to client
-		// The client can reply in 3 ways:
-		//
-		// 1. If type is an odd number (unknown type?), or file download for the current file is completed:
-		//		client sends []byte{0x00, 0x03} to tell the server to continue to the next file
-		//
-		// 2. If download of a file is to be resumed:
-		//		client sends:
-		//			[]byte{0x00, 0x02} // download folder action
-		//			[2]byte // Resume data size
-		//			[]byte file resume data (see myField_FileResumeData)
-		//
-		// 3. Otherwise, download of the file is requested and client sends []byte{0x00, 0x01}
-		//
-		// When download is requested (case 2 or 3), server replies with:
-		// 			[4]byte - file size
-		//			[]byte  - Flattened File Object
-		//
-		// After every file download, client could request next file with:
-		// 			[]byte{0x00, 0x03}
-		//
-		// This notifies the server to send the next item header
-
-		fullFilePath, err := readPath(s.Config.FileRoot, fileTransfer.FilePath, fileTransfer.FileName)
+		fullFilePath, err := s.resolvePath(fileTransfer.FilePath, fileTransfer.FileName)
 		if err != nil {
 			return err
 		}
 
-		basePathLen := len(fullFilePath)
-
 		s.Logger.Infow("Start folder download", "path", fullFilePath, "ReferenceNumber", fileTransfer.ReferenceNumber)
 
-		nextAction := make([]byte, 2)
-		if _, err := io.ReadFull(conn, nextAction); err != nil {
-			return err
+		// Drop boxes and folders denied by ACLs are left out, as they were when the folder item count was sent
+		var include func(string) bool
+		if fileTransfer.clientConn != nil {
+			include = fileTransfer.clientConn.canTransferFolder
 		}
 
-		i := 0
-		err = filepath.Walk(fullFilePath+"/", func(path string, info os.FileInfo, err error) error {
-			s.Stats.DownloadCounter += 1
-
-			if err != nil {
-				return err
-			}
-			i += 1
-			subPath := path[basePathLen+1:]
-			s.Logger.Infow("Sending fileheader", "i", i, "path", path, "fullFilePath", fullFilePath, "subPath", subPath, "IsDir", info.IsDir())
-
-			if i == 1 {
-				return nil
-			}
-
-			fileHeader := NewFileHeader(subPath, info.IsDir())
-
-			// Send the file header to client
-			if _, err := conn.Write(fileHeader.Payload()); err != nil {
-				s.Logger.Errorf("error sending file header: %v", err)
-				return err
-			}
-
-			// Read the client's Next Action request
-			if _, err := io.ReadFull(conn, nextAction); err != nil {
-				return err
-			}
-
-			s.Logger.Infow("Client folder download action", "action", fmt.Sprintf("%X", nextAction[0:2]))
-
-			var dataOffset int64
-
-			switch nextAction[1] {
-			case dlFldrActionResumeFile:
-				// client asked to resume this file
-				var frd FileResumeData
-				// get size of resumeData
-				if _, err := io.ReadFull(conn, nextAction); err != nil {
-					return err
-				}
-
-				resumeDataLen := binary.BigEndian.Uint16(nextAction)
-				resumeDataBytes := make([]byte, resumeDataLen)
-				if _, err := io.ReadFull(conn, resumeDataBytes); err != nil {
-					return err
-				}
-
-				if err := frd.UnmarshalBinary(resumeDataBytes); err != nil {
-					return err
-				}
-				dataOffset = int64(binary.BigEndian.Uint32(frd.ForkInfoList[0].DataSize[:]))
-			case dlFldrActionNextFile:
-				// client asked to skip this file
-				return nil
-			}
-
-			if info.IsDir() {
-				return nil
-			}
-
-			splitPath := strings.Split(path, "/")
-
-			ffo, err := NewFlattenedFileObject(strings.Join(splitPath[:len(splitPath)-1], "/"), nil, []byte(info.Name()), dataOffset)
-			if err != nil {
-				return err
-			}
-			s.Logger.Infow("File download started",
-				"fileName", info.Name(),
-				"transactionRef", fileTransfer.ReferenceNumber,
-				"TransferSize", fmt.Sprintf("%x", ffo.TransferSize()),
-			)
-
-			// Send file size to client
-			if _, err := conn.Write(ffo.TransferSize()); err != nil {
-				s.Logger.Error(err)
-				return err
-			}
-
-			// Send ffo bytes to client
-			if _, err := conn.Write(ffo.BinaryMarshal()); err != nil {
-				s.Logger.Error(err)
-				return err
-			}
-
-			file, err := s.FS.Open(path)
-			if err != nil {
-				return err
-			}
-
-			// // Copy N bytes from file to connection
-			// _, err = io.CopyN(conn, file, int64(binary.BigEndian.Uint32(ffo.FlatFileDataForkHeader.DataSize[:])))
-			// if err != nil {
-			// 	return err
-			// }
-			// file.Close()
-			sendBuffer := make([]byte, 1048576)
-			var totalSent int64
-			for {
-				var bytesRead int
-				if bytesRead, err = file.ReadAt(sendBuffer, dataOffset+totalSent); err == io.EOF {
-					if _, err := conn.Write(sendBuffer[:bytesRead]); err != nil {
-						return err
-					}
-					break
-				}
-				if err != nil {
-					panic(err)
-				}
-				totalSent += int64(bytesRead)
-
-				fileTransfer.BytesSent += bytesRead
-
-				if _, err := conn.Write(sendBuffer[:bytesRead]); err != nil {
-					return err
-				}
-			}
-
-			// TODO: optionally send resource fork header and resource fork data
-
-			// Read the client's Next Action request.  This is always 3, I think?
-			if _, err := io.ReadFull(conn, nextAction); err != nil {
-				return err
-			}
+		items, err := folderItems(s.FS, fullFilePath, include)
+		if err != nil {
+			return err
+		}
 
-			return nil
-		})
+		sender := newFolderSender(conn, items, &folderDownloadSource{server: s, ft: fileTransfer, root: fullFilePath})
+		err = sender.run()
+		s.Stats.DownloadCounter += sender.files
+		if err != nil {
+			return err
+		}
 
+		s.Logger.Infow("Folder download complete", "path", fullFilePath, "files", sender.files, "skipped", sender.skipped)
 	case FolderUpload:
-		dstPath, err := readPath(s.Config.FileRoot, fileTransfer.FilePath, fileTransfer.FileName)
+		dstPath, err := s.resolvePath(fileTransfer.FilePath, fileTransfer.FileName)
 		if err != nil {
 			return err
 		}
@@ -978,144 +1030,24 @@ func (s *Server) handleFileTransfer(conn io.ReadWriteCloser) error {
 			}
 		}
 
-		// Begin the folder upload flow by sending the "next file action" to client
-		if _, err := conn.Write([]byte{0, dlFldrActionNextFile}); err != nil {
+		budget := s.newUploadBudget(fileTransfer.account(), dstPath, fileTransfer)
+		defer budget.save()
+
+		receiver := newFolderReceiver(conn, fileTransfer.ItemCount(), &folderUploadDestination{
+			server: s,
+			ft:     fileTransfer,
+			root:   dstPath,
+			budget: budget,
+		})
+		err = receiver.run()
+		s.Stats.UploadCounter += receiver.files
+		if err != nil {
 			return err
 		}
 
-		fileSize := make([]byte, 4)
-
-		for i := 0; i < fileTransfer.ItemCount(); i++ {
-			s.Stats.UploadCounter += 1
+		s.Logger.Infow("Folder upload complete", "path", dstPath, "files", receiver.files, "skipped", receiver.skipped)
 
-			var fu folderUpload
-			if _, err := io.ReadFull(conn, fu.DataSize[:]); err != nil {
-				return err
-			}
-
-			if _, err := io.ReadFull(conn, fu.IsFolder[:]); err != nil {
-				return err
-			}
-			if _, err := io.ReadFull(conn, fu.PathItemCount[:]); err != nil {
-				return err
-			}
-			fu.FileNamePath = make([]byte, binary.BigEndian.Uint16(fu.DataSize[:])-4)
-
-			if _, err := io.ReadFull(conn, fu.FileNamePath); err != nil {
-				return err
-			}
-
-			s.Logger.Infow(
-				"Folder upload continued",
-				"transactionRef", fmt.Sprintf("%x", fileTransfer.ReferenceNumber),
-				"FormattedPath", fu.FormattedPath(),
-				"IsFolder", fmt.Sprintf("%x", fu.IsFolder),
-				"PathItemCount", binary.BigEndian.Uint16(fu.PathItemCount[:]),
-			)
-
-			if fu.IsFolder == [2]byte{0, 1} {
-				if _, err := os.Stat(dstPath + "/" + fu.FormattedPath()); os.IsNotExist(err) {
-					if err := os.Mkdir(dstPath+"/"+fu.FormattedPath(), 0777); err != nil {
-						return err
-					}
-				}
-
-				// Tell client to send next file
-				if _, err := conn.Write([]byte{0, dlFldrActionNextFile}); err != nil {
-					return err
-				}
-			} else {
-				nextAction := dlFldrActionSendFile
-
-				// Check if we have the full file already.  If so, send dlFldrAction_NextFile to client to skip.
-				_, err := os.Stat(dstPath + "/" + fu.FormattedPath())
-				if err != nil && !errors.Is(err, fs.ErrNotExist) {
-					return err
-				}
-				if err == nil {
-					nextAction = dlFldrActionNextFile
-				}
-
-				//  Check if we have a partial file already.  If so, send dlFldrAction_ResumeFile to client to resume upload.
-				inccompleteFile, err := os.Stat(dstPath + "/" + fu.FormattedPath() + incompleteFileSuffix)
-				if err != nil && !errors.Is(err, fs.ErrNotExist) {
-					return err
-				}
-				if err == nil {
-					nextAction = dlFldrActionResumeFile
-				}
-
-				if _, err := conn.Write([]byte{0, uint8(nextAction)}); err != nil {
-					return err
-				}
-
-				switch nextAction {
-				case dlFldrActionNextFile:
-					continue
-				case dlFldrActionResumeFile:
-					offset := make([]byte, 4)
-					binary.BigEndian.PutUint32(offset, uint32(inccompleteFile.Size()))
-
-					file, err := os.OpenFile(dstPath+"/"+fu.FormattedPath()+incompleteFileSuffix, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-					if err != nil {
-						return err
-					}
-
-					fileResumeData := NewFileResumeData([]ForkInfoList{
-						*NewForkInfoList(offset),
-					})
-
-					b, _ := fileResumeData.BinaryMarshal()
-
-					bs := make([]byte, 2)
-					binary.BigEndian.PutUint16(bs, uint16(len(b)))
-
-					if _, err := conn.Write(append(bs, b...)); err != nil {
-						return err
-					}
-
-					if _, err := io.ReadFull(conn, fileSize); err != nil {
-						return err
-					}
-
-					if err := receiveFile(conn, file, ioutil.Discard); err != nil {
-						s.Logger.Error(err)
-					}
-
-					err = os.Rename(dstPath+"/"+fu.FormattedPath()+".incomplete", dstPath+"/"+fu.FormattedPath())
-					if err != nil {
-						return err
-					}
-
-				case dlFldrActionSendFile:
-					if _, err := io.ReadFull(conn, fileSize); err != nil {
-						return err
-					}
-
-					filePath := dstPath + "/" + fu.FormattedPath()
-					s.Logger.Infow("Starting file transfer", "path", filePath, "fileNum", i+1, "totalFiles", "zz", "fileSize", binary.BigEndian.Uint32(fileSize))
-
-					newFile, err := s.FS.Create(filePath + ".incomplete")
-					if err != nil {
-						return err
-					}
-
-					if err := receiveFile(conn, newFile, ioutil.Discard); err != nil {
-						s.Logger.Error(err)
-					}
-					_ = newFile.Close()
-					if err := os.Rename(filePath+".incomplete", filePath); err != nil {
-						return err
-					}
-				}
-
-				// Tell client to send next file
-				if _, err := conn.Write([]byte{0, dlFldrActionNextFile}); err != nil {
-					return err
-				}
-			}
-		}
-		s.Logger.Infof("Folder upload complete")
+		s.notifyDropBoxUpload(fileTransfer.clientConn, path.Dir(dstPath), string(fileTransfer.FileName))
 	}
 
 	return nil
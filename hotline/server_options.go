@@ -0,0 +1,191 @@
+package hotline
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+
+	"github.com/go-playground/validator/v10"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+// Option configures a Server constructed with New
+type Option func(s *Server) error
+
+// WithConfig sets the server config.  The config is validated by New after all options are applied.
+func WithConfig(config *Config) Option {
+	return func(s *Server) error {
+		s.Config = config
+		return nil
+	}
+}
+
+// WithConfigDir loads the config, agreement, news and accounts from the files in configDir and stores changes there.
+// Options after WithConfigDir can replace any of the individual pieces, e.g. to keep accounts in memory.
+func WithConfigDir(configDir string) Option {
+	return func(s *Server) error {
+		cfgFS := &OSFileStore{}
+
+		s.ConfigDir = configDir
+
+		if err := s.loadConfig(cfgFS, filepath.Join(configDir, "config.yaml")); err != nil {
+			return err
+		}
+
+		// A relative FileRoot or mount path is relative to the config dir
+		if !isFileStoreURL(s.Config.FileRoot) && !filepath.IsAbs(s.Config.FileRoot) {
+			s.Config.FileRoot = filepath.Join(configDir, s.Config.FileRoot)
+		}
+		for i, mount := range s.Config.Mounts {
+			if !isFileStoreURL(mount.Path) && !filepath.IsAbs(mount.Path) {
+				s.Config.Mounts[i].Path = filepath.Join(configDir, mount.Path)
+			}
+		}
+
+		agreement, err := readFile(cfgFS, filepath.Join(configDir, agreementFile))
+		if err != nil {
+			return err
+		}
+		s.Agreement = agreement
+
+		s.AccountStore = NewYAMLAccountStore(filepath.Join(configDir, "Users"), cfgFS)
+		s.FlatNewsStore = &FlatNewsFile{Path: filepath.Join(configDir, "MessageBoard.txt"), FS: cfgFS}
+		s.ThreadedNewsStore = &ThreadedNewsFile{Path: filepath.Join(configDir, "ThreadedNews.yaml"), FS: cfgFS}
+
+		return nil
+	}
+}
+
+// WithPort sets the port for the transaction listener.  The file transfer listener uses port+1.
+func WithPort(port int) Option {
+	return func(s *Server) error {
+		s.Port = port
+		return nil
+	}
+}
+
+// WithInterface sets the network interface address the listeners bind to
+func WithInterface(netInterface string) Option {
+	return func(s *Server) error {
+		s.NetInterface = netInterface
+		return nil
+	}
+}
+
+// WithLogger sets the logger used by the server
+func WithLogger(logger *zap.SugaredLogger) Option {
+	return func(s *Server) error {
+		s.Logger = logger
+		return nil
+	}
+}
+
+// WithFileStore sets the FileStore used to serve the file area
+func WithFileStore(fs FileStore) Option {
+	return func(s *Server) error {
+		s.FS = fs
+		return nil
+	}
+}
+
+// WithAccountStore sets the AccountStore that user accounts are loaded from and saved to
+func WithAccountStore(store AccountStore) Option {
+	return func(s *Server) error {
+		s.AccountStore = store
+		return nil
+	}
+}
+
+// WithFlatNewsStore sets the FlatNewsStore that holds the message board
+func WithFlatNewsStore(store FlatNewsStore) Option {
+	return func(s *Server) error {
+		s.FlatNewsStore = store
+		return nil
+	}
+}
+
+// WithThreadedNewsStore sets the ThreadedNewsStore that holds the threaded news categories and articles
+func WithThreadedNewsStore(store ThreadedNewsStore) Option {
+	return func(s *Server) error {
+		s.ThreadedNewsStore = store
+		return nil
+	}
+}
+
+// WithAgreement sets the agreement text shown to clients on login
+func WithAgreement(agreement []byte) Option {
+	return func(s *Server) error {
+		s.Agreement = agreement
+		return nil
+	}
+}
+
+// WithClock sets the Clock the server reads the current time from.  The default is the system clock.
+func WithClock(clock Clock) Option {
+	return func(s *Server) error {
+		s.Clock = clock
+		return nil
+	}
+}
+
+// WithListener sets the function used by ListenAndServe to create the transaction and file transfer listeners.
+// The default is net.Listen.
+func WithListener(listen func(network, address string) (net.Listener, error)) Option {
+	return func(s *Server) error {
+		s.Listen = listen
+		return nil
+	}
+}
+
+func (s *Server) loadConfig(fs FileStore, path string) error {
+	config, err := readServerConfig(fs, path)
+	if err != nil {
+		return err
+	}
+	s.Config = config
+
+	return nil
+}
+
+func readServerConfig(fs FileStore, path string) (*Config, error) {
+	fh, err := fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = fh.Close() }()
+
+	config := new(Config)
+	if err := yaml.NewDecoder(fh).Decode(config); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// ReloadConfig reads config.yaml and the account files in ConfigDir again and applies the settings that can be changed
+// while the server is running: the transfer rate limits.  Other changes take effect when the server is restarted.
+func (s *Server) ReloadConfig() error {
+	if s.ConfigDir == "" {
+		return errors.New("server has no config dir to reload from")
+	}
+
+	config, err := readServerConfig(&OSFileStore{}, filepath.Join(s.ConfigDir, "config.yaml"))
+	if err != nil {
+		return err
+	}
+	if err := validator.New().Struct(config); err != nil {
+		return err
+	}
+	accounts, err := s.AccountStore.List()
+	if err != nil {
+		return err
+	}
+
+	s.mux.Lock()
+	s.rateLimiter.reload(config, accounts, s.Accounts)
+	s.mux.Unlock()
+	s.Logger.Infow("Reloaded config", "MaxTransferRate", config.MaxTransferRate, "MaxRatePerTransfer", config.MaxRatePerTransfer)
+
+	return nil
+}
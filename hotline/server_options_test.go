@@ -0,0 +1,84 @@
+package hotline
+
+import (
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type fixedClock struct {
+	t time.Time
+}
+
+func (c fixedClock) Now() time.Time {
+	return c.t
+}
+
+func TestNew(t *testing.T) {
+	t.Run("with in-memory config and stores", func(t *testing.T) {
+		startTime := time.Date(1997, time.January, 1, 0, 0, 0, 0, time.UTC)
+		accounts := NewMemAccountStore(&Account{Login: "guest", Name: "Guest", Access: &[]byte{0, 0, 0, 0, 0, 0, 0, 0}})
+		flatNews := &MemFlatNewsStore{}
+		_ = flatNews.Save([]byte("Hello"))
+
+		srv, err := New(
+			WithConfig(&Config{Name: "Test", Description: "Test server", FileRoot: "/Files"}),
+			WithAccountStore(accounts),
+			WithFlatNewsStore(flatNews),
+			WithAgreement([]byte("Be nice")),
+			WithClock(fixedClock{t: startTime}),
+			WithPort(5600),
+		)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		assert.Equal(t, 5600, srv.Port)
+		assert.Equal(t, []byte("Be nice"), srv.Agreement)
+		assert.Equal(t, []byte("Hello"), srv.FlatNews)
+		assert.Equal(t, "Guest", srv.Accounts["guest"].Name)
+		assert.Equal(t, startTime, srv.Stats.StartTime)
+		assert.NotNil(t, srv.ThreadedNews.Categories)
+
+		assert.NoError(t, srv.NewUser("test", "Test User", "", []byte{0, 0, 0, 0, 0, 0, 0, 0}))
+		stored, _ := accounts.List()
+		assert.Len(t, stored, 2)
+
+		assert.NoError(t, srv.UpdateUser("test", "test2", "Test User", "", []byte{0, 0, 0, 0, 0, 0, 0, 0}))
+		stored, _ = accounts.List()
+		assert.Equal(t, "test2", stored[1].Login)
+
+		assert.NoError(t, srv.DeleteUser("test2"))
+		stored, _ = accounts.List()
+		assert.Len(t, stored, 1)
+	})
+
+	t.Run("with invalid config", func(t *testing.T) {
+		_, err := New(WithConfig(&Config{}))
+		assert.Error(t, err)
+	})
+
+	t.Run("with invalid file type codes", func(t *testing.T) {
+		_, err := New(WithConfig(&Config{
+			Name:        "Test Server",
+			Description: "Test",
+			FileRoot:    "mem://",
+			FileTypes:   map[string]FileType{"dsk": {TypeCode: "dImage", CreatorCode: "ddsk"}},
+		}))
+		assert.Error(t, err)
+	})
+
+	t.Run("with config dir", func(t *testing.T) {
+		srv, err := New(WithConfigDir("test/config/"))
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		assert.Equal(t, "Halcyon's Test Server", srv.Config.Name)
+		assert.Equal(t, filepath.Join("test/config", "conFiles"), srv.Config.FileRoot)
+		assert.Contains(t, srv.Accounts, "admin")
+		assert.Contains(t, srv.Accounts, "guest")
+		assert.IsType(t, &YAMLAccountStore{}, srv.AccountStore)
+	})
+}
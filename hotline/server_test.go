@@ -1,5 +1,18 @@
 package hotline
 
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
 //
 // import (
 //	"bytes"
@@ -803,3 +816,569 @@ package hotline
 //		})
 //	}
 // }
+
+func TestServer_RegisterTransactionType(t *testing.T) {
+	const tranCustom = 4000
+
+	newClientConn := func(access accessBitmap) *ClientConn {
+		accessBytes := access[:]
+		return &ClientConn{
+			ID:       &[]byte{0, 1},
+			UserName: []byte("test"),
+			Account:  &Account{Login: "test", Access: &accessBytes},
+			Server: &Server{
+				Logger:  NewTestLogger(),
+				Clients: map[uint16]*ClientConn{},
+				outbox:  make(chan Transaction, 10),
+			},
+		}
+	}
+
+	t.Run("handles a custom transaction type", func(t *testing.T) {
+		cc := newClientConn(accessBitmap{})
+		cc.Server.RegisterTransactionType(tranCustom, TransactionType{
+			Handler: func(cc *ClientConn, t *Transaction) ([]Transaction, error) {
+				return []Transaction{cc.NewReply(t, NewField(fieldData, []byte("pong")))}, nil
+			},
+			RequiredFields: []RequiredField{{ID: fieldData, MinLen: 1}},
+		})
+
+		err := cc.handleTransaction(NewTransaction(tranCustom, nil, NewField(fieldData, []byte("ping"))))
+		assert.NoError(t, err)
+
+		reply := <-cc.Server.outbox
+		assert.Equal(t, []byte("pong"), reply.GetField(fieldData).Data)
+	})
+
+	t.Run("ignores a custom transaction missing a required field", func(t *testing.T) {
+		cc := newClientConn(accessBitmap{})
+		cc.Server.RegisterTransactionType(tranCustom, TransactionType{
+			Handler: func(cc *ClientConn, t *Transaction) ([]Transaction, error) {
+				return []Transaction{cc.NewReply(t)}, nil
+			},
+			RequiredFields: []RequiredField{{ID: fieldData, MinLen: 1}},
+		})
+
+		err := cc.handleTransaction(NewTransaction(tranCustom, nil))
+		assert.NoError(t, err)
+		assert.Len(t, cc.Server.outbox, 0)
+	})
+
+	t.Run("denies a custom transaction when the account lacks access", func(t *testing.T) {
+		cc := newClientConn(accessBitmap{})
+		cc.Server.RegisterTransactionType(tranCustom, TransactionType{
+			Handler: func(cc *ClientConn, t *Transaction) ([]Transaction, error) {
+				return []Transaction{cc.NewReply(t)}, nil
+			},
+			Access:  []int{accessBroadcast},
+			DenyMsg: "You are not allowed to do custom things.",
+		})
+
+		err := cc.handleTransaction(NewTransaction(tranCustom, nil))
+		assert.NoError(t, err)
+
+		reply := <-cc.Server.outbox
+		assert.Equal(t, []byte{0, 0, 0, 1}, reply.ErrorCode)
+		assert.Equal(t, []byte("You are not allowed to do custom things."), reply.GetField(fieldError).Data)
+	})
+
+	t.Run("overrides a built-in transaction type", func(t *testing.T) {
+		cc := newClientConn(accessBitmap{})
+		cc.Server.RegisterTransactionType(tranKeepAlive, TransactionType{
+			Handler: func(cc *ClientConn, t *Transaction) ([]Transaction, error) {
+				return []Transaction{cc.NewReply(t, NewField(fieldData, []byte("custom keepalive")))}, nil
+			},
+		})
+
+		err := cc.handleTransaction(NewTransaction(tranKeepAlive, nil))
+		assert.NoError(t, err)
+
+		reply := <-cc.Server.outbox
+		assert.Equal(t, []byte("custom keepalive"), reply.GetField(fieldData).Data)
+
+		tt, _ := cc.Server.transactionType(tranKeepAlive)
+		assert.Equal(t, "tran500", tt.Name)
+		assert.Equal(t, "tranKeepAlive", TransactionHandlers[tranKeepAlive].Name)
+	})
+}
+
+type closeRecorder struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestServer_checkIdleUsers(t *testing.T) {
+	newServer := func(config Config, accounts ...*Account) *Server {
+		s := &Server{
+			Config:  &config,
+			Logger:  NewTestLogger(),
+			Clients: map[uint16]*ClientConn{},
+			outbox:  make(chan Transaction, 10),
+		}
+		for i, account := range accounts {
+			s.Clients[uint16(i+1)] = &ClientConn{
+				Connection: &closeRecorder{},
+				ID:         &[]byte{0, byte(i + 1)},
+				Icon:       &[]byte{0, 1},
+				Flags:      &[]byte{0, 0},
+				UserName:   []byte(account.Login),
+				Account:    account,
+				Server:     s,
+			}
+		}
+		return s
+	}
+	noAccess := func() *[]byte { return &[]byte{0, 0, 0, 0, 0, 0, 0, 0} }
+
+	t.Run("marks a user away after the default threshold", func(t *testing.T) {
+		s := newServer(Config{}, &Account{Login: "test", Access: noAccess()})
+		cc := s.Clients[1]
+
+		s.checkIdleUsers(defaultIdleAwayTime)
+		assert.False(t, cc.Idle)
+
+		s.checkIdleUsers(idleCheckInterval)
+		assert.True(t, cc.Idle)
+		assert.Equal(t, []byte{0, 1}, *cc.Flags)
+
+		notification := <-s.outbox
+		assert.Equal(t, []byte{0x01, 0x2d}, notification.Type)
+		assert.Equal(t, []byte{0, 1}, notification.GetField(fieldUserFlags).Data)
+	})
+
+	t.Run("uses the configured away threshold", func(t *testing.T) {
+		s := newServer(Config{IdleAwayTime: 60}, &Account{Login: "test", Access: noAccess()})
+
+		s.checkIdleUsers(70)
+		assert.True(t, s.Clients[1].Idle)
+	})
+
+	t.Run("does not mark users away when disabled", func(t *testing.T) {
+		s := newServer(Config{IdleAwayTime: -1}, &Account{Login: "test", Access: noAccess()})
+
+		s.checkIdleUsers(10000)
+		assert.False(t, s.Clients[1].Idle)
+	})
+
+	t.Run("disconnects idle users unless exempt", func(t *testing.T) {
+		cannotBeDiscon := accessBitmap{}
+		cannotBeDiscon.Set(accessCannotBeDiscon)
+		cannotBeDisconBytes := cannotBeDiscon[:]
+
+		s := newServer(
+			Config{IdleDisconnectTime: 600},
+			&Account{Login: "idle", Access: noAccess()},
+			&Account{Login: "exempt", Access: noAccess(), IdleExempt: true},
+			&Account{Login: "admin", Access: &cannotBeDisconBytes},
+		)
+
+		s.checkIdleUsers(500)
+		assert.False(t, s.Clients[1].Connection.(*closeRecorder).closed)
+
+		s.checkIdleUsers(200)
+		assert.True(t, s.Clients[1].Connection.(*closeRecorder).closed)
+		assert.False(t, s.Clients[2].Connection.(*closeRecorder).closed)
+		assert.False(t, s.Clients[3].Connection.(*closeRecorder).closed)
+	})
+}
+
+func TestClientConn_handleTransaction_idle(t *testing.T) {
+	s := &Server{
+		Config:  &Config{},
+		Logger:  NewTestLogger(),
+		Clients: map[uint16]*ClientConn{},
+		outbox:  make(chan Transaction, 10),
+	}
+	cc := &ClientConn{
+		ID:       &[]byte{0, 1},
+		Icon:     &[]byte{0, 1},
+		Flags:    &[]byte{0, 0},
+		UserName: []byte("test"),
+		Account:  &Account{Login: "test", Access: &[]byte{0, 0, 0, 0, 0, 0, 0, 0}},
+		Server:   s,
+	}
+	s.Clients[1] = cc
+
+	s.checkIdleUsers(defaultIdleAwayTime + 1)
+	assert.True(t, cc.Idle)
+	<-s.outbox
+
+	assert.NoError(t, cc.handleTransaction(NewTransaction(tranKeepAlive, nil)))
+	<-s.outbox // keepalive reply
+	assert.True(t, cc.Idle, "keepalive should not count as activity")
+	assert.Equal(t, defaultIdleAwayTime+1, cc.IdleTime)
+
+	assert.NoError(t, cc.handleTransaction(NewTransaction(tranGetUserNameList, nil)))
+	<-s.outbox // user name list reply
+	assert.False(t, cc.Idle)
+	assert.Equal(t, 0, cc.IdleTime)
+	assert.Equal(t, []byte{0, 0}, *cc.Flags)
+
+	notification := <-s.outbox
+	assert.Equal(t, []byte{0, 0}, notification.GetField(fieldUserFlags).Data)
+}
+
+func TestServer_checkLiveness(t *testing.T) {
+	now := time.Date(2022, time.June, 1, 12, 0, 0, 0, time.UTC)
+	s := &Server{
+		Config:  &Config{ReadTimeout: 60},
+		Logger:  NewTestLogger(),
+		Clock:   fixedClock{t: now},
+		Clients: map[uint16]*ClientConn{},
+		outbox:  make(chan Transaction, 10),
+	}
+	s.Clients[1] = &ClientConn{ID: &[]byte{0, 1}, Agreed: true, lastSeen: now.Add(-90 * time.Second)}
+	s.Clients[2] = &ClientConn{ID: &[]byte{0, 2}, Agreed: true, lastSeen: now.Add(-30 * time.Second)}
+	s.Clients[3] = &ClientConn{ID: &[]byte{0, 3}, Agreed: true, lastSeen: now.Add(-90 * time.Second), sendsKeepalives: true}
+
+	s.checkLiveness()
+
+	if assert.Len(t, s.outbox, 1) {
+		probe := <-s.outbox
+		assert.Equal(t, []byte{0x01, 0xf4}, probe.Type)
+		assert.Equal(t, []byte{0, 1}, *probe.clientID)
+	}
+
+	// A client that was just probed is not probed again until another timeout elapses
+	s.checkLiveness()
+	assert.Len(t, s.outbox, 0)
+}
+
+func TestServer_reclaimFileTransfers(t *testing.T) {
+	now := time.Date(2022, time.June, 1, 12, 0, 0, 0, time.UTC)
+	cc := &ClientConn{Transfers: map[int][]*FileTransfer{}}
+	stale := &FileTransfer{Type: FileDownload, clientConn: cc, created: now.Add(-fileTransferClaimTimeout*time.Second - time.Second)}
+	fresh := &FileTransfer{Type: FileDownload, clientConn: cc, created: now}
+	active := &FileTransfer{Type: FileDownload, clientConn: cc, created: now.Add(-time.Hour), active: true}
+	cc.Transfers[FileDownload] = []*FileTransfer{stale, fresh, active}
+
+	s := &Server{
+		Logger:        NewTestLogger(),
+		Clock:         fixedClock{t: now},
+		Clients:       map[uint16]*ClientConn{1: cc},
+		FileTransfers: map[uint32]*FileTransfer{1: stale, 2: fresh, 3: active},
+	}
+
+	s.reclaimFileTransfers()
+
+	assert.Equal(t, map[uint32]*FileTransfer{2: fresh, 3: active}, s.FileTransfers)
+	assert.Equal(t, []*FileTransfer{fresh, active}, cc.Transfers[FileDownload])
+}
+
+// newTransferTestServer returns a Server backed by an in-memory file store for exercising file transfers
+func newTransferTestServer(fileStore FileStore, ft *FileTransfer) *Server {
+	ft.ReferenceNumber = []byte{0, 0, 0, 1}
+	return &Server{
+		Config:        &Config{FileRoot: "/Files"},
+		FS:            fileStore,
+		Logger:        NewTestLogger(),
+		Stats:         &Stats{},
+		Clients:       map[uint16]*ClientConn{},
+		FileTransfers: map[uint32]*FileTransfer{1: ft},
+	}
+}
+
+// flatFile returns a flattened file object containing data, as sent by a client uploading a file
+func flatFile(name string, data []byte) []byte {
+	ffo := flattenedFileObject{
+		FlatFileHeader:          NewFlatFileHeader(),
+		FlatFileInformationFork: NewFlatFileInformationFork(name, make([]byte, 8), "TEXT", "ttxt"),
+	}
+	ffo.FlatFileDataForkHeader.ForkType = [4]byte{0x44, 0x41, 0x54, 0x41} // DATA
+	binary.BigEndian.PutUint32(ffo.FlatFileDataForkHeader.DataSize[:], uint32(len(data)))
+
+	return append(ffo.BinaryMarshal(), data...)
+}
+
+// htxf returns the file transfer handshake for transfer reference number 1
+func htxf() []byte {
+	return []byte{0x48, 0x54, 0x58, 0x46, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0}
+}
+
+func TestServer_handleFileTransfer(t *testing.T) {
+	t.Parallel()
+
+	t.Run("file download", func(t *testing.T) {
+		t.Parallel()
+
+		mfs := NewMemFileStore()
+		_ = mfs.MkdirAll("/Files", 0777)
+		_ = mfs.WriteFile("/Files/hello.txt", []byte("hello world"), 0644)
+
+		s := newTransferTestServer(mfs, &FileTransfer{Type: FileDownload, FileName: []byte("hello.txt")})
+
+		client, server := net.Pipe()
+		errs := make(chan error, 1)
+		go func() { errs <- s.handleFileTransfer(server) }()
+
+		_, _ = client.Write(htxf())
+		got, err := io.ReadAll(client)
+		assert.NoError(t, err)
+		assert.NoError(t, <-errs)
+
+		ffo, _ := NewFlattenedFileObject(mfs, nil, "/Files", nil, []byte("hello.txt"), 0)
+		assert.Equal(t, append(ffo.BinaryMarshal(), []byte("hello world")...), got)
+		assert.Empty(t, s.FileTransfers)
+	})
+
+	t.Run("file upload", func(t *testing.T) {
+		t.Parallel()
+
+		mfs := NewMemFileStore()
+		_ = mfs.MkdirAll("/Files/Uploads", 0777)
+
+		s := newTransferTestServer(mfs, &FileTransfer{
+			Type:     FileUpload,
+			FileName: []byte("new.txt"),
+			FilePath: EncodeFilePath("Uploads"),
+		})
+
+		client, server := net.Pipe()
+		errs := make(chan error, 1)
+		go func() { errs <- s.handleFileTransfer(server) }()
+
+		_, _ = client.Write(append(htxf(), flatFile("new.txt", []byte("uploaded"))...))
+		assert.NoError(t, <-errs)
+
+		got, err := readFile(mfs, "/Files/Uploads/new.txt")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("uploaded"), got)
+
+		_, err = mfs.Stat("/Files/Uploads/new.txt" + incompleteFileSuffix)
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("file download with resource fork", func(t *testing.T) {
+		t.Parallel()
+
+		mfs := NewMemFileStore()
+		_ = mfs.MkdirAll("/Files", 0777)
+		_ = mfs.WriteFile("/Files/App", []byte("data"), 0644)
+		ad := &appleDouble{ResourceFork: []byte("rsrc")}
+		copy(ad.FinderInfo[:], "APPLAPPL")
+		sidecar, _ := ad.MarshalBinary()
+		_ = mfs.WriteFile("/Files/._App", sidecar, 0644)
+
+		s := newTransferTestServer(mfs, &FileTransfer{Type: FileDownload, FileName: []byte("App")})
+
+		client, server := net.Pipe()
+		errs := make(chan error, 1)
+		go func() { errs <- s.handleFileTransfer(server) }()
+
+		_, _ = client.Write(htxf())
+		got, err := io.ReadAll(client)
+		assert.NoError(t, err)
+		assert.NoError(t, <-errs)
+
+		ffo, _ := NewFlattenedFileObject(mfs, nil, "/Files", nil, []byte("App"), 0)
+		want := append(ffo.BinaryMarshal(), "data"...)
+		want = append(want, ffo.resForkHeader()...)
+		want = append(want, "rsrc"...)
+		assert.Equal(t, want, got)
+		assert.Equal(t, len(got), int(binary.BigEndian.Uint32(ffo.TransferSize())))
+	})
+
+	t.Run("file upload with resource fork", func(t *testing.T) {
+		t.Parallel()
+
+		mfs := NewMemFileStore()
+		_ = mfs.MkdirAll("/Files", 0777)
+
+		s := newTransferTestServer(mfs, &FileTransfer{Type: FileUpload, FileName: []byte("App")})
+
+		upload := flatFile("App", []byte("data"))
+		upload[23] = 3                     // fork count
+		copy(upload[24+16+4:], "APPLAPPL") // type and creator codes
+		upload = append(upload, "MACR\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x04rsrc"...)
+
+		client, server := net.Pipe()
+		errs := make(chan error, 1)
+		go func() { errs <- s.handleFileTransfer(server) }()
+
+		_, _ = client.Write(append(htxf(), upload...))
+		assert.NoError(t, <-errs)
+
+		got, err := readFile(mfs, "/Files/App")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("data"), got)
+
+		ad, err := readAppleDouble(mfs, "/Files/App")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("APPL"), ad.TypeCode())
+		assert.Equal(t, []byte("APPL"), ad.CreatorCode())
+		assert.Equal(t, []byte("rsrc"), ad.ResourceFork)
+	})
+
+	t.Run("folder download", func(t *testing.T) {
+		t.Parallel()
+
+		mfs := NewMemFileStore()
+		_ = mfs.MkdirAll("/Files/Docs/Sub", 0777)
+		_ = mfs.WriteFile("/Files/Docs/a.txt", []byte("aaa"), 0644)
+		_ = mfs.WriteFile("/Files/Docs/Sub/b.txt", []byte("bb"), 0644)
+		sidecar, _ := (&appleDouble{ResourceFork: []byte("rsrc")}).MarshalBinary()
+		_ = mfs.WriteFile("/Files/Docs/._a.txt", sidecar, 0644)
+
+		s := newTransferTestServer(mfs, &FileTransfer{Type: FolderDownload, FileName: []byte("Docs")})
+
+		client, server := net.Pipe()
+		errs := make(chan error, 1)
+		go func() { errs <- s.handleFileTransfer(server) }()
+
+		_, _ = client.Write(htxf())
+		_, _ = client.Write([]byte{0, dlFldrActionNextFile})
+
+		received := map[string][]byte{}
+		for {
+			headerSize := make([]byte, 2)
+			if _, err := io.ReadFull(client, headerSize); err == io.EOF {
+				break
+			} else if !assert.NoError(t, err) {
+				return
+			}
+			header := make([]byte, binary.BigEndian.Uint16(headerSize))
+			_, _ = io.ReadFull(client, header)
+
+			var fp FilePath
+			assert.NoError(t, fp.UnmarshalBinary(header[2:]))
+			isDir := header[1] == 1
+
+			if isDir {
+				received[fp.String()] = nil
+				_, _ = client.Write([]byte{0, dlFldrActionNextFile})
+				continue
+			}
+
+			_, _ = client.Write([]byte{0, dlFldrActionSendFile})
+
+			transferSize := make([]byte, 4)
+			_, _ = io.ReadFull(client, transferSize)
+			payload := make([]byte, binary.BigEndian.Uint32(transferSize))
+			_, _ = io.ReadFull(client, payload)
+
+			headerLen := len(flatFile(path.Base(fp.String()), nil))
+			received[fp.String()] = payload[headerLen:]
+
+			_, _ = client.Write([]byte{0, dlFldrActionNextFile})
+		}
+		assert.NoError(t, <-errs)
+
+		assert.Equal(t, map[string][]byte{
+			"/Sub":       nil,
+			"/Sub/b.txt": []byte("bb"),
+			"/a.txt":     []byte("aaaMACR\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x04rsrc"),
+		}, received)
+	})
+
+	t.Run("folder upload", func(t *testing.T) {
+		t.Parallel()
+
+		mfs := NewMemFileStore()
+		_ = mfs.MkdirAll("/Files/Uploads", 0777)
+
+		s := newTransferTestServer(mfs, &FileTransfer{
+			Type:            FolderUpload,
+			FileName:        []byte("Docs"),
+			FilePath:        EncodeFilePath("Uploads"),
+			FolderItemCount: []byte{0, 2},
+		})
+
+		client, server := net.Pipe()
+		errs := make(chan error, 1)
+		go func() { errs <- s.handleFileTransfer(server) }()
+
+		nextAction := make([]byte, 2)
+		_, _ = client.Write(htxf())
+		_, _ = io.ReadFull(client, nextAction)
+		assert.Equal(t, []byte{0, dlFldrActionNextFile}, nextAction)
+
+		// folderItem encodes a folder upload item header
+		folderItem := func(isFolder bool, name string) []byte {
+			item := []byte{0, 0, 0, 1, 0, 0, byte(len(name))}
+			if isFolder {
+				item[1] = 1
+			}
+			item = append(item, name...)
+			size := make([]byte, 2)
+			binary.BigEndian.PutUint16(size, uint16(len(item)))
+			return append(size, item...)
+		}
+
+		_, _ = client.Write(folderItem(true, "Sub"))
+		_, _ = io.ReadFull(client, nextAction)
+		assert.Equal(t, []byte{0, dlFldrActionNextFile}, nextAction)
+
+		_, _ = client.Write(folderItem(false, "a.txt"))
+		_, _ = io.ReadFull(client, nextAction)
+		assert.Equal(t, []byte{0, dlFldrActionSendFile}, nextAction)
+
+		file := flatFile("a.txt", []byte("aaa"))
+		fileSize := make([]byte, 4)
+		binary.BigEndian.PutUint32(fileSize, uint32(len(file)))
+		_, _ = client.Write(append(fileSize, file...))
+		_, _ = io.ReadFull(client, nextAction)
+		assert.Equal(t, []byte{0, dlFldrActionNextFile}, nextAction)
+
+		assert.NoError(t, <-errs)
+
+		info, err := mfs.Stat("/Files/Uploads/Docs/Sub")
+		assert.NoError(t, err)
+		assert.True(t, info.IsDir())
+
+		got, err := readFile(mfs, "/Files/Uploads/Docs/a.txt")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("aaa"), got)
+	})
+}
+
+func TestServer_Serve_stopsWhenListenerClosed(t *testing.T) {
+	s := &Server{Logger: NewTestLogger(), outbox: make(chan Transaction)}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(context.Background(), func() {}, ln) }()
+
+	_ = ln.Close()
+
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, net.ErrClosed)
+	case <-time.After(time.Second):
+		t.Fatal("Serve did not return after its listener was closed")
+	}
+}
+
+func TestServer_ListenAndServe_shutdown(t *testing.T) {
+	s, err := New(
+		WithConfig(&Config{Name: "Test", Description: "Test server", FileRoot: "/Files"}),
+		WithFileStore(NewMemFileStore()),
+		WithListener(func(network, _ string) (net.Listener, error) {
+			return net.Listen(network, "127.0.0.1:0")
+		}),
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.ListenAndServe(ctx, cancel) }()
+
+	cancel()
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("ListenAndServe did not return after its context was cancelled")
+	}
+}
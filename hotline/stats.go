@@ -10,6 +10,9 @@ type Stats struct {
 	StartTime       time.Time `yaml:"start time"`
 	DownloadCounter int
 	UploadCounter   int
+
+	StaleUploadsRemoved int // Incomplete uploads removed or quarantined by the upload janitor
+	ActiveTransfers     int // File transfers in progress
 }
 
 func (s *Stats) String() string {
@@ -18,6 +21,8 @@ Server Stats:
   Start Time:		%v
   Uptime:			%s
   Login Count:	%v
+  Stale Uploads Removed:	%v
+  Active Transfers:	%v
 `
 	d := time.Since(s.StartTime)
 	d = d.Round(time.Minute)
@@ -30,5 +35,7 @@ Server Stats:
 		s.StartTime.Format(time.RFC1123Z),
 		fmt.Sprintf("%02d:%02d", h, m),
 		s.LoginCount,
+		s.StaleUploadsRemoved,
+		s.ActiveTransfers,
 	)
 }
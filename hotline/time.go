@@ -23,3 +23,15 @@ func toHotlineTime(t time.Time) (b []byte) {
 
 	return b
 }
+
+// Clock provides the current time to the Server.  It can be replaced to control time in tests or when embedding the
+// server in another program.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
@@ -5,22 +5,23 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"gopkg.in/yaml.v3"
-	"io/ioutil"
 	"math/big"
 	"os"
 	"path"
 	"sort"
 	"strings"
-	"time"
 )
 
 type TransactionType struct {
 	Handler        func(*ClientConn, *Transaction) ([]Transaction, error) // function for handling the transaction type
 	Name           string                                                 // Name of transaction as it will appear in logging
-	RequiredFields []requiredField
+	RequiredFields []RequiredField                                        // Fields that must be present in the request
+	Access         []int                                                  // Access bits the account must have; checked before Handler is called
+	DenyMsg        string                                                 // Error sent to the client when an Access check fails
 }
 
+// TransactionHandlers contains the built-in transaction types.  Use Server.RegisterTransactionType to add custom
+// transaction types or override these for a single Server.
 var TransactionHandlers = map[uint16]TransactionType{
 	// Server initiated
 	tranChatMsg: {
@@ -49,10 +50,10 @@ var TransactionHandlers = map[uint16]TransactionType{
 	tranChatSend: {
 		Name:    "tranChatSend",
 		Handler: HandleChatSend,
-		RequiredFields: []requiredField{
+		RequiredFields: []RequiredField{
 			{
 				ID:     fieldData,
-				minLen: 0,
+				MinLen: 0,
 			},
 		},
 	},
@@ -183,10 +184,10 @@ var TransactionHandlers = map[uint16]TransactionType{
 	tranSendInstantMsg: {
 		Name:    "tranSendInstantMsg",
 		Handler: HandleSendInstantMsg,
-		RequiredFields: []requiredField{
+		RequiredFields: []RequiredField{
 			{
 				ID:     fieldData,
-				minLen: 0,
+				MinLen: 0,
 			},
 			{
 				ID: fieldUserID,
@@ -200,10 +201,10 @@ var TransactionHandlers = map[uint16]TransactionType{
 	tranMakeFileAlias: {
 		Name:    "tranMakeFileAlias",
 		Handler: HandleMakeAlias,
-		RequiredFields: []requiredField{
-			{ID: fieldFileName, minLen: 1},
-			{ID: fieldFilePath, minLen: 1},
-			{ID: fieldFileNewPath, minLen: 1},
+		RequiredFields: []RequiredField{
+			{ID: fieldFileName, MinLen: 1},
+			{ID: fieldFilePath, MinLen: 1},
+			{ID: fieldFileNewPath, MinLen: 1},
 		},
 	},
 	tranSetClientUserInfo: {
@@ -238,6 +239,16 @@ func HandleChatSend(cc *ClientConn, t *Transaction) (res []Transaction, err erro
 		return res, err
 	}
 
+	// Admin commands are answered privately rather than sent to the chat
+	if reply, ok := cc.runAdminCommand(t.GetField(fieldData).Data); ok {
+		fields := []Field{NewField(fieldData, []byte(reply))}
+		if chatID := t.GetField(fieldChatID).Data; chatID != nil {
+			fields = append(fields, NewField(fieldChatID, chatID))
+		}
+		res = append(res, *NewTransaction(tranChatMsg, cc.ID, fields...))
+		return res, err
+	}
+
 	// Truncate long usernames
 	trunc := fmt.Sprintf("%13s", cc.UserName)
 	formattedMsg := fmt.Sprintf("\r%.14s:  %s", trunc, t.GetField(fieldData).Data)
@@ -347,12 +358,30 @@ func HandleGetFileInfo(cc *ClientConn, t *Transaction) (res []Transaction, err e
 	fileName := t.GetField(fieldFileName).Data
 	filePath := t.GetField(fieldFilePath).Data
 
-	ffo, err := NewFlattenedFileObject(cc.Server.Config.FileRoot, filePath, fileName, 0)
+	fullFilePath, err := cc.Server.resolvePath(filePath, fileName)
 	if err != nil {
+		return cc.pathErrReply(t, err)
+	}
+
+	if !authorize(cc.Account.Access, accessViewDropBoxes) && inDropBox(cc.Server.FS, cc.Server.Config.FileRoot, path.Dir(fullFilePath)) {
+		res = append(res, cc.NewErrReply(t, "You are not allowed to view drop boxes."))
 		return res, err
 	}
 
-	res = append(res, cc.NewReply(t,
+	if !cc.Server.folderAllowed(cc.Account, aclFolder(cc.Server.FS, fullFilePath), folderRightList) {
+		res = append(res, cc.NewErrReply(t, "You are not allowed to view this folder."))
+		return res, err
+	}
+
+	ffo, err := NewFlattenedFileObject(cc.Server.FS, cc.Server.fileTypes, cc.Server.Config.FileRoot, filePath, fileName, 0)
+	if err != nil {
+		return res, err
+	}
+
+	// The size shown by the client is the combined size of the data and resource forks
+	fileSize := ffo.FlatFileDataForkHeader.forkSize() + ffo.FlatFileResForkHeader.forkSize()
+
+	fields := []Field{
 		NewField(fieldFileName, fileName),
 		NewField(fieldFileTypeString, ffo.FlatFileInformationFork.friendlyType()),
 		NewField(fieldFileCreatorString, ffo.FlatFileInformationFork.CreatorSignature),
@@ -360,13 +389,17 @@ func HandleGetFileInfo(cc *ClientConn, t *Transaction) (res []Transaction, err e
 		NewField(fieldFileType, ffo.FlatFileInformationFork.TypeSignature),
 		NewField(fieldFileCreateDate, ffo.FlatFileInformationFork.CreateDate),
 		NewField(fieldFileModifyDate, ffo.FlatFileInformationFork.ModifyDate),
-		NewField(fieldFileSize, ffo.FlatFileDataForkHeader.DataSize[:]),
-	))
+		NewField(fieldFileSize, size32(fileSize)),
+	}
+	if cc.largeFiles {
+		fields = append(fields, NewField(fieldFileSize64, size64(fileSize)))
+	}
+
+	res = append(res, cc.NewReply(t, fields...))
 	return res, err
 }
 
 // HandleSetFileInfo updates a file or folder name and/or comment from the Get Info window
-// TODO: Implement support for comments
 // Fields used in the request:
 // * 201	File name
 // * 202	File path	Optional
@@ -377,24 +410,65 @@ func HandleSetFileInfo(cc *ClientConn, t *Transaction) (res []Transaction, err e
 	fileName := t.GetField(fieldFileName).Data
 	filePath := t.GetField(fieldFilePath).Data
 
-	fullFilePath, err := readPath(cc.Server.Config.FileRoot, filePath, fileName)
+	fullFilePath, err := cc.Server.resolvePath(filePath, fileName)
 	if err != nil {
-		return res, err
+		return cc.pathErrReply(t, err)
 	}
 
-	fullNewFilePath, err := readPath(cc.Server.Config.FileRoot, filePath, t.GetField(fieldFileNewName).Data)
+	fullNewFilePath, err := cc.Server.resolvePath(filePath, t.GetField(fieldFileNewName).Data)
 	if err != nil {
-		return nil, err
+		return cc.pathErrReply(t, err)
 	}
 
-	// fileComment := t.GetField(fieldFileComment).Data
+	fileComment := t.GetField(fieldFileComment).Data
 	fileNewName := t.GetField(fieldFileNewName).Data
 
+	// Items in drop boxes can't be changed by users who can't see them
+	if !authorize(cc.Account.Access, accessViewDropBoxes) && inDropBox(cc.Server.FS, cc.Server.Config.FileRoot, path.Dir(fullFilePath)) {
+		res = append(res, cc.NewErrReply(t, "You are not allowed to view drop boxes."))
+		return res, err
+	}
+
+	if fileComment != nil {
+		fi, err := cc.Server.FS.Stat(fullFilePath)
+		if err != nil {
+			return res, err
+		}
+		if !cc.Server.folderAllowed(cc.Account, aclFolder(cc.Server.FS, fullFilePath), folderRightRename) {
+			res = append(res, cc.NewErrReply(t, "You are not allowed to set comments for items in this folder."))
+			return res, err
+		}
+		switch mode := fi.Mode(); {
+		case mode.IsDir():
+			if !authorize(cc.Account.Access, accessSetFolderComment) {
+				res = append(res, cc.NewErrReply(t, "You are not allowed to set comments for folders."))
+				return res, err
+			}
+		case mode.IsRegular():
+			if !authorize(cc.Account.Access, accessSetFileComment) {
+				res = append(res, cc.NewErrReply(t, "You are not allowed to set comments for files."))
+				return res, err
+			}
+		}
+
+		if err := setComment(cc.Server.FS, fullFilePath, fileComment); err != nil {
+			return res, err
+		}
+	}
+
 	if fileNewName != nil {
 		fi, err := cc.Server.FS.Stat(fullFilePath)
 		if err != nil {
 			return res, err
 		}
+		if !cc.Server.folderAllowed(cc.Account, aclFolder(cc.Server.FS, fullFilePath), folderRightRename) {
+			res = append(res, cc.NewErrReply(t, "You are not allowed to rename items in this folder."))
+			return res, err
+		}
+		if isMountPoint(cc.Server.FS, fullFilePath) {
+			res = append(res, cc.NewErrReply(t, "Cannot rename folder "+string(fileName)+" because it is a mount point."))
+			return res, err
+		}
 		switch mode := fi.Mode(); {
 		case mode.IsDir():
 			if !authorize(cc.Account.Access, accessRenameFolder) {
@@ -408,11 +482,14 @@ func HandleSetFileInfo(cc *ClientConn, t *Transaction) (res []Transaction, err e
 			}
 		}
 
-		err = os.Rename(fullFilePath, fullNewFilePath)
+		err = cc.Server.FS.Rename(fullFilePath, fullNewFilePath)
 		if os.IsNotExist(err) {
 			res = append(res, cc.NewErrReply(t, "Cannot rename file "+string(fileName)+" because it does not exist or cannot be found."))
 			return res, err
 		}
+		if err := renameAppleDouble(cc.Server.FS, fullFilePath, fullNewFilePath); err != nil {
+			return res, err
+		}
 	}
 
 	res = append(res, cc.NewReply(t))
@@ -428,14 +505,14 @@ func HandleDeleteFile(cc *ClientConn, t *Transaction) (res []Transaction, err er
 	fileName := t.GetField(fieldFileName).Data
 	filePath := t.GetField(fieldFilePath).Data
 
-	fullFilePath, err := readPath(cc.Server.Config.FileRoot, filePath, fileName)
+	fullFilePath, err := cc.Server.resolvePath(filePath, fileName)
 	if err != nil {
-		return res, err
+		return cc.pathErrReply(t, err)
 	}
 
 	cc.Server.Logger.Debugw("Delete file", "src", fullFilePath)
 
-	fi, err := os.Stat(fullFilePath)
+	fi, err := cc.Server.FS.Stat(fullFilePath)
 	if err != nil {
 		res = append(res, cc.NewErrReply(t, "Cannot delete file "+string(fileName)+" because it does not exist or cannot be found."))
 		return res, nil
@@ -453,7 +530,30 @@ func HandleDeleteFile(cc *ClientConn, t *Transaction) (res []Transaction, err er
 		}
 	}
 
-	if err := os.RemoveAll(fullFilePath); err != nil {
+	if !cc.Server.folderAllowed(cc.Account, aclFolder(cc.Server.FS, fullFilePath), folderRightDelete) {
+		res = append(res, cc.NewErrReply(t, "You are not allowed to delete items in this folder."))
+		return res, err
+	}
+	if isMountPoint(cc.Server.FS, fullFilePath) {
+		res = append(res, cc.NewErrReply(t, "Cannot delete folder "+string(fileName)+" because it is a mount point."))
+		return res, err
+	}
+
+	if cc.Server.Config.EnableTrash {
+		item, err := cc.Server.moveToTrash(fullFilePath, cc.Account.Login)
+		if err != nil {
+			return res, err
+		}
+		cc.Server.Logger.Infow("Moved to trash", "path", fullFilePath, "id", item.ID, "login", cc.Account.Login)
+
+		res = append(res, cc.NewReply(t))
+		return res, err
+	}
+
+	if err := cc.Server.FS.RemoveAll(fullFilePath); err != nil {
+		return res, err
+	}
+	if err := removeAppleDouble(cc.Server.FS, fullFilePath); err != nil {
 		return res, err
 	}
 
@@ -464,13 +564,22 @@ func HandleDeleteFile(cc *ClientConn, t *Transaction) (res []Transaction, err er
 // HandleMoveFile moves files or folders. Note: seemingly not documented
 func HandleMoveFile(cc *ClientConn, t *Transaction) (res []Transaction, err error) {
 	fileName := string(t.GetField(fieldFileName).Data)
-	filePath := cc.Server.Config.FileRoot + ReadFilePath(t.GetField(fieldFilePath).Data)
-	fileNewPath := cc.Server.Config.FileRoot + ReadFilePath(t.GetField(fieldFileNewPath).Data)
+	filePath, err := cc.Server.resolvePath(t.GetField(fieldFilePath).Data, nil)
+	if err != nil {
+		return cc.pathErrReply(t, err)
+	}
+	fileNewPath, err := cc.Server.resolvePath(t.GetField(fieldFileNewPath).Data, nil)
+	if err != nil {
+		return cc.pathErrReply(t, err)
+	}
+	if err := checkPathItem([]byte(fileName)); err != nil {
+		return cc.pathErrReply(t, err)
+	}
 
 	cc.Server.Logger.Debugw("Move file", "src", filePath+"/"+fileName, "dst", fileNewPath+"/"+fileName)
 
 	fp := filePath + "/" + fileName
-	fi, err := os.Stat(fp)
+	fi, err := cc.Server.FS.Stat(fp)
 	if err != nil {
 		return res, err
 	}
@@ -487,7 +596,24 @@ func HandleMoveFile(cc *ClientConn, t *Transaction) (res []Transaction, err erro
 		}
 	}
 
-	err = os.Rename(filePath+"/"+fileName, fileNewPath+"/"+fileName)
+	if !authorize(cc.Account.Access, accessViewDropBoxes) && inDropBox(cc.Server.FS, cc.Server.Config.FileRoot, filePath) {
+		res = append(res, cc.NewErrReply(t, "You are not allowed to view drop boxes."))
+		return res, err
+	}
+	if !cc.Server.folderAllowed(cc.Account, aclFolder(cc.Server.FS, fp), folderRightRename) {
+		res = append(res, cc.NewErrReply(t, "You are not allowed to move items in this folder."))
+		return res, err
+	}
+	if !cc.Server.folderAllowed(cc.Account, fileNewPath, folderRightUpload) {
+		res = append(res, cc.NewErrReply(t, "You are not allowed to move items to this folder."))
+		return res, err
+	}
+	if isMountPoint(cc.Server.FS, fp) {
+		res = append(res, cc.NewErrReply(t, "Cannot move folder "+fileName+" because it is a mount point."))
+		return res, err
+	}
+
+	err = cc.Server.FS.Rename(filePath+"/"+fileName, fileNewPath+"/"+fileName)
 	if os.IsNotExist(err) {
 		res = append(res, cc.NewErrReply(t, "Cannot delete file "+fileName+" because it does not exist or cannot be found."))
 		return res, err
@@ -495,6 +621,9 @@ func HandleMoveFile(cc *ClientConn, t *Transaction) (res []Transaction, err erro
 	if err != nil {
 		return []Transaction{}, err
 	}
+	if err := renameAppleDouble(cc.Server.FS, filePath+"/"+fileName, fileNewPath+"/"+fileName); err != nil {
+		return []Transaction{}, err
+	}
 	// TODO: handle other possible errors; e.g. file delete fails due to file permission issue
 
 	res = append(res, cc.NewReply(t))
@@ -506,24 +635,21 @@ func HandleNewFolder(cc *ClientConn, t *Transaction) (res []Transaction, err err
 		res = append(res, cc.NewErrReply(t, "You are not allowed to create folders."))
 		return res, err
 	}
-	newFolderPath := cc.Server.Config.FileRoot
 	folderName := string(t.GetField(fieldFileName).Data)
 
-	folderName = path.Join("/", folderName)
-
 	// fieldFilePath is only present for nested paths
-	if t.GetField(fieldFilePath).Data != nil {
-		var newFp FilePath
-		err := newFp.UnmarshalBinary(t.GetField(fieldFilePath).Data)
-		if err != nil {
-			return nil, err
-		}
-		newFolderPath += newFp.String()
+	newFolderPath, err := cc.Server.resolvePath(t.GetField(fieldFilePath).Data, t.GetField(fieldFileName).Data)
+	if err != nil {
+		return cc.pathErrReply(t, err)
 	}
-	newFolderPath = path.Join(newFolderPath, folderName)
 
 	// TODO: check path and folder name lengths
 
+	if !cc.Server.folderAllowed(cc.Account, path.Dir(newFolderPath), folderRightUpload) {
+		res = append(res, cc.NewErrReply(t, "You are not allowed to create folders in this folder."))
+		return res, err
+	}
+
 	if _, err := cc.Server.FS.Stat(newFolderPath); !os.IsNotExist(err) {
 		msg := fmt.Sprintf("Cannot create folder \"%s\" because there is already a file or folder with that name.", folderName)
 		return []Transaction{cc.NewErrReply(t, msg)}, nil
@@ -564,11 +690,7 @@ func HandleSetUser(cc *ClientConn, t *Transaction) (res []Transaction, err error
 		account.Password = hashAndSalt(t.GetField(fieldUserPassword).Data)
 	}
 
-	out, err := yaml.Marshal(&account)
-	if err != nil {
-		return res, err
-	}
-	if err := os.WriteFile(cc.Server.ConfigDir+"Users/"+login+".yaml", out, 0666); err != nil {
+	if err := cc.Server.AccountStore.Put(account); err != nil {
 		return res, err
 	}
 
@@ -814,7 +936,6 @@ func HandleGetClientConnInfoText(cc *ClientConn, t *Transaction) (res []Transact
 		return res, errors.New("invalid client")
 	}
 
-	// TODO: Implement non-hardcoded values
 	template := `Nickname:   %s
 Name:       %s
 Account:    %s
@@ -826,26 +947,39 @@ Address:    %s
 
 ------- Folder Downloads --------
 
-None.
+%s
 
 --------- File Uploads ----------
 
-None.
+%s
 
 -------- Folder Uploads ---------
 
-None.
+%s
 
 ------- Waiting Downloads -------
 
-None.
+%s
 
 	`
 
-	activeDownloads := clientConn.Transfers[FileDownload]
-	activeDownloadList := "None."
-	for _, dl := range activeDownloads {
-		activeDownloadList += dl.String() + "\n"
+	// Downloads that have not started yet are listed as waiting
+	transfers := make(map[string][]string)
+	for _, ts := range cc.Server.Transfers() {
+		if ts.ClientID != uint16(clientID) {
+			continue
+		}
+		section := ts.Type
+		if ts.Waiting && (ts.Type == transferTypeNames[FileDownload] || ts.Type == transferTypeNames[FolderDownload]) {
+			section = "Waiting"
+		}
+		transfers[section] = append(transfers[section], ts.String())
+	}
+	transferList := func(section string) string {
+		if len(transfers[section]) == 0 {
+			return "None."
+		}
+		return strings.Join(transfers[section], "\n")
 	}
 
 	template = fmt.Sprintf(
@@ -854,7 +988,11 @@ None.
 		clientConn.Account.Name,
 		clientConn.Account.Login,
 		clientConn.RemoteAddr,
-		activeDownloadList,
+		transferList(transferTypeNames[FileDownload]),
+		transferList(transferTypeNames[FolderDownload]),
+		transferList(transferTypeNames[FileUpload]),
+		transferList(transferTypeNames[FolderUpload]),
+		transferList("Waiting"),
 	)
 	template = strings.Replace(template, "\n", "\r", -1)
 
@@ -946,14 +1084,14 @@ func HandleTranOldPostNews(cc *ClientConn, t *Transaction) (res []Transaction, e
 		newsTemplate = cc.Server.Config.NewsDelimiter
 	}
 
-	newsPost := fmt.Sprintf(newsTemplate+"\r", cc.UserName, time.Now().Format(newsDateTemplate), t.GetField(fieldData).Data)
+	newsPost := fmt.Sprintf(newsTemplate+"\r", cc.UserName, cc.Server.now().Format(newsDateTemplate), t.GetField(fieldData).Data)
 	newsPost = strings.Replace(newsPost, "\n", "\r", -1)
 
 	// update news in memory
 	cc.Server.FlatNews = append([]byte(newsPost), cc.Server.FlatNews...)
 
 	// update news on disk
-	if err := ioutil.WriteFile(cc.Server.ConfigDir+"MessageBoard.txt", cc.Server.FlatNews, 0644); err != nil {
+	if err := cc.Server.FlatNewsStore.Save(cc.Server.FlatNews); err != nil {
 		return res, err
 	}
 
@@ -1243,7 +1381,7 @@ func HandlePostNewsArt(cc *ClientConn, t *Transaction) (res []Transaction, err e
 	newArt := NewsArtData{
 		Title:         string(t.GetField(fieldNewsArtTitle).Data),
 		Poster:        string(cc.UserName),
-		Date:          toHotlineTime(time.Now()),
+		Date:          toHotlineTime(cc.Server.now()),
 		PrevArt:       []byte{0, 0, 0, 0},
 		NextArt:       []byte{0, 0, 0, 0},
 		ParentArt:     append([]byte{0, 0}, t.GetField(fieldNewsArtID).Data...),
@@ -1313,13 +1451,13 @@ func HandleDownloadFile(cc *ClientConn, t *Transaction) (res []Transaction, err
 
 	resumeData := t.GetField(fieldFileResumeData).Data
 
-	var dataOffset int64
+	var dataOffset, rsrcOffset int64
 	var frd FileResumeData
 	if resumeData != nil {
 		if err := frd.UnmarshalBinary(t.GetField(fieldFileResumeData).Data); err != nil {
 			return res, err
 		}
-		dataOffset = int64(binary.BigEndian.Uint32(frd.ForkInfoList[0].DataSize[:]))
+		dataOffset, rsrcOffset = frd.forkOffsets(cc.largeFiles)
 	}
 
 	var fp FilePath
@@ -1328,10 +1466,31 @@ func HandleDownloadFile(cc *ClientConn, t *Transaction) (res []Transaction, err
 		return res, err
 	}
 
-	ffo, err := NewFlattenedFileObject(cc.Server.Config.FileRoot, filePath, fileName, dataOffset)
+	fullFilePath, err := cc.Server.resolvePath(filePath, fileName)
+	if err != nil {
+		return cc.pathErrReply(t, err)
+	}
+
+	if !authorize(cc.Account.Access, accessViewDropBoxes) && inDropBox(cc.Server.FS, cc.Server.Config.FileRoot, path.Dir(fullFilePath)) {
+		res = append(res, cc.NewErrReply(t, "You are not allowed to download files from drop boxes."))
+		return res, err
+	}
+
+	if !cc.Server.folderAllowed(cc.Account, path.Dir(fullFilePath), folderRightDownload) {
+		res = append(res, cc.NewErrReply(t, "You are not allowed to download files from this folder."))
+		return res, err
+	}
+
+	ffo, err := NewFlattenedFileObject(cc.Server.FS, cc.Server.fileTypes, cc.Server.Config.FileRoot, filePath, fileName, dataOffset)
 	if err != nil {
 		return res, err
 	}
+	ffo.resumeResourceFork(rsrcOffset)
+
+	if ffo.transferSize64() > maxFileSize32 && !cc.largeFiles {
+		res = append(res, cc.NewErrReply(t, fileTooLargeMsg(fileName)))
+		return res, err
+	}
 
 	transactionRef := cc.Server.NewTransactionRef()
 	data := binary.BigEndian.Uint32(transactionRef)
@@ -1341,6 +1500,8 @@ func HandleDownloadFile(cc *ClientConn, t *Transaction) (res []Transaction, err
 		FilePath:        filePath,
 		ReferenceNumber: transactionRef,
 		Type:            FileDownload,
+		clientConn:      cc,
+		created:         cc.Server.now(),
 	}
 
 	if resumeData != nil {
@@ -1351,15 +1512,16 @@ func HandleDownloadFile(cc *ClientConn, t *Transaction) (res []Transaction, err
 		ft.fileResumeData = &frd
 	}
 
-	xferSize := ffo.TransferSize()
+	xferSize := ffo.transferSize64()
 
 	// Optional field for when a HL v1.5+ client requests file preview
 	// Used only for TEXT, JPEG, GIFF, BMP or PICT files
 	// The value will always be 2
 	if t.GetField(fieldFileTransferOptions).Data != nil {
 		ft.options = t.GetField(fieldFileTransferOptions).Data
-		xferSize = ffo.FlatFileDataForkHeader.DataSize[:]
+		xferSize = ffo.FlatFileDataForkHeader.forkSize()
 	}
+	ft.TransferSize = size64(xferSize)
 
 	cc.Server.mux.Lock()
 	defer cc.Server.mux.Unlock()
@@ -1367,16 +1529,29 @@ func HandleDownloadFile(cc *ClientConn, t *Transaction) (res []Transaction, err
 
 	cc.Transfers[FileDownload] = append(cc.Transfers[FileDownload], ft)
 
-	res = append(res, cc.NewReply(t,
+	fields := []Field{
 		NewField(fieldRefNum, transactionRef),
 		NewField(fieldWaitingCount, []byte{0x00, 0x00}), // TODO: Implement waiting count
-		NewField(fieldTransferSize, xferSize),
-		NewField(fieldFileSize, ffo.FlatFileDataForkHeader.DataSize[:]),
-	))
+		NewField(fieldTransferSize, size32(xferSize)),
+		NewField(fieldFileSize, size32(ffo.FlatFileDataForkHeader.forkSize())),
+	}
+	if cc.largeFiles {
+		fields = append(fields,
+			NewField(fieldTransferSize64, size64(xferSize)),
+			NewField(fieldFileSize64, size64(ffo.FlatFileDataForkHeader.forkSize())),
+		)
+	}
+
+	res = append(res, cc.NewReply(t, fields...))
 
 	return res, err
 }
 
+// fileTooLargeMsg is the error shown to clients without large file support that request a file over 4 GiB
+func fileTooLargeMsg(fileName []byte) string {
+	return fmt.Sprintf("Cannot download %s because it is too large for your client.  Files over 4 GB require a client that supports large files.", fileName)
+}
+
 // Download all files from the specified folder and sub-folders
 func HandleDownloadFolder(cc *ClientConn, t *Transaction) (res []Transaction, err error) {
 	if !authorize(cc.Account.Access, accessDownloadFile) {
@@ -1384,45 +1559,70 @@ func HandleDownloadFolder(cc *ClientConn, t *Transaction) (res []Transaction, er
 		return res, err
 	}
 
-	transactionRef := cc.Server.NewTransactionRef()
-	data := binary.BigEndian.Uint32(transactionRef)
-
-	fileTransfer := &FileTransfer{
-		FileName:        t.GetField(fieldFileName).Data,
-		FilePath:        t.GetField(fieldFilePath).Data,
-		ReferenceNumber: transactionRef,
-		Type:            FolderDownload,
-	}
-	cc.Server.mux.Lock()
-	cc.Server.FileTransfers[data] = fileTransfer
-	cc.Server.mux.Unlock()
-	cc.Transfers[FolderDownload] = append(cc.Transfers[FolderDownload], fileTransfer)
-
 	var fp FilePath
 	err = fp.UnmarshalBinary(t.GetField(fieldFilePath).Data)
 	if err != nil {
 		return res, err
 	}
 
-	fullFilePath, err := readPath(cc.Server.Config.FileRoot, t.GetField(fieldFilePath).Data, t.GetField(fieldFileName).Data)
+	fullFilePath, err := cc.Server.resolvePath(t.GetField(fieldFilePath).Data, t.GetField(fieldFileName).Data)
 	if err != nil {
+		return cc.pathErrReply(t, err)
+	}
+
+	if !authorize(cc.Account.Access, accessViewDropBoxes) && inDropBox(cc.Server.FS, cc.Server.Config.FileRoot, fullFilePath) {
+		res = append(res, cc.NewErrReply(t, "You are not allowed to download folders from drop boxes."))
 		return res, err
 	}
 
-	transferSize, err := CalcTotalSize(fullFilePath)
+	if !cc.Server.folderAllowed(cc.Account, fullFilePath, folderRightDownload) {
+		res = append(res, cc.NewErrReply(t, "You are not allowed to download this folder."))
+		return res, err
+	}
+
+	// Drop boxes and folders denied by ACLs inside the folder are left out of the transfer
+	transferSize, largestFile, err := folderSize(cc.Server.FS, fullFilePath, cc.canTransferFolder)
 	if err != nil {
 		return res, err
 	}
-	itemCount, err := CalcItemCount(fullFilePath)
+	if largestFile > maxFileSize32 && !cc.largeFiles {
+		res = append(res, cc.NewErrReply(t, fileTooLargeMsg(t.GetField(fieldFileName).Data)))
+		return res, err
+	}
+
+	itemCount, err := folderItemCount(cc.Server.FS, fullFilePath, cc.canTransferFolder)
 	if err != nil {
 		return res, err
 	}
-	res = append(res, cc.NewReply(t,
+
+	transactionRef := cc.Server.NewTransactionRef()
+	data := binary.BigEndian.Uint32(transactionRef)
+
+	fileTransfer := &FileTransfer{
+		FileName:        t.GetField(fieldFileName).Data,
+		FilePath:        t.GetField(fieldFilePath).Data,
+		ReferenceNumber: transactionRef,
+		Type:            FolderDownload,
+		TransferSize:    size64(transferSize),
+		clientConn:      cc,
+		created:         cc.Server.now(),
+	}
+	cc.Server.mux.Lock()
+	cc.Server.FileTransfers[data] = fileTransfer
+	cc.Transfers[FolderDownload] = append(cc.Transfers[FolderDownload], fileTransfer)
+	cc.Server.mux.Unlock()
+
+	fields := []Field{
 		NewField(fieldRefNum, transactionRef),
-		NewField(fieldTransferSize, transferSize),
+		NewField(fieldTransferSize, size32(transferSize)),
 		NewField(fieldFolderItemCount, itemCount),
 		NewField(fieldWaitingCount, []byte{0x00, 0x00}), // TODO: Implement waiting count
-	))
+	}
+	if cc.largeFiles {
+		fields = append(fields, NewField(fieldTransferSize64, size64(transferSize)))
+	}
+
+	res = append(res, cc.NewReply(t, fields...))
 	return res, err
 }
 
@@ -1434,31 +1634,48 @@ func HandleDownloadFolder(cc *ClientConn, t *Transaction) (res []Transaction, er
 // 220	Folder item count
 // 204	File transfer options	"Optional Currently set to 1" (TODO: ??)
 func HandleUploadFolder(cc *ClientConn, t *Transaction) (res []Transaction, err error) {
-	transactionRef := cc.Server.NewTransactionRef()
-	data := binary.BigEndian.Uint32(transactionRef)
+	if !authorize(cc.Account.Access, accessUploadFile) {
+		res = append(res, cc.NewErrReply(t, "You are not allowed to upload folders."))
+		return res, err
+	}
 
-	var fp FilePath
-	if t.GetField(fieldFilePath).Data != nil {
-		if err = fp.UnmarshalBinary(t.GetField(fieldFilePath).Data); err != nil {
-			return res, err
-		}
+	folderPath, err := cc.Server.resolvePath(t.GetField(fieldFilePath).Data, nil)
+	if err != nil {
+		return cc.pathErrReply(t, err)
+	}
+	if _, err := cc.Server.resolvePath(t.GetField(fieldFilePath).Data, t.GetField(fieldFileName).Data); err != nil {
+		return cc.pathErrReply(t, err)
 	}
 
 	// Handle special cases for Upload and Drop Box folders
-	if !authorize(cc.Account.Access, accessUploadAnywhere) {
-		if !fp.IsUploadDir() && !fp.IsDropbox() {
-			res = append(res, cc.NewErrReply(t, fmt.Sprintf("Cannot accept upload of the folder \"%v\" because you are only allowed to upload to the \"Uploads\" folder.", string(t.GetField(fieldFileName).Data))))
-			return res, err
-		}
+	if !authorize(cc.Account.Access, accessUploadAnywhere) && !cc.Server.inUploadFolder(folderPath) {
+		res = append(res, cc.NewErrReply(t, fmt.Sprintf("Cannot accept upload of the folder \"%v\" because you are only allowed to upload to the \"Uploads\" folder.", string(t.GetField(fieldFileName).Data))))
+		return res, err
+	}
+
+	if !cc.Server.folderAllowed(cc.Account, folderPath, folderRightUpload) {
+		res = append(res, cc.NewErrReply(t, "You are not allowed to upload to this folder."))
+		return res, err
+	}
+
+	transferSizeData := cc.requestedTransferSize(t)
+	if err := cc.Server.newUploadBudget(cc.Account, folderPath, nil).check(0, transferSize(transferSizeData)); err != nil {
+		res = append(res, cc.NewErrReply(t, cc.Server.uploadLimitMsg(cc.Account, "folder", string(t.GetField(fieldFileName).Data), err)))
+		return res, nil
 	}
 
+	transactionRef := cc.Server.NewTransactionRef()
+	data := binary.BigEndian.Uint32(transactionRef)
+
 	fileTransfer := &FileTransfer{
 		FileName:        t.GetField(fieldFileName).Data,
 		FilePath:        t.GetField(fieldFilePath).Data,
 		ReferenceNumber: transactionRef,
 		Type:            FolderUpload,
 		FolderItemCount: t.GetField(fieldFolderItemCount).Data,
-		TransferSize:    t.GetField(fieldTransferSize).Data,
+		TransferSize:    transferSizeData,
+		clientConn:      cc,
+		created:         cc.Server.now(),
 	}
 	cc.Server.FileTransfers[data] = fileTransfer
 
@@ -1483,23 +1700,45 @@ func HandleUploadFile(cc *ClientConn, t *Transaction) (res []Transaction, err er
 	filePath := t.GetField(fieldFilePath).Data
 
 	transferOptions := t.GetField(fieldFileTransferOptions).Data
+	transferSizeData := cc.requestedTransferSize(t)
 
-	// TODO: is this field useful for anything?
-	// transferSize := t.GetField(fieldTransferSize).Data
-
-	var fp FilePath
-	if filePath != nil {
-		if err = fp.UnmarshalBinary(filePath); err != nil {
-			return res, err
-		}
+	folderPath, err := cc.Server.resolvePath(filePath, nil)
+	if err != nil {
+		return cc.pathErrReply(t, err)
+	}
+	fullFilePath, err := cc.Server.resolvePath(filePath, fileName)
+	if err != nil {
+		return cc.pathErrReply(t, err)
 	}
 
 	// Handle special cases for Upload and Drop Box folders
-	if !authorize(cc.Account.Access, accessUploadAnywhere) {
-		if !fp.IsUploadDir() && !fp.IsDropbox() {
-			res = append(res, cc.NewErrReply(t, fmt.Sprintf("Cannot accept upload of the file \"%v\" because you are only allowed to upload to the \"Uploads\" folder.", string(fileName))))
+	if !authorize(cc.Account.Access, accessUploadAnywhere) && !cc.Server.inUploadFolder(folderPath) {
+		res = append(res, cc.NewErrReply(t, fmt.Sprintf("Cannot accept upload of the file \"%v\" because you are only allowed to upload to the \"Uploads\" folder.", string(fileName))))
+		return res, err
+	}
+
+	if !cc.Server.folderAllowed(cc.Account, folderPath, folderRightUpload) {
+		res = append(res, cc.NewErrReply(t, "You are not allowed to upload to this folder."))
+		return res, err
+	}
+
+	size := transferSize(transferSizeData)
+	if err := cc.Server.newUploadBudget(cc.Account, folderPath, nil).check(size, size); err != nil {
+		res = append(res, cc.NewErrReply(t, cc.Server.uploadLimitMsg(cc.Account, "file", string(fileName), err)))
+		return res, nil
+	}
+
+	// client has requested to resume a partially transfered file
+	var fileResumeData *FileResumeData
+	if transferOptions != nil {
+		fileInfo, err := cc.Server.FS.Stat(fullFilePath + incompleteFileSuffix)
+		if err != nil {
 			return res, err
 		}
+
+		fileResumeData = NewFileResumeData([]ForkInfoList{
+			*newDataForkInfoList(uint64(fileInfo.Size())),
+		})
 	}
 
 	transactionRef := cc.Server.NewTransactionRef()
@@ -1511,32 +1750,16 @@ func HandleUploadFile(cc *ClientConn, t *Transaction) (res []Transaction, err er
 		FilePath:        filePath,
 		ReferenceNumber: transactionRef,
 		Type:            FileUpload,
+		TransferSize:    transferSizeData,
+		fileResumeData:  fileResumeData,
+		clientConn:      cc,
+		created:         cc.Server.now(),
 	}
 	cc.Server.mux.Unlock()
 
 	replyT := cc.NewReply(t, NewField(fieldRefNum, transactionRef))
-
-	// client has requested to resume a partially transfered file
-	if transferOptions != nil {
-		fullFilePath, err := readPath(cc.Server.Config.FileRoot, filePath, fileName)
-		if err != nil {
-			return res, err
-		}
-
-		fileInfo, err := cc.Server.FS.Stat(fullFilePath + incompleteFileSuffix)
-		if err != nil {
-			return res, err
-		}
-
-		offset := make([]byte, 4)
-		binary.BigEndian.PutUint32(offset, uint32(fileInfo.Size()))
-
-		fileResumeData := NewFileResumeData([]ForkInfoList{
-			*NewForkInfoList(offset),
-		})
-
+	if fileResumeData != nil {
 		b, _ := fileResumeData.BinaryMarshal()
-
 		replyT.Fields = append(replyT.Fields, NewField(fieldFileResumeData, b))
 	}
 
@@ -1590,6 +1813,7 @@ func HandleSetClientUserInfo(cc *ClientConn, t *Transaction) (res []Transaction,
 // HandleKeepAlive responds to keepalive transactions with an empty reply
 // * HL 1.9.2 Client sends keepalive msg every 3 minutes
 // * HL 1.2.3 Client doesn't send keepalives
+// Keepalives are not counted as user activity and do not reset the idle timer.
 func HandleKeepAlive(cc *ClientConn, t *Transaction) (res []Transaction, err error) {
 	res = append(res, cc.NewReply(t))
 
@@ -1597,29 +1821,28 @@ func HandleKeepAlive(cc *ClientConn, t *Transaction) (res []Transaction, err err
 }
 
 func HandleGetFileNameList(cc *ClientConn, t *Transaction) (res []Transaction, err error) {
-	fullPath, err := readPath(
-		cc.Server.Config.FileRoot,
-		t.GetField(fieldFilePath).Data,
-		nil,
-	)
+	fullPath, err := cc.Server.resolvePath(t.GetField(fieldFilePath).Data, nil)
 	if err != nil {
-		return res, err
+		return cc.pathErrReply(t, err)
 	}
 
-	var fp FilePath
-	if t.GetField(fieldFilePath).Data != nil {
-		if err = fp.UnmarshalBinary(t.GetField(fieldFilePath).Data); err != nil {
-			return res, err
-		}
+	// The contents of drop boxes, including any folders inside of them, are only listed for users who can view them
+	if !authorize(cc.Account.Access, accessViewDropBoxes) && inDropBox(cc.Server.FS, cc.Server.Config.FileRoot, fullPath) {
+		res = append(res, cc.NewReply(t))
+		return res, err
 	}
 
-	// Handle special case for drop box folders
-	if fp.IsDropbox() && !authorize(cc.Account.Access, accessViewDropBoxes) {
-		res = append(res, cc.NewReply(t))
+	if !cc.Server.folderAllowed(cc.Account, fullPath, folderRightList) {
+		res = append(res, cc.NewErrReply(t, "You are not allowed to view this folder."))
 		return res, err
 	}
 
-	fileNames, err := getFileNameList(fullPath)
+	// Folders the user is not allowed to list are hidden
+	canList := func(folderPath string) bool {
+		return cc.Server.folderAllowed(cc.Account, folderPath, folderRightList)
+	}
+
+	fileNames, err := getFileNameList(cc.Server.FS, cc.Server.fileTypes, cc.Server.Config.FileRoot, fullPath, canList)
 	if err != nil {
 		return res, err
 	}
@@ -1844,18 +2067,30 @@ func HandleMakeAlias(cc *ClientConn, t *Transaction) (res []Transaction, err err
 	filePath := t.GetField(fieldFilePath).Data
 	fileNewPath := t.GetField(fieldFileNewPath).Data
 
-	fullFilePath, err := readPath(cc.Server.Config.FileRoot, filePath, fileName)
+	fullFilePath, err := cc.Server.resolvePath(filePath, fileName)
 	if err != nil {
-		return res, err
+		return cc.pathErrReply(t, err)
 	}
 
-	fullNewFilePath, err := readPath(cc.Server.Config.FileRoot, fileNewPath, fileName)
+	fullNewFilePath, err := cc.Server.resolvePath(fileNewPath, fileName)
 	if err != nil {
-		return res, err
+		return cc.pathErrReply(t, err)
 	}
 
 	cc.Server.Logger.Debugw("Make alias", "src", fullFilePath, "dst", fullNewFilePath)
 
+	if !authorize(cc.Account.Access, accessViewDropBoxes) && inDropBox(cc.Server.FS, cc.Server.Config.FileRoot, path.Dir(fullFilePath)) {
+		res = append(res, cc.NewErrReply(t, "You are not allowed to view drop boxes."))
+		return res, err
+	}
+
+	// An alias exposes its original in another folder, so the original must be downloadable by the user
+	if !cc.Server.folderAllowed(cc.Account, aclFolder(cc.Server.FS, fullFilePath), folderRightDownload) ||
+		!cc.Server.folderAllowed(cc.Account, path.Dir(fullNewFilePath), folderRightUpload) {
+		res = append(res, cc.NewErrReply(t, "You are not allowed to make aliases in this folder."))
+		return res, err
+	}
+
 	if err := cc.Server.FS.Symlink(fullFilePath, fullNewFilePath); err != nil {
 		res = append(res, cc.NewErrReply(t, "Error creating alias"))
 		return res, nil
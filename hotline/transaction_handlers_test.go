@@ -1,9 +1,11 @@
 package hotline
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 	"io/fs"
 	"math/rand"
 	"os"
@@ -624,12 +626,22 @@ func TestHandleGetFileInfo(t *testing.T) {
 			args: args{
 				cc: &ClientConn{
 					ID: &[]byte{0x00, 0x01},
+					Account: &Account{
+						Access: func() *[]byte {
+							var bits accessBitmap
+							access := bits[:]
+							return &access
+						}(),
+					},
 					Server: &Server{
+						FS: func() *MemFileStore {
+							mfs := NewMemFileStore()
+							_ = mfs.MkdirAll("/Files", 0777)
+							_ = mfs.WriteFile("/Files/testfile.txt", []byte("Hello, Hotline client!\n"), 0644)
+							return mfs
+						}(),
 						Config: &Config{
-							FileRoot: func() string {
-								path, _ := os.Getwd()
-								return path + "/test/config/Files"
-							}(),
+							FileRoot: "/Files",
 						},
 					},
 				},
@@ -683,6 +695,180 @@ func TestHandleGetFileInfo(t *testing.T) {
 	}
 }
 
+func TestHandleSetFileInfo(t *testing.T) {
+	newServer := func() *Server {
+		mfs := NewMemFileStore()
+		_ = mfs.MkdirAll("/Files/Docs", 0777)
+		_ = mfs.WriteFile("/Files/testfile.txt", []byte("Hello, Hotline client!\n"), 0644)
+		return &Server{FS: mfs, Config: &Config{FileRoot: "/Files"}}
+	}
+	accessWith := func(accessBits ...int) *[]byte {
+		var bits accessBitmap
+		for _, bit := range accessBits {
+			bits.Set(bit)
+		}
+		access := bits[:]
+		return &access
+	}
+
+	type args struct {
+		access *[]byte
+		t      *Transaction
+	}
+	tests := []struct {
+		name        string
+		args        args
+		wantRes     []Transaction
+		wantPath    string
+		wantComment []byte
+	}{
+		{
+			name: "sets a file comment",
+			args: args{
+				access: accessWith(accessSetFileComment),
+				t: NewTransaction(
+					tranSetFileInfo, nil,
+					NewField(fieldFileName, []byte("testfile.txt")),
+					NewField(fieldFileComment, []byte("A friendly greeting")),
+				),
+			},
+			wantRes: []Transaction{
+				{
+					clientID:  &[]byte{0, 1},
+					IsReply:   0x01,
+					Type:      []byte{0, 0xcf},
+					ID:        []byte{0x9a, 0xcb, 0x04, 0x42},
+					ErrorCode: []byte{0, 0, 0, 0},
+				},
+			},
+			wantPath:    "/Files/testfile.txt",
+			wantComment: []byte("A friendly greeting"),
+		},
+		{
+			name: "keeps the comment when the file is renamed",
+			args: args{
+				access: accessWith(accessSetFileComment, accessRenameFile),
+				t: NewTransaction(
+					tranSetFileInfo, nil,
+					NewField(fieldFileName, []byte("testfile.txt")),
+					NewField(fieldFileComment, []byte("A friendly greeting")),
+					NewField(fieldFileNewName, []byte("renamed.txt")),
+				),
+			},
+			wantRes: []Transaction{
+				{
+					clientID:  &[]byte{0, 1},
+					IsReply:   0x01,
+					Type:      []byte{0, 0xcf},
+					ID:        []byte{0x9a, 0xcb, 0x04, 0x42},
+					ErrorCode: []byte{0, 0, 0, 0},
+				},
+			},
+			wantPath:    "/Files/renamed.txt",
+			wantComment: []byte("A friendly greeting"),
+		},
+		{
+			name: "sets a folder comment",
+			args: args{
+				access: accessWith(accessSetFolderComment),
+				t: NewTransaction(
+					tranSetFileInfo, nil,
+					NewField(fieldFileName, []byte("Docs")),
+					NewField(fieldFileComment, []byte("Manuals")),
+				),
+			},
+			wantRes: []Transaction{
+				{
+					clientID:  &[]byte{0, 1},
+					IsReply:   0x01,
+					Type:      []byte{0, 0xcf},
+					ID:        []byte{0x9a, 0xcb, 0x04, 0x42},
+					ErrorCode: []byte{0, 0, 0, 0},
+				},
+			},
+			wantPath:    "/Files/Docs",
+			wantComment: []byte("Manuals"),
+		},
+		{
+			name: "without permission to set file comments",
+			args: args{
+				access: accessWith(accessSetFolderComment),
+				t: NewTransaction(
+					tranSetFileInfo, nil,
+					NewField(fieldFileName, []byte("testfile.txt")),
+					NewField(fieldFileComment, []byte("A friendly greeting")),
+				),
+			},
+			wantRes: []Transaction{
+				{
+					clientID:  &[]byte{0, 1},
+					IsReply:   0x01,
+					Type:      []byte{0, 0},
+					ID:        []byte{0x9a, 0xcb, 0x04, 0x42},
+					ErrorCode: []byte{0, 0, 0, 1},
+					Fields: []Field{
+						NewField(fieldError, []byte("You are not allowed to set comments for files.")),
+					},
+				},
+			},
+			wantPath: "/Files/testfile.txt",
+		},
+		{
+			name: "without permission to set folder comments",
+			args: args{
+				access: accessWith(accessSetFileComment),
+				t: NewTransaction(
+					tranSetFileInfo, nil,
+					NewField(fieldFileName, []byte("Docs")),
+					NewField(fieldFileComment, []byte("Manuals")),
+				),
+			},
+			wantRes: []Transaction{
+				{
+					clientID:  &[]byte{0, 1},
+					IsReply:   0x01,
+					Type:      []byte{0, 0},
+					ID:        []byte{0x9a, 0xcb, 0x04, 0x42},
+					ErrorCode: []byte{0, 0, 0, 1},
+					Fields: []Field{
+						NewField(fieldError, []byte("You are not allowed to set comments for folders.")),
+					},
+				},
+			},
+			wantPath: "/Files/Docs",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rand.Seed(1) // reset seed between tests to make transaction IDs predictable
+
+			cc := &ClientConn{
+				ID:      &[]byte{0, 1},
+				Account: &Account{Access: tt.args.access},
+				Server:  newServer(),
+			}
+			tt.args.t.ID = []byte{0x9a, 0xcb, 0x04, 0x42}
+
+			gotRes, err := HandleSetFileInfo(cc, tt.args.t)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantRes, gotRes)
+
+			ad, _ := readAppleDouble(cc.Server.FS, tt.wantPath)
+			if tt.wantComment == nil {
+				assert.Nil(t, ad)
+				return
+			}
+			assert.Equal(t, tt.wantComment, ad.Comment)
+
+			// The comment is returned by Get Info
+			fileName := strings.TrimPrefix(tt.wantPath, "/Files/")
+			infoRes, err := HandleGetFileInfo(cc, NewTransaction(tranGetFileInfo, nil, NewField(fieldFileName, []byte(fileName))))
+			assert.NoError(t, err)
+			assert.Equal(t, NewField(fieldFileComment, tt.wantComment), infoRes[0].Fields[3])
+		})
+	}
+}
+
 func TestHandleNewFolder(t *testing.T) {
 	type args struct {
 		cc *ClientConn
@@ -744,8 +930,11 @@ func TestHandleNewFolder(t *testing.T) {
 						},
 						FS: func() *MockFileStore {
 							mfs := &MockFileStore{}
+							mfs.On("Lstat", mock.Anything).Return(nil, os.ErrNotExist)
 							mfs.On("Mkdir", "/Files/aaa/testFolder", fs.FileMode(0777)).Return(nil)
 							mfs.On("Stat", "/Files/aaa/testFolder").Return(nil, os.ErrNotExist)
+							mfs.On("Open", "/Files/aaa/"+folderACLFile).Return(nil, os.ErrNotExist)
+							mfs.On("Open", "/Files/"+folderACLFile).Return(nil, os.ErrNotExist)
 							return mfs
 						}(),
 					},
@@ -792,8 +981,10 @@ func TestHandleNewFolder(t *testing.T) {
 						},
 						FS: func() *MockFileStore {
 							mfs := &MockFileStore{}
+							mfs.On("Lstat", mock.Anything).Return(nil, os.ErrNotExist)
 							mfs.On("Mkdir", "/Files/testFolder", fs.FileMode(0777)).Return(nil)
 							mfs.On("Stat", "/Files/testFolder").Return(nil, os.ErrNotExist)
+							mfs.On("Open", "/Files/"+folderACLFile).Return(nil, os.ErrNotExist)
 							return mfs
 						}(),
 					},
@@ -834,8 +1025,11 @@ func TestHandleNewFolder(t *testing.T) {
 						},
 						FS: func() *MockFileStore {
 							mfs := &MockFileStore{}
+							mfs.On("Lstat", mock.Anything).Return(nil, os.ErrNotExist)
 							mfs.On("Mkdir", "/Files/aaa/testFolder", fs.FileMode(0777)).Return(nil)
 							mfs.On("Stat", "/Files/aaa/testFolder").Return(nil, os.ErrNotExist)
+							mfs.On("Open", "/Files/aaa/"+folderACLFile).Return(nil, os.ErrNotExist)
+							mfs.On("Open", "/Files/"+folderACLFile).Return(nil, os.ErrNotExist)
 							return mfs
 						}(),
 					},
@@ -870,8 +1064,6 @@ func TestHandleNewFolder(t *testing.T) {
 						},
 						FS: func() *MockFileStore {
 							mfs := &MockFileStore{}
-							mfs.On("Mkdir", "/Files/testFolder", fs.FileMode(0777)).Return(nil)
-							mfs.On("Stat", "/Files/testFolder").Return(nil, os.ErrNotExist)
 							return mfs
 						}(),
 					},
@@ -886,9 +1078,12 @@ func TestHandleNewFolder(t *testing.T) {
 					clientID:  &[]byte{0, 1},
 					Flags:     0x00,
 					IsReply:   0x01,
-					Type:      []byte{0, 0xcd},
+					Type:      []byte{0, 0x00},
 					ID:        []byte{0x9a, 0xcb, 0x04, 0x42}, // Random ID from rand.Seed(1)
-					ErrorCode: []byte{0, 0, 0, 0},
+					ErrorCode: []byte{0, 0, 0, 1},
+					Fields: []Field{
+						NewField(fieldError, []byte("Cannot complete the request because the file path is not valid.")),
+					},
 				},
 			}, wantErr: false,
 		},
@@ -911,8 +1106,6 @@ func TestHandleNewFolder(t *testing.T) {
 						},
 						FS: func() *MockFileStore {
 							mfs := &MockFileStore{}
-							mfs.On("Mkdir", "/Files/foo/testFolder", fs.FileMode(0777)).Return(nil)
-							mfs.On("Stat", "/Files/foo/testFolder").Return(nil, os.ErrNotExist)
 							return mfs
 						}(),
 					},
@@ -936,9 +1129,12 @@ func TestHandleNewFolder(t *testing.T) {
 					clientID:  &[]byte{0, 1},
 					Flags:     0x00,
 					IsReply:   0x01,
-					Type:      []byte{0, 0xcd},
+					Type:      []byte{0, 0x00},
 					ID:        []byte{0x9a, 0xcb, 0x04, 0x42}, // Random ID from rand.Seed(1)
-					ErrorCode: []byte{0, 0, 0, 0},
+					ErrorCode: []byte{0, 0, 0, 1},
+					Fields: []Field{
+						NewField(fieldError, []byte("Cannot complete the request because the file path is not valid.")),
+					},
 				},
 			}, wantErr: false,
 		},
@@ -971,11 +1167,13 @@ func TestHandleUploadFile(t *testing.T) {
 		wantErr bool
 	}{
 		{
-			name: "when request is valid and user has Upload Anywhere permission",
+			name: "when the file path is not valid",
 			args: args{
 				cc: &ClientConn{
 					Server: &Server{
+						FS:            NewMemFileStore(),
 						FileTransfers: map[uint32]*FileTransfer{},
+						Config:        &Config{FileRoot: "/Files"},
 					},
 					Account: &Account{
 						Access: func() *[]byte {
@@ -998,6 +1196,50 @@ func TestHandleUploadFile(t *testing.T) {
 					}),
 				),
 			},
+			wantRes: []Transaction{
+				{
+					Flags:     0x00,
+					IsReply:   0x01,
+					Type:      []byte{0, 0x00},
+					ID:        []byte{0x9a, 0xcb, 0x04, 0x42},
+					ErrorCode: []byte{0, 0, 0, 1},
+					Fields: []Field{
+						NewField(fieldError, []byte("Cannot complete the request because the file path is not valid.")),
+					},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "when request is valid and user has Upload Anywhere permission",
+			args: args{
+				cc: &ClientConn{
+					Server: &Server{
+						FS:            NewMemFileStore(),
+						FileTransfers: map[uint32]*FileTransfer{},
+						Config:        &Config{FileRoot: "/Files"},
+					},
+					Account: &Account{
+						Access: func() *[]byte {
+							var bits accessBitmap
+							bits.Set(accessUploadFile)
+							bits.Set(accessUploadAnywhere)
+							access := bits[:]
+							return &access
+						}(),
+					},
+				},
+				t: NewTransaction(
+					tranUploadFile, &[]byte{0, 1},
+					NewField(fieldFileName, []byte("testFile")),
+					NewField(fieldFilePath, []byte{
+						0x00, 0x01,
+						0x00, 0x00,
+						0x03,
+						0x66, 0x6f, 0x6f,
+					}),
+				),
+			},
 			wantRes: []Transaction{
 				{
 					Flags:     0x00,
@@ -1101,6 +1343,9 @@ func TestHandleMakeAlias(t *testing.T) {
 						Logger: NewTestLogger(),
 						FS: func() *MockFileStore {
 							mfs := &MockFileStore{}
+							mfs.On("Lstat", mock.Anything).Return(nil, os.ErrNotExist)
+							mfs.On("Stat", mock.Anything).Return(nil, os.ErrNotExist)
+							mfs.On("Open", mock.Anything).Return(nil, os.ErrNotExist)
 							path, _ := os.Getwd()
 							mfs.On(
 								"Symlink",
@@ -1152,6 +1397,9 @@ func TestHandleMakeAlias(t *testing.T) {
 						Logger: NewTestLogger(),
 						FS: func() *MockFileStore {
 							mfs := &MockFileStore{}
+							mfs.On("Lstat", mock.Anything).Return(nil, os.ErrNotExist)
+							mfs.On("Stat", mock.Anything).Return(nil, os.ErrNotExist)
+							mfs.On("Open", mock.Anything).Return(nil, os.ErrNotExist)
 							path, _ := os.Getwd()
 							mfs.On(
 								"Symlink",
@@ -1418,10 +1666,10 @@ func TestHandleDeleteUser(t *testing.T) {
 								Access:   &[]byte{1},
 							},
 						},
-						FS: func() *MockFileStore {
+						AccountStore: func() AccountStore {
 							mfs := &MockFileStore{}
 							mfs.On("Remove", "Users/testuser.yaml").Return(nil)
-							return mfs
+							return NewYAMLAccountStore("Users", mfs)
 						}(),
 					},
 				},
@@ -1748,6 +1996,7 @@ func TestHandleDownloadFile(t *testing.T) {
 						}(),
 					},
 					Server: &Server{
+						FS:            &OSFileStore{},
 						FileTransfers: make(map[uint32]*FileTransfer),
 						Config: &Config{
 							FileRoot: func() string { path, _ := os.Getwd(); return path + "/test/config/Files" }(),
@@ -2244,3 +2493,158 @@ func TestHandleSendInstantMsg(t *testing.T) {
 		})
 	}
 }
+
+// largeFileStore reports a size of 5 GiB for files named big.iso to test large file support without storing them
+type largeFileStore struct {
+	*MemFileStore
+}
+
+const largeFileSize = 5 << 30
+
+func (lfs *largeFileStore) inflate(fi os.FileInfo) os.FileInfo {
+	if fi.Name() != "big.iso" {
+		return fi
+	}
+	return &memFileInfo{name: fi.Name(), size: largeFileSize, mode: fi.Mode(), modTime: fi.ModTime()}
+}
+
+func (lfs *largeFileStore) Stat(name string) (os.FileInfo, error) {
+	fi, err := lfs.MemFileStore.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return lfs.inflate(fi), nil
+}
+
+func (lfs *largeFileStore) Lstat(name string) (os.FileInfo, error) {
+	fi, err := lfs.MemFileStore.Lstat(name)
+	if err != nil {
+		return nil, err
+	}
+	return lfs.inflate(fi), nil
+}
+
+func (lfs *largeFileStore) Open(name string) (File, error) {
+	f, err := lfs.MemFileStore.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &largeFile{File: f, lfs: lfs}, nil
+}
+
+type largeFile struct {
+	File
+	lfs *largeFileStore
+}
+
+func (f *largeFile) Stat() (os.FileInfo, error) {
+	fi, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return f.lfs.inflate(fi), nil
+}
+
+func (lfs *largeFileStore) ReadDir(name string) ([]os.FileInfo, error) {
+	entries, err := lfs.MemFileStore.ReadDir(name)
+	for i := range entries {
+		entries[i] = lfs.inflate(entries[i])
+	}
+	return entries, err
+}
+
+func TestLargeFiles(t *testing.T) {
+	newClient := func(largeFiles bool) *ClientConn {
+		mfs := NewMemFileStore()
+		_ = mfs.MkdirAll("/Files/ISOs", 0777)
+		_ = mfs.WriteFile("/Files/ISOs/big.iso", []byte{}, 0644)
+		_ = mfs.WriteFile("/Files/ISOs/small.txt", []byte("hello"), 0644)
+
+		var bits accessBitmap
+		bits.Set(accessDownloadFile)
+		access := bits[:]
+
+		return &ClientConn{
+			ID:         &[]byte{0, 1},
+			Account:    &Account{Access: &access},
+			Transfers:  make(map[int][]*FileTransfer),
+			largeFiles: largeFiles,
+			Server: &Server{
+				FS:            &largeFileStore{mfs},
+				FileTransfers: make(map[uint32]*FileTransfer),
+				Config:        &Config{FileRoot: "/Files"},
+			},
+		}
+	}
+	isoPath := EncodeFilePath("ISOs")
+
+	t.Run("file list shows large files with a clamped size", func(t *testing.T) {
+		cc := newClient(false)
+		fields, err := getFileNameList(cc.Server.FS, nil, "/Files", "/Files/ISOs", nil)
+		assert.NoError(t, err)
+		assert.Len(t, fields, 2)
+
+		var fnwi FileNameWithInfo
+		assert.NoError(t, fnwi.UnmarshalBinary(fields[0].Data))
+		assert.Equal(t, "big.iso", string(fnwi.name))
+		assert.Equal(t, [4]byte{0xff, 0xff, 0xff, 0xff}, fnwi.FileSize)
+	})
+
+	t.Run("download is refused for clients without large file support", func(t *testing.T) {
+		cc := newClient(false)
+		res, err := HandleDownloadFile(cc, NewTransaction(tranDownloadFile, &[]byte{0, 1},
+			NewField(fieldFileName, []byte("big.iso")),
+			NewField(fieldFilePath, isoPath),
+		))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{0, 0, 0, 1}, res[0].ErrorCode)
+		assert.Contains(t, string(res[0].GetField(fieldError).Data), "too large for your client")
+		assert.Empty(t, cc.Server.FileTransfers)
+	})
+
+	t.Run("download sends 64-bit sizes to clients with large file support", func(t *testing.T) {
+		cc := newClient(true)
+		res, err := HandleDownloadFile(cc, NewTransaction(tranDownloadFile, &[]byte{0, 1},
+			NewField(fieldFileName, []byte("big.iso")),
+			NewField(fieldFilePath, isoPath),
+		))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{0, 0, 0, 0}, res[0].ErrorCode)
+		assert.Equal(t, []byte{0xff, 0xff, 0xff, 0xff}, res[0].GetField(fieldFileSize).Data)
+		assert.Equal(t, size64(largeFileSize), res[0].GetField(fieldFileSize64).Data)
+		assert.Greater(t, binary.BigEndian.Uint64(res[0].GetField(fieldTransferSize64).Data), uint64(largeFileSize))
+	})
+
+	t.Run("get info sends the 64-bit size to clients with large file support", func(t *testing.T) {
+		cc := newClient(true)
+		res, err := HandleGetFileInfo(cc, NewTransaction(tranGetFileInfo, &[]byte{0, 1},
+			NewField(fieldFileName, []byte("big.iso")),
+			NewField(fieldFilePath, isoPath),
+		))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{0xff, 0xff, 0xff, 0xff}, res[0].GetField(fieldFileSize).Data)
+		assert.Equal(t, size64(largeFileSize), res[0].GetField(fieldFileSize64).Data)
+	})
+
+	t.Run("folder download is refused for clients without large file support", func(t *testing.T) {
+		cc := newClient(false)
+		res, err := HandleDownloadFolder(cc, NewTransaction(tranDownloadFldr, &[]byte{0, 1},
+			NewField(fieldFileName, []byte("ISOs")),
+			NewField(fieldFilePath, []byte{0, 0}),
+		))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{0, 0, 0, 1}, res[0].ErrorCode)
+		assert.Empty(t, cc.Server.FileTransfers)
+	})
+
+	t.Run("folder download size does not overflow", func(t *testing.T) {
+		cc := newClient(true)
+		res, err := HandleDownloadFolder(cc, NewTransaction(tranDownloadFldr, &[]byte{0, 1},
+			NewField(fieldFileName, []byte("ISOs")),
+			NewField(fieldFilePath, []byte{0, 0}),
+		))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{0xff, 0xff, 0xff, 0xff}, res[0].GetField(fieldTransferSize).Data)
+		assert.Equal(t, size64(largeFileSize+5), res[0].GetField(fieldTransferSize64).Data)
+	})
+}
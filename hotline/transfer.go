@@ -6,6 +6,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"io"
+	"math"
 )
 
 type transfer struct {
@@ -30,7 +31,23 @@ func (tf *transfer) Write(b []byte) (int, error) {
 }
 
 const fileCopyBufSize = 524288 // 512k
-func receiveFile(conn io.Reader, targetFile io.Writer, resForkFile io.Writer) error {
+
+// Information and resource forks are held in memory until they are stored in the AppleDouble sidecar, so their sizes
+// are limited.  An information fork holds at most a name and a comment of up to 64 KiB each, and the classic Mac OS
+// Resource Manager cannot use resource forks over 16 MiB.
+const (
+	maxInfoForkSize     = 72 + math.MaxUint16 + 2 + math.MaxUint16
+	maxResourceForkSize = 16 << 20
+)
+
+var errForkTooLarge = errors.New("fork too large")
+
+// receiveFile reads a flattened file object from conn, writing the data fork to targetFile, the resource fork to
+// resForkFile and the raw information fork to infoFork.  The reserved field of the fork headers holds the high 32 bits
+// of the fork size only if largeFiles is set, for clients with large file support; other clients may send anything in
+// it.  Information and resource forks larger than maxInfoForkSize
+// and maxResourceForkSize are rejected with errForkTooLarge before they are read.
+func receiveFile(conn io.Reader, targetFile io.Writer, resForkFile io.Writer, infoFork io.Writer, largeFiles bool) error {
 	ffhBuf := make([]byte, 24)
 	if _, err := io.ReadFull(conn, ffhBuf); err != nil {
 		return err
@@ -56,6 +73,9 @@ func receiveFile(conn io.Reader, targetFile io.Writer, resForkFile io.Writer) er
 	var ffif FlatFileInformationFork
 
 	dataLen := binary.BigEndian.Uint32(ffifh.DataSize[:])
+	if dataLen > maxInfoForkSize {
+		return errForkTooLarge
+	}
 	ffifBuf := make([]byte, dataLen)
 	if _, err := io.ReadFull(conn, ffifBuf); err != nil {
 		return err
@@ -63,6 +83,9 @@ func receiveFile(conn io.Reader, targetFile io.Writer, resForkFile io.Writer) er
 	if err := ffif.UnmarshalBinary(ffifBuf); err != nil {
 		return err
 	}
+	if _, err := infoFork.Write(ffifBuf); err != nil {
+		return err
+	}
 
 	var ffdfh FlatFileDataForkHeader
 	ffdfhBuf := make([]byte, 16)
@@ -73,13 +96,18 @@ func receiveFile(conn io.Reader, targetFile io.Writer, resForkFile io.Writer) er
 	if err != nil {
 		return err
 	}
+	if !largeFiles {
+		ffdfh.RSVD = [4]byte{}
+	}
 
 	// this will be zero if the file only has a resource fork
-	fileSize := int(binary.BigEndian.Uint32(ffdfh.DataSize[:]))
+	fileSize := ffdfh.forkSize()
 
+	// What was received is written out even if the transfer fails, so that it can be resumed from there
 	bw := bufio.NewWriterSize(targetFile, fileCopyBufSize)
 	_, err = io.CopyN(bw, conn, int64(fileSize))
 	if err != nil {
+		_ = bw.Flush()
 		return err
 	}
 	if err := bw.Flush(); err != nil {
@@ -104,14 +132,133 @@ func receiveFile(conn io.Reader, targetFile io.Writer, resForkFile io.Writer) er
 			return err
 		}
 
-		bw = bufio.NewWriterSize(resForkFile, fileCopyBufSize)
-		_, err = io.CopyN(resForkFile, conn, int64(binary.BigEndian.Uint32(resForkHeader.DataSize[:])))
-		if err != nil {
-			return err
+		if !largeFiles {
+			resForkHeader.RSVD = [4]byte{}
 		}
-		if err := bw.Flush(); err != nil {
+		if resForkHeader.forkSize() > maxResourceForkSize {
+			return errForkTooLarge
+		}
+		if _, err := io.CopyN(resForkFile, conn, int64(resForkHeader.forkSize())); err != nil {
 			return err
 		}
 	}
 	return nil
 }
+
+// sendFile streams the flattened file object of the file at filePath to w: the header, the data fork from dataOffset,
+// and the resource fork header and resource fork from rsrcOffset if the file has one.  ffo must have been created with
+// the same offsets.  If dataOnly is set, only the data fork is sent, as for file previews.  The data fork is copied with
+// io.CopyN so that it can be sent with sendfile when w is a TCP connection and the file is on disk.
+func sendFile(w io.Writer, fileStore FileStore, filePath string, ffo *flattenedFileObject, dataOffset, rsrcOffset int64, dataOnly bool) error {
+	if !dataOnly {
+		if _, err := w.Write(ffo.BinaryMarshal()); err != nil {
+			return err
+		}
+	}
+
+	file, err := fileStore.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = file.Close() }()
+
+	if _, err := file.Seek(dataOffset, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(w, file, int64(ffo.FlatFileDataForkHeader.forkSize())); err != nil {
+		return err
+	}
+
+	if dataOnly {
+		return nil
+	}
+
+	return sendResourceFork(w, fileStore, filePath, ffo, rsrcOffset)
+}
+
+// sendResourceFork sends the resource fork header and the resource fork stored in the AppleDouble sidecar of
+// filePath from offset if ffo has a resource fork
+func sendResourceFork(w io.Writer, fileStore FileStore, filePath string, ffo *flattenedFileObject, offset int64) error {
+	if !ffo.hasResourceFork() {
+		return nil
+	}
+
+	ad, err := readAppleDouble(fileStore, filePath)
+	if err != nil {
+		return err
+	}
+	if offset > int64(len(ad.ResourceFork)) {
+		offset = int64(len(ad.ResourceFork))
+	}
+
+	if _, err := w.Write(ffo.resForkHeader()); err != nil {
+		return err
+	}
+	_, err = w.Write(ad.ResourceFork[offset:])
+
+	return err
+}
+
+// copyChunks copies src to dst in chunks, so that wrappers of a file transfer connection can act between the writes of
+// a large file, e.g. to push a deadline forward or to wait for a rate limit.  beforeChunk is called before each chunk
+// and returns its size; afterChunk, if not nil, is called with the number of bytes copied by each chunk.  When src is an
+// *io.LimitedReader, as it is for io.CopyN, the chunks read directly from the reader it wraps so that a *net.TCPConn
+// still sees the *os.File and can send it with sendfile.
+func copyChunks(dst io.Writer, src io.Reader, beforeChunk func() (int64, error), afterChunk func(n int64)) (int64, error) {
+	limited, isLimited := src.(*io.LimitedReader)
+
+	var total int64
+	for {
+		size, err := beforeChunk()
+		if err != nil {
+			return total, err
+		}
+
+		chunk := &io.LimitedReader{R: src, N: size}
+		if isLimited {
+			if limited.N <= 0 {
+				return total, nil
+			}
+			if limited.N < size {
+				size = limited.N
+			}
+			chunk = &io.LimitedReader{R: limited.R, N: size}
+		}
+
+		n, err := io.Copy(dst, chunk)
+		total += n
+		if isLimited {
+			limited.N -= n
+		}
+		if afterChunk != nil {
+			afterChunk(n)
+		}
+		if err != nil || n < size {
+			return total, err
+		}
+	}
+}
+
+// saveForks stores the Finder info and resource fork received with an upload in the AppleDouble sidecar of filePath.
+// If the client sent no type code for a file that fileTypes identifies by its content, the detected type is stored
+// instead, so that listings don't have to read the file.
+func saveForks(fileStore FileStore, fileTypes *fileTypeMap, filePath string, infoFork, rsrcFork []byte) error {
+	// Nothing is saved if the transfer failed before the information fork was received
+	if len(infoFork) < 72 {
+		return nil
+	}
+
+	var ffif FlatFileInformationFork
+	if err := ffif.UnmarshalBinary(infoFork); err != nil {
+		return err
+	}
+
+	ad := newAppleDouble(ffif, rsrcFork)
+	if ad.TypeCode()[0] == 0 && detectsFromContent(filePath) {
+		ft := fileTypes.detect(fileStore, filePath)
+		copy(ad.FinderInfo[0:4], ft.TypeCode)
+		copy(ad.FinderInfo[4:8], ft.CreatorCode)
+	}
+
+	return writeAppleDouble(fileStore, filePath, ad)
+}
@@ -0,0 +1,183 @@
+package hotline
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+var errTransferNotFound = errors.New("transfer not found")
+
+// transferTypeNames are the names of the file transfer types shown to users
+var transferTypeNames = map[int]string{
+	FileDownload:   "File Download",
+	FileUpload:     "File Upload",
+	FolderDownload: "Folder Download",
+	FolderUpload:   "Folder Upload",
+}
+
+// transferProgress tracks the bytes sent and received by a file transfer in progress.  Bytes are counted on the file
+// transfer connection, so they include the headers of the protocol as do the transfer sizes sent to clients.
+type transferProgress struct {
+	bytes int64 // accessed atomically
+	start time.Time
+}
+
+// transferred returns the number of bytes transferred so far
+func (p *transferProgress) transferred() int64 {
+	return atomic.LoadInt64(&p.bytes)
+}
+
+// conn returns conn with the bytes read from and written to it counted
+func (p *transferProgress) conn(conn io.ReadWriteCloser) io.ReadWriteCloser {
+	return &countingConn{ReadWriteCloser: conn, progress: p}
+}
+
+type countingConn struct {
+	io.ReadWriteCloser
+	progress *transferProgress
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	atomic.AddInt64(&c.progress.bytes, int64(n))
+
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	atomic.AddInt64(&c.progress.bytes, int64(n))
+
+	return n, err
+}
+
+// ReadFrom counts each chunk of r as it is written, so that the progress of a download copied with io.CopyN is kept
+// up to date
+func (c *countingConn) ReadFrom(r io.Reader) (int64, error) {
+	return copyChunks(c.ReadWriteCloser, r, func() (int64, error) {
+		return copyChunkSize, nil
+	}, func(n int64) {
+		atomic.AddInt64(&c.progress.bytes, n)
+	})
+}
+
+// TransferStatus describes a file transfer that has been requested by a client
+type TransferStatus struct {
+	ID       uint32 // Reference number of the transfer, used to cancel it
+	Type     string
+	Name     string // Name of the file or folder being transferred
+	ClientID uint16
+	Login    string
+	UserName string
+	Waiting  bool          // True until the client connects to transfer the file
+	Started  time.Time     // Time the client connected to transfer the file
+	Bytes    int64         // Bytes transferred so far
+	Size     int64         // Total bytes of the transfer
+	Rate     float64       // Average bytes per second since the transfer started
+	ETA      time.Duration // Estimated time until the transfer completes; 0 if not known
+}
+
+// String formats the status as shown in Get Client Info, e.g. "notes.txt  12.0 KB of 40.0 KB (30%) at 4.0 KB/s, 7s left"
+func (ts TransferStatus) String() string {
+	if ts.Waiting {
+		return fmt.Sprintf("%s  %s, waiting", ts.Name, formatBytes(uint64(ts.Size)))
+	}
+
+	out := fmt.Sprintf("%s  %s", ts.Name, formatBytes(uint64(ts.Bytes)))
+	if ts.Size > 0 {
+		percent := ts.Bytes * 100 / ts.Size
+		if percent > 100 {
+			percent = 100
+		}
+		out += fmt.Sprintf(" of %s (%d%%)", formatBytes(uint64(ts.Size)), percent)
+	}
+	out += fmt.Sprintf(" at %s/s", formatBytes(uint64(ts.Rate)))
+	if ts.ETA > 0 {
+		out += fmt.Sprintf(", %s left", ts.ETA)
+	}
+
+	return out
+}
+
+// status returns the status of ft at time now.  The server lock must be held.
+func (ft *FileTransfer) status(now time.Time) TransferStatus {
+	ts := TransferStatus{
+		Type:    transferTypeNames[ft.Type],
+		Name:    string(ft.FileName),
+		Waiting: ft.progress == nil,
+		Size:    int64(transferSize(ft.TransferSize)),
+	}
+	if len(ft.ReferenceNumber) == 4 {
+		ts.ID = binary.BigEndian.Uint32(ft.ReferenceNumber)
+	}
+	if cc := ft.clientConn; cc != nil {
+		if cc.ID != nil {
+			ts.ClientID = binary.BigEndian.Uint16(*cc.ID)
+		}
+		if cc.Account != nil {
+			ts.Login = cc.Account.Login
+		}
+		ts.UserName = string(cc.UserName)
+	}
+	if ft.progress == nil {
+		return ts
+	}
+
+	ts.Started = ft.progress.start
+	ts.Bytes = ft.progress.transferred()
+	if elapsed := now.Sub(ts.Started).Seconds(); elapsed > 0 {
+		ts.Rate = float64(ts.Bytes) / elapsed
+	}
+	if ts.Rate > 0 && ts.Size > ts.Bytes {
+		ts.ETA = time.Duration(float64(ts.Size-ts.Bytes) / ts.Rate * float64(time.Second)).Round(time.Second)
+	}
+
+	return ts
+}
+
+// Transfers returns the status of the file transfers that are waiting to start or in progress, ordered by ID
+func (s *Server) Transfers() []TransferStatus {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	now := s.now()
+	transfers := make([]TransferStatus, 0, len(s.FileTransfers))
+	for _, ft := range s.FileTransfers {
+		transfers = append(transfers, ft.status(now))
+	}
+	sort.Slice(transfers, func(i, j int) bool { return transfers[i].ID < transfers[j].ID })
+
+	return transfers
+}
+
+// CancelTransfer stops the file transfer with reference number id.  A transfer in progress is disconnected and a
+// transfer that is waiting to start is removed.  The client is told that the transfer was cancelled.
+func (s *Server) CancelTransfer(id uint32) error {
+	s.mux.Lock()
+	ft, ok := s.FileTransfers[id]
+	if !ok {
+		s.mux.Unlock()
+		return errTransferNotFound
+	}
+	if ft.cancel != nil {
+		ft.cancel()
+	} else {
+		delete(s.FileTransfers, id)
+		s.removeClientTransfer(ft)
+	}
+	s.mux.Unlock()
+
+	s.Logger.Infow("Transfer cancelled", "transactionRef", ft.ReferenceNumber, "name", string(ft.FileName))
+
+	if cc := ft.clientConn; cc != nil {
+		msg := fmt.Sprintf("The transfer of \"%s\" was cancelled by an administrator.", ft.FileName)
+		s.outbox <- *NewTransaction(tranServerMsg, cc.ID, NewField(fieldData, []byte(msg)), NewField(fieldChatOptions, []byte{0}))
+	}
+
+	return nil
+}
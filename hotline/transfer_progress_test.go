@@ -0,0 +1,185 @@
+package hotline
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTransferStatus_String(t *testing.T) {
+	tests := []struct {
+		name string
+		ts   TransferStatus
+		want string
+	}{
+		{
+			name: "waiting",
+			ts:   TransferStatus{Name: "notes.txt", Waiting: true, Size: 40 * 1024},
+			want: "notes.txt  40.0 KB, waiting",
+		},
+		{
+			name: "in progress",
+			ts:   TransferStatus{Name: "notes.txt", Bytes: 12 * 1024, Size: 40 * 1024, Rate: 4 * 1024, ETA: 7 * time.Second},
+			want: "notes.txt  12.0 KB of 40.0 KB (30%) at 4.0 KB/s, 7s left",
+		},
+		{
+			name: "size not known",
+			ts:   TransferStatus{Name: "Album", Bytes: 2048, Rate: 1024},
+			want: "Album  2.0 KB at 1.0 KB/s",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.ts.String())
+		})
+	}
+}
+
+func newProgressTestServer() (*Server, *ClientConn) {
+	mfs := NewMemFileStore()
+	_ = mfs.MkdirAll("/Files", 0777)
+	_ = mfs.WriteFile("/Files/big.iso", make([]byte, 4*1024*1024), 0644)
+
+	var bits accessBitmap
+	bits.Set(accessSendChat)
+	bits.Set(accessDisconUser)
+	bits.Set(accessGetClientInfo)
+	access := bits[:]
+
+	s := newTransferTestServer(mfs, &FileTransfer{})
+	s.outbox = make(chan Transaction, 1)
+	cc := &ClientConn{
+		ID:         &[]byte{0, 1},
+		UserName:   []byte("Halcyon"),
+		Account:    &Account{Login: "admin", Name: "Admin", Access: &access},
+		Server:     s,
+		RemoteAddr: "192.0.2.1:5500",
+		Transfers:  make(map[int][]*FileTransfer),
+	}
+	s.Clients[1] = cc
+	s.FileTransfers[1] = &FileTransfer{
+		Type:            FileDownload,
+		FileName:        []byte("big.iso"),
+		ReferenceNumber: []byte{0, 0, 0, 1},
+		TransferSize:    size64(4*1024*1024 + 100),
+		clientConn:      cc,
+	}
+	s.FileTransfers[2] = &FileTransfer{
+		Type:            FileUpload,
+		FileName:        []byte("notes.txt"),
+		ReferenceNumber: []byte{0, 0, 0, 2},
+		TransferSize:    []byte{0, 0, 0x10, 0},
+		clientConn:      cc,
+	}
+
+	return s, cc
+}
+
+func TestFileTransfer_status(t *testing.T) {
+	start := time.Date(2023, time.March, 1, 12, 0, 0, 0, time.UTC)
+	ft := &FileTransfer{
+		Type:            FileDownload,
+		FileName:        []byte("big.iso"),
+		ReferenceNumber: []byte{0, 0, 0, 7},
+		TransferSize:    size64(1000),
+		progress:        &transferProgress{bytes: 250, start: start},
+	}
+
+	ts := ft.status(start.Add(5 * time.Second))
+	assert.Equal(t, uint32(7), ts.ID)
+	assert.Equal(t, "File Download", ts.Type)
+	assert.False(t, ts.Waiting)
+	assert.Equal(t, int64(250), ts.Bytes)
+	assert.Equal(t, int64(1000), ts.Size)
+	assert.Equal(t, float64(50), ts.Rate)
+	assert.Equal(t, 15*time.Second, ts.ETA)
+}
+
+func TestFileTransfer_String(t *testing.T) {
+	start := time.Date(2023, time.March, 1, 12, 0, 0, 0, time.UTC)
+	s := &Server{Clock: fixedClock{t: start.Add(5 * time.Second)}}
+	ft := &FileTransfer{
+		Type:         FileDownload,
+		FileName:     []byte("big.iso"),
+		TransferSize: size64(1000),
+		progress:     &transferProgress{bytes: 250, start: start},
+		clientConn:   &ClientConn{Server: s},
+	}
+
+	assert.Equal(t, "big.iso  250 bytes of 1000 bytes (25%) at 50 bytes/s, 15s left", ft.String())
+}
+
+func TestTransferTracking(t *testing.T) {
+	t.Run("transfers in progress are tracked and can be cancelled", func(t *testing.T) {
+		s, _ := newProgressTestServer()
+
+		client, server := net.Pipe()
+		errs := make(chan error, 1)
+		go func() { errs <- s.handleFileTransfer(server) }()
+
+		_, _ = client.Write(htxf())
+		_, err := io.ReadFull(client, make([]byte, 1024))
+		assert.NoError(t, err)
+
+		assert.Eventually(t, func() bool {
+			transfers := s.Transfers()
+			return len(transfers) == 2 && !transfers[0].Waiting && transfers[0].Bytes > 0
+		}, time.Second, time.Millisecond)
+		assert.Equal(t, 1, s.Stats.ActiveTransfers)
+		assert.True(t, s.Transfers()[1].Waiting)
+
+		assert.NoError(t, s.CancelTransfer(1))
+		assert.Error(t, <-errs)
+		assert.Equal(t, 0, s.Stats.ActiveTransfers)
+		assert.Len(t, s.Transfers(), 1)
+
+		msg := <-s.outbox
+		assert.Equal(t, "The transfer of \"big.iso\" was cancelled by an administrator.", string(msg.GetField(fieldData).Data))
+	})
+
+	t.Run("waiting transfers can be cancelled", func(t *testing.T) {
+		s, cc := newProgressTestServer()
+		cc.Transfers[FileDownload] = []*FileTransfer{s.FileTransfers[1]}
+
+		assert.NoError(t, s.CancelTransfer(1))
+		assert.NotContains(t, s.FileTransfers, uint32(1))
+		assert.Empty(t, cc.Transfers[FileDownload])
+		<-s.outbox
+
+		assert.ErrorIs(t, s.CancelTransfer(1), errTransferNotFound)
+	})
+
+	t.Run("transfers are listed in Get Client Info", func(t *testing.T) {
+		_, cc := newProgressTestServer()
+
+		res, err := HandleGetClientConnInfoText(cc, NewTransaction(tranGetClientInfoText, &[]byte{0, 1}, NewField(fieldUserID, []byte{0, 1})))
+		assert.NoError(t, err)
+
+		info := strings.Split(string(res[0].GetField(fieldData).Data), "\r")
+		assert.Equal(t, []string{
+			"-------- File Downloads ---------", "", "None.", "",
+			"------- Folder Downloads --------", "", "None.", "",
+			"--------- File Uploads ----------", "", "notes.txt  4.0 KB, waiting", "",
+			"-------- Folder Uploads ---------", "", "None.", "",
+			"------- Waiting Downloads -------", "", "big.iso  4.0 MB, waiting",
+		}, info[5:24])
+	})
+
+	t.Run("admins can list and cancel transfers in chat", func(t *testing.T) {
+		s, cc := newProgressTestServer()
+		chat := func(msg string) string {
+			res, err := HandleChatSend(cc, NewTransaction(tranChatSend, &[]byte{0, 1}, NewField(fieldData, []byte(msg))))
+			assert.NoError(t, err)
+			return string(res[0].GetField(fieldData).Data)
+		}
+
+		assert.Equal(t, "Transfers:\r  1  File Download by Halcyon: big.iso  4.0 MB, waiting\r  2  File Upload by Halcyon: notes.txt  4.0 KB, waiting", chat("/transfers"))
+		assert.Equal(t, "Cancelled transfer 2.", chat("/cancel 2"))
+		<-s.outbox
+		assert.Equal(t, "Cannot cancel transfer 2: transfer not found.", chat("/cancel 2"))
+		assert.Equal(t, "Usage: /cancel <transfer ID>", chat("/cancel"))
+	})
+}
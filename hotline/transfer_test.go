@@ -2,9 +2,14 @@ package hotline
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -110,6 +115,7 @@ func Test_receiveFile(t *testing.T) {
 	tests := []struct {
 		name            string
 		args            args
+		largeFiles      bool
 		wantTargetFile  []byte
 		wantResForkFile []byte
 		wantErr         assert.ErrorAssertionFunc
@@ -141,12 +147,104 @@ func Test_receiveFile(t *testing.T) {
 
 			wantErr: assert.NoError,
 		},
+		{
+			name: "transfers file with resource fork",
+			args: args{
+				conn: func() io.Reader {
+					testFile := flattenedFileObject{
+						FlatFileHeader:          NewFlatFileHeader(),
+						FlatFileInformationFork: NewFlatFileInformationFork("testfile", make([]byte, 8), "APPL", "APPL"),
+						FlatFileDataForkHeader: FlatFileDataForkHeader{
+							ForkType: [4]byte{0x44, 0x41, 0x54, 0x41}, // DATA
+							DataSize: [4]byte{0x00, 0x00, 0x00, 0x03},
+						},
+					}
+					testFile.FlatFileHeader.ForkCount = [2]byte{0, 3}
+					b := testFile.BinaryMarshal()
+					b = append(b, []byte{1, 2, 3}...)
+					b = append(b, []byte{0x4d, 0x41, 0x43, 0x52, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2}...) // MACR
+					b = append(b, []byte{4, 5}...)
+					return bytes.NewReader(b)
+				}(),
+			},
+			wantTargetFile:  []byte{1, 2, 3},
+			wantResForkFile: []byte{4, 5},
+
+			wantErr: assert.NoError,
+		},
+		{
+			name: "rejects resource forks over maxResourceForkSize before reading them",
+			args: args{
+				conn: func() io.Reader {
+					testFile := flattenedFileObject{
+						FlatFileHeader:          NewFlatFileHeader(),
+						FlatFileInformationFork: NewFlatFileInformationFork("testfile", make([]byte, 8), "APPL", "APPL"),
+						FlatFileDataForkHeader: FlatFileDataForkHeader{
+							ForkType: [4]byte{0x44, 0x41, 0x54, 0x41}, // DATA
+							DataSize: [4]byte{0x00, 0x00, 0x00, 0x03},
+						},
+					}
+					testFile.FlatFileHeader.ForkCount = [2]byte{0, 3}
+					b := testFile.BinaryMarshal()
+					b = append(b, []byte{1, 2, 3}...)
+					b = append(b, []byte{0x4d, 0x41, 0x43, 0x52, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 2}...) // MACR of 4 GiB + 2
+					b = append(b, []byte{4, 5}...)
+					return bytes.NewReader(b)
+				}(),
+			},
+			largeFiles:      true,
+			wantTargetFile:  []byte{1, 2, 3},
+			wantResForkFile: []byte(nil),
+
+			wantErr: func(t assert.TestingT, err error, i ...interface{}) bool {
+				return assert.ErrorIs(t, err, errForkTooLarge, i...)
+			},
+		},
+		{
+			name: "ignores the reserved field of fork headers from clients without large file support",
+			args: args{
+				conn: func() io.Reader {
+					testFile := flattenedFileObject{
+						FlatFileHeader:          NewFlatFileHeader(),
+						FlatFileInformationFork: NewFlatFileInformationFork("testfile", make([]byte, 8), "APPL", "APPL"),
+						FlatFileDataForkHeader: FlatFileDataForkHeader{
+							ForkType: [4]byte{0x44, 0x41, 0x54, 0x41}, // DATA
+							RSVD:     [4]byte{0xff, 0xff, 0xff, 0xff},
+							DataSize: [4]byte{0x00, 0x00, 0x00, 0x03},
+						},
+					}
+					testFile.FlatFileHeader.ForkCount = [2]byte{0, 3}
+					b := testFile.BinaryMarshal()
+					b = append(b, []byte{1, 2, 3}...)
+					b = append(b, []byte{0x4d, 0x41, 0x43, 0x52, 0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 2}...) // MACR
+					b = append(b, []byte{4, 5}...)
+					return bytes.NewReader(b)
+				}(),
+			},
+			wantTargetFile:  []byte{1, 2, 3},
+			wantResForkFile: []byte{4, 5},
+
+			wantErr: assert.NoError,
+		},
+		{
+			name: "rejects information forks over maxInfoForkSize before reading them",
+			args: args{
+				conn: bytes.NewReader([]byte{
+					0x46, 0x49, 0x4c, 0x50, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2, // FILP
+					0x49, 0x4e, 0x46, 0x4f, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff, // INFO of 4 GiB - 1
+				}),
+			},
+			wantErr: func(t assert.TestingT, err error, i ...interface{}) bool {
+				return assert.ErrorIs(t, err, errForkTooLarge, i...)
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			targetFile := &bytes.Buffer{}
 			resForkFile := &bytes.Buffer{}
-			err := receiveFile(tt.args.conn, targetFile, resForkFile)
+			infoFork := &bytes.Buffer{}
+			err := receiveFile(tt.args.conn, targetFile, resForkFile, infoFork, tt.largeFiles)
 			if !tt.wantErr(t, err, fmt.Sprintf("receiveFile(%v, %v, %v)", tt.args.conn, targetFile, resForkFile)) {
 				return
 			}
@@ -156,3 +254,203 @@ func Test_receiveFile(t *testing.T) {
 		})
 	}
 }
+
+// newResourceForkFile returns a file store with /Files/app containing "data fork" and the resource fork "resource fork"
+func newResourceForkFile(t *testing.T) *MemFileStore {
+	mfs := NewMemFileStore()
+	_ = mfs.MkdirAll("/Files", 0777)
+	_ = mfs.WriteFile("/Files/app", []byte("data fork"), 0644)
+	ad := newAppleDouble(NewFlatFileInformationFork("app", make([]byte, 8), "APPL", "????"), []byte("resource fork"))
+	assert.NoError(t, writeAppleDouble(mfs, "/Files/app", ad))
+
+	return mfs
+}
+
+func Test_sendFile(t *testing.T) {
+	tests := []struct {
+		name       string
+		dataOffset int64
+		rsrcOffset int64
+		dataOnly   bool
+		wantData   []byte
+		wantRsrc   []byte
+	}{
+		{
+			name:     "sends both forks",
+			wantData: []byte("data fork"),
+			wantRsrc: []byte("resource fork"),
+		},
+		{
+			name:       "resumes both forks from their offsets",
+			dataOffset: 5,
+			rsrcOffset: 9,
+			wantData:   []byte("fork"),
+			wantRsrc:   []byte("fork"),
+		},
+		{
+			name:       "resumes a download that only needs the rest of the resource fork",
+			dataOffset: 9,
+			rsrcOffset: 13,
+			wantData:   []byte{},
+			wantRsrc:   []byte{},
+		},
+		{
+			name:       "sends only the data fork for a preview",
+			dataOffset: 5,
+			dataOnly:   true,
+			wantData:   []byte("fork"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mfs := newResourceForkFile(t)
+			ffo, err := NewFlattenedFileObject(mfs, nil, "/Files", nil, []byte("app"), tt.dataOffset)
+			assert.NoError(t, err)
+			ffo.resumeResourceFork(tt.rsrcOffset)
+
+			var buf bytes.Buffer
+			assert.NoError(t, sendFile(&buf, mfs, "/Files/app", ffo, tt.dataOffset, tt.rsrcOffset, tt.dataOnly))
+
+			if tt.dataOnly {
+				assert.Equal(t, tt.wantData, buf.Bytes())
+				return
+			}
+			assert.Equal(t, ffo.transferSize64(), uint64(buf.Len()), "the bytes sent match the transfer size")
+
+			data, rsrc, info := &bytes.Buffer{}, &bytes.Buffer{}, &bytes.Buffer{}
+			assert.NoError(t, receiveFile(&buf, data, rsrc, info, true))
+			assert.Equal(t, tt.wantData, append([]byte{}, data.Bytes()...))
+			assert.Equal(t, tt.wantRsrc, append([]byte{}, rsrc.Bytes()...))
+		})
+	}
+
+	t.Run("returns an error if the file is shorter than its header says", func(t *testing.T) {
+		mfs := newResourceForkFile(t)
+		ffo, err := NewFlattenedFileObject(mfs, nil, "/Files", nil, []byte("app"), 0)
+		assert.NoError(t, err)
+		ffo.FlatFileDataForkHeader.setForkSize(100)
+
+		assert.ErrorIs(t, sendFile(io.Discard, mfs, "/Files/app", ffo, 0, 0, false), io.EOF)
+	})
+
+	t.Run("returns an error if the file is missing", func(t *testing.T) {
+		mfs := newResourceForkFile(t)
+		ffo, err := NewFlattenedFileObject(mfs, nil, "/Files", nil, []byte("app"), 0)
+		assert.NoError(t, err)
+		_ = mfs.Remove("/Files/app")
+
+		err = sendFile(io.Discard, mfs, "/Files/app", ffo, 0, 0, false)
+		assert.True(t, errors.Is(err, fs.ErrNotExist))
+	})
+}
+
+// readerFromRecorder records the readers passed to ReadFrom
+type readerFromRecorder struct {
+	bytes.Buffer
+	readers []io.Reader
+}
+
+func (w *readerFromRecorder) ReadFrom(r io.Reader) (int64, error) {
+	w.readers = append(w.readers, r)
+	return w.Buffer.ReadFrom(r)
+}
+
+func Test_copyChunks(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 10)
+	chunkSize := func() (int64, error) { return 32, nil }
+
+	t.Run("copies a limited reader in chunks of the underlying reader", func(t *testing.T) {
+		src := bytes.NewReader(data)
+		dst := &readerFromRecorder{}
+		var chunks []int64
+
+		n, err := copyChunks(dst, io.LimitReader(src, 70), chunkSize, func(n int64) { chunks = append(chunks, n) })
+		assert.NoError(t, err)
+		assert.Equal(t, int64(70), n)
+		assert.Equal(t, data[:70], dst.Bytes())
+		assert.Equal(t, []int64{32, 32, 6}, chunks)
+		for _, r := range dst.readers {
+			assert.Same(t, src, r.(*io.LimitedReader).R, "the chunks read directly from the file so that sendfile can be used")
+		}
+	})
+
+	t.Run("copies other readers until EOF", func(t *testing.T) {
+		var dst bytes.Buffer
+		n, err := copyChunks(&dst, bytes.NewReader(data), chunkSize, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(data)), n)
+		assert.Equal(t, data, dst.Bytes())
+	})
+
+	t.Run("stops when a chunk fails to start", func(t *testing.T) {
+		errStop := errors.New("stop")
+		n, err := copyChunks(io.Discard, bytes.NewReader(data), func() (int64, error) { return 0, errStop }, nil)
+		assert.ErrorIs(t, err, errStop)
+		assert.Equal(t, int64(0), n)
+	})
+}
+
+// writeOnlyConn hides the ReadFrom method of a connection so that copies to it go through a buffer
+type writeOnlyConn struct {
+	io.Writer
+}
+
+// BenchmarkSendFile compares sending a file from disk to a TCP connection with sendfile against copying it through a
+// buffer, as downloads did before they were streamed with io.CopyN
+func BenchmarkSendFile(b *testing.B) {
+	const size = 64 << 20
+
+	dir := b.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "Files"), 0755); err != nil {
+		b.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "Files", "big.bin"), make([]byte, size), 0644); err != nil {
+		b.Fatal(err)
+	}
+	fileStore := &OSFileStore{}
+	filePath := filepath.Join(dir, "Files", "big.bin")
+	ffo, err := NewFlattenedFileObject(fileStore, nil, filepath.Join(dir, "Files"), nil, []byte("big.bin"), 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() { _, _ = io.Copy(io.Discard, conn) }()
+		}
+	}()
+
+	for _, bm := range []struct {
+		name string
+		wrap func(net.Conn) io.Writer
+	}{
+		{name: "sendfile", wrap: func(conn net.Conn) io.Writer { return newTimeoutConn(conn, 0, 0) }},
+		{name: "buffered", wrap: func(conn net.Conn) io.Writer { return writeOnlyConn{conn} }},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer conn.Close()
+			w := bm.wrap(conn)
+
+			b.SetBytes(int64(ffo.transferSize64()))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := sendFile(w, fileStore, filePath, ffo, 0, 0, false); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
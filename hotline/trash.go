@@ -0,0 +1,218 @@
+package hotline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// When EnableTrash is set, deleted files and folders are moved to the trash folder at the top of the file area rather
+// than removed.  Each deleted item is kept in a folder of its own, named after its trash ID, next to a YAML file of the
+// same name that records where the item came from, who deleted it and when.  Items are purged once they are older than
+// TrashRetention days.
+const trashFolder = ".trash"
+
+const trashPurgeInterval = 3600 // seconds between checks for trash items to purge
+
+var (
+	errTrashItemNotFound = errors.New("trash item not found")
+	errRestoreExists     = errors.New("a file or folder already exists at the original path")
+	errRestoreNoFolder   = errors.New("the original folder no longer exists")
+)
+
+// TrashItem describes a deleted file or folder in the trash
+type TrashItem struct {
+	ID        string    `yaml:"-"`
+	Path      string    `yaml:"Path"`      // Original path, relative to the file root
+	DeletedBy string    `yaml:"DeletedBy"` // Login of the account that deleted the item
+	DeletedAt time.Time `yaml:"DeletedAt"`
+}
+
+func (s *Server) trashPath() string {
+	return path.Join("/", s.Config.FileRoot, trashFolder)
+}
+
+// moveToTrash moves the file or folder at filePath, along with its AppleDouble sidecar, to the trash
+func (s *Server) moveToTrash(filePath, login string) (*TrashItem, error) {
+	if _, err := s.FS.Stat(s.trashPath()); errors.Is(err, fs.ErrNotExist) {
+		if err := s.FS.Mkdir(s.trashPath(), 0777); err != nil {
+			return nil, err
+		}
+	}
+
+	now := s.now()
+	item := &TrashItem{
+		ID:        now.Format(timestampIDFormat),
+		Path:      areaPath(s.Config.FileRoot, filePath),
+		DeletedBy: login,
+		DeletedAt: now,
+	}
+	for i := 2; ; i++ {
+		err := s.FS.Mkdir(path.Join(s.trashPath(), item.ID), 0777)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, err
+		}
+		item.ID = fmt.Sprintf("%s-%d", now.Format(timestampIDFormat), i)
+	}
+
+	itemPath := path.Join(s.trashPath(), item.ID, path.Base(filePath))
+	if err := s.FS.Rename(filePath, itemPath); err != nil {
+		_ = s.FS.Remove(path.Join(s.trashPath(), item.ID))
+		return nil, err
+	}
+	if err := renameAppleDouble(s.FS, filePath, itemPath); err != nil {
+		return nil, err
+	}
+
+	b, err := yaml.Marshal(item)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.FS.WriteFile(path.Join(s.trashPath(), item.ID+".yaml"), b, 0644); err != nil {
+		return nil, err
+	}
+
+	return item, nil
+}
+
+func (s *Server) readTrashItem(id string) (*TrashItem, error) {
+	if checkPathItem([]byte(id)) != nil || id == "" {
+		return nil, errTrashItemNotFound
+	}
+
+	b, err := readFile(s.FS, path.Join(s.trashPath(), id+".yaml"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, errTrashItemNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	item := &TrashItem{ID: id}
+	if err := yaml.Unmarshal(b, item); err != nil {
+		return nil, err
+	}
+
+	return item, nil
+}
+
+// TrashItems returns the items in the trash, oldest first
+func (s *Server) TrashItems() ([]TrashItem, error) {
+	entries, err := s.FS.ReadDir(s.trashPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var items []TrashItem
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".yaml") {
+			continue
+		}
+		item, err := s.readTrashItem(strings.TrimSuffix(entry.Name(), ".yaml"))
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, *item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if !items[i].DeletedAt.Equal(items[j].DeletedAt) {
+			return items[i].DeletedAt.Before(items[j].DeletedAt)
+		}
+		// Items deleted in the same second are numbered in the order they were deleted
+		if len(items[i].ID) != len(items[j].ID) {
+			return len(items[i].ID) < len(items[j].ID)
+		}
+		return items[i].ID < items[j].ID
+	})
+
+	return items, nil
+}
+
+// RestoreTrashItem moves the trash item with the given ID back to its original path.  It fails rather than replace a
+// file or folder that has since been put in its place, or recreate a folder that has since been deleted.
+func (s *Server) RestoreTrashItem(id string) (*TrashItem, error) {
+	item, err := s.readTrashItem(id)
+	if err != nil {
+		return nil, err
+	}
+
+	dstPath := path.Join("/", s.Config.FileRoot, item.Path)
+	if _, err := s.FS.Lstat(dstPath); err == nil {
+		return nil, errRestoreExists
+	}
+	if fi, err := s.FS.Stat(path.Dir(dstPath)); err != nil || !fi.IsDir() {
+		return nil, errRestoreNoFolder
+	}
+
+	itemPath := path.Join(s.trashPath(), item.ID, path.Base(item.Path))
+	if err := s.FS.Rename(itemPath, dstPath); err != nil {
+		return nil, err
+	}
+	if err := renameAppleDouble(s.FS, itemPath, dstPath); err != nil {
+		return nil, err
+	}
+
+	return item, s.removeTrashItem(item.ID)
+}
+
+func (s *Server) removeTrashItem(id string) error {
+	if err := s.FS.RemoveAll(path.Join(s.trashPath(), id)); err != nil {
+		return err
+	}
+
+	return s.FS.Remove(path.Join(s.trashPath(), id+".yaml"))
+}
+
+// purgeTrash permanently deletes the trash items that are older than TrashRetention days
+func (s *Server) purgeTrash() {
+	if s.Config.TrashRetention <= 0 {
+		return
+	}
+
+	items, err := s.TrashItems()
+	if err != nil {
+		s.Logger.Errorw("Error reading trash", "err", err)
+		return
+	}
+
+	cutoff := s.now().AddDate(0, 0, -s.Config.TrashRetention)
+	for _, item := range items {
+		if !item.DeletedAt.Before(cutoff) {
+			continue
+		}
+		if err := s.removeTrashItem(item.ID); err != nil {
+			s.Logger.Errorw("Error purging trash item", "id", item.ID, "path", item.Path, "err", err)
+			continue
+		}
+		s.Logger.Infow("Purged trash item", "id", item.ID, "path", item.Path, "deletedBy", item.DeletedBy)
+	}
+}
+
+// trashPurger purges old trash items every trashPurgeInterval seconds until ctx is done
+func (s *Server) trashPurger(ctx context.Context) {
+	ticker := time.NewTicker(trashPurgeInterval * time.Second)
+	defer ticker.Stop()
+
+	for {
+		s.purgeTrash()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package hotline
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io/fs"
+	"testing"
+	"time"
+)
+
+func newTrashTestClient(accessBits ...int) *ClientConn {
+	mfs := NewMemFileStore()
+	_ = mfs.MkdirAll("/Files/Uploads/Album", 0777)
+	_ = mfs.WriteFile("/Files/Uploads/Album/track.mp3", []byte("la la la"), 0644)
+	_ = mfs.WriteFile("/Files/Uploads/notes.txt", []byte("notes"), 0644)
+	_ = mfs.WriteFile("/Files/Uploads/._notes.txt", []byte("sidecar"), 0644)
+
+	var bits accessBitmap
+	for _, bit := range append([]int{accessDeleteFile, accessDeleteFolder, accessSendChat}, accessBits...) {
+		bits.Set(bit)
+	}
+	access := bits[:]
+
+	return &ClientConn{
+		ID:      &[]byte{0, 1},
+		Account: &Account{Login: "mod", Access: &access},
+		Server: &Server{
+			FS:      mfs,
+			Config:  &Config{FileRoot: "/Files", EnableTrash: true, TrashRetention: 30},
+			Clock:   fixedClock{t: time.Date(2023, time.March, 1, 12, 0, 0, 0, time.UTC)},
+			Clients: map[uint16]*ClientConn{},
+			Logger:  NewTestLogger(),
+		},
+	}
+}
+
+func deleteFile(t *testing.T, cc *ClientConn, filePath, fileName string) {
+	res, err := HandleDeleteFile(cc, NewTransaction(tranDeleteFile, &[]byte{0, 1},
+		NewField(fieldFileName, []byte(fileName)),
+		NewField(fieldFilePath, EncodeFilePath(filePath)),
+	))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0, 0, 0, 0}, res[0].ErrorCode)
+}
+
+func TestTrash(t *testing.T) {
+	t.Run("deleted items are moved to the trash", func(t *testing.T) {
+		cc := newTrashTestClient()
+		deleteFile(t, cc, "Uploads", "Album")
+		deleteFile(t, cc, "Uploads", "notes.txt")
+
+		_, err := cc.Server.FS.Stat("/Files/Uploads/Album")
+		assert.True(t, errors.Is(err, fs.ErrNotExist))
+
+		items, err := cc.Server.TrashItems()
+		assert.NoError(t, err)
+		assert.Equal(t, []TrashItem{
+			{ID: "20230301-120000", Path: "/Uploads/Album", DeletedBy: "mod", DeletedAt: cc.Server.now()},
+			{ID: "20230301-120000-2", Path: "/Uploads/notes.txt", DeletedBy: "mod", DeletedAt: cc.Server.now()},
+		}, items)
+
+		b, err := readFile(cc.Server.FS, "/Files/.trash/20230301-120000-2/._notes.txt")
+		assert.NoError(t, err)
+		assert.Equal(t, "sidecar", string(b))
+	})
+
+	t.Run("items are deleted permanently when the trash is disabled", func(t *testing.T) {
+		cc := newTrashTestClient()
+		cc.Server.Config.EnableTrash = false
+		deleteFile(t, cc, "Uploads", "notes.txt")
+
+		items, err := cc.Server.TrashItems()
+		assert.NoError(t, err)
+		assert.Empty(t, items)
+	})
+
+	t.Run("the trash is hidden from clients", func(t *testing.T) {
+		cc := newTrashTestClient()
+		deleteFile(t, cc, "Uploads", "notes.txt")
+
+		fields, err := getFileNameList(cc.Server.FS, nil, "/Files", "/Files", nil)
+		assert.NoError(t, err)
+		assert.Len(t, fields, 1)
+
+		_, err = cc.Server.resolvePath(EncodeFilePath(".trash"), []byte("20230301-120000"))
+		assert.ErrorIs(t, err, errInvalidPath)
+	})
+
+	t.Run("items can be restored to their original path", func(t *testing.T) {
+		cc := newTrashTestClient()
+		deleteFile(t, cc, "Uploads", "notes.txt")
+
+		item, err := cc.Server.RestoreTrashItem("20230301-120000")
+		assert.NoError(t, err)
+		assert.Equal(t, "/Uploads/notes.txt", item.Path)
+
+		b, err := readFile(cc.Server.FS, "/Files/Uploads/notes.txt")
+		assert.NoError(t, err)
+		assert.Equal(t, "notes", string(b))
+		_, err = cc.Server.FS.Stat("/Files/Uploads/._notes.txt")
+		assert.NoError(t, err)
+
+		items, err := cc.Server.TrashItems()
+		assert.NoError(t, err)
+		assert.Empty(t, items)
+	})
+
+	t.Run("restores do not replace newer files", func(t *testing.T) {
+		cc := newTrashTestClient()
+		deleteFile(t, cc, "Uploads", "notes.txt")
+		_ = cc.Server.FS.WriteFile("/Files/Uploads/notes.txt", []byte("new notes"), 0644)
+
+		_, err := cc.Server.RestoreTrashItem("20230301-120000")
+		assert.ErrorIs(t, err, errRestoreExists)
+	})
+
+	t.Run("restores do not recreate deleted folders", func(t *testing.T) {
+		cc := newTrashTestClient()
+		deleteFile(t, cc, "Uploads/Album", "track.mp3")
+		deleteFile(t, cc, "Uploads", "Album")
+
+		_, err := cc.Server.RestoreTrashItem("20230301-120000")
+		assert.ErrorIs(t, err, errRestoreNoFolder)
+
+		_, err = cc.Server.RestoreTrashItem("../Uploads")
+		assert.ErrorIs(t, err, errTrashItemNotFound)
+	})
+
+	t.Run("items older than the retention period are purged", func(t *testing.T) {
+		cc := newTrashTestClient()
+		deleteFile(t, cc, "Uploads", "notes.txt")
+		cc.Server.Clock = fixedClock{t: cc.Server.now().AddDate(0, 0, 20)}
+		deleteFile(t, cc, "Uploads", "Album")
+
+		cc.Server.Clock = fixedClock{t: cc.Server.now().AddDate(0, 0, 15)}
+		cc.Server.purgeTrash()
+
+		items, err := cc.Server.TrashItems()
+		assert.NoError(t, err)
+		if assert.Len(t, items, 1) {
+			assert.Equal(t, "/Uploads/Album", items[0].Path)
+		}
+		_, err = cc.Server.FS.Stat("/Files/.trash/20230301-120000")
+		assert.True(t, errors.Is(err, fs.ErrNotExist))
+	})
+}
+
+func TestTrashCommands(t *testing.T) {
+	chat := func(cc *ClientConn, msg string) []Transaction {
+		res, err := HandleChatSend(cc, NewTransaction(tranChatSend, &[]byte{0, 1}, NewField(fieldData, []byte(msg))))
+		assert.NoError(t, err)
+		return res
+	}
+
+	t.Run("admins can list and restore trash items", func(t *testing.T) {
+		cc := newTrashTestClient(accessDisconUser)
+		assert.Equal(t, "The trash is empty.", string(chat(cc, "/trash")[0].GetField(fieldData).Data))
+
+		deleteFile(t, cc, "Uploads", "notes.txt")
+		res := chat(cc, "/trash")
+		if assert.Len(t, res, 1) {
+			assert.Equal(t, cc.ID, res[0].clientID)
+			assert.Equal(t, "Trash:\r  20230301-120000  /Uploads/notes.txt  deleted by mod on Mar 1 2023 12:00", string(res[0].GetField(fieldData).Data))
+		}
+
+		assert.Equal(t, "Restored /Uploads/notes.txt.", string(chat(cc, "/restore 20230301-120000")[0].GetField(fieldData).Data))
+		assert.Equal(t, "Cannot restore 20230301-120000: trash item not found.", string(chat(cc, "/restore 20230301-120000")[0].GetField(fieldData).Data))
+		assert.Equal(t, "Usage: /restore <trash ID>", string(chat(cc, "/restore")[0].GetField(fieldData).Data))
+	})
+
+	t.Run("commands from other users are sent as chat", func(t *testing.T) {
+		cc := newTrashTestClient()
+		deleteFile(t, cc, "Uploads", "notes.txt")
+		assert.Empty(t, chat(cc, "/restore 20230301-120000"))
+
+		items, err := cc.Server.TrashItems()
+		assert.NoError(t, err)
+		assert.Len(t, items, 1)
+	})
+}
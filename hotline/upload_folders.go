@@ -0,0 +1,35 @@
+package hotline
+
+import (
+	"path"
+	"strings"
+)
+
+// Users without accessUploadAnywhere can only upload into upload folders.  As with the original Hotline server, a
+// folder is an upload folder if its name contains "upload" or "drop box"; drop boxes marked with dropBoxMarker and the
+// folders listed in Config.UploadFolders are upload folders as well.  Folders inside of an upload folder are also
+// upload folders.
+
+// isUploadFolderName reports whether a folder named name is an upload folder by the Hotline naming convention
+func isUploadFolderName(name string) bool {
+	name = strings.ToLower(name)
+	return strings.Contains(name, "upload") || strings.Contains(name, "drop box")
+}
+
+// inUploadFolder reports whether the folder at folderPath is an upload folder or is inside of one
+func (s *Server) inUploadFolder(folderPath string) bool {
+	fileRoot := path.Join("/", s.Config.FileRoot)
+
+	configured := make(map[string]bool)
+	for _, f := range s.Config.UploadFolders {
+		configured[path.Join("/", f)] = true
+	}
+
+	for p := path.Join("/", folderPath); p != fileRoot && isWithin(fileRoot, p); p = path.Dir(p) {
+		if isUploadFolderName(path.Base(p)) || configured[areaPath(fileRoot, p)] || isDropBox(s.FS, p) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,158 @@
+package hotline
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func newUploadFolderTestServer() *Server {
+	mfs := NewMemFileStore()
+	_ = mfs.MkdirAll("/Files/Uploads/Incoming", 0777)
+	_ = mfs.MkdirAll("/Files/Drop Box", 0777)
+	_ = mfs.MkdirAll("/Files/Submissions", 0777)
+	_ = mfs.WriteFile("/Files/Submissions/"+dropBoxMarker, []byte{}, 0644)
+	_ = mfs.MkdirAll("/Files/Public/Incoming", 0777)
+	_ = mfs.MkdirAll("/Files/Software", 0777)
+
+	return &Server{
+		FS:            mfs,
+		FileTransfers: make(map[uint32]*FileTransfer),
+		Config: &Config{
+			FileRoot:      "/Files",
+			UploadFolders: []string{"Public/Incoming"},
+		},
+	}
+}
+
+func TestServer_inUploadFolder(t *testing.T) {
+	s := newUploadFolderTestServer()
+
+	tests := []struct {
+		folderPath string
+		want       bool
+	}{
+		{folderPath: "/Files", want: false},
+		{folderPath: "/Files/Software", want: false},
+		{folderPath: "/Files/Public", want: false},
+		{folderPath: "/Files/Uploads", want: true},
+		{folderPath: "/Files/Uploads/Incoming", want: true},
+		{folderPath: "/Files/Drop Box", want: true},
+		{folderPath: "/Files/Submissions", want: true},
+		{folderPath: "/Files/Public/Incoming", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.folderPath, func(t *testing.T) {
+			assert.Equal(t, tt.want, s.inUploadFolder(tt.folderPath))
+		})
+	}
+}
+
+func TestServer_inUploadFolder_rootFileRoot(t *testing.T) {
+	mfs := NewMemFileStore()
+	_ = mfs.MkdirAll("/Uploads/Incoming", 0777)
+	_ = mfs.MkdirAll("/Public/Incoming", 0777)
+	_ = mfs.MkdirAll("/Software", 0777)
+	s := &Server{FS: mfs, Config: &Config{FileRoot: "/", UploadFolders: []string{"Public/Incoming"}}}
+
+	assert.True(t, s.inUploadFolder("/Uploads"))
+	assert.True(t, s.inUploadFolder("/Uploads/Incoming"))
+	assert.True(t, s.inUploadFolder("/Public/Incoming"))
+	assert.False(t, s.inUploadFolder("/Software"))
+	assert.False(t, s.inUploadFolder("/"))
+}
+
+func TestUploadFolders(t *testing.T) {
+	newClient := func(accessBits ...int) *ClientConn {
+		var bits accessBitmap
+		for _, bit := range accessBits {
+			bits.Set(bit)
+		}
+		access := bits[:]
+
+		return &ClientConn{
+			ID:      &[]byte{0, 1},
+			Account: &Account{Access: &access},
+			Server:  newUploadFolderTestServer(),
+		}
+	}
+
+	tests := []struct {
+		name      string
+		access    []int
+		handler   func(*ClientConn, *Transaction) ([]Transaction, error)
+		fileName  string
+		filePath  string
+		wantError string
+	}{
+		{
+			name:     "file upload to an upload folder",
+			access:   []int{accessUploadFile},
+			handler:  HandleUploadFile,
+			fileName: "a.txt",
+			filePath: "Uploads/Incoming",
+		},
+		{
+			name:     "file upload to a configured upload folder",
+			access:   []int{accessUploadFile},
+			handler:  HandleUploadFile,
+			fileName: "a.txt",
+			filePath: "Public/Incoming",
+		},
+		{
+			name:      "file upload elsewhere without Upload Anywhere",
+			access:    []int{accessUploadFile},
+			handler:   HandleUploadFile,
+			fileName:  "a.txt",
+			filePath:  "Software",
+			wantError: "Cannot accept upload of the file \"a.txt\" because you are only allowed to upload to the \"Uploads\" folder.",
+		},
+		{
+			name:     "file upload elsewhere with Upload Anywhere",
+			access:   []int{accessUploadFile, accessUploadAnywhere},
+			handler:  HandleUploadFile,
+			fileName: "a.txt",
+			filePath: "Software",
+		},
+		{
+			name:     "folder upload to a drop box",
+			access:   []int{accessUploadFile},
+			handler:  HandleUploadFolder,
+			fileName: "Stuff",
+			filePath: "Submissions",
+		},
+		{
+			name:      "folder upload elsewhere without Upload Anywhere",
+			access:    []int{accessUploadFile},
+			handler:   HandleUploadFolder,
+			fileName:  "Stuff",
+			filePath:  "Public",
+			wantError: "Cannot accept upload of the folder \"Stuff\" because you are only allowed to upload to the \"Uploads\" folder.",
+		},
+		{
+			name:      "folder upload without upload access",
+			access:    []int{accessUploadAnywhere},
+			handler:   HandleUploadFolder,
+			fileName:  "Stuff",
+			filePath:  "Uploads",
+			wantError: "You are not allowed to upload folders.",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cc := newClient(tt.access...)
+			res, err := tt.handler(cc, NewTransaction(tranUploadFile, &[]byte{0, 1},
+				NewField(fieldFileName, []byte(tt.fileName)),
+				NewField(fieldFilePath, EncodeFilePath(tt.filePath)),
+			))
+			assert.NoError(t, err)
+
+			if tt.wantError != "" {
+				assert.Equal(t, tt.wantError, string(res[0].GetField(fieldError).Data))
+				assert.Empty(t, cc.Server.FileTransfers)
+				return
+			}
+			assert.Equal(t, []byte{0, 0, 0, 0}, res[0].ErrorCode)
+			assert.Len(t, cc.Server.FileTransfers, 1)
+		})
+	}
+}
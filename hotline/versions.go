@@ -0,0 +1,171 @@
+package hotline
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+)
+
+// When KeepVersions is set, files replaced by an upload are kept as prior versions in the versions folder at the top
+// of the file area.  The versions of a file are kept in a folder of their own at the same relative path as the file,
+// named after the time the version was replaced, e.g. .versions/Uploads/notes.txt/20230301-120000.  The oldest versions
+// are removed once a file has more than KeepVersions of them.
+const versionsFolder = ".versions"
+
+var errVersionNotFound = errors.New("version not found")
+
+// timestampIDFormat is the time format of the IDs of trash items and file versions.  IDs of items created in the same
+// second are numbered from -2.
+const timestampIDFormat = "20060102-150405"
+
+func (s *Server) versionsPath(filePath string) string {
+	return path.Join("/", s.Config.FileRoot, versionsFolder, areaPath(s.Config.FileRoot, filePath))
+}
+
+// mkdirAll creates the folder dir along with any missing parents
+func mkdirAll(fileStore FileStore, dir string) error {
+	fi, err := fileStore.Stat(dir)
+	if err == nil {
+		if !fi.IsDir() {
+			return &fs.PathError{Op: "mkdir", Path: dir, Err: errors.New("not a directory")}
+		}
+		return nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	if parent := path.Dir(dir); parent != dir {
+		if err := mkdirAll(fileStore, parent); err != nil {
+			return err
+		}
+	}
+	if err := fileStore.Mkdir(dir, 0777); err != nil && !errors.Is(err, fs.ErrExist) {
+		return err
+	}
+
+	return nil
+}
+
+// replaceFile moves newPath to filePath.  If filePath exists and KeepVersions is set, it is kept as a prior version of
+// the file rather than replaced.
+func (s *Server) replaceFile(newPath, filePath string) error {
+	if s.Config.KeepVersions <= 0 {
+		return s.FS.Rename(newPath, filePath)
+	}
+
+	if _, err := s.FS.Stat(filePath); err == nil {
+		if err := s.saveVersion(filePath); err != nil {
+			return err
+		}
+	}
+	if err := s.FS.Rename(newPath, filePath); err != nil {
+		return err
+	}
+
+	return s.pruneVersions(filePath)
+}
+
+// saveVersion moves the file at filePath, along with its AppleDouble sidecar, to its versions folder
+func (s *Server) saveVersion(filePath string) error {
+	dir := s.versionsPath(filePath)
+	if err := mkdirAll(s.FS, dir); err != nil {
+		return err
+	}
+
+	now := s.now()
+	id := now.Format(timestampIDFormat)
+	for i := 2; ; i++ {
+		if _, err := s.FS.Lstat(path.Join(dir, id)); errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+		id = fmt.Sprintf("%s-%d", now.Format(timestampIDFormat), i)
+	}
+
+	if err := s.FS.Rename(filePath, path.Join(dir, id)); err != nil {
+		return err
+	}
+
+	return renameAppleDouble(s.FS, filePath, path.Join(dir, id))
+}
+
+// pruneVersions removes the oldest versions of the file at filePath beyond KeepVersions
+func (s *Server) pruneVersions(filePath string) error {
+	versions, err := s.FileVersions(filePath)
+	if err != nil {
+		return err
+	}
+
+	for len(versions) > s.Config.KeepVersions {
+		versionPath := path.Join(s.versionsPath(filePath), versions[0])
+		if err := s.FS.Remove(versionPath); err != nil {
+			return err
+		}
+		if err := removeAppleDouble(s.FS, versionPath); err != nil {
+			return err
+		}
+		versions = versions[1:]
+	}
+
+	return nil
+}
+
+// versionLess orders version IDs by time, and IDs from the same second by their number
+func versionLess(a, b string) bool {
+	n := len(timestampIDFormat)
+	if len(a) >= n && len(b) >= n && a[:n] == b[:n] && len(a) != len(b) {
+		return len(a) < len(b)
+	}
+
+	return a < b
+}
+
+// FileVersions returns the IDs of the prior versions of the file at filePath, oldest first
+func (s *Server) FileVersions(filePath string) ([]string, error) {
+	entries, err := s.FS.ReadDir(s.versionsPath(filePath))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []string
+	for _, entry := range entries {
+		if entry.IsDir() || isAppleDouble(entry.Name()) {
+			continue
+		}
+		versions = append(versions, entry.Name())
+	}
+	sort.Slice(versions, func(i, j int) bool { return versionLess(versions[i], versions[j]) })
+
+	return versions, nil
+}
+
+// RollbackFile replaces the file at filePath with its prior version id.  The current file is kept as a version in turn,
+// so that a rollback can itself be undone.
+func (s *Server) RollbackFile(filePath, id string) error {
+	if checkPathItem([]byte(id)) != nil || id == "" {
+		return errVersionNotFound
+	}
+	versionPath := path.Join(s.versionsPath(filePath), id)
+	if fi, err := s.FS.Lstat(versionPath); err != nil || fi.IsDir() || isAppleDouble(id) {
+		return errVersionNotFound
+	}
+
+	if _, err := s.FS.Stat(filePath); err == nil {
+		if err := s.saveVersion(filePath); err != nil {
+			return err
+		}
+	}
+	if err := s.FS.Rename(versionPath, filePath); err != nil {
+		return err
+	}
+	if err := renameAppleDouble(s.FS, versionPath, filePath); err != nil {
+		return err
+	}
+
+	return s.pruneVersions(filePath)
+}
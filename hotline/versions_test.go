@@ -0,0 +1,178 @@
+package hotline
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func newVersionsTestServer(keepVersions int) *Server {
+	mfs := NewMemFileStore()
+	_ = mfs.MkdirAll("/Files/Uploads", 0777)
+	_ = mfs.WriteFile("/Files/Uploads/notes.txt", []byte("version 1"), 0644)
+
+	s := newTransferTestServer(mfs, &FileTransfer{})
+	s.Config.KeepVersions = keepVersions
+	s.Clock = fixedClock{t: time.Date(2023, time.March, 1, 12, 0, 0, 0, time.UTC)}
+	return s
+}
+
+// uploadNotes uploads data to /Files/Uploads/notes.txt, closing the connection after the first sent bytes
+func uploadNotes(s *Server, data []byte, sent int) error {
+	s.FileTransfers[1] = &FileTransfer{
+		Type:            FileUpload,
+		FileName:        []byte("notes.txt"),
+		FilePath:        EncodeFilePath("Uploads"),
+		ReferenceNumber: []byte{0, 0, 0, 1},
+	}
+
+	client, server := net.Pipe()
+	errs := make(chan error, 1)
+	go func() { errs <- s.handleFileTransfer(server) }()
+
+	upload := append(htxf(), flatFile("notes.txt", data)...)
+	_, _ = client.Write(upload[:len(upload)-len(data)+sent])
+	_ = client.Close()
+
+	return <-errs
+}
+
+func TestVersionedReplacement(t *testing.T) {
+	t.Run("a failed replacement keeps the original", func(t *testing.T) {
+		s := newVersionsTestServer(0)
+		assert.Error(t, uploadNotes(s, []byte("version 2"), 3))
+
+		got, err := readFile(s.FS, "/Files/Uploads/notes.txt")
+		assert.NoError(t, err)
+		assert.Equal(t, "version 1", string(got))
+
+		_, err = s.FS.Stat("/Files/Uploads/notes.txt" + incompleteFileSuffix)
+		assert.NoError(t, err)
+	})
+
+	t.Run("an interrupted replacement can be resumed", func(t *testing.T) {
+		s := newVersionsTestServer(0)
+		assert.Error(t, uploadNotes(s, []byte("version 2"), 3))
+
+		var bits accessBitmap
+		bits.Set(accessUploadFile)
+		bits.Set(accessUploadAnywhere)
+		access := bits[:]
+		cc := &ClientConn{ID: &[]byte{0, 1}, Account: &Account{Login: "user", Access: &access}, Server: s}
+		s.AccountStore = NewMemAccountStore()
+
+		res, err := HandleUploadFile(cc, NewTransaction(tranUploadFile, &[]byte{0, 1},
+			NewField(fieldFileName, []byte("notes.txt")),
+			NewField(fieldFilePath, EncodeFilePath("Uploads")),
+			NewField(fieldFileTransferOptions, []byte{0, 0, 0, 2}),
+		))
+		assert.NoError(t, err)
+		var frd FileResumeData
+		assert.NoError(t, frd.UnmarshalBinary(res[0].GetField(fieldFileResumeData).Data))
+		offset, _ := frd.forkOffsets(false)
+		assert.Equal(t, int64(3), offset)
+
+		client, server := net.Pipe()
+		errs := make(chan error, 1)
+		go func() { errs <- s.handleFileTransfer(server) }()
+		handshake := htxf()
+		copy(handshake[4:8], res[0].GetField(fieldRefNum).Data)
+		_, _ = client.Write(append(handshake, flatFile("notes.txt", []byte("version 2")[offset:])...))
+		_ = client.Close()
+		assert.NoError(t, <-errs)
+
+		got, err := readFile(s.FS, "/Files/Uploads/notes.txt")
+		assert.NoError(t, err)
+		assert.Equal(t, "version 2", string(got))
+	})
+
+	t.Run("replaced files are not kept without KeepVersions", func(t *testing.T) {
+		s := newVersionsTestServer(0)
+		assert.NoError(t, uploadNotes(s, []byte("version 2"), 9))
+
+		got, err := readFile(s.FS, "/Files/Uploads/notes.txt")
+		assert.NoError(t, err)
+		assert.Equal(t, "version 2", string(got))
+
+		versions, err := s.FileVersions("/Files/Uploads/notes.txt")
+		assert.NoError(t, err)
+		assert.Empty(t, versions)
+	})
+
+	t.Run("replaced files are kept as prior versions", func(t *testing.T) {
+		s := newVersionsTestServer(2)
+		assert.NoError(t, uploadNotes(s, []byte("version 2"), 9))
+		assert.NoError(t, uploadNotes(s, []byte("version 3"), 9))
+		s.Clock = fixedClock{t: s.now().Add(time.Hour)}
+		assert.NoError(t, uploadNotes(s, []byte("version 4"), 9))
+
+		got, err := readFile(s.FS, "/Files/Uploads/notes.txt")
+		assert.NoError(t, err)
+		assert.Equal(t, "version 4", string(got))
+
+		versions, err := s.FileVersions("/Files/Uploads/notes.txt")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"20230301-120000-2", "20230301-130000"}, versions)
+
+		got, err = readFile(s.FS, "/Files/.versions/Uploads/notes.txt/20230301-120000-2")
+		assert.NoError(t, err)
+		assert.Equal(t, "version 2", string(got))
+	})
+
+	t.Run("files can be rolled back to a prior version", func(t *testing.T) {
+		s := newVersionsTestServer(5)
+		assert.NoError(t, uploadNotes(s, []byte("version 2"), 9))
+
+		assert.NoError(t, s.RollbackFile("/Files/Uploads/notes.txt", "20230301-120000"))
+		got, err := readFile(s.FS, "/Files/Uploads/notes.txt")
+		assert.NoError(t, err)
+		assert.Equal(t, "version 1", string(got))
+
+		versions, err := s.FileVersions("/Files/Uploads/notes.txt")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"20230301-120000-2"}, versions)
+
+		assert.ErrorIs(t, s.RollbackFile("/Files/Uploads/notes.txt", "20230301-120000"), errVersionNotFound)
+		assert.ErrorIs(t, s.RollbackFile("/Files/Uploads/notes.txt", "../notes.txt"), errVersionNotFound)
+	})
+
+	t.Run("the versions folder is hidden from clients", func(t *testing.T) {
+		s := newVersionsTestServer(2)
+		assert.NoError(t, uploadNotes(s, []byte("version 2"), 9))
+
+		fields, err := getFileNameList(s.FS, nil, "/Files", "/Files", nil)
+		assert.NoError(t, err)
+		assert.Len(t, fields, 1)
+
+		_, err = s.resolvePath(EncodeFilePath(".versions/Uploads"), []byte("notes.txt"))
+		assert.ErrorIs(t, err, errInvalidPath)
+	})
+}
+
+func TestVersionCommands(t *testing.T) {
+	s := newVersionsTestServer(2)
+	assert.NoError(t, uploadNotes(s, []byte("version 2"), 9))
+
+	var bits accessBitmap
+	bits.Set(accessSendChat)
+	bits.Set(accessDisconUser)
+	access := bits[:]
+	cc := &ClientConn{ID: &[]byte{0, 1}, Account: &Account{Login: "admin", Access: &access}, Server: s}
+
+	chat := func(msg string) string {
+		res, err := HandleChatSend(cc, NewTransaction(tranChatSend, &[]byte{0, 1}, NewField(fieldData, []byte(msg))))
+		assert.NoError(t, err)
+		return string(res[0].GetField(fieldData).Data)
+	}
+
+	assert.Equal(t, "Versions of /Uploads/notes.txt:\r  20230301-120000", chat("/versions /Uploads/notes.txt"))
+	assert.Equal(t, "There are no prior versions of /Uploads/other.txt.", chat("/versions /Uploads/other.txt"))
+	assert.Equal(t, "Rolled back /Uploads/notes.txt to version 20230301-120000.", chat("/rollback 20230301-120000 /Uploads/notes.txt"))
+	assert.Equal(t, "Cannot roll back /Uploads/notes.txt: version not found.", chat("/rollback 20990101-000000 /Uploads/notes.txt"))
+	assert.Equal(t, "Usage: /rollback <version> <path>", chat("/rollback 20230301-120000"))
+
+	got, err := readFile(s.FS, "/Files/Uploads/notes.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "version 1", string(got))
+}